@@ -26,23 +26,25 @@ func init() {
 	parseS3Config()
 
 	backupCmd.Flags().StringArrayVarP(&cmdLists, "lists", "l", nil, "Accepts comma-separated names of command lists to execute.")
+	addOutputFlags(backupCmd)
 
 }
 
 func Backup(cmd *cobra.Command, args []string) {
+	checkOutputFormat()
 	backyConfOpts := backy.NewConfigOptions(configFile,
 		backy.AddCommandLists(cmdLists),
 		backy.SetLogFile(logFile),
 		backy.EnableCommandStdOut(cmdStdOut),
+		backy.SetCmdStdOutMode(parseCmdStdOutMode()),
+		backy.EnableCmdStdOutColor(cmdStdOutColor),
+		backy.SetMaxParallel(maxParallel),
 		backy.SetHostsConfigFile(hostsConfigFile))
 
 	backyConfOpts.InitConfig()
 	backyConfOpts.ParseConfigurationFile()
 
 	backyConfOpts.RunListConfig("")
-	for _, host := range backyConfOpts.Hosts {
-		if host.SshClient != nil {
-			host.SshClient.Close()
-		}
-	}
+	writeCmdResults(backyConfOpts)
+	backyConfOpts.CloseHostConnections()
 }
@@ -22,6 +22,9 @@ func cron(cmd *cobra.Command, args []string) {
 		backy.EnableCron(),
 		backy.SetLogFile(logFile),
 		backy.EnableCommandStdOut(cmdStdOut),
+		backy.SetCmdStdOutMode(parseCmdStdOutMode()),
+		backy.EnableCmdStdOutColor(cmdStdOutColor),
+		backy.SetMaxParallel(maxParallel),
 		backy.SetHostsConfigFile(hostsConfigFile))
 
 	opts.InitConfig()
@@ -5,6 +5,8 @@
 package cmd
 
 import (
+	"os"
+
 	"git.andrewnw.xyz/CyberShell/backy/pkg/backy"
 	"git.andrewnw.xyz/CyberShell/backy/pkg/logging"
 
@@ -20,13 +22,56 @@ var (
 	}
 )
 
+// Holds the format and file of the run summary
+var (
+	outputFormat string
+	outputFile   string
+)
+
 func init() {
 	execCmd.AddCommand(hostExecCommand, hostsExecCommand)
+	addOutputFlags(execCmd)
+}
+
+// addOutputFlags adds the flags for the run summary to cmd
+func addOutputFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&outputFormat, "output", "", "Write a summary of the commands run: table, json or junit")
+	cmd.Flags().StringVar(&outputFile, "outputFile", "", "File to write the summary to. Defaults to stdout")
+}
 
+// checkOutputFormat exits if the --output format is not valid, before anything is run
+func checkOutputFormat() {
+	switch outputFormat {
+	case "", "table", "json", "junit":
+	default:
+		logging.ExitWithMSG("--output must be table, json or junit", 1, nil)
+	}
+}
+
+// writeCmdResults writes the run summary if --output is set
+func writeCmdResults(opts *backy.ConfigOpts) {
+	if outputFormat == "" {
+		return
+	}
+
+	out := os.Stdout
+	if outputFile != "" {
+		f, err := os.Create(outputFile)
+		if err != nil {
+			logging.ExitWithMSG("error creating output file: "+err.Error(), 1, &opts.Logger)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if err := backy.WriteCmdResults(out, opts.CmdResults(), outputFormat); err != nil {
+		logging.ExitWithMSG("error writing summary: "+err.Error(), 1, &opts.Logger)
+	}
 }
 
 func execute(cmd *cobra.Command, args []string) {
 	parseS3Config()
+	checkOutputFormat()
 
 	if len(args) < 1 {
 		logging.ExitWithMSG("Please provide a command to run. Pass --help to see options.", 1, nil)
@@ -36,8 +81,12 @@ func execute(cmd *cobra.Command, args []string) {
 		backy.AddCommands(args),
 		backy.SetLogFile(logFile),
 		backy.EnableCommandStdOut(cmdStdOut),
+		backy.SetCmdStdOutMode(parseCmdStdOutMode()),
+		backy.EnableCmdStdOutColor(cmdStdOutColor),
+		backy.SetMaxParallel(maxParallel),
 		backy.SetHostsConfigFile(hostsConfigFile))
 	opts.InitConfig()
 	opts.ParseConfigurationFile()
 	opts.ExecuteCmds()
+	writeCmdResults(opts)
 }
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"os"
+
 	"git.andrewnw.xyz/CyberShell/backy/pkg/backy"
 	"git.andrewnw.xyz/CyberShell/backy/pkg/logging"
 	"github.com/spf13/cobra"
@@ -8,9 +10,9 @@ import (
 
 var (
 	hostExecCommand = &cobra.Command{
-		Use:   "host [--command=command1 --command=command2 ... | -c command1 -c command2 ...] [--hosts=host1 --hosts=hosts2 ... | -m host1 -m host2 ...] ",
+		Use:   "host [--command=command1 --command=command2 ... | -c command1 -c command2 ... | --stdin] [--hosts=host1 --hosts=hosts2 ... | -m host1 -m host2 ...] ",
 		Short: "Runs command defined in config file on the hosts in order specified.",
-		Long:  "Host executes specified commands on the hosts defined in config file.\nUse the --commands or -c flag to choose the commands.",
+		Long:  "Host executes specified commands on the hosts defined in config file.\nUse the --commands or -c flag to choose the commands, or pipe a script to --stdin.",
 		Run:   Host,
 	}
 )
@@ -21,10 +23,23 @@ var hostsList []string
 // Holds command list to run
 var cmdList []string
 
+// Whether the commands to run are read from stdin
+var cmdsFromStdin bool
+
+// Holds the format and file of the package report
+var (
+	packageReportFormat string
+	packageReportFile   string
+)
+
 func init() {
 
-	hostExecCommand.Flags().StringArrayVarP(&hostsList, "hosts", "m", nil, "Accepts space-separated names of hosts. Specify multiple times for multiple hosts.")
+	hostExecCommand.Flags().StringArrayVarP(&hostsList, "hosts", "m", nil, "Accepts host names and selectors (group:name, tag:name, web-*, !host) separated by commas. Specify multiple times for multiple hosts.")
 	hostExecCommand.Flags().StringArrayVarP(&cmdList, "command", "c", nil, "Accepts space-separated names of commands. Specify multiple times for multiple commands.")
+	hostExecCommand.Flags().BoolVar(&cmdsFromStdin, "stdin", false, "Read a script from stdin and run it on the hosts with sh, instead of commands")
+	hostExecCommand.Flags().StringVar(&packageReportFormat, "packageReport", "table", "Format of the package upgrade report: table or json")
+	hostExecCommand.Flags().StringVar(&packageReportFile, "packageReportFile", "", "File to write the package upgrade report to. Defaults to stdout")
+	addOutputFlags(hostExecCommand)
 	parseS3Config()
 
 }
@@ -32,12 +47,16 @@ func init() {
 // cli input should be hosts and commands. Hosts are defined in config files.
 // commands can be passed by the following mutually exclusive options:
 //    1. as a list of commands defined in the config file
-//    2. stdin (on command line) (TODO)
+//    2. a script read from stdin, with --stdin
 
 func Host(cmd *cobra.Command, args []string) {
+	checkOutputFormat()
 	backyConfOpts := backy.NewConfigOptions(configFile,
 		backy.SetLogFile(logFile),
 		backy.EnableCommandStdOut(cmdStdOut),
+		backy.SetCmdStdOutMode(parseCmdStdOutMode()),
+		backy.EnableCmdStdOutColor(cmdStdOutColor),
+		backy.SetMaxParallel(maxParallel),
 		backy.SetHostsConfigFile(hostsConfigFile))
 	backyConfOpts.InitConfig()
 
@@ -48,7 +67,48 @@ func Host(cmd *cobra.Command, args []string) {
 		logging.ExitWithMSG("error: hosts must be specified", 1, &backyConfOpts.Logger)
 	}
 
-	for _, h := range hostsList {
+	resolvedHosts, err := backyConfOpts.ResolveHostSelectors(hostsList)
+	if err != nil {
+		logging.ExitWithMSG("error: "+err.Error(), 1, &backyConfOpts.Logger)
+	}
+	hostsList = resolvedHosts
+
+	addHostsFromSSHConfig(backyConfOpts, hostsList)
+
+	addStdinCommand(backyConfOpts)
+	if cmdList == nil {
+		logging.ExitWithMSG("error: commands must be specified", 1, &backyConfOpts.Logger)
+	}
+	for _, c := range cmdList {
+		_, cmdFound := backyConfOpts.Cmds[c]
+		if !cmdFound {
+			logging.ExitWithMSG("cmd "+c+" not found", 1, &backyConfOpts.Logger)
+		}
+	}
+
+	backyConfOpts.ExecCmdsOnHosts(cmdList, hostsList)
+	writePackageReport(backyConfOpts)
+	writeCmdResults(backyConfOpts)
+}
+
+// addStdinCommand adds the script read from stdin as the command to run, if --stdin was given
+func addStdinCommand(backyConfOpts *backy.ConfigOpts) {
+	if !cmdsFromStdin {
+		return
+	}
+	if cmdList != nil {
+		logging.ExitWithMSG("error: --stdin and --command cannot be used together", 1, &backyConfOpts.Logger)
+	}
+	name, err := backyConfOpts.AddStdinCommand(os.Stdin)
+	if err != nil {
+		logging.ExitWithMSG("error: "+err.Error(), 1, &backyConfOpts.Logger)
+	}
+	cmdList = []string{name}
+}
+
+// addHostsFromSSHConfig adds hosts that are not in the config file but are in the SSH config file
+func addHostsFromSSHConfig(backyConfOpts *backy.ConfigOpts, hosts []string) {
+	for _, h := range hosts {
 		if backy.IsHostLocal(h) {
 			continue
 		}
@@ -67,15 +127,26 @@ func Host(cmd *cobra.Command, args []string) {
 			backyConfOpts.Hosts[h] = &backy.Host{Host: h, HostName: s}
 		}
 	}
-	if cmdList == nil {
-		logging.ExitWithMSG("error: commands must be specified", 1, &backyConfOpts.Logger)
+}
+
+// writePackageReport writes the package upgrade report if any listUpgrades or securityUpgrade commands were run
+func writePackageReport(opts *backy.ConfigOpts) {
+	reports := opts.PackageReports()
+	if len(reports) == 0 {
+		return
 	}
-	for _, c := range cmdList {
-		_, cmdFound := backyConfOpts.Cmds[c]
-		if !cmdFound {
-			logging.ExitWithMSG("cmd "+c+" not found", 1, &backyConfOpts.Logger)
+
+	out := os.Stdout
+	if packageReportFile != "" {
+		f, err := os.Create(packageReportFile)
+		if err != nil {
+			logging.ExitWithMSG("error creating package report file: "+err.Error(), 1, &opts.Logger)
 		}
+		defer f.Close()
+		out = f
 	}
 
-	backyConfOpts.ExecCmdsOnHosts(cmdList, hostsList)
+	if err := backy.WritePackageReport(out, reports, packageReportFormat); err != nil {
+		logging.ExitWithMSG("error writing package report: "+err.Error(), 1, &opts.Logger)
+	}
 }
@@ -13,9 +13,9 @@ var (
 	runCommandsInParallel bool
 
 	hostsExecCommand = &cobra.Command{
-		Use:   "hosts [--command=command1 --command=command2 ... | -c command1 -c command2 ...]",
+		Use:   "hosts [--command=command1 --command=command2 ... | -c command1 -c command2 ... | --stdin]",
 		Short: "Runs command defined in config file on the hosts in order specified.",
-		Long:  "Hosts executes specified commands on all the hosts defined in config file.\nUse the --commands or -c flag to choose the commands.",
+		Long:  "Hosts executes specified commands on all the hosts defined in config file.\nUse the --commands or -c flag to choose the commands, or pipe a script to --stdin.",
 		Run:   Hosts,
 	}
 
@@ -29,29 +29,51 @@ var (
 
 func init() {
 	hostsExecCommand.AddCommand(hostsListExecCommand)
+	hostsExecCommand.Flags().StringArrayVarP(&hostsList, "hosts", "m", nil, "Accepts host selectors (group:name, tag:name, web-*, !host) separated by commas. Defaults to all hosts.")
+	hostsExecCommand.Flags().StringArrayVarP(&cmdList, "command", "c", nil, "Accepts space-separated names of commands. Specify multiple times for multiple commands.")
+	hostsExecCommand.Flags().BoolVar(&cmdsFromStdin, "stdin", false, "Read a script from stdin and run it on the hosts with sh, instead of commands")
+	hostsExecCommand.Flags().StringVar(&packageReportFormat, "packageReport", "table", "Format of the package upgrade report: table or json")
+	hostsExecCommand.Flags().StringVar(&packageReportFile, "packageReportFile", "", "File to write the package upgrade report to. Defaults to stdout")
 	hostsListExecCommand.Flags().BoolVarP(&runCommandsInParallel, "parallel", "p", false, "Run commands in parallel on hosts")
+	hostsListExecCommand.Flags().StringArrayVarP(&hostsList, "hosts", "m", nil, "Accepts host selectors (group:name, tag:name, web-*, !host) separated by commas. Defaults to all hosts.")
+	addOutputFlags(hostsExecCommand)
+	addOutputFlags(hostsListExecCommand)
 	parseS3Config()
 }
 
 // cli input should be hosts and commands. Hosts are defined in config files.
 // commands can be passed by the following mutually exclusive options:
 //    1. as a list of commands defined in the config file
-//    2. stdin (on command line) (TODO)
+//    2. a script read from stdin, with --stdin
 
 func Hosts(cmd *cobra.Command, args []string) {
+	checkOutputFormat()
 	backyConfOpts := backy.NewConfigOptions(configFile,
 		backy.SetLogFile(logFile),
 		backy.EnableCommandStdOut(cmdStdOut),
+		backy.SetCmdStdOutMode(parseCmdStdOutMode()),
+		backy.EnableCmdStdOutColor(cmdStdOutColor),
+		backy.SetMaxParallel(maxParallel),
 		backy.SetHostsConfigFile(hostsConfigFile))
 	backyConfOpts.InitConfig()
 
 	backyConfOpts.ParseConfigurationFile()
 
-	for _, h := range backyConfOpts.Hosts {
+	if hostsList == nil {
+		for _, h := range backyConfOpts.Hosts {
 
-		hostsList = append(hostsList, h.Host)
+			hostsList = append(hostsList, h.Host)
+		}
+	} else {
+		resolvedHosts, err := backyConfOpts.ResolveHostSelectors(hostsList)
+		if err != nil {
+			logging.ExitWithMSG("error: "+err.Error(), 1, &backyConfOpts.Logger)
+		}
+		hostsList = resolvedHosts
+		addHostsFromSSHConfig(backyConfOpts, hostsList)
 	}
 
+	addStdinCommand(backyConfOpts)
 	if cmdList == nil {
 		logging.ExitWithMSG("error: commands must be specified", 1, &backyConfOpts.Logger)
 	}
@@ -63,12 +85,19 @@ func Hosts(cmd *cobra.Command, args []string) {
 	}
 
 	backyConfOpts.ExecCmdsOnHosts(cmdList, hostsList)
+	writePackageReport(backyConfOpts)
+	writeCmdResults(backyConfOpts)
 }
 
 func HostsList(cmd *cobra.Command, args []string) {
+	checkOutputFormat()
 	backyConfOpts := backy.NewConfigOptions(configFile,
+		backy.SetHostsToSearch(hostsList),
 		backy.SetLogFile(logFile),
 		backy.EnableCommandStdOut(cmdStdOut),
+		backy.SetCmdStdOutMode(parseCmdStdOutMode()),
+		backy.EnableCmdStdOutColor(cmdStdOutColor),
+		backy.SetMaxParallel(maxParallel),
 		backy.SetHostsConfigFile(hostsConfigFile))
 	backyConfOpts.InitConfig()
 
@@ -90,4 +119,5 @@ func HostsList(cmd *cobra.Command, args []string) {
 	})
 
 	backyConfOpts.ExecuteListOnHosts(args, runCommandsInParallel)
+	writeCmdResults(backyConfOpts)
 }
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"os"
 
+	"git.andrewnw.xyz/CyberShell/backy/pkg/backy"
+	"git.andrewnw.xyz/CyberShell/backy/pkg/logging"
 	"github.com/spf13/cobra"
 )
 
@@ -17,7 +19,10 @@ var (
 	hostsConfigFile string
 	verbose         bool
 	cmdStdOut       bool
+	cmdStdOutMode   string
+	cmdStdOutColor  bool
 	logFile         string
+	maxParallel     int
 	s3Endpoint      string
 
 	rootCmd = &cobra.Command{
@@ -38,12 +43,15 @@ func Execute() {
 func init() {
 	rootCmd.PersistentFlags().StringVar(&logFile, "logFile", "", "log file to write to")
 	rootCmd.PersistentFlags().BoolVar(&cmdStdOut, "cmdStdOut", false, "Pass to print command output to stdout")
+	rootCmd.PersistentFlags().StringVar(&cmdStdOutMode, "cmdStdOutMode", "", "How command output is printed to stdout: prefixed, grouped or raw. Defaults to prefixed.")
+	rootCmd.PersistentFlags().BoolVar(&cmdStdOutColor, "cmdStdOutColor", false, "Color the host prefix of command output on stdout")
+	rootCmd.PersistentFlags().IntVar(&maxParallel, "maxParallel", 0, "Maximum number of hosts to run commands on at once. Overrides maxParallel in the config file. Defaults to 10.")
 
 	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "f", "", "config file to read from")
 	rootCmd.PersistentFlags().StringVar(&hostsConfigFile, "hostsConfig", "", "yaml hosts file to read from")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Sets verbose level")
 	rootCmd.PersistentFlags().StringVar(&s3Endpoint, "s3Endpoint", "", "Sets the S3 endpoint used for config file fetching. Overrides S3_ENDPOINT env variable.")
-	rootCmd.AddCommand(backupCmd, execCmd, cronCmd, versionCmd, listCmd)
+	rootCmd.AddCommand(backupCmd, execCmd, cronCmd, versionCmd, listCmd, hostsCmd)
 }
 
 func parseS3Config() {
@@ -51,3 +59,15 @@ func parseS3Config() {
 		os.Setenv("S3_ENDPOINT", s3Endpoint)
 	}
 }
+
+// parseCmdStdOutMode returns the mode of the --cmdStdOutMode flag
+func parseCmdStdOutMode() backy.CmdStdOutMode {
+	if cmdStdOutMode == "" {
+		return backy.DefaultCmdStdOutMode
+	}
+	mode, err := backy.CmdStdOutModeString(cmdStdOutMode)
+	if err != nil {
+		logging.ExitWithMSG("--cmdStdOutMode must be prefixed, grouped or raw", 1, nil)
+	}
+	return mode
+}
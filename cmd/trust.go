@@ -0,0 +1,54 @@
+// trust.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package cmd
+
+import (
+	"os"
+
+	"git.andrewnw.xyz/CyberShell/backy/pkg/backy"
+	"git.andrewnw.xyz/CyberShell/backy/pkg/logging"
+	"github.com/spf13/cobra"
+)
+
+var (
+	hostsCmd = &cobra.Command{
+		Use:   "hosts [command]",
+		Short: "Manage hosts defined in config file.",
+		Long:  "Manage hosts defined in config file",
+	}
+
+	hostsTrustCmd = &cobra.Command{
+		Use:   "trust host1 host2 ...",
+		Short: "Adds the host keys of hosts to their known_hosts files.",
+		Long:  "Trust fetches the host key of each host, through its ProxyJump hosts, shows the fingerprint and adds the key to the host's known_hosts file after confirmation.",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   TrustHosts,
+	}
+)
+
+// Skips the confirmation prompt
+var trustAssumeYes bool
+
+func init() {
+	hostsCmd.AddCommand(hostsTrustCmd)
+	hostsTrustCmd.Flags().BoolVarP(&trustAssumeYes, "yes", "y", false, "Add the keys without asking")
+}
+
+func TrustHosts(cmd *cobra.Command, args []string) {
+	parseS3Config()
+
+	opts := backy.NewConfigOptions(configFile,
+		backy.SetLogFile(logFile),
+		backy.SetHostsConfigFile(hostsConfigFile))
+
+	opts.InitConfig()
+	opts.ParseConfigurationFile()
+
+	for _, h := range args {
+		if err := opts.TrustHost(h, trustAssumeYes, os.Stdin, os.Stdout); err != nil {
+			logging.ExitWithMSG("error: "+err.Error(), 1, &opts.Logger)
+		}
+	}
+}
@@ -11,9 +11,8 @@ import (
 	"io"
 	"os"
 	"os/exec"
-	"strings"
-	"sync"
 	"text/template"
+	"time"
 
 	"embed"
 
@@ -65,13 +64,13 @@ func (e *PackageCommandExecutor) Run(cmd *Command, opts *ConfigOpts, logger zero
 
 		// Execute the package version command
 		execCmd := exec.Command(cmd.Cmd, cmd.Args...)
-		cmdOutWriters = io.MultiWriter(&cmdOutBuf)
-
-		if IsCmdStdOutEnabled() {
-			cmdOutWriters = io.MultiWriter(os.Stdout, &cmdOutBuf)
-		}
+		var closeStdOut func()
+		cmdOutWriters, closeStdOut = opts.cmdOutputWriter(cmd, &cmdOutBuf)
+		defer closeStdOut()
+		errWriters, closeStdErr := opts.stderrWriter(cmd, logger)
+		defer closeStdErr()
 		execCmd.Stdout = cmdOutWriters
-		execCmd.Stderr = cmdOutWriters
+		execCmd.Stderr = errWriters
 
 		if err := execCmd.Run(); err != nil {
 			return nil, fmt.Errorf("error running command %s: %w", ArgsStr, err)
@@ -80,12 +79,38 @@ func (e *PackageCommandExecutor) Run(cmd *Command, opts *ConfigOpts, logger zero
 		return parsePackageVersion(cmdOutBuf.String(), logger, cmd, cmdOutBuf)
 	}
 
+	if cmd.isPackageListOperation() {
+		ArgsStr = fmt.Sprintf("%s%s", cmd.Cmd, ArgsStr)
+		logger.Info().Str("operation", cmd.PackageOperation.String()).Msg("Listing package upgrades")
+
+		// the command is a pipeline, so it needs a shell
+		execCmd := exec.Command("/bin/sh", "-c", ArgsStr)
+		var closeStdOut func()
+		cmdOutWriters, closeStdOut = opts.cmdOutputWriter(cmd, &cmdOutBuf)
+		defer closeStdOut()
+		errWriters, closeStdErr := opts.stderrWriter(cmd, logger)
+		defer closeStdErr()
+		execCmd.Stdout = cmdOutWriters
+		execCmd.Stderr = errWriters
+
+		runErr := execCmd.Run()
+		output := cmdOutBuf.String()
+		outputArr = logCommandOutput(cmd, cmdOutBuf, logger, outputArr)
+		if runErr != nil {
+			return outputArr, fmt.Errorf("error running command %s: %w", ArgsStr, runErr)
+		}
+
+		return outputArr, cmd.parsePackageUpgrades(output, "localhost", opts, logger)
+	}
+
 	// Other package operations (install, upgrade, etc.) can be handled here
 
 	// Default: run as a shell command
 	execCmd := exec.Command(cmd.Cmd, cmd.Args...)
+	errWriters, closeStdErr := opts.stderrWriter(cmd, logger)
+	defer closeStdErr()
 	execCmd.Stdout = &cmdOutBuf
-	execCmd.Stderr = &cmdOutBuf
+	execCmd.Stderr = errWriters
 	err := execCmd.Run()
 	outputArr = logCommandOutput(cmd, cmdOutBuf, logger, outputArr)
 	if err != nil {
@@ -127,12 +152,12 @@ func (e *LocalCommandExecutor) Run(cmd *Command, opts *ConfigOpts, logger zerolo
 	// injectEnvIntoLocalCMD(...)
 
 	// Set output writers
-	cmdOutWriters := io.MultiWriter(&cmdOutBuf)
-	if IsCmdStdOutEnabled() {
-		cmdOutWriters = io.MultiWriter(os.Stdout, &cmdOutBuf)
-	}
+	cmdOutWriters, closeStdOut := opts.cmdOutputWriter(cmd, &cmdOutBuf)
+	defer closeStdOut()
+	errWriters, closeStdErr := opts.stderrWriter(cmd, logger)
+	defer closeStdErr()
 	localCMD.Stdout = cmdOutWriters
-	localCMD.Stderr = cmdOutWriters
+	localCMD.Stderr = errWriters
 
 	// Run the command
 	err := localCMD.Run()
@@ -151,8 +176,11 @@ func (opts *ConfigOpts) ensureRemoteHost(localCmd *Command, host string) {
 	if localCmd.RemoteHost != nil {
 		return
 	}
-	if opts != nil && opts.Hosts != nil {
-		if rh, found := opts.Hosts[host]; found {
+	if opts != nil {
+		opts.hostsMu.Lock()
+		rh, found := opts.Hosts[host]
+		opts.hostsMu.Unlock()
+		if found {
 			localCmd.RemoteHost = rh
 			return
 		}
@@ -162,7 +190,8 @@ func (opts *ConfigOpts) ensureRemoteHost(localCmd *Command, host string) {
 	localCmd.RemoteHost = &Host{Host: host}
 }
 
-// ExecCommandOnHostsParallel runs a single configured command concurrently on the command.Hosts list.
+// ExecCommandOnHostsParallel runs a single configured command concurrently on the command.Hosts list,
+// on at most maxParallel hosts at a time. The results are in the order of command.Hosts.
 // It reuses the standard RunCmd / RunCmdOnHost flow so the behavior is identical to normal execution.
 func (opts *ConfigOpts) ExecCommandOnHostsParallel(cmdName string) ([]CmdResult, error) {
 	cmdObj, ok := opts.Cmds[cmdName]
@@ -173,43 +202,38 @@ func (opts *ConfigOpts) ExecCommandOnHostsParallel(cmdName string) ([]CmdResult,
 		return nil, fmt.Errorf("no hosts configured for command %s", cmdName)
 	}
 
-	var wg sync.WaitGroup
-	resultsCh := make(chan CmdResult, len(cmdObj.Hosts))
-
-	for _, host := range cmdObj.Hosts {
-		wg.Add(1)
-		go func(h string) {
-			defer wg.Done()
-			// shallow copy to avoid races
-			local := *cmdObj
-			local.Host = h
-			opts.Logger.Debug().Str("host", h).Msg("executing command in parallel on host")
-
-			var err error
-			if IsHostLocal(h) {
-				_, err := local.RunCmd(local.GenerateLogger(opts), opts)
-				resultsCh <- CmdResult{CmdName: cmdName, ListName: "", Error: err}
-				return
-				// _, err = local.RunCmd(local.GenerateLogger(opts), opts)
-			}
+	return opts.execCommandOnHosts("", cmdObj), nil
+}
 
+// execCommandOnHosts runs cmdObj on each of its hosts, on at most maxParallel hosts at a time
+func (opts *ConfigOpts) execCommandOnHosts(list string, cmdObj *Command) []CmdResult {
+	results := make([]CmdResult, len(cmdObj.Hosts))
+	runParallel(len(cmdObj.Hosts), opts.maxParallel(), func(i int) {
+		h := cmdObj.Hosts[i]
+		// each host runs its own copy of the command
+		local := *cmdObj
+		local.Host = h
+		local.Hosts = nil
+		local.RemoteHost = nil
+		opts.Logger.Debug().Str("host", h).Msg("executing command in parallel on host")
+
+		var (
+			output []string
+			err    error
+		)
+		start := time.Now()
+		if IsHostLocal(h) {
+			output, err = local.RunCmd(local.GenerateLogger(opts), opts)
+		} else {
 			// ensure RemoteHost is populated before calling RunCmdOnHost
 			opts.ensureRemoteHost(&local, h)
+			output, err = local.RunCmdOnHost(local.GenerateLogger(opts), opts)
+		}
 
-			_, err = local.RunCmdOnHost(local.GenerateLogger(opts), opts)
-
-			resultsCh <- CmdResult{CmdName: cmdName, ListName: "", Error: err}
-		}(host)
-	}
-
-	wg.Wait()
-	close(resultsCh)
+		results[i] = newCmdResult(list, &local, output, err, time.Since(start))
+	})
 
-	var results []CmdResult
-	for r := range resultsCh {
-		results = append(results, r)
-	}
-	return results, nil
+	return results
 }
 
 // RunCmd runs a Command.
@@ -217,8 +241,27 @@ func (opts *ConfigOpts) ExecCommandOnHostsParallel(cmdName string) ([]CmdResult,
 // variables specified in the Env file or Environment.
 // Dir can also be specified for local commands.
 //
-// Returns the output as a slice and an error, if any
+// Commands with Template set are rendered before they run.
+//
+// Returns the stdout as a slice and an error, if any.
+// Exit codes in SuccessExitCodes do not return an error.
 func (command *Command) RunCmd(cmdCtxLogger zerolog.Logger, opts *ConfigOpts) ([]string, error) {
+	command.stderr = nil
+	// the run has its own leases, so they are not shared with other runs of the command
+	run := *command
+	run.leases = &vaultLeases{}
+	defer run.leases.revoke(opts, cmdCtxLogger)
+	toRun, err := run.renderTemplates(opts)
+	if err != nil {
+		cmdCtxLogger.Err(err).Send()
+		return nil, command.checkExitCode(err, cmdCtxLogger)
+	}
+	outputArr, err := toRun.run(cmdCtxLogger, opts)
+	command.stderr = toRun.stderr
+	return outputArr, command.checkExitCode(err, cmdCtxLogger)
+}
+
+func (command *Command) run(cmdCtxLogger zerolog.Logger, opts *ConfigOpts) ([]string, error) {
 
 	var (
 		ArgsStr       string
@@ -227,8 +270,10 @@ func (command *Command) RunCmd(cmdCtxLogger zerolog.Logger, opts *ConfigOpts) ([
 		errSSH        error
 
 		envVars = environmentVars{
-			file: command.Env,
-			env:  command.Environment,
+			file:   command.Env,
+			env:    command.Environment,
+			vars:   command.hookEnv,
+			leases: command.leases,
 		}
 
 		outputArr []string // holds the output strings returned by processes
@@ -238,8 +283,11 @@ func (command *Command) RunCmd(cmdCtxLogger zerolog.Logger, opts *ConfigOpts) ([
 		cmdCtxLogger.Warn().Msg("both 'host' and 'hosts' are set; 'hosts' will be ignored")
 		return nil, fmt.Errorf("both 'host' and 'hosts' are set; please set one or the other")
 	} else if command.Hosts != nil {
-		opts.ExecCommandOnHostsParallel(command.Name)
-		return nil, nil
+		return hostsResultsOutput(command, opts.execCommandOnHosts("", command), cmdCtxLogger)
+	}
+
+	if command.Type == PipelineCommandType {
+		return opts.runPipeline(command, cmdCtxLogger)
 	}
 
 	// Getting the command type must be done before concatenating the arguments
@@ -251,22 +299,32 @@ func (command *Command) RunCmd(cmdCtxLogger zerolog.Logger, opts *ConfigOpts) ([
 
 	if command.Type == UserCommandType {
 		if command.UserOperation == "password" {
-			cmdCtxLogger.Info().Str("password", command.UserPassword).Msg("user password to be updated")
+			cmdCtxLogger.Info().Msg("user password to be updated")
 		}
 	}
 
 	if !IsHostLocal(command.Host) {
 
-		outputArr, errSSH = command.RunCmdOnHost(cmdCtxLogger, opts)
+		outputArr, errSSH = command.runOnHost(cmdCtxLogger, opts)
 		if errSSH != nil {
 			return outputArr, errSSH
 		}
 	} else {
 
+		closeForwards, forwardErr := command.openForwards(cmdCtxLogger, opts)
+		if forwardErr != nil {
+			return nil, forwardErr
+		}
+		defer closeForwards()
+
 		switch command.Type {
 		case PackageCommandType:
 			var executor PackageCommandExecutor
 			return executor.Run(command, opts, cmdCtxLogger)
+		case UserCommandType:
+			if command.UserOperation == "ensure" {
+				return command.ensureUser(cmdCtxLogger, opts)
+			}
 		}
 
 		var localCMD *exec.Cmd
@@ -276,6 +334,9 @@ func (command *Command) RunCmd(cmdCtxLogger zerolog.Logger, opts *ConfigOpts) ([
 			if err != nil {
 				return nil, err
 			}
+			if script, err = command.renderScript(script); err != nil {
+				return nil, err
+			}
 
 			if command.Shell == "" {
 				command.Shell = "sh"
@@ -283,28 +344,26 @@ func (command *Command) RunCmd(cmdCtxLogger zerolog.Logger, opts *ConfigOpts) ([
 			localCMD = exec.Command(command.Shell, command.Args...)
 			injectEnvIntoLocalCMD(envVars, localCMD, cmdCtxLogger, opts)
 
-			cmdOutWriters = io.MultiWriter(&cmdOutBuf)
-
-			if IsCmdStdOutEnabled() {
-				cmdOutWriters = io.MultiWriter(os.Stdout, &cmdOutBuf)
-			}
+			outWriters := []io.Writer{&cmdOutBuf}
 			if command.Output.File != "" {
 				file, err := os.Create(command.Output.File)
 				if err != nil {
 					return nil, fmt.Errorf("error creating output file: %w", err)
 				}
 				defer file.Close()
-				cmdOutWriters = io.MultiWriter(file, &cmdOutBuf)
-
-				if IsCmdStdOutEnabled() {
-					cmdOutWriters = io.MultiWriter(os.Stdout, file, &cmdOutBuf)
-				}
-
+				redacted := newRedactWriter(file, opts.Redact)
+				defer redacted.Close()
+				outWriters = append(outWriters, redacted)
 			}
+			var closeStdOut func()
+			cmdOutWriters, closeStdOut = opts.cmdOutputWriter(command, outWriters...)
+			defer closeStdOut()
 
+			errWriters, closeStdErr := opts.stderrWriter(command, cmdCtxLogger)
+			defer closeStdErr()
 			localCMD.Stdin = bytes.NewReader(script)
 			localCMD.Stdout = cmdOutWriters
-			localCMD.Stderr = cmdOutWriters
+			localCMD.Stderr = errWriters
 
 			cmdCtxLogger.Info().Str("Command", fmt.Sprintf("Running remoteScript %s on local machine in %s", command.Cmd, command.Shell)).Send()
 			err = localCMD.Run()
@@ -342,8 +401,8 @@ func (command *Command) RunCmd(cmdCtxLogger zerolog.Logger, opts *ConfigOpts) ([
 
 			cmdCtxLogger.Info().Str("Command", fmt.Sprintf("Running command %s on local machine", command.Name)).Send()
 
-			// execute package commands in a shell
-			if command.Type == PackageCommandType {
+			// execute package and user commands in a shell
+			if command.Type == PackageCommandType || command.Type == UserCommandType {
 				for _, p := range command.Packages {
 					cmdCtxLogger.Info().Str("packages", p.Name).Msg("Executing package command")
 				}
@@ -361,23 +420,31 @@ func (command *Command) RunCmd(cmdCtxLogger zerolog.Logger, opts *ConfigOpts) ([
 		if command.Type == UserCommandType {
 			if command.UserOperation == "password" {
 				localCMD.Stdin = command.stdin
-				cmdCtxLogger.Info().Str("password", command.UserPassword).Msg("user password to be updated")
+				cmdCtxLogger.Info().Msg("user password to be updated")
 			}
 		}
+		if command.Stdin != nil {
+			stdin, closeStdin, err := opts.stdinReader(command, cmdCtxLogger)
+			if err != nil {
+				return nil, err
+			}
+			defer closeStdin()
+			localCMD.Stdin = stdin
+		}
 		if command.Dir != nil {
 			localCMD.Dir = *command.Dir
 		}
 
 		injectEnvIntoLocalCMD(envVars, localCMD, cmdCtxLogger, opts)
 
-		cmdOutWriters = io.MultiWriter(&cmdOutBuf)
-
-		if IsCmdStdOutEnabled() {
-			cmdOutWriters = io.MultiWriter(os.Stdout, &cmdOutBuf)
-		}
+		var closeStdOut func()
+		cmdOutWriters, closeStdOut = opts.cmdOutputWriter(command, &cmdOutBuf)
+		defer closeStdOut()
+		errWriters, closeStdErr := opts.stderrWriter(command, cmdCtxLogger)
+		defer closeStdErr()
 
 		localCMD.Stdout = cmdOutWriters
-		localCMD.Stderr = cmdOutWriters
+		localCMD.Stderr = errWriters
 
 		err = localCMD.Run()
 
@@ -387,62 +454,6 @@ func (command *Command) RunCmd(cmdCtxLogger zerolog.Logger, opts *ConfigOpts) ([
 			return outputArr, err
 		}
 
-		if command.Type == UserCommandType {
-
-			if command.UserOperation == "add" {
-				if command.UserSshPubKeys != nil {
-					var (
-						authorizedKeysFile *os.File
-						err                error
-						userHome           []byte
-					)
-
-					cmdCtxLogger.Info().Msg("adding SSH Keys")
-
-					localCMD := exec.Command(fmt.Sprintf("grep \"%s\" /etc/passwd | cut -d: -f6", command.Username))
-					userHome, err = localCMD.CombinedOutput()
-					if err != nil {
-						return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), fmt.Errorf("error finding user home from /etc/passwd: %v", err)
-					}
-
-					command.UserHome = strings.TrimSpace(string(userHome))
-					userSshDir := fmt.Sprintf("%s/.ssh", command.UserHome)
-
-					if _, err := os.Stat(userSshDir); os.IsNotExist(err) {
-						err := os.MkdirAll(userSshDir, 0700)
-						if err != nil {
-							return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), fmt.Errorf("error creating directory %s %v", userSshDir, err)
-						}
-					}
-
-					if _, err := os.Stat(fmt.Sprintf("%s/authorized_keys", userSshDir)); os.IsNotExist(err) {
-						_, err := os.Create(fmt.Sprintf("%s/authorized_keys", userSshDir))
-						if err != nil {
-							return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), fmt.Errorf("error creating file %s/authorized_keys: %v", userSshDir, err)
-						}
-					}
-
-					authorizedKeysFile, err = os.OpenFile(fmt.Sprintf("%s/authorized_keys", userSshDir), 0700, os.ModeAppend)
-					if err != nil {
-						return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), fmt.Errorf("error opening file %s/authorized_keys: %v", userSshDir, err)
-					}
-					defer authorizedKeysFile.Close()
-					for _, k := range command.UserSshPubKeys {
-						buf := bytes.NewBufferString(k)
-						cmdCtxLogger.Info().Str("key", k).Msg("adding SSH key")
-						if _, err := authorizedKeysFile.ReadFrom(buf); err != nil {
-							return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), fmt.Errorf("error adding to authorized keys: %v", err)
-						}
-					}
-					localCMD = exec.Command(fmt.Sprintf("chown -R %s:%s %s", command.Username, command.Username, userHome))
-					_, err = localCMD.CombinedOutput()
-					if err != nil {
-						return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), err
-					}
-
-				}
-			}
-		}
 	}
 	return outputArr, nil
 }
@@ -457,14 +468,16 @@ func cmdListWorker(msgTemps *msgTemplates, jobs <-chan *CmdList, results chan<-
 		var hasError bool // Tracks if any command in the list failed
 
 		for _, cmd := range list.Order {
-			cmdToRun := opts.Cmds[cmd]
+			// lists run at the same time, so each runs its own copy of the command
+			cmdCopy := *opts.Cmds[cmd]
+			cmdToRun := &cmdCopy
 			commandExecuted = cmdToRun
 			currentCmd := cmdToRun.Name
 			fieldsMap["cmd"] = currentCmd
 			cmdLogger = cmdToRun.GenerateLogger(opts)
 			cmdLogger.Info().Fields(fieldsMap).Send()
 
-			outputArr, runErr := cmdToRun.RunCmd(cmdLogger, opts)
+			outputArr, runErr := opts.runCmd(list.Name, cmdToRun, cmdLogger)
 			cmdsRan = append(cmdsRan, cmd)
 
 			if runErr != nil {
@@ -475,7 +488,7 @@ func cmdListWorker(msgTemps *msgTemplates, jobs <-chan *CmdList, results chan<-
 
 				// Notify failure
 				if list.NotifyConfig != nil {
-					notifyError(cmdLogger, msgTemps, list, cmdsRan, outStructArr, runErr, cmdToRun)
+					notifyError(cmdLogger, msgTemps, list, cmdsRan, outStructArr, opts.packageReportsForCmds(cmdsRan, ""), runErr, cmdToRun)
 				}
 
 				// Execute error hooks for the failed command
@@ -488,12 +501,14 @@ func cmdListWorker(msgTemps *msgTemplates, jobs <-chan *CmdList, results chan<-
 					CmdName:     currentCmd,
 					CmdExecuted: currentCmd,
 					Output:      outputArr,
+					Stderr:      cmdToRun.stderr,
+					ExitCode:    cmdToRun.exitCode,
 				})
 			}
 		}
 
 		if !hasError && list.NotifyConfig != nil && list.Notify.OnFailure {
-			notifySuccess(cmdLogger, msgTemps, list, cmdsRan, outStructArr)
+			notifySuccess(cmdLogger, msgTemps, list, cmdsRan, outStructArr, opts.packageReportsForCmds(cmdsRan, ""))
 		}
 
 		if !hasError {
@@ -505,7 +520,7 @@ func cmdListWorker(msgTemps *msgTemplates, jobs <-chan *CmdList, results chan<-
 		results <- "done"
 	}
 }
-func cmdListWorkerWithHosts(msgTemps *msgTemplates, jobs <-chan *CmdList, hosts <-chan *Host, results chan<- string, opts *ConfigOpts) {
+func cmdListWorkerWithHosts(msgTemps *msgTemplates, jobs <-chan *CmdList, hosts []*Host, results chan<- string, opts *ConfigOpts) {
 	for list := range jobs {
 		fieldsMap := map[string]interface{}{"list": list.Name}
 		var cmdLogger zerolog.Logger
@@ -514,10 +529,15 @@ func cmdListWorkerWithHosts(msgTemps *msgTemplates, jobs <-chan *CmdList, hosts
 		var outStructArr []outStruct
 		var hasError bool // Tracks if any command in the list failed
 
-		for host := range hosts {
+		for _, host := range hosts {
+			if !list.runsOnHost(host, opts) {
+				continue
+			}
 
 			for _, cmd := range list.Order {
-				cmdToRun := opts.Cmds[cmd]
+				// lists run at the same time, so each runs its own copy of the command
+				cmdCopy := *opts.Cmds[cmd]
+				cmdToRun := &cmdCopy
 				if cmdToRun.Host != host.Host {
 					cmdToRun.Host = host.Host
 					cmdToRun.RemoteHost = host
@@ -528,7 +548,7 @@ func cmdListWorkerWithHosts(msgTemps *msgTemplates, jobs <-chan *CmdList, hosts
 				cmdLogger = cmdToRun.GenerateLogger(opts)
 				cmdLogger.Info().Fields(fieldsMap).Send()
 
-				outputArr, runErr := cmdToRun.RunCmd(cmdLogger, opts)
+				outputArr, runErr := opts.runCmd(list.Name, cmdToRun, cmdLogger)
 				cmdsRan = append(cmdsRan, cmd)
 
 				if runErr != nil {
@@ -539,7 +559,7 @@ func cmdListWorkerWithHosts(msgTemps *msgTemplates, jobs <-chan *CmdList, hosts
 
 					// Notify failure
 					if list.NotifyConfig != nil {
-						notifyError(cmdLogger, msgTemps, list, cmdsRan, outStructArr, runErr, cmdToRun)
+						notifyError(cmdLogger, msgTemps, list, cmdsRan, outStructArr, opts.packageReportsForCmds(cmdsRan, host.Host), runErr, cmdToRun)
 					}
 
 					// Execute error hooks for the failed command
@@ -552,12 +572,14 @@ func cmdListWorkerWithHosts(msgTemps *msgTemplates, jobs <-chan *CmdList, hosts
 						CmdName:     currentCmd,
 						CmdExecuted: currentCmd,
 						Output:      outputArr,
+						Stderr:      cmdToRun.stderr,
+						ExitCode:    cmdToRun.exitCode,
 					})
 				}
 			}
 
 			if !hasError && list.NotifyConfig != nil && list.Notify.OnFailure {
-				notifySuccess(cmdLogger, msgTemps, list, cmdsRan, outStructArr)
+				notifySuccess(cmdLogger, msgTemps, list, cmdsRan, outStructArr, opts.packageReportsForCmds(cmdsRan, host.Host))
 			}
 
 			if !hasError {
@@ -594,7 +616,7 @@ func cmdListWorkerWithHosts(msgTemps *msgTemplates, jobs <-chan *CmdList, hosts
 // 				cmdLogger = cmdToRun.GenerateLogger(opts)
 // 				cmdLogger.Info().Fields(fieldsMap).Send()
 
-// 				outputArr, runErr := cmdToRun.RunCmd(cmdLogger, opts)
+// 				outputArr, runErr := opts.runCmd(list.Name, cmdToRun, cmdLogger)
 // 				cmdsRan = append(cmdsRan, cmd)
 
 // 				if runErr != nil {
@@ -637,130 +659,138 @@ func cmdListWorkerWithHosts(msgTemps *msgTemplates, jobs <-chan *CmdList, hosts
 // 	}
 // }
 
-func cmdListWorkerExecuteCommandsInParallel(msgTemps *msgTemplates, jobs <-chan *CmdList, hosts <-chan *Host, results chan<- string, opts *ConfigOpts) {
-	opts.Logger.Info().Msg("Running commands in parallel")
+// cmdListWorkerExecuteCommandsInParallel runs each command of a list on all of the list's hosts,
+// on at most maxParallel hosts at a time, before moving on to the next command.
+func cmdListWorkerExecuteCommandsInParallel(msgTemps *msgTemplates, jobs <-chan *CmdList, hosts []*Host, results chan<- string, opts *ConfigOpts) {
 	for list := range jobs {
-		fieldsMap := map[string]interface{}{"list": list.Name}
-		var cmdLogger zerolog.Logger
 		var commandExecuted *Command
 		var cmdsRan []string
 		var outStructArr []outStruct
 		var hasError bool // Tracks if any command in the list failed
 
-		var wg sync.WaitGroup
 		hostList := []*Host{}
-		for host := range hosts {
+		for _, host := range hosts {
+			if !list.runsOnHost(host, opts) {
+				continue
+			}
 			hostList = append(hostList, host)
 		}
-		println("Total hosts to run commands on:", len(hostList))
-		println("Total commands to run:", len(list.Order))
+		opts.Logger.Info().Str("list", list.Name).Int("hosts", len(hostList)).Int("maxParallel", opts.maxParallel()).Msg("Running commands in parallel")
 
 		for _, cmd := range list.Order {
 			cmdsRan = append(cmdsRan, cmd)
-			println("Running cmd:", cmd, "on", len(hostList), "hosts")
-			outputChan := make(chan outStruct, len(hostList))
-			errorChan := make(chan error, len(hostList))
-			// cmdToRun := opts.Cmds[cmd]
 			origCmd := opts.Cmds[cmd]
+			commandExecuted = origCmd
 
-			for _, host := range hostList {
-				wg.Add(1)
-				cmdToRun := *origCmd // shallow copy
-				commandExecuted = origCmd
-				if cmdToRun.Host != host.Host {
-					cmdToRun.Host = host.Host
-					cmdToRun.RemoteHost = host
+			// each host stores its output, error and failed command at its own index
+			outputs := make([]*outStruct, len(hostList))
+			errs := make([]error, len(hostList))
+			failedCmds := make([]*Command, len(hostList))
+
+			runParallel(len(hostList), opts.maxParallel(), func(i int) {
+				host := hostList[i]
+				// each host runs its own copy of the command
+				cmdToRun := *origCmd
+				cmdToRun.Host = host.Host
+				cmdToRun.RemoteHost = host
+				cmdToRun.Hosts = nil
+
+				cmdLogger := cmdToRun.GenerateLogger(opts)
+				cmdLogger.Info().Str("list", list.Name).Str("cmd", cmdToRun.Name).Send()
+
+				outputArr, runErr := opts.runCmd(list.Name, &cmdToRun, cmdLogger)
+				if runErr != nil {
+					cmdLogger.Err(runErr).Send()
+					cmdToRun.ExecuteHooks("error", opts)
+					errs[i] = runErr
+					failedCmds[i] = &cmdToRun
+					return
 				}
-				cmdLogger = cmdToRun.GenerateLogger(opts)
-				cmdLogger.Info().Fields(fieldsMap).Send()
-				print("Running cmd on: ", host.Host, "\n")
-
-				go func(cmd string, host *Host) {
-					defer wg.Done()
-					currentCmd := cmdToRun.Name
-					fieldsMap["cmd"] = currentCmd
-
-					outputArr, runErr := cmdToRun.RunCmd(cmdLogger, opts)
-					if runErr != nil {
-						cmdLogger.Err(runErr).Send()
-						cmdToRun.ExecuteHooks("error", opts)
-						errorChan <- runErr
-						return
-					}
 
-					if list.GetCommandOutputInNotificationsOnSuccess || cmdToRun.Output.InList {
-						outputChan <- outStruct{
-							CmdName:     currentCmd,
-							CmdExecuted: currentCmd,
-							Output:      outputArr,
-						}
+				if list.GetCommandOutputInNotificationsOnSuccess || cmdToRun.Output.InList {
+					outputs[i] = &outStruct{
+						CmdName:     cmdToRun.Name,
+						CmdExecuted: cmdToRun.Name,
+						Output:      outputArr,
+						Stderr:      cmdToRun.stderr,
+						ExitCode:    cmdToRun.exitCode,
 					}
-				}(cmd, host)
-			}
-
-			wg.Wait()
-			close(outputChan)
-			close(errorChan)
+				}
+			})
 
-			for out := range outputChan {
-				outStructArr = append(outStructArr, out)
+			for _, out := range outputs {
+				if out != nil {
+					outStructArr = append(outStructArr, *out)
+				}
 			}
-			if len(errorChan) > 0 {
+
+			for i, runErr := range errs {
+				if runErr == nil {
+					continue
+				}
 				hasError = true
-				runErr := <-errorChan
 				if list.NotifyConfig != nil {
-					notifyError(cmdLogger, msgTemps, list, cmdsRan, outStructArr, runErr, commandExecuted)
+					cmdLogger := opts.Logger.With().Str("list", list.Name).Str("host", hostList[i].Host).Logger()
+					notifyError(cmdLogger, msgTemps, list, cmdsRan, outStructArr, opts.packageReportsForCmds(cmdsRan, ""), runErr, failedCmds[i])
 				}
 				break
 			}
-
-			if !hasError && list.NotifyConfig != nil && list.Notify.OnFailure {
-				notifySuccess(cmdLogger, msgTemps, list, cmdsRan, outStructArr)
+			if hasError {
+				break
 			}
+		}
 
+		if commandExecuted != nil {
 			if !hasError {
+				if list.NotifyConfig != nil && list.Notify.OnFailure {
+					notifySuccess(opts.Logger, msgTemps, list, cmdsRan, outStructArr, opts.packageReportsForCmds(cmdsRan, ""))
+				}
 				commandExecuted.ExecuteHooks("success", opts)
 			}
-
+			commandExecuted.ExecuteHooks("final", opts)
 		}
-		commandExecuted.ExecuteHooks("final", opts)
 		results <- "done"
 	}
 }
 
-func notifyError(logger zerolog.Logger, templates *msgTemplates, list *CmdList, cmdsRan []string, outStructArr []outStruct, err error, cmd *Command) {
+func notifyError(logger zerolog.Logger, templates *msgTemplates, list *CmdList, cmdsRan []string, outStructArr []outStruct, packageReports []PackageReport, err error, cmd *Command) {
 	errStruct := map[string]interface{}{
-		"listName":  list.Name,
-		"CmdsRan":   cmdsRan,
-		"CmdOutput": outStructArr,
-		"Err":       err,
-		"CmdName":   cmd.Name,
-		"Command":   cmd.Cmd,
-		"Args":      cmd.Args,
+		"listName":       list.Name,
+		"CmdsRan":        cmdsRan,
+		"CmdOutput":      outStructArr,
+		"PackageReports": packageReports,
+		"Err":            err,
+		"CmdName":        cmd.Name,
+		"Command":        cmd.Cmd,
+		"Args":           cmd.Args,
+		"Host":           cmd.hostLabel(),
+		"ExitCode":       cmd.exitCode,
+		"Stderr":         cmd.stderr,
 	}
 	var errMsg bytes.Buffer
 	if e := templates.err.Execute(&errMsg, errStruct); e != nil {
 		logger.Err(e).Send()
 		return
 	}
-	if e := list.NotifyConfig.Send(context.Background(), fmt.Sprintf("List %s failed", list.Name), errMsg.String()); e != nil {
+	if e := list.NotifyConfig.Send(context.Background(), fmt.Sprintf("List %s failed", list.Name), templates.redactMsg(errMsg.String())); e != nil {
 		logger.Err(e).Send()
 	}
 }
 
 // Helper to notify success
-func notifySuccess(logger zerolog.Logger, templates *msgTemplates, list *CmdList, cmdsRan []string, outStructArr []outStruct) {
+func notifySuccess(logger zerolog.Logger, templates *msgTemplates, list *CmdList, cmdsRan []string, outStructArr []outStruct, packageReports []PackageReport) {
 	successStruct := map[string]interface{}{
-		"listName":  list.Name,
-		"CmdsRan":   cmdsRan,
-		"CmdOutput": outStructArr,
+		"listName":       list.Name,
+		"CmdsRan":        cmdsRan,
+		"CmdOutput":      outStructArr,
+		"PackageReports": packageReports,
 	}
 	var successMsg bytes.Buffer
 	if e := templates.success.Execute(&successMsg, successStruct); e != nil {
 		logger.Err(e).Send()
 		return
 	}
-	if e := list.NotifyConfig.Send(context.Background(), fmt.Sprintf("List %s succeeded", list.Name), successMsg.String()); e != nil {
+	if e := list.NotifyConfig.Send(context.Background(), fmt.Sprintf("List %s succeeded", list.Name), templates.redactMsg(successMsg.String())); e != nil {
 		logger.Err(e).Send()
 	}
 }
@@ -770,6 +800,7 @@ func (opts *ConfigOpts) RunListConfig(cron string) {
 	mTemps := &msgTemplates{
 		err:     template.Must(template.New("error.txt").ParseFS(templates, "templates/error.txt")),
 		success: template.Must(template.New("success.txt").ParseFS(templates, "templates/success.txt")),
+		redact:  opts.Redact,
 	}
 	configListsLen := len(opts.CmdConfigLists)
 	listChan := make(chan *CmdList, configListsLen)
@@ -803,6 +834,7 @@ func (opts *ConfigOpts) ExecuteListOnHosts(lists []string, parallel bool) {
 	mTemps := &msgTemplates{
 		err:     template.Must(template.New("error.txt").ParseFS(templates, "templates/error.txt")),
 		success: template.Must(template.New("success.txt").ParseFS(templates, "templates/success.txt")),
+		redact:  opts.Redact,
 	}
 	// for _, l := range opts.CmdConfigLists {
 	// 	if !slices.Contains(lists, l.Name) {
@@ -810,17 +842,22 @@ func (opts *ConfigOpts) ExecuteListOnHosts(lists []string, parallel bool) {
 	// 	}
 	// }
 	configListsLen := len(opts.CmdConfigLists)
-	listChan := make(chan *CmdList, configListsLen)
-	hostChan := make(chan *Host, len(opts.Hosts))
+	serialListChan := make(chan *CmdList, configListsLen)
+	parallelListChan := make(chan *CmdList, configListsLen)
 	results := make(chan string, configListsLen)
 
+	var hostsToRun []*Host
+	for _, h := range opts.hostsToRunOn() {
+		if h.isProxyHost {
+			continue
+		}
+		hostsToRun = append(hostsToRun, h)
+	}
+
 	// Start workers
 	for w := 1; w <= configListsLen; w++ {
-		if parallel {
-			go cmdListWorkerExecuteCommandsInParallel(mTemps, listChan, hostChan, results, opts)
-		} else {
-			go cmdListWorkerWithHosts(mTemps, listChan, hostChan, results, opts)
-		}
+		go cmdListWorkerExecuteCommandsInParallel(mTemps, parallelListChan, hostsToRun, results, opts)
+		go cmdListWorkerWithHosts(mTemps, serialListChan, hostsToRun, results, opts)
 	}
 
 	// Enqueue jobs
@@ -828,22 +865,26 @@ func (opts *ConfigOpts) ExecuteListOnHosts(lists []string, parallel bool) {
 		if cmdConfig.Name == "" {
 			cmdConfig.Name = listName
 		}
-		listChan <- cmdConfig
-	}
-	for _, h := range opts.Hosts {
-		if h.isProxyHost {
-			continue
+		switch cmdConfig.Strategy {
+		case RollingListStrategy:
+			go func(list *CmdList) {
+				opts.runListRolling(mTemps, list, hostsToRun)
+				results <- "done"
+			}(cmdConfig)
+		case ParallelListStrategy:
+			parallelListChan <- cmdConfig
+		case SerialListStrategy:
+			serialListChan <- cmdConfig
+		default:
+			if parallel {
+				parallelListChan <- cmdConfig
+			} else {
+				serialListChan <- cmdConfig
+			}
 		}
-		hostChan <- h
-		// for _, proxyHost := range h.ProxyHost {
-		// 	if proxyHost.isProxyHost {
-		// 		continue
-		// 	}
-		// 	hostChan <- proxyHost
-		// }
 	}
-	close(listChan)
-	close(hostChan)
+	close(serialListChan)
+	close(parallelListChan)
 
 	// Process results
 	for a := 1; a <= configListsLen; a++ {
@@ -855,9 +896,10 @@ func (opts *ConfigOpts) ExecuteListOnHosts(lists []string, parallel bool) {
 
 func (opts *ConfigOpts) ExecuteCmds() {
 	for _, cmd := range opts.executeCmds {
-		cmdToRun := opts.Cmds[cmd]
+		cmdCopy := *opts.Cmds[cmd]
+		cmdToRun := &cmdCopy
 		cmdLogger := cmdToRun.GenerateLogger(opts)
-		_, runErr := cmdToRun.RunCmd(cmdLogger, opts)
+		_, runErr := opts.runCmd("", cmdToRun, cmdLogger)
 		if runErr != nil {
 			opts.Logger.Err(runErr).Send()
 			cmdToRun.ExecuteHooks("error", opts)
@@ -871,42 +913,37 @@ func (opts *ConfigOpts) ExecuteCmds() {
 	opts.closeHostConnections()
 }
 
+// closeHostConnections closes the pooled SSH connections after a run.
+// In cron mode the connections are kept open for the next scheduled run,
+// and the pool closes them once they are idle.
 func (c *ConfigOpts) closeHostConnections() {
+	// forwards only last for the run, even if the connections are kept
 	for _, host := range c.Hosts {
-		if host.isProxyHost {
-			continue
-		}
-		if host.SshClient != nil {
-			if _, err := host.SshClient.NewSession(); err == nil {
-				c.Logger.Info().Msgf("Closing host connection %s", host.HostName)
-				host.SshClient.Close()
-				host.SshClient = nil
-			}
-		}
-		for _, proxyHost := range host.ProxyHost {
-			if proxyHost.isProxyHost {
-				continue
-			}
-			if proxyHost.SshClient != nil {
-				if _, err := host.SshClient.NewSession(); err == nil {
-					c.Logger.Info().Msgf("Closing connection to proxy host %s", host.HostName)
-					host.SshClient.Close()
-					host.SshClient = nil
-				}
-			}
-		}
+		host.closeForwards()
 	}
+	// in cron mode, the dynamic secrets of variables are used by the next runs
+	if !c.cronEnabled {
+		c.vaultLeases.revoke(c, c.Logger)
+	}
+	if c.cronEnabled && !c.SSHPool.Disabled {
+		return
+	}
+	c.CloseHostConnections()
+}
+
+// CloseHostConnections closes all SSH connections, including those to proxy hosts
+func (c *ConfigOpts) CloseHostConnections() {
+	c.connectionPool().closeAll()
 	for _, host := range c.Hosts {
-		if host.SshClient != nil {
-			if _, err := host.SshClient.NewSession(); err == nil {
-				c.Logger.Info().Msgf("Closing proxy host connection %s", host.HostName)
-				host.SshClient.Close()
-				host.SshClient = nil
-			}
+		host.SshClient = nil
+		for _, proxyHost := range host.ProxyHost {
+			proxyHost.SshClient = nil
 		}
 	}
 }
 
+// ExecuteHooks runs the hooks of hookType of cmd.
+// The hooks are run with the variables of hookEnvironment, such as the exit code and stderr of cmd.
 func (cmd *Command) ExecuteHooks(hookType string, opts *ConfigOpts) {
 	if cmd.Hooks == nil {
 		return
@@ -914,7 +951,7 @@ func (cmd *Command) ExecuteHooks(hookType string, opts *ConfigOpts) {
 	switch hookType {
 	case "error":
 		for _, v := range cmd.Hooks.Error {
-			errCmd := opts.Cmds[v]
+			errCmd := opts.hookCmd(v, cmd)
 			cmdLogger := opts.Logger.With().
 				Str("backy-cmd", v).Str("hookType", "error").
 				Logger()
@@ -926,7 +963,7 @@ func (cmd *Command) ExecuteHooks(hookType string, opts *ConfigOpts) {
 
 	case "success":
 		for _, v := range cmd.Hooks.Success {
-			successCmd := opts.Cmds[v]
+			successCmd := opts.hookCmd(v, cmd)
 			cmdLogger := opts.Logger.With().
 				Str("backy-cmd", v).Str("hookType", "success").
 				Logger()
@@ -935,7 +972,7 @@ func (cmd *Command) ExecuteHooks(hookType string, opts *ConfigOpts) {
 		}
 	case "final":
 		for _, v := range cmd.Hooks.Final {
-			finalCmd := opts.Cmds[v]
+			finalCmd := opts.hookCmd(v, cmd)
 			cmdLogger := opts.Logger.With().
 				Str("backy-cmd", v).Str("hookType", "final").
 				Logger()
@@ -945,6 +982,13 @@ func (cmd *Command) ExecuteHooks(hookType string, opts *ConfigOpts) {
 	}
 }
 
+// hookCmd returns a copy of the hook command name, run with the hook variables of cmd
+func (opts *ConfigOpts) hookCmd(name string, cmd *Command) *Command {
+	hook := *opts.Cmds[name]
+	hook.hookEnv = cmd.hookEnvironment()
+	return &hook
+}
+
 func (cmd *Command) GenerateLogger(opts *ConfigOpts) zerolog.Logger {
 	cmdLogger := opts.Logger.With().
 		Str("Backy-cmd", cmd.Name).Str("Host", "local machine").
@@ -963,11 +1007,12 @@ func (opts *ConfigOpts) ExecCmdsOnHosts(cmdList []string, hostsList []string) {
 	for _, h := range hostsList {
 		host := opts.Hosts[h]
 		for _, c := range cmdList {
-			cmd := opts.Cmds[c]
+			cmdCopy := *opts.Cmds[c]
+			cmd := &cmdCopy
 			cmd.RemoteHost = host
 			cmd.Host = h
 			if IsHostLocal(h) {
-				_, err := cmd.RunCmd(cmd.GenerateLogger(opts), opts)
+				_, err := opts.runCmd("", cmd, cmd.GenerateLogger(opts))
 				if err != nil {
 					opts.Logger.Err(err).Str("host", h).Str("cmd", c).Send()
 				}
@@ -975,7 +1020,7 @@ func (opts *ConfigOpts) ExecCmdsOnHosts(cmdList []string, hostsList []string) {
 
 				cmd.Host = host.Host
 				opts.Logger.Info().Str("host", h).Str("cmd", c).Send()
-				_, err := cmd.RunCmdOnHost(cmd.GenerateLogger(opts), opts)
+				_, err := opts.runCmdOnHost("", cmd, cmd.GenerateLogger(opts))
 				if err != nil {
 					opts.Logger.Err(err).Str("host", h).Str("cmd", c).Send()
 				}
@@ -986,28 +1031,30 @@ func (opts *ConfigOpts) ExecCmdsOnHosts(cmdList []string, hostsList []string) {
 
 func (opts *ConfigOpts) ExecCmdsOnHostsInParallel(cmdList []string, hostsList []string) {
 	opts.Logger.Info().Msg("Executing commands in parallel on hosts")
-	// Iterate over hosts and exec commands
+	// Run each command on the hosts before moving on to the next
 	for _, c := range cmdList {
-		for _, h := range hostsList {
-			host := opts.Hosts[h]
-			cmd := opts.Cmds[c]
-			cmd.RemoteHost = host
+		runParallel(len(hostsList), opts.maxParallel(), func(i int) {
+			h := hostsList[i]
+			// each host runs its own copy of the command
+			cmd := *opts.Cmds[c]
 			cmd.Host = h
+			cmd.Hosts = nil
 			if IsHostLocal(h) {
-				_, err := cmd.RunCmd(cmd.GenerateLogger(opts), opts)
+				_, err := opts.runCmd("", &cmd, cmd.GenerateLogger(opts))
 				if err != nil {
 					opts.Logger.Err(err).Str("host", h).Str("cmd", c).Send()
 				}
-			} else {
+				return
+			}
 
-				cmd.Host = host.Host
-				opts.Logger.Info().Str("host", h).Str("cmd", c).Send()
-				_, err := cmd.RunCmdOnHost(cmd.GenerateLogger(opts), opts)
-				if err != nil {
-					opts.Logger.Err(err).Str("host", h).Str("cmd", c).Send()
-				}
+			cmd.RemoteHost = nil
+			opts.ensureRemoteHost(&cmd, h)
+			opts.Logger.Info().Str("host", h).Str("cmd", c).Send()
+			_, err := opts.runCmdOnHost("", &cmd, cmd.GenerateLogger(opts))
+			if err != nil {
+				opts.Logger.Err(err).Str("host", h).Str("cmd", c).Send()
 			}
-		}
+		})
 	}
 }
 
@@ -22,11 +22,9 @@ import (
 )
 
 const (
-	externDirectiveStart      string = "%{"
-	externDirectiveEnd        string = "}%"
-	externFileDirectiveStart  string = "%{file:"
-	envExternDirectiveStart   string = "%{env:"
-	vaultExternDirectiveStart string = "%{vault:"
+	externDirectiveStart    string = "%{"
+	externDirectiveEnd      string = "}%"
+	envExternDirectiveStart string = "%{env:"
 )
 
 func (opts *ConfigOpts) InitConfig() {
@@ -96,6 +94,10 @@ func (opts *ConfigOpts) InitConfig() {
 		loadDefaultConfigFiles(fetcher, configFiles, backyKoanf, opts)
 	}
 
+	if err := opts.loadIncludes(backyKoanf, opts.ConfigFilePath); err != nil {
+		logging.ExitWithMSG(fmt.Sprintf("error loading included config files: %v", err), 1, nil)
+	}
+
 	opts.koanf = backyKoanf
 }
 
@@ -121,6 +123,18 @@ func (opts *ConfigOpts) ParseConfigurationFile() *ConfigOpts {
 		os.Setenv("BACKY_CMDSTDOUT", "enabled")
 	}
 
+	// the flags take precedence over the config file
+	if opts.CmdStdOutMode == DefaultCmdStdOutMode && backyKoanf.Exists(getNestedConfig("logging", "cmd-std-out-mode")) {
+		mode, err := CmdStdOutModeString(backyKoanf.String(getNestedConfig("logging", "cmd-std-out-mode")))
+		if err != nil {
+			logging.ExitWithMSG("logging.cmd-std-out-mode must be prefixed, grouped or raw", 1, nil)
+		}
+		opts.CmdStdOutMode = mode
+	}
+	if !opts.CmdStdOutColor {
+		opts.CmdStdOutColor = backyKoanf.Bool(getNestedConfig("logging", "cmd-std-out-color"))
+	}
+
 	CheckConfigValues(backyKoanf, opts.ConfigFilePath)
 
 	validateExecCommandsFromCLI(backyKoanf, opts)
@@ -144,6 +158,8 @@ func (opts *ConfigOpts) ParseConfigurationFile() *ConfigOpts {
 		unmarshalConfigIntoStruct(backyKoanf, "hosts", &opts.Hosts, opts.Logger)
 	}
 
+	loadInventory(opts, backyKoanf, hostKoanf)
+
 	log.Info().Str("config file", opts.ConfigFilePath).Send()
 
 	if err := opts.initializeVault(); err != nil {
@@ -165,12 +181,26 @@ func (opts *ConfigOpts) ParseConfigurationFile() *ConfigOpts {
 
 	validateCommandLists(opts)
 
+	resolveHostSelectorsInConfig(opts)
+
 	if opts.cronEnabled && len(opts.CmdConfigLists) == 0 {
 		logging.ExitWithMSG("No cron fields detected in any command lists", 1, nil)
 	}
 
 	unmarshalConfigIntoStruct(backyKoanf, "goCron", &opts.GoCron, opts.Logger)
 
+	if backyKoanf.Exists("sshPool") {
+		unmarshalConfigIntoStruct(backyKoanf, "sshPool", &opts.SSHPool, opts.Logger)
+	}
+
+	// the CLI flag takes precedence over the config file
+	if opts.MaxParallel == 0 && backyKoanf.Exists("maxParallel") {
+		opts.MaxParallel = backyKoanf.Int("maxParallel")
+	}
+	if opts.MaxParallel < 0 {
+		logging.ExitWithMSG("maxParallel must not be negative", 1, &opts.Logger)
+	}
+
 	if err := processCmds(opts); err != nil {
 		logging.ExitWithMSG(err.Error(), 1, &opts.Logger)
 	}
@@ -262,7 +292,7 @@ func setLoggingOptions(backyKoanf *koanf.Koanf, opts *ConfigOpts) {
 
 func setupLogger(opts *ConfigOpts) zerolog.Logger {
 	writers := logging.SetLoggingWriters(opts.LogFilePath)
-	return zerolog.New(writers).With().Timestamp().Logger()
+	return zerolog.New(newRedactWriter(writers, opts.Redact)).With().Timestamp().Logger()
 }
 
 func unmarshalConfigIntoStruct(k *koanf.Koanf, key string, target interface{}, log zerolog.Logger) {
@@ -289,6 +319,8 @@ func getHostConfigs(opts *ConfigOpts) {
 		if host.Host == "" {
 			host.Host = hostConfigName
 		}
+		// passwords set with directives are added when they are resolved
+		opts.addSecret(host.Password, host.PrivateKeyPassword)
 		if host.ProxyJump != "" {
 			getProxyHosts(host, opts)
 		}
@@ -296,15 +328,11 @@ func getHostConfigs(opts *ConfigOpts) {
 }
 
 func getProxyHosts(host *Host, opts *ConfigOpts) {
-	proxyHosts := strings.Split(host.ProxyJump, ",")
-	for _, h := range proxyHosts {
-		proxyHost, defined := opts.Hosts[h]
-		if !defined {
-			proxyHost = &Host{Host: h}
-			opts.Hosts[h] = proxyHost
-		}
-		host.ProxyHost = append(host.ProxyHost, proxyHost)
+	proxyHosts, err := parseProxyJump(host.ProxyJump, opts.Hosts)
+	if err != nil {
+		logging.ExitWithMSG(fmt.Sprintf("host %s: %v", host.Host, err), 1, &opts.Logger)
 	}
+	host.ProxyHost = proxyHosts
 }
 
 func getConfigDir(opts *ConfigOpts) {
@@ -436,6 +464,9 @@ func validateCommandLists(opts *ConfigOpts) {
 			delete(opts.CmdConfigLists, cmdListName)
 			continue
 		}
+		if err := validateRollingList(cmdList); err != nil {
+			logging.ExitWithMSG(err.Error(), 1, &opts.Logger)
+		}
 		for _, cmdInList := range cmdList.Order {
 			if _, cmdNameFound := opts.Cmds[cmdInList]; !cmdNameFound {
 				cmdNotFoundSliceErr = append(cmdNotFoundSliceErr, fmt.Errorf("command %s in list %s is not defined in commands section in config file", cmdInList, cmdListName))
@@ -492,15 +523,14 @@ func (opts *ConfigOpts) initializeVault() error {
 		return err
 	}
 
-	token := opts.koanf.String("vault.token")
-	if strings.TrimSpace(token) == "" {
-		token = os.Getenv("VAULT_TOKEN")
+	if opts.koanf.Exists("vault.auth") {
+		unmarshalConfigIntoStruct(opts.koanf, "vault.auth", &opts.vaultAuth, opts.Logger)
 	}
-	if strings.TrimSpace(token) == "" {
-		return fmt.Errorf("no token found. One is required. \n\nSet the config key vault.token or the environment variable VAULT_TOKEN")
+	login, err := opts.vaultLogin(client)
+	if err != nil {
+		return err
 	}
-
-	client.SetToken(token)
+	opts.vaultToken = login
 
 	unmarshalErr := opts.koanf.UnmarshalWithConf("vault.keys", &opts.VaultKeys, koanf.UnmarshalConf{Tag: "yaml"})
 	if unmarshalErr != nil {
@@ -508,9 +538,11 @@ func (opts *ConfigOpts) initializeVault() error {
 	}
 
 	opts.vaultClient = client
+	opts.vaultLeases = &vaultLeases{}
 
 	for _, v := range opts.VaultKeys {
-		v.Name = replaceVarInString(opts.Vars, v.Key, opts.Logger)
+		v.Key = replaceVarInString(opts.Vars, v.Key, opts.Logger)
+		v.Path = replaceVarInString(opts.Vars, v.Path, opts.Logger)
 		v.MountPath = replaceVarInString(opts.Vars, v.MountPath, opts.Logger)
 	}
 
@@ -519,6 +551,12 @@ func (opts *ConfigOpts) initializeVault() error {
 
 func processCmds(opts *ConfigOpts) error {
 
+	for hostName, host := range opts.Hosts {
+		if _, err := parseForwardSpecs(host.LocalForwards, host.RemoteForwards); err != nil {
+			return fmt.Errorf("host %s: %v", hostName, err)
+		}
+	}
+
 	// process commands
 	for cmdName, cmd := range opts.Cmds {
 		cmd.GetVariablesFromConf(opts)
@@ -590,7 +628,8 @@ func processCmds(opts *ConfigOpts) error {
 			if cmd.PackageOperation.String() == "" {
 				return fmt.Errorf("package operation is required for package command %s", cmd.Name)
 			}
-			if cmd.Packages == nil {
+			// listUpgrades and securityUpgrade act on all packages if none are given
+			if cmd.Packages == nil && !cmd.isPackageListOperation() {
 				return fmt.Errorf("package name is required for package command %s", cmd.Name)
 			}
 			var err error
@@ -610,9 +649,16 @@ func processCmds(opts *ConfigOpts) error {
 
 		// Parse user commands
 		if cmd.Type == UserCommandType {
-			if cmd.Username == "" {
+			isGroupOperation := cmd.UserOperation == "addGroup" || cmd.UserOperation == "removeGroup"
+			if cmd.Username == "" && !isGroupOperation {
 				return fmt.Errorf("username is required for user command %s", cmd.Name)
 			}
+			if isGroupOperation && len(cmd.UserGroups) == 0 {
+				return fmt.Errorf("userGroups is required for user command %s", cmd.Name)
+			}
+			if cmd.UserOperation == "sudoers" && len(cmd.UserSudoRules) == 0 {
+				return fmt.Errorf("userSudoRules is required for user command %s", cmd.Name)
+			}
 			cmd.Username = replaceVarInString(opts.Vars, cmd.Username, opts.Logger)
 			err := detectOSType(cmd, opts)
 			if err != nil {
@@ -621,12 +667,14 @@ func processCmds(opts *ConfigOpts) error {
 
 			// Validate the operation
 			switch cmd.UserOperation {
-			case "add", "remove", "modify", "checkIfExists", "delete", "password":
+			case "add", "remove", "modify", "checkIfExists", "delete", "password",
+				"addGroup", "removeGroup", "authorizedKeys", "lock", "unlock", "expire", "sudoers", "removeSudoers", "ensure":
 				cmd.userMan, err = usermanager.NewUserManager(cmd.OS)
 
 				if cmd.UserOperation == "password" {
 					opts.Logger.Debug().Msg("changing password for user: " + cmd.Username)
 					cmd.UserPassword = getExternalConfigDirectiveValue(cmd.UserPassword, opts, AllowedExternalDirectiveAll)
+					opts.addSecret(cmd.UserPassword)
 				}
 
 				if !IsHostLocal(cmd.Host) {
@@ -661,6 +709,38 @@ func processCmds(opts *ConfigOpts) error {
 			}
 
 		}
+		if cmd.Template {
+			if err := validateTemplates(cmd, opts); err != nil {
+				return err
+			}
+		}
+		if cmd.Type == PipelineCommandType {
+			if err := validatePipeline(cmd, opts); err != nil {
+				return err
+			}
+		}
+		if cmd.Stdin != nil {
+			if err := validateStdin(cmd, opts); err != nil {
+				return err
+			}
+			cmd.Stdin.Content = replaceVarInString(opts.Vars, cmd.Stdin.Content, opts.Logger)
+		}
+		if _, err := parseForwardSpecs(cmd.LocalForwards, cmd.RemoteForwards); err != nil {
+			return fmt.Errorf("command %s: %v", cmd.Name, err)
+		}
+		hasForwards := len(cmd.LocalForwards) > 0 || len(cmd.RemoteForwards) > 0
+		if hasForwards && IsHostLocal(cmd.Host) && cmd.Hosts == nil && cmd.ForwardHost == "" {
+			return fmt.Errorf("forwardHost is required for forwards of local command %s", cmd.Name)
+		}
+		// commands with hosts run on the hosts in parallel, and a port can only be bound once
+		if cmd.Hosts != nil && len(cmd.LocalForwards) > 0 {
+			return fmt.Errorf("command %s: localForwards can't be used with hosts, as each host would bind the same local port", cmd.Name)
+		}
+		if cmd.Hosts != nil && cmd.ForwardHost != "" && len(cmd.RemoteForwards) > 0 {
+			return fmt.Errorf("command %s: remoteForwards can't be used with hosts and forwardHost, as each host would bind the same port on the forward host", cmd.Name)
+		}
+		cmd.ForwardHost = replaceVarInString(opts.Vars, cmd.ForwardHost, opts.Logger)
+
 		if cmd.Output.File != "" {
 			var err error
 			cmd.Output.File, err = getFullPathWithHomeDir(cmd.Output.File)
@@ -703,9 +783,10 @@ func detectOSType(cmd *Command, opts *ConfigOpts) error {
 
 	if IsHostLocal(cmd.Host) {
 
-		if runtime.GOOS == "linux" {
-			cmd.OS = "linux"
-			opts.Logger.Info().Msg("Unix/Linux type OS detected")
+		switch runtime.GOOS {
+		case "linux", "freebsd", "darwin":
+			cmd.OS = runtime.GOOS
+			opts.Logger.Info().Str("os", runtime.GOOS).Msg("Unix/Linux type OS detected")
 			return nil
 		}
 		return fmt.Errorf("using an os that is not yet supported for user commands")
@@ -725,7 +806,7 @@ func detectOSType(cmd *Command, opts *ConfigOpts) error {
 		if os == "" {
 			return fmt.Errorf("error detecting os for command %s: empty string", cmd.Name)
 		}
-		if strings.Contains(os, "linux") {
+		if strings.Contains(strings.ToLower(os), "linux") {
 			os = "linux"
 		}
 		host.OS = os
@@ -21,6 +21,7 @@ func (opts *ConfigOpts) Cron() {
 	s, _ := gocron.NewScheduler(gocron.WithLocation(time.Local))
 	defer func() { _ = s.Shutdown() }()
 	opts.Logger.Info().Msg("Starting cron mode...")
+	opts.renewVaultToken(opts.vaultToken, nil)
 	s.Start()
 	cmdLists := opts.CmdConfigLists
 	for _, config := range cmdLists {
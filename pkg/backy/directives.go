@@ -0,0 +1,250 @@
+// directives.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// DirectiveResolver resolves the value of an external directive, such as %{name:ref}%
+type DirectiveResolver interface {
+	Resolve(ref string, opts *ConfigOpts) (string, error)
+}
+
+// DirectiveResolverFunc is a function that is a DirectiveResolver
+type DirectiveResolverFunc func(ref string, opts *ConfigOpts) (string, error)
+
+func (f DirectiveResolverFunc) Resolve(ref string, opts *ConfigOpts) (string, error) {
+	return f(ref, opts)
+}
+
+var (
+	directiveResolversMu sync.RWMutex
+	directiveResolvers   = map[string]DirectiveResolver{
+		"env":   DirectiveResolverFunc(resolveEnvDirective),
+		"file":  DirectiveResolverFunc(resolveFileDirective),
+		"vault": DirectiveResolverFunc(resolveVaultDirective),
+		"sops":  DirectiveResolverFunc(resolveSopsDirective),
+		"pass":  DirectiveResolverFunc(resolvePassDirective),
+		"exec":  DirectiveResolverFunc(resolveExecDirective),
+		"ssm":   DirectiveResolverFunc(resolveSSMDirective),
+	}
+)
+
+// RegisterDirectiveResolver adds resolver for %{name:ref}% directives, replacing the resolver of name if there is one.
+// Directives other than env, file and vault can be used in the fields that support all directives.
+func RegisterDirectiveResolver(name string, resolver DirectiveResolver) {
+	directiveResolversMu.Lock()
+	defer directiveResolversMu.Unlock()
+	directiveResolvers[name] = resolver
+}
+
+func getDirectiveResolver(name string) (DirectiveResolver, bool) {
+	directiveResolversMu.RLock()
+	defer directiveResolversMu.RUnlock()
+	resolver, found := directiveResolvers[name]
+	return resolver, found
+}
+
+// allows returns whether the directive name can be used
+func (a AllowedExternalDirectives) allows(name string) bool {
+	switch name {
+	case "env":
+		return IsExternalDirectiveEnv(a)
+	case "file":
+		return IsExternalDirectiveFile(a)
+	case "vault":
+		return IsExternalDirectiveVault(a)
+	}
+	return a == AllowedExternalDirectiveAll
+}
+
+func resolveEnvDirective(ref string, opts *ConfigOpts) (string, error) {
+	return os.Getenv(ref), nil
+}
+
+// directiveFilePath returns the full path of file. Relative paths are in the config file's directory.
+func directiveFilePath(file string, opts *ConfigOpts) (string, error) {
+	file, err := getFullPathWithHomeDir(file)
+	if err != nil {
+		return "", err
+	}
+	if !path.IsAbs(file) {
+		file = path.Join(opts.ConfigDir, file)
+	}
+	return file, nil
+}
+
+func resolveFileDirective(ref string, opts *ConfigOpts) (string, error) {
+	file, err := directiveFilePath(ref, opts)
+	if err != nil {
+		return "", err
+	}
+	value, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+func resolveVaultDirective(ref string, opts *ConfigOpts) (string, error) {
+	return GetVaultKey(ref, opts, opts.Logger), nil
+}
+
+// runDirectiveCommand runs name with args locally, and returns its stdout
+func runDirectiveCommand(opts *ConfigOpts, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Dir = opts.ConfigDir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("error running %s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// resolveSopsDirective decrypts a file with sops. The ref is file#key, where key is the
+// dot-separated path of a value in the file, such as db.password or users.0.name.
+// Without a key, the whole decrypted file is returned.
+func resolveSopsDirective(ref string, opts *ConfigOpts) (string, error) {
+	file, key, _ := strings.Cut(ref, "#")
+	file, err := directiveFilePath(file, opts)
+	if err != nil {
+		return "", err
+	}
+
+	if key == "" {
+		out, err := runDirectiveCommand(opts, "sops", "--decrypt", file)
+		if err != nil {
+			return "", err
+		}
+		return string(out), nil
+	}
+
+	data, err := opts.sopsFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	value := data
+	for _, part := range strings.Split(key, ".") {
+		switch v := value.(type) {
+		case map[string]any:
+			var found bool
+			if value, found = v[part]; !found {
+				return "", fmt.Errorf("key %s not found in sops file %s", key, file)
+			}
+		case []any:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return "", fmt.Errorf("key %s not found in sops file %s", key, file)
+			}
+			value = v[i]
+		default:
+			return "", fmt.Errorf("key %s not found in sops file %s", key, file)
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case map[string]any, []any:
+		return "", fmt.Errorf("key %s in sops file %s is not a value", key, file)
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// sopsFile returns the decrypted data of file. Files are decrypted once.
+func (opts *ConfigOpts) sopsFile(file string) (any, error) {
+	opts.sopsFilesMu.Lock()
+	defer opts.sopsFilesMu.Unlock()
+
+	if data, found := opts.sopsFiles[file]; found {
+		return data, nil
+	}
+	out, err := runDirectiveCommand(opts, "sops", "--decrypt", "--output-type", "json", file)
+	if err != nil {
+		return nil, err
+	}
+	var data any
+	if err := json.Unmarshal(out, &data); err != nil {
+		return nil, fmt.Errorf("error parsing decrypted sops file %s: %w", file, err)
+	}
+	if opts.sopsFiles == nil {
+		opts.sopsFiles = make(map[string]any)
+	}
+	opts.sopsFiles[file] = data
+	return data, nil
+}
+
+// resolvePassDirective returns the first line of an entry in the pass password store
+func resolvePassDirective(ref string, opts *ConfigOpts) (string, error) {
+	out, err := runDirectiveCommand(opts, "pass", "show", ref)
+	if err != nil {
+		return "", err
+	}
+	password, _, _ := strings.Cut(string(out), "\n")
+	return password, nil
+}
+
+// resolveExecDirective runs ref with sh locally and returns its output, without trailing newlines.
+// Any secret manager with a CLI can be used with it, such as op read or age --decrypt.
+func resolveExecDirective(ref string, opts *ConfigOpts) (string, error) {
+	out, err := runDirectiveCommand(opts, "sh", "-c", ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// ssmTimeout is the timeout for requests to SSM
+const ssmTimeout = 30 * time.Second
+
+// resolveSSMDirective gets a parameter from AWS Systems Manager Parameter Store.
+// SecureString parameters are decrypted.
+//
+// The region and credentials are from the default AWS config chain: the environment, the shared
+// config and credentials files with AWS_PROFILE, SSO, assumed roles and EC2 or ECS instance roles.
+// AWS_ENDPOINT_URL_SSM or AWS_ENDPOINT_URL set the client's base endpoint.
+func resolveSSMDirective(ref string, opts *ConfigOpts) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ssmTimeout)
+	defer cancel()
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return "", fmt.Errorf("ssm parameter %s: error loading AWS config: %w", ref, err)
+	}
+	if cfg.Region == "" {
+		return "", fmt.Errorf("ssm parameter %s: AWS_REGION is not set", ref)
+	}
+
+	out, err := ssm.NewFromConfig(cfg).GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(ref),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("ssm parameter %s: %w", ref, err)
+	}
+	if out.Parameter == nil {
+		return "", fmt.Errorf("ssm parameter %s: parameter not returned", ref)
+	}
+	return aws.ToString(out.Parameter.Value), nil
+}
@@ -0,0 +1,178 @@
+package backy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// fakeCommand adds a script named name to the front of PATH
+func fakeCommand(t *testing.T, name, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestDirectiveResolvers(t *testing.T) {
+	configDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(configDir, "token"), []byte("file-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BACKY_TEST_SECRET", "env-secret")
+
+	// sops prints the decrypted file as JSON, or as it is without --output-type
+	fakeCommand(t, "sops", `for last; do :; done
+case "$last" in
+*secrets.yaml) ;;
+*) echo "open $last: no such file" >&2; exit 1 ;;
+esac
+if [ "$2" = "--output-type" ]; then
+	echo '{"db":{"password":"sops-pass","port":5432},"users":["alice","bob"]}'
+else
+	printf 'db:\n  password: sops-pass\n'
+fi
+`)
+	fakeCommand(t, "pass", `[ "$1" = show ] && [ "$2" = backups/db ] || exit 1
+printf 'pass-secret\nuser: backy\n'
+`)
+
+	opts := &ConfigOpts{ConfigDir: configDir, Logger: zerolog.Nop()}
+
+	tests := []struct {
+		directive string
+		allowed   AllowedExternalDirectives
+		want      string
+	}{
+		{directive: "%{env:BACKY_TEST_SECRET}%", allowed: AllowedExternalDirectiveAll, want: "env-secret"},
+		{directive: "%{file:token}%", allowed: AllowedExternalDirectiveAll, want: "file-token"},
+		{directive: "%{sops:secrets.yaml#db.password}%", allowed: AllowedExternalDirectiveAll, want: "sops-pass"},
+		{directive: "%{sops:secrets.yaml#db.port}%", allowed: AllowedExternalDirectiveAll, want: "5432"},
+		{directive: "%{sops:secrets.yaml#users.1}%", allowed: AllowedExternalDirectiveAll, want: "bob"},
+		{directive: "%{sops:secrets.yaml}%", allowed: AllowedExternalDirectiveAll, want: "db:\n  password: sops-pass\n"},
+		{directive: "%{sops:secrets.yaml#db.user}%", allowed: AllowedExternalDirectiveAll, want: ""},
+		{directive: "%{sops:secrets.yaml#db}%", allowed: AllowedExternalDirectiveAll, want: ""},
+		{directive: "%{sops:missing.yaml#db.password}%", allowed: AllowedExternalDirectiveAll, want: ""},
+		{directive: "%{pass:backups/db}%", allowed: AllowedExternalDirectiveAll, want: "pass-secret"},
+		{directive: "%{pass:backups/web}%", allowed: AllowedExternalDirectiveAll, want: ""},
+		{directive: "%{exec:echo exec-secret}%", allowed: AllowedExternalDirectiveAll, want: "exec-secret"},
+		{directive: "%{exec:exit 1}%", allowed: AllowedExternalDirectiveAll, want: ""},
+		{directive: "%{exec:echo exec-secret}%", allowed: AllowedExternalDirectiveVault, want: "%{exec:echo exec-secret}%"},
+		{directive: "%{env:BACKY_TEST_SECRET}%", allowed: AllowedExternalDirectiveFile, want: "%{env:BACKY_TEST_SECRET}%"},
+		{directive: "%{unknown:key}%", allowed: AllowedExternalDirectiveAll, want: "%{unknown:key}%"},
+		{directive: "not a directive", allowed: AllowedExternalDirectiveAll, want: "not a directive"},
+	}
+
+	for _, tt := range tests {
+		if got := getExternalConfigDirectiveValue(tt.directive, opts, tt.allowed); got != tt.want {
+			t.Errorf("getExternalConfigDirectiveValue(%q, %s) = %q, want %q", tt.directive, tt.allowed, got, tt.want)
+		}
+	}
+
+	if got := opts.Redact("sops-pass pass-secret exec-secret"); got != "******** ******** ********" {
+		t.Errorf("resolved values were not added as secrets: %q", got)
+	}
+}
+
+func TestRegisterDirectiveResolver(t *testing.T) {
+	RegisterDirectiveResolver("test", DirectiveResolverFunc(func(ref string, opts *ConfigOpts) (string, error) {
+		return strings.ToUpper(ref), nil
+	}))
+	t.Cleanup(func() {
+		directiveResolversMu.Lock()
+		delete(directiveResolvers, "test")
+		directiveResolversMu.Unlock()
+	})
+
+	opts := &ConfigOpts{Logger: zerolog.Nop()}
+	if got := getExternalConfigDirectiveValue("%{test:value}%", opts, AllowedExternalDirectiveAll); got != "VALUE" {
+		t.Errorf("value = %q, want VALUE", got)
+	}
+	if got := getExternalConfigDirectiveValue("%{test:value}%", opts, AllowedExternalDirectiveVaultEnv); got != "%{test:value}%" {
+		t.Errorf("value = %q, want the directive, as only vault and env are allowed", got)
+	}
+}
+
+func TestSSMDirective(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "AmazonSSM.GetParameter" {
+			http.Error(w, "unknown target", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDTEST/") ||
+			!strings.Contains(r.Header.Get("Authorization"), "/us-east-2/ssm/aws4_request") {
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+
+		var req struct {
+			Name           string
+			WithDecryption bool
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Name != "/backy/db" || !req.WithDecryption {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"ParameterNotFound","message":"not found"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"Parameter":{"Name":"/backy/db","Type":"SecureString","Value":"ssm-secret"}}`))
+	}))
+	defer server.Close()
+
+	// the shared config files and instance metadata of this machine are not used
+	awsDir := t.TempDir()
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(awsDir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(awsDir, "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_PROFILE", "")
+
+	t.Setenv("AWS_ENDPOINT_URL_SSM", server.URL)
+	t.Setenv("AWS_REGION", "us-east-2")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	opts := &ConfigOpts{Logger: zerolog.Nop()}
+
+	got, err := resolveSSMDirective("/backy/db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "ssm-secret" {
+		t.Errorf("value = %q, want ssm-secret", got)
+	}
+
+	if _, err := resolveSSMDirective("/backy/missing", opts); err == nil || !strings.Contains(err.Error(), "ParameterNotFound") {
+		t.Errorf("error = %v, want ParameterNotFound", err)
+	}
+
+	// the region and credentials of a profile in the shared config files
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	if err := os.WriteFile(filepath.Join(awsDir, "config"), []byte("[profile backy]\nregion = us-east-2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(awsDir, "credentials"), []byte("[backy]\naws_access_key_id = AKIDTEST\naws_secret_access_key = secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_PROFILE", "backy")
+	if got, err := resolveSSMDirective("/backy/db", opts); err != nil || got != "ssm-secret" {
+		t.Errorf("value with AWS_PROFILE = %q, %v, want ssm-secret", got, err)
+	}
+
+	t.Setenv("AWS_PROFILE", "")
+	if _, err := resolveSSMDirective("/backy/db", opts); err == nil {
+		t.Error("missing region did not fail")
+	}
+}
@@ -0,0 +1,77 @@
+// exitcode.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/ssh"
+)
+
+// exitCode returns the exit code of the process that returned err, or -1 if the process did not exit
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	var sshExitErr *ssh.ExitError
+	if errors.As(err, &sshExitErr) {
+		return sshExitErr.ExitStatus()
+	}
+	return -1
+}
+
+// checkExitCode records the exit code of err on command.
+// If the exit code is one of the command's SuccessExitCodes, the command succeeded and nil is returned.
+func (command *Command) checkExitCode(err error, cmdCtxLogger zerolog.Logger) error {
+	command.exitCode = exitCode(err)
+	if err != nil && command.exitCode > 0 && slices.Contains(command.SuccessExitCodes, command.exitCode) {
+		cmdCtxLogger.Warn().Int("exitCode", command.exitCode).Msgf("Command %s exited with %d, which is one of its successExitCodes", command.Name, command.exitCode)
+		return nil
+	}
+	return err
+}
+
+// stderrWriter returns the writer for the stderr of command.
+// The returned function stores the lines written on command, and must be called once the command has run.
+func (opts *ConfigOpts) stderrWriter(command *Command, cmdCtxLogger zerolog.Logger) (io.Writer, func()) {
+	var buf bytes.Buffer
+	w, closeStdOut := opts.cmdOutputWriter(command, &buf)
+
+	return w, func() {
+		closeStdOut()
+
+		var lines []string
+		scanner := bufio.NewScanner(&buf)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+			if command.Output.ToLog {
+				cmdCtxLogger.Info().Str("cmd", command.Name).Str("stderr", scanner.Text()).Send()
+			}
+		}
+		command.stderr = lines
+	}
+}
+
+// hookEnvironment returns the variables that hooks of command are run with
+func (command *Command) hookEnvironment() []string {
+	return []string{
+		"BACKY_CMD=" + command.Name,
+		"BACKY_HOST=" + command.hostLabel(),
+		fmt.Sprintf("BACKY_EXIT_CODE=%d", command.exitCode),
+		"BACKY_STDERR=" + strings.Join(command.stderr, "\n"),
+	}
+}
@@ -0,0 +1,199 @@
+package backy
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/rs/zerolog"
+)
+
+func TestExitCode(t *testing.T) {
+	localErr := exec.Command("sh", "-c", "exit 3").Run()
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "success", want: 0},
+		{name: "exit error", err: localErr, want: 3},
+		{name: "wrapped exit error", err: errors.Join(errors.New("running backup"), localErr), want: 3},
+		{name: "no exit", err: errors.New("connection refused"), want: -1},
+	}
+
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("%s: exitCode(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestCheckExitCode(t *testing.T) {
+	tests := []struct {
+		name             string
+		script           string
+		successExitCodes []int
+		wantExitCode     int
+		wantErr          bool
+	}{
+		{name: "success", script: "exit 0", wantExitCode: 0},
+		{name: "failure", script: "exit 24", wantExitCode: 24, wantErr: true},
+		{name: "success exit code", script: "exit 24", successExitCodes: []int{23, 24}, wantExitCode: 24},
+		{name: "other exit code", script: "exit 3", successExitCodes: []int{24}, wantExitCode: 3, wantErr: true},
+		{name: "no exit", successExitCodes: []int{-1}, wantExitCode: -1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := errors.New("connection refused")
+			if tt.script != "" {
+				err = exec.Command("sh", "-c", tt.script).Run()
+			}
+
+			command := &Command{Name: tt.name, SuccessExitCodes: tt.successExitCodes}
+			got := command.checkExitCode(err, zerolog.Nop())
+			if (got != nil) != tt.wantErr {
+				t.Errorf("checkExitCode error = %v, want error %t", got, tt.wantErr)
+			}
+			if command.exitCode != tt.wantExitCode {
+				t.Errorf("exit code = %d, want %d", command.exitCode, tt.wantExitCode)
+			}
+		})
+	}
+}
+
+func TestRunCmdSeparatesStderr(t *testing.T) {
+	opts := newTestOpts(t)
+	command := &Command{
+		Name:             "sync",
+		Cmd:              "sh",
+		Args:             []string{"-c", "echo out; echo err >&2; exit 24"},
+		SuccessExitCodes: []int{24},
+	}
+
+	output, err := opts.runCmd("backup", command, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("runCmd: %v", err)
+	}
+	if !slices.Equal(output, []string{"out"}) {
+		t.Errorf("output = %q, want [out]", output)
+	}
+
+	results := opts.CmdResults()
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	if r := results[0]; r.Status != HostResultSucceeded || r.ExitCode != 24 || !slices.Equal(r.Stderr, []string{"err"}) {
+		t.Errorf("result = %+v, want succeeded with exit code 24 and stderr [err]", r)
+	}
+}
+
+func TestHooksEnvironment(t *testing.T) {
+	opts := newTestOpts(t)
+	hookOut := filepath.Join(t.TempDir(), "hook")
+	opts.Cmds = map[string]*Command{
+		"record": {
+			Name: "record",
+			Cmd:  "sh",
+			Args: []string{"-c", `printf '%s\n' "$BACKY_CMD" "$BACKY_HOST" "$BACKY_EXIT_CODE" "$BACKY_STDERR" > ` + hookOut},
+		},
+	}
+
+	command := &Command{
+		Name:  "fail",
+		Cmd:   "sh",
+		Args:  []string{"-c", "echo 'a=b' >&2; echo \"it's broken\" >&2; exit 5"},
+		Hooks: &Hooks{Error: []string{"record"}},
+	}
+	if _, err := command.RunCmd(zerolog.Nop(), opts); err == nil {
+		t.Fatal("RunCmd did not fail")
+	}
+	command.ExecuteHooks("error", opts)
+
+	got, err := os.ReadFile(hookOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "fail\nlocal\n5\na=b\nit's broken\n"; string(got) != want {
+		t.Errorf("hook environment = %q, want %q", got, want)
+	}
+	if slices.ContainsFunc(opts.Cmds["record"].Environment, func(v string) bool { return strings.HasPrefix(v, "BACKY_") }) {
+		t.Error("hook variables were added to the hook command")
+	}
+}
+
+func TestErrorTemplate(t *testing.T) {
+	tmpl := template.Must(template.New("error.txt").ParseFS(templates, "templates/error.txt"))
+
+	var out bytes.Buffer
+	err := tmpl.Execute(&out, map[string]interface{}{
+		"listName": "backup",
+		"CmdName":  "sync",
+		"Command":  "rsync",
+		"Err":      errors.New("exit status 23"),
+		"Host":     "db-1",
+		"ExitCode": 23,
+		"Stderr":   []string{"some files could not be transferred"},
+		"CmdOutput": []outStruct{
+			{CmdName: "dump", Output: []string{"dumped"}},
+			{CmdName: "sync", ExitCode: 23, Stderr: []string{"some files could not be transferred"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"The command on db-1 exited with code 23.",
+		"Stderr:\n    some files could not be transferred",
+		"Command output for sync (exit code 23):",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("message does not contain %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "dump (exit code") {
+		t.Errorf("message has an exit code for a command that succeeded:\n%s", out.String())
+	}
+}
+
+func TestListsSharingCommand(t *testing.T) {
+	opts := newTestOpts(t)
+	opts.Cmds = map[string]*Command{
+		// the pid of the shell differs between runs
+		"shared": {Name: "shared", Cmd: "sh", Args: []string{"-c", "echo $$; echo $$ >&2; exit $(($$ % 2))"}, SuccessExitCodes: []int{1}},
+	}
+	opts.CmdConfigLists = make(map[string]*CmdList)
+	for i := range 8 {
+		name := "list" + strconv.Itoa(i)
+		opts.CmdConfigLists[name] = &CmdList{Name: name, Order: []string{"shared"}}
+	}
+
+	opts.RunListConfig("")
+
+	results := opts.CmdResults()
+	if len(results) != 8 {
+		t.Fatalf("got %d results, want 8", len(results))
+	}
+	for _, r := range results {
+		if len(r.Output) != 1 || !slices.Equal(r.Stderr, r.Output) {
+			t.Errorf("list %s: stderr = %q, want the pid of its own run %q", r.ListName, r.Stderr, r.Output)
+			continue
+		}
+		pid, _ := strconv.Atoi(r.Output[0])
+		if r.ExitCode != pid%2 {
+			t.Errorf("list %s: exit code = %d, want %d", r.ListName, r.ExitCode, pid%2)
+		}
+	}
+	if opts.Cmds["shared"].stderr != nil {
+		t.Error("result was stored on the shared command")
+	}
+}
@@ -0,0 +1,290 @@
+// forward.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// forwardsMu guards the forwards opened for hosts, as commands that run at the same time can share a forward host
+var forwardsMu sync.Mutex
+
+// portForward is a parsed localForwards or remoteForwards entry
+type portForward struct {
+	remote bool
+	// bind is the address listened on, locally for local forwards and on the host for remote forwards
+	bind string
+	// target is the address connections are forwarded to, from the host for local forwards and from here for remote forwards
+	target string
+}
+
+func (f portForward) String() string {
+	if f.remote {
+		return fmt.Sprintf("remote %s -> local %s", f.bind, f.target)
+	}
+	return fmt.Sprintf("local %s -> remote %s", f.bind, f.target)
+}
+
+// parseForwardSpec parses a forward in the format of ssh -L and -R: [bind_address:]port:host:hostport.
+// IPv6 addresses must be in brackets.
+func parseForwardSpec(spec string, remote bool) (portForward, error) {
+	parts := splitForwardSpec(TS(spec))
+
+	bindAddr := "localhost"
+	switch len(parts) {
+	case 3:
+	case 4:
+		bindAddr = parts[0]
+		parts = parts[1:]
+		if bindAddr == "*" {
+			bindAddr = ""
+		}
+	default:
+		return portForward{}, fmt.Errorf("invalid forward %q, must be [bind_address:]port:host:hostport", spec)
+	}
+
+	for _, port := range []string{parts[0], parts[2]} {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return portForward{}, fmt.Errorf("invalid port %q in forward %q", port, spec)
+		}
+	}
+
+	return portForward{
+		remote: remote,
+		bind:   net.JoinHostPort(strings.Trim(bindAddr, "[]"), parts[0]),
+		target: net.JoinHostPort(strings.Trim(parts[1], "[]"), parts[2]),
+	}, nil
+}
+
+// splitForwardSpec splits spec on colons that are not in brackets
+func splitForwardSpec(spec string) []string {
+	var parts []string
+	var current strings.Builder
+	inBrackets := false
+	for _, r := range spec {
+		switch {
+		case r == '[':
+			inBrackets = true
+		case r == ']':
+			inBrackets = false
+		case r == ':' && !inBrackets:
+			parts = append(parts, current.String())
+			current.Reset()
+			continue
+		}
+		current.WriteRune(r)
+	}
+	return append(parts, current.String())
+}
+
+// parseForwardSpecs parses local and remote forwards
+func parseForwardSpecs(localForwards, remoteForwards []string) ([]portForward, error) {
+	var forwards []portForward
+	for _, spec := range localForwards {
+		f, err := parseForwardSpec(spec, false)
+		if err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, f)
+	}
+	for _, spec := range remoteForwards {
+		f, err := parseForwardSpec(spec, true)
+		if err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, f)
+	}
+	return forwards, nil
+}
+
+// startForward listens on the forward's bind address and forwards connections over the host's client.
+// The pooled connection of the host is kept open until the forward is closed.
+func startForward(host *Host, f portForward, logger zerolog.Logger, opts *ConfigOpts) (io.Closer, error) {
+	client := host.SshClient
+	var listener net.Listener
+	var err error
+	if f.remote {
+		listener, err = client.Listen("tcp", f.bind)
+	} else {
+		listener, err = net.Listen("tcp", f.bind)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open %s", f)
+	}
+
+	logger.Info().Msgf("Forwarding %s", f)
+	release := opts.connectionPool().acquire(host.poolKey())
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				var targetConn net.Conn
+				var err error
+				if f.remote {
+					targetConn, err = net.Dial("tcp", f.target)
+				} else {
+					targetConn, err = client.Dial("tcp", f.target)
+				}
+				if err != nil {
+					logger.Err(err).Msgf("forwarding %s", f)
+					conn.Close()
+					return
+				}
+				pipeConns(conn, targetConn)
+			}()
+		}
+	}()
+
+	return &forwardListener{Listener: listener, release: release}, nil
+}
+
+// forwardListener releases the pooled connection of a forward when it is closed
+type forwardListener struct {
+	net.Listener
+	release func()
+}
+
+func (l *forwardListener) Close() error {
+	defer l.release()
+	return l.Listener.Close()
+}
+
+// pipeConns copies data between a and b until either side is closed
+func pipeConns(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// openForwards opens the host's localForwards and remoteForwards over its SSH client.
+// They stay open until closeForwards is called at the end of the run.
+func (remoteHost *Host) openForwards(logger zerolog.Logger, opts *ConfigOpts) error {
+	if len(remoteHost.LocalForwards) == 0 && len(remoteHost.RemoteForwards) == 0 {
+		return nil
+	}
+
+	forwardsMu.Lock()
+	defer forwardsMu.Unlock()
+
+	// the forwards are reopened if the host has reconnected
+	if remoteHost.forwardsClient == remoteHost.SshClient && remoteHost.forwards != nil {
+		return nil
+	}
+	closeAll(remoteHost.forwards)
+	remoteHost.forwards = nil
+
+	forwards, err := parseForwardSpecs(remoteHost.LocalForwards, remoteHost.RemoteForwards)
+	if err != nil {
+		return errors.Wrapf(err, "host %s", remoteHost.Host)
+	}
+
+	for _, f := range forwards {
+		closer, err := startForward(remoteHost, f, logger, opts)
+		if err != nil {
+			closeAll(remoteHost.forwards)
+			remoteHost.forwards = nil
+			return errors.Wrapf(err, "host %s", remoteHost.Host)
+		}
+		remoteHost.forwards = append(remoteHost.forwards, closer)
+	}
+	remoteHost.forwardsClient = remoteHost.SshClient
+
+	return nil
+}
+
+// closeForwards closes the host's forwards
+func (remoteHost *Host) closeForwards() {
+	forwardsMu.Lock()
+	defer forwardsMu.Unlock()
+
+	closeAll(remoteHost.forwards)
+	remoteHost.forwards = nil
+	remoteHost.forwardsClient = nil
+}
+
+// openForwards opens the command's forwards, and the forwards of its forwardHost, for the duration of the command.
+// The forwards go through forwardHost, or the command's host if forwardHost is not set.
+// The returned function closes the command's forwards.
+func (command *Command) openForwards(logger zerolog.Logger, opts *ConfigOpts) (func(), error) {
+	noop := func() {}
+	if len(command.LocalForwards) == 0 && len(command.RemoteForwards) == 0 && command.ForwardHost == "" {
+		return noop, nil
+	}
+
+	hostName := command.ForwardHost
+	if hostName == "" {
+		hostName = command.Host
+	}
+	if IsHostLocal(hostName) {
+		return noop, fmt.Errorf("forwardHost is required for forwards of local command %s", command.Name)
+	}
+
+	host := command.RemoteHost
+	if hostName != command.Host || host == nil {
+		// commands run on hosts in parallel, so opts.Hosts is guarded by hostsMu
+		opts.hostsMu.Lock()
+		var found bool
+		host, found = opts.Hosts[hostName]
+		if !found {
+			if opts.Hosts == nil {
+				opts.Hosts = make(map[string]*Host)
+			}
+			host = &Host{Host: hostName}
+			opts.Hosts[hostName] = host
+		}
+		opts.hostsMu.Unlock()
+	}
+	if err := host.ensureConnected(opts); err != nil {
+		return noop, errors.Wrapf(err, "could not connect to forward host %s", hostName)
+	}
+
+	if err := host.openForwards(logger, opts); err != nil {
+		return noop, err
+	}
+
+	forwards, err := parseForwardSpecs(command.LocalForwards, command.RemoteForwards)
+	if err != nil {
+		return noop, err
+	}
+
+	var closers []io.Closer
+	for _, f := range forwards {
+		closer, err := startForward(host, f, logger, opts)
+		if err != nil {
+			closeAll(closers)
+			return noop, err
+		}
+		closers = append(closers, closer)
+	}
+
+	return func() { closeAll(closers) }, nil
+}
+
+func closeAll(closers []io.Closer) {
+	for _, c := range closers {
+		c.Close()
+	}
+}
@@ -0,0 +1,167 @@
+package backy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestParseForwardSpec(t *testing.T) {
+	tests := []struct {
+		spec    string
+		remote  bool
+		bind    string
+		target  string
+		wantErr bool
+	}{
+		{spec: "15432:localhost:5432", bind: "localhost:15432", target: "localhost:5432"},
+		{spec: "0.0.0.0:8080:10.0.0.5:80", bind: "0.0.0.0:8080", target: "10.0.0.5:80"},
+		{spec: "*:8080:web:80", remote: true, bind: ":8080", target: "web:80"},
+		{spec: "[::1]:2222:[fd00::5]:22", bind: "[::1]:2222", target: "[fd00::5]:22"},
+		{spec: "5432:localhost", wantErr: true},
+		{spec: "port:localhost:5432", wantErr: true},
+		{spec: "5432:localhost:99999", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		f, err := parseForwardSpec(tt.spec, tt.remote)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseForwardSpec(%q) = %+v, want an error", tt.spec, f)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseForwardSpec(%q): %v", tt.spec, err)
+			continue
+		}
+		if f.bind != tt.bind || f.target != tt.target || f.remote != tt.remote {
+			t.Errorf("parseForwardSpec(%q) = %+v, want bind %s and target %s", tt.spec, f, tt.bind, tt.target)
+		}
+	}
+}
+
+func TestProcessCmdsForwardsWithHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     Command
+		wantErr string
+	}{
+		{name: "local forwards", cmd: Command{Cmd: "true", Hosts: []string{"a", "b"}, LocalForwards: []string{"15432:localhost:5432"}}, wantErr: "localForwards can't be used with hosts"},
+		{name: "remote forwards through forward host", cmd: Command{Cmd: "true", Hosts: []string{"a", "b"}, ForwardHost: "jump", RemoteForwards: []string{"8080:localhost:80"}}, wantErr: "remoteForwards can't be used with hosts and forwardHost"},
+		{name: "remote forwards on each host", cmd: Command{Cmd: "true", Hosts: []string{"a", "b"}, RemoteForwards: []string{"8080:localhost:80"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := newTestOpts(t)
+			cmd := tt.cmd
+			opts.Cmds = map[string]*Command{"fanout": &cmd}
+			err := processCmds(opts)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("processCmds: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// echoServer accepts connections and writes back what it reads
+func echoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// freePort returns a port of 127.0.0.1 that nothing listens on
+func freePort(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+func TestCommandLocalForwards(t *testing.T) {
+	opts := newTestOpts(t)
+	host, _ := newTestHost(t, opts, "db")
+	target := echoServer(t)
+
+	// two local commands forward through the same host at the same time
+	var wg sync.WaitGroup
+	for i := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			port := freePort(t)
+			command := &Command{
+				Name:          fmt.Sprintf("dump-%d", i),
+				ForwardHost:   "db",
+				LocalForwards: []string{"127.0.0.1:" + port + ":" + target},
+			}
+			closeForwards, err := command.openForwards(zerolog.Nop(), opts)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+			if err != nil {
+				t.Error(err)
+				closeForwards()
+				return
+			}
+			msg := fmt.Sprintf("hello from %s\n", command.Name)
+			_, _ = conn.Write([]byte(msg))
+			got, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil || got != msg {
+				t.Errorf("%s: read %q, %v through the forward, want %q", command.Name, got, err, msg)
+			}
+			conn.Close()
+
+			closeForwards()
+			if conn, err := net.Dial("tcp", "127.0.0.1:"+port); err == nil {
+				conn.Close()
+				t.Errorf("%s: forward is still open after the command", command.Name)
+			}
+		}()
+	}
+	wg.Wait()
+
+	pool := opts.connectionPool()
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if conn := pool.conns[host.poolKey()]; conn == nil || conn.active != 0 {
+		t.Errorf("pooled connection = %+v, want it kept with no active forwards", conn)
+	}
+}
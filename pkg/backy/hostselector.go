@@ -0,0 +1,200 @@
+// hostselector.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"git.andrewnw.xyz/CyberShell/backy/pkg/logging"
+)
+
+const (
+	hostSelectorGroupPrefix = "group:"
+	hostSelectorTagPrefix   = "tag:"
+	hostSelectorExclude     = "!"
+)
+
+// ResolveHostSelectors returns the names of the hosts matched by selectors.
+// A selector can be:
+//   - group:name, all hosts in the group
+//   - tag:name, all hosts with the tag
+//   - a pattern such as web-*, all hosts whose name matches
+//   - a host name
+//
+// A selector starting with ! excludes the hosts it matches.
+// If there are only exclusions, they are removed from all hosts.
+// Selectors can also be separated by commas.
+//
+// Names that are not in the hosts config are kept, as they may be in the SSH config file.
+func (opts *ConfigOpts) ResolveHostSelectors(selectors []string) ([]string, error) {
+	var (
+		included     []string
+		excluded     []string
+		onlyExcludes = true
+	)
+
+	for _, s := range splitHostSelectors(selectors) {
+		exclude := strings.HasPrefix(s, hostSelectorExclude)
+		s = strings.TrimPrefix(s, hostSelectorExclude)
+
+		matches, err := opts.matchHostSelector(s)
+		if err != nil {
+			return nil, err
+		}
+
+		if exclude {
+			excluded = append(excluded, matches...)
+			continue
+		}
+		onlyExcludes = false
+		for _, m := range matches {
+			if !slices.Contains(included, m) {
+				included = append(included, m)
+			}
+		}
+	}
+
+	if onlyExcludes && len(excluded) > 0 {
+		included = opts.hostNames()
+	}
+
+	return slices.DeleteFunc(included, func(h string) bool {
+		return slices.Contains(excluded, h)
+	}), nil
+}
+
+// matchHostSelector returns the names of the hosts matched by a single selector
+func (opts *ConfigOpts) matchHostSelector(selector string) ([]string, error) {
+	var matches []string
+
+	switch {
+	case strings.HasPrefix(selector, hostSelectorGroupPrefix):
+		group := strings.TrimPrefix(selector, hostSelectorGroupPrefix)
+		for _, name := range opts.hostNames() {
+			if slices.Contains(opts.Hosts[name].Groups, group) {
+				matches = append(matches, name)
+			}
+		}
+	case strings.HasPrefix(selector, hostSelectorTagPrefix):
+		tag := strings.TrimPrefix(selector, hostSelectorTagPrefix)
+		for _, name := range opts.hostNames() {
+			if slices.Contains(opts.Hosts[name].Tags, tag) {
+				matches = append(matches, name)
+			}
+		}
+	case strings.ContainsAny(selector, "*?["):
+		for _, name := range opts.hostNames() {
+			matched, err := path.Match(selector, name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid host pattern %s: %w", selector, err)
+			}
+			if matched {
+				matches = append(matches, name)
+			}
+		}
+	default:
+		return []string{selector}, nil
+	}
+
+	if len(matches) == 0 {
+		opts.Logger.Warn().Str("selector", selector).Msg("host selector did not match any hosts")
+	}
+
+	return matches, nil
+}
+
+// hostNames returns the sorted names of the hosts in the config, excluding proxy hosts
+// that were only added for a ProxyJump.
+func (opts *ConfigOpts) hostNames() []string {
+	names := slices.Sorted(maps.Keys(opts.Hosts))
+	return slices.DeleteFunc(names, func(name string) bool {
+		return opts.Hosts[name].isProxyHost
+	})
+}
+
+// hostsToRunOn returns the hosts selected on the command line, or all hosts if none were selected
+func (opts *ConfigOpts) hostsToRunOn() []*Host {
+	names := opts.List.Hosts
+	if len(names) == 0 {
+		names = opts.hostNames()
+	}
+
+	hosts := make([]*Host, 0, len(names))
+	for _, name := range names {
+		host, found := opts.Hosts[name]
+		if !found {
+			host = &Host{Host: name}
+			if opts.Hosts == nil {
+				opts.Hosts = make(map[string]*Host)
+			}
+			opts.Hosts[name] = host
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// runsOnHost returns true if the list has no hosts or host is one of the list's hosts
+func (list *CmdList) runsOnHost(host *Host, opts *ConfigOpts) bool {
+	if len(list.Hosts) == 0 {
+		return true
+	}
+	for _, name := range list.Hosts {
+		if name == host.Host || opts.Hosts[name] == host {
+			return true
+		}
+	}
+	return false
+}
+
+func splitHostSelectors(selectors []string) []string {
+	var split []string
+	for _, s := range selectors {
+		for _, part := range strings.Split(s, ",") {
+			part = strings.TrimSpace(part)
+			if part != "" {
+				split = append(split, part)
+			}
+		}
+	}
+	return split
+}
+
+// resolveHostSelectorsInConfig replaces the host selectors of commands and lists with host names
+func resolveHostSelectorsInConfig(opts *ConfigOpts) {
+	for cmdName, cmd := range opts.Cmds {
+		if cmd.Hosts == nil {
+			continue
+		}
+		hosts, err := opts.ResolveHostSelectors(cmd.Hosts)
+		if err != nil {
+			logging.ExitWithMSG(fmt.Sprintf("error resolving hosts for command %s: %v", cmdName, err), 1, &opts.Logger)
+		}
+		cmd.Hosts = hosts
+	}
+
+	for listName, list := range opts.CmdConfigLists {
+		if list.Hosts == nil {
+			continue
+		}
+		hosts, err := opts.ResolveHostSelectors(list.Hosts)
+		if err != nil {
+			logging.ExitWithMSG(fmt.Sprintf("error resolving hosts for list %s: %v", listName, err), 1, &opts.Logger)
+		}
+		list.Hosts = hosts
+	}
+
+	if opts.List.Hosts != nil {
+		hosts, err := opts.ResolveHostSelectors(opts.List.Hosts)
+		if err != nil {
+			logging.ExitWithMSG(fmt.Sprintf("error resolving hosts: %v", err), 1, &opts.Logger)
+		}
+		opts.List.Hosts = hosts
+	}
+}
@@ -0,0 +1,73 @@
+package backy
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestResolveHostSelectors(t *testing.T) {
+	opts := &ConfigOpts{
+		Logger: zerolog.Nop(),
+		Hosts: map[string]*Host{
+			"web-1":   {Host: "web-1", Groups: []string{"web", "prod"}, Tags: []string{"nginx"}},
+			"web-2":   {Host: "web-2", Groups: []string{"web", "staging"}, Tags: []string{"nginx"}},
+			"db-1":    {Host: "db-1", Groups: []string{"db", "prod"}, Tags: []string{"postgres"}},
+			"cache-1": {Host: "cache-1", Groups: []string{"prod"}},
+			"bastion": {Host: "bastion", isProxyHost: true},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		selectors []string
+		want      []string
+		wantErr   bool
+	}{
+		{name: "host name", selectors: []string{"db-1"}, want: []string{"db-1"}},
+		{name: "host not in config", selectors: []string{"backup.example.com"}, want: []string{"backup.example.com"}},
+		{name: "group", selectors: []string{"group:prod"}, want: []string{"cache-1", "db-1", "web-1"}},
+		{name: "tag", selectors: []string{"tag:nginx"}, want: []string{"web-1", "web-2"}},
+		{name: "glob", selectors: []string{"web-*"}, want: []string{"web-1", "web-2"}},
+		{name: "glob excludes proxy hosts", selectors: []string{"*"}, want: []string{"cache-1", "db-1", "web-1", "web-2"}},
+		{name: "exclusion", selectors: []string{"group:prod", "!tag:postgres"}, want: []string{"cache-1", "web-1"}},
+		{name: "only exclusions", selectors: []string{"!group:web"}, want: []string{"cache-1", "db-1"}},
+		{name: "comma separated", selectors: []string{"group:db, web-2", "!db-1,cache-1"}, want: []string{"web-2", "cache-1"}},
+		{name: "duplicates", selectors: []string{"web-1", "group:web", "tag:nginx"}, want: []string{"web-1", "web-2"}},
+		{name: "unknown group", selectors: []string{"group:missing"}},
+		{name: "unknown tag", selectors: []string{"tag:missing", "db-1"}, want: []string{"db-1"}},
+		{name: "glob without matches", selectors: []string{"mail-?"}},
+		{name: "invalid glob", selectors: []string{"web-["}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := opts.ResolveHostSelectors(tt.selectors)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("hosts = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitHostSelectors(t *testing.T) {
+	tests := []struct {
+		selectors []string
+		want      []string
+	}{
+		{selectors: []string{"web-1"}, want: []string{"web-1"}},
+		{selectors: []string{"web-1,db-1", "cache-1"}, want: []string{"web-1", "db-1", "cache-1"}},
+		{selectors: []string{" group:web , !web-2 ,"}, want: []string{"group:web", "!web-2"}},
+		{selectors: []string{",", ""}},
+		{},
+	}
+	for _, tt := range tests {
+		if got := splitHostSelectors(tt.selectors); !slices.Equal(got, tt.want) {
+			t.Errorf("splitHostSelectors(%q) = %q, want %q", tt.selectors, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// hosttrust.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// errHostKeyFetched stops the handshake once the host key has been received
+var errHostKeyFetched = errors.New("host key fetched")
+
+// TrustHost fetches the host keys of the ProxyJump hosts and the host itself, in order,
+// shows their fingerprints and adds unknown keys to each host's known_hosts file.
+// The user is asked before each key is added, unless assumeYes is true.
+// Changed keys are never replaced.
+func (opts *ConfigOpts) TrustHost(name string, assumeYes bool, in io.Reader, out io.Writer) error {
+	if opts.Hosts == nil {
+		opts.Hosts = make(map[string]*Host)
+	}
+	remoteHost, found := opts.Hosts[name]
+	if !found {
+		remoteHost = &Host{Host: name}
+		opts.Hosts[name] = remoteHost
+	}
+
+	if err := remoteHost.resolveConnectionConfig(opts); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(in)
+	hops := append(append([]*Host{}, remoteHost.ProxyHost...), remoteHost)
+
+	var via *ssh.Client
+	for i, hop := range hops {
+		key, remote, err := hop.fetchHostKey(via)
+		if err != nil {
+			return errors.Wrapf(err, "could not get host key of %s", hop.Host)
+		}
+
+		if err := hop.trustHostKey(key, remote, assumeYes, reader, out); err != nil {
+			return err
+		}
+
+		if i == len(hops)-1 {
+			break
+		}
+
+		// connect to the jump host to reach the next hop
+		hostKeyCallback, err := hop.strictHostKeyCallback()
+		if err != nil {
+			return err
+		}
+		hop.ClientConfig.HostKeyCallback = hostKeyCallback
+
+		conn, err := hop.dial(via)
+		if err != nil {
+			return err
+		}
+		via, err = newClientConn(conn, hop.HostName, hop.ClientConfig)
+		if err != nil {
+			return errors.Wrapf(err, "could not connect to proxy host %s", hop.Host)
+		}
+		defer via.Close()
+	}
+
+	return nil
+}
+
+// dial opens a connection to the host, through via if it is not nil
+func (remoteHost *Host) dial(via *ssh.Client) (net.Conn, error) {
+	if via != nil {
+		return dialVia(via, remoteHost.HostName, remoteHost.ClientConfig.Timeout)
+	}
+	if remoteHost.proxyCommand != "" {
+		return remoteHost.dialProxyCommand()
+	}
+	return net.DialTimeout("tcp", remoteHost.HostName, remoteHost.ClientConfig.Timeout)
+}
+
+// fetchHostKey starts a handshake with the host and returns its host key without authenticating
+func (remoteHost *Host) fetchHostKey(via *ssh.Client) (ssh.PublicKey, net.Addr, error) {
+	conn, err := remoteHost.dial(via)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	var hostKey ssh.PublicKey
+	var remoteAddr net.Addr
+	config := &ssh.ClientConfig{
+		User:              remoteHost.User,
+		Config:            remoteHost.ClientConfig.Config,
+		HostKeyAlgorithms: remoteHost.ClientConfig.HostKeyAlgorithms,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			remoteAddr = remote
+			return errHostKeyFetched
+		},
+	}
+
+	_, _, _, err = ssh.NewClientConn(conn, remoteHost.HostName, config)
+	if hostKey != nil {
+		return hostKey, remoteAddr, nil
+	}
+	return nil, nil, err
+}
+
+// trustHostKey adds key to the host's known_hosts file if it is not known yet
+func (remoteHost *Host) trustHostKey(key ssh.PublicKey, remote net.Addr, assumeYes bool, reader *bufio.Reader, out io.Writer) error {
+	if existing := existingFiles(remoteHost.knownHostsFiles); len(existing) > 0 {
+		callback, err := knownhosts.New(existing...)
+		if err != nil {
+			return errors.Wrap(err, "could not read known_hosts")
+		}
+
+		err = callback(remoteHost.HostName, remote, key)
+		if err == nil {
+			fmt.Fprintf(out, "%s (%s): host key %s is already trusted\n", remoteHost.Host, remoteHost.HostName, ssh.FingerprintSHA256(key))
+			return nil
+		}
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return remoteHost.hostKeyError(remoteHost.HostName, key, err)
+		}
+	}
+
+	fmt.Fprintf(out, "%s (%s)\n  key type:    %s\n  fingerprint: %s\n", remoteHost.Host, remoteHost.HostName, key.Type(), ssh.FingerprintSHA256(key))
+
+	if !assumeYes {
+		fmt.Fprintf(out, "Add this key to %s? [y/N] ", remoteHost.KnownHostsFile)
+		answer, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		answer = strings.ToLower(TS(answer))
+		if answer != "y" && answer != "yes" {
+			return errors.Errorf("host key of %s was not trusted", remoteHost.Host)
+		}
+	}
+
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+	if err := appendKnownHost(remoteHost.KnownHostsFile, remoteHost.HostName, key); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Added host key of %s to %s\n", remoteHost.Host, remoteHost.KnownHostsFile)
+
+	return nil
+}
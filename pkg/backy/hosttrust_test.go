@@ -0,0 +1,154 @@
+package backy
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"git.andrewnw.xyz/CyberShell/backy/pkg/sshtest"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// readKnownHosts returns the lines of file
+func readKnownHosts(t *testing.T, file string) []string {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// clearKnownHosts empties the known_hosts file of host
+func clearKnownHosts(t *testing.T, host *Host) {
+	t.Helper()
+	if err := os.WriteFile(host.KnownHostsFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrustHost(t *testing.T) {
+	tests := []struct {
+		name      string
+		assumeYes bool
+		input     string
+		trusted   bool
+		wantErr   string
+	}{
+		{name: "assume yes", assumeYes: true, trusted: true},
+		{name: "accept", input: "y\n", trusted: true},
+		{name: "accept yes", input: "YES\n", trusted: true},
+		{name: "decline", input: "n\n", wantErr: "host key of web was not trusted"},
+		{name: "no answer", input: "", wantErr: "host key of web was not trusted"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := newTestOpts(t)
+			host, server := newTestHost(t, opts, "web")
+			clearKnownHosts(t, host)
+
+			var out bytes.Buffer
+			err := opts.TrustHost("web", tt.assumeYes, strings.NewReader(tt.input), &out)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := ssh.FingerprintSHA256(server.HostKey.PublicKey()); !strings.Contains(out.String(), want) {
+				t.Errorf("output does not show the fingerprint %s:\n%s", want, out.String())
+			}
+			if prompted := strings.Contains(out.String(), "[y/N]"); prompted == tt.assumeYes {
+				t.Errorf("prompted = %v with assumeYes %v", prompted, tt.assumeYes)
+			}
+
+			lines := readKnownHosts(t, host.KnownHostsFile)
+			if !tt.trusted {
+				if len(lines) != 0 {
+					t.Errorf("known_hosts = %q, want no keys", lines)
+				}
+				return
+			}
+			if len(lines) != 1 || lines[0] != server.KnownHostsLine() {
+				t.Errorf("known_hosts = %q, want %q", lines, server.KnownHostsLine())
+			}
+
+			// the key is trusted now
+			if err := host.ConnectToHost(opts); err != nil {
+				t.Errorf("could not connect after trusting the host: %v", err)
+			}
+		})
+	}
+}
+
+func TestTrustHostAlreadyTrusted(t *testing.T) {
+	opts := newTestOpts(t)
+	host, _ := newTestHost(t, opts, "web")
+	before := readKnownHosts(t, host.KnownHostsFile)
+
+	var out bytes.Buffer
+	if err := opts.TrustHost("web", false, strings.NewReader(""), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "is already trusted") {
+		t.Errorf("output = %q, want already trusted", out.String())
+	}
+	if after := readKnownHosts(t, host.KnownHostsFile); len(after) != len(before) {
+		t.Errorf("known_hosts changed from %q to %q", before, after)
+	}
+}
+
+func TestTrustHostChangedKey(t *testing.T) {
+	opts := newTestOpts(t)
+	host, server := newTestHost(t, opts, "web")
+
+	// known_hosts has another key for the server's address
+	_, other := sshtest.NewKey(t)
+	line := knownhosts.Line([]string{knownhosts.Normalize(server.Addr)}, other.PublicKey())
+	if err := os.WriteFile(host.KnownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := opts.TrustHost("web", true, strings.NewReader(""), &out); err == nil {
+		t.Fatal("changed host key was trusted")
+	}
+	if lines := readKnownHosts(t, host.KnownHostsFile); len(lines) != 1 {
+		t.Errorf("known_hosts = %q, want only the old key", lines)
+	}
+}
+
+func TestTrustHostThroughProxyJump(t *testing.T) {
+	opts, servers := newProxyJumpTest(t, "jump", "target")
+	opts.Hosts["target"].ProxyJump = "jump"
+	for _, name := range []string{"jump", "target"} {
+		clearKnownHosts(t, opts.Hosts[name])
+	}
+	getHostConfigs(opts)
+
+	var out bytes.Buffer
+	if err := opts.TrustHost("target", true, strings.NewReader(""), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"jump", "target"} {
+		lines := readKnownHosts(t, opts.Hosts[name].KnownHostsFile)
+		if len(lines) != 1 || lines[0] != servers[name].KnownHostsLine() {
+			t.Errorf("%s known_hosts = %q, want %q", name, lines, servers[name].KnownHostsLine())
+		}
+	}
+	if strings.Index(out.String(), "jump (") > strings.Index(out.String(), "target (") {
+		t.Errorf("the jump host was not trusted before the target:\n%s", out.String())
+	}
+}
@@ -0,0 +1,220 @@
+// include.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"git.andrewnw.xyz/CyberShell/backy/pkg/remotefetcher"
+	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/rawbytes"
+	"github.com/knadh/koanf/v2"
+)
+
+const includeKey = "include"
+
+// includeSections are the keys that included files can set, with the depth of the names in them.
+// The names of notifications are service.id, such as mail.prod.
+var includeSections = map[string]int{
+	"commands":      1,
+	"cmdLists":      1,
+	"hosts":         1,
+	"variables":     1,
+	"notifications": 2,
+}
+
+// loadIncludes merges the files included by the config file into k.
+// Included files can include other files. Relative include paths are relative to the file that includes them.
+// Other paths in included files, such as scriptFile, are resolved as if they were in the main config file.
+func (opts *ConfigOpts) loadIncludes(k *koanf.Koanf, file string) error {
+	if !k.Exists(includeKey) {
+		return nil
+	}
+
+	origins := make(map[string]string)
+	for _, name := range includeNames(k) {
+		origins[name] = file
+	}
+	if !isRemoteURL(file) {
+		file = filepath.Clean(file)
+	}
+	if err := opts.includeFiles(k, k, file, origins, map[string]bool{file: true}); err != nil {
+		return err
+	}
+	k.Delete(includeKey)
+	return nil
+}
+
+// includeFiles merges the files included by config, which was loaded from file, into k
+func (opts *ConfigOpts) includeFiles(k, config *koanf.Koanf, file string, origins map[string]string, loaded map[string]bool) error {
+	patterns, err := includePatterns(config)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+
+	for _, pattern := range patterns {
+		files, err := expandInclude(file, pattern)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+
+		for _, includedFile := range files {
+			if loaded[includedFile] {
+				return fmt.Errorf("%s: config file %s is included more than once", file, includedFile)
+			}
+			loaded[includedFile] = true
+
+			included, err := opts.loadIncludedFile(includedFile)
+			if err != nil {
+				return err
+			}
+			if err := opts.checkIncludedFile(k, included, includedFile, origins); err != nil {
+				return err
+			}
+			if err := opts.includeFiles(k, included, includedFile, origins, loaded); err != nil {
+				return err
+			}
+
+			included.Delete(includeKey)
+			if err := k.Merge(included); err != nil {
+				return fmt.Errorf("error merging config file %s: %w", includedFile, err)
+			}
+			opts.Logger.Info().Str("included config file", includedFile).Send()
+		}
+	}
+	return nil
+}
+
+func (opts *ConfigOpts) loadIncludedFile(file string) (*koanf.Koanf, error) {
+	fetcher, err := remotefetcher.NewRemoteFetcher(file, opts.Cache)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing config fetcher for %s: %w", file, err)
+	}
+	data, err := fetcher.Fetch(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch included config file %s: %w", file, err)
+	}
+	included := koanf.New(".")
+	if err := included.Load(rawbytes.Provider(data), yaml.Parser()); err != nil {
+		return nil, fmt.Errorf("error loading config file %s: %w", file, err)
+	}
+	return included, nil
+}
+
+// checkIncludedFile checks that the included file only sets the keys that can be included,
+// and that its names are not defined in another file
+func (opts *ConfigOpts) checkIncludedFile(k, included *koanf.Koanf, file string, origins map[string]string) error {
+	for key := range included.Raw() {
+		if _, found := includeSections[key]; !found && key != includeKey {
+			return fmt.Errorf("config file %s: key %s can only be set in the main config file; included files can set %s", file, key, strings.Join(includeSectionNames(), ", "))
+		}
+	}
+
+	if included.Exists("cmdLists") && (k.Exists("cmdLists.file") || included.Exists("cmdLists.file")) {
+		return fmt.Errorf("config file %s: cmdLists can't be included when cmdLists.file is set", file)
+	}
+	if included.Exists("hosts") && opts.HostsFilePath != "" {
+		return fmt.Errorf("config file %s: hosts can't be included when a hosts file is used", file)
+	}
+
+	for _, name := range includeNames(included) {
+		if origin, found := origins[name]; found {
+			return fmt.Errorf("%s is defined in %s and %s", name, origin, file)
+		}
+		origins[name] = file
+	}
+	return nil
+}
+
+// includeNames returns the names defined in the sections of k that can be included, such as commands.backup
+func includeNames(k *koanf.Koanf) []string {
+	var names []string
+	for section, depth := range includeSections {
+		prefixes := []string{section}
+		for range depth {
+			var keys []string
+			for _, prefix := range prefixes {
+				for _, key := range k.MapKeys(prefix) {
+					keys = append(keys, prefix+"."+key)
+				}
+			}
+			prefixes = keys
+		}
+		names = append(names, prefixes...)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func includeSectionNames() []string {
+	var names []string
+	for section := range includeSections {
+		names = append(names, section)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// includePatterns returns the include key of config, which is a path or a list of paths
+func includePatterns(config *koanf.Koanf) ([]string, error) {
+	switch v := config.Get(includeKey).(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []any:
+		patterns := make([]string, 0, len(v))
+		for _, p := range v {
+			s, ok := p.(string)
+			if !ok {
+				return nil, fmt.Errorf("include must be a path or a list of paths")
+			}
+			patterns = append(patterns, s)
+		}
+		return patterns, nil
+	default:
+		return nil, fmt.Errorf("include must be a path or a list of paths")
+	}
+}
+
+// expandInclude returns the files of pattern, included by file.
+// Local patterns can be globs, and the files that match are returned in lexical order.
+func expandInclude(file, pattern string) ([]string, error) {
+	pattern = strings.TrimSpace(pattern)
+	isGlob := strings.ContainsAny(pattern, "*?[")
+
+	if isRemoteURL(pattern) || isRemoteURL(file) {
+		if isGlob {
+			return nil, fmt.Errorf("include %s: globs can only be used for local files", pattern)
+		}
+		if isRemoteURL(pattern) {
+			return []string{pattern}, nil
+		}
+		_, u := getRemoteDir(file)
+		if u == nil {
+			return nil, fmt.Errorf("include %s: invalid URL %s", pattern, file)
+		}
+		return []string{u.JoinPath(pattern).String()}, nil
+	}
+
+	pattern, err := getFullPathWithHomeDir(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(file), pattern)
+	}
+	if !isGlob {
+		return []string{pattern}, nil
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("include %s: %w", pattern, err)
+	}
+	return files, nil
+}
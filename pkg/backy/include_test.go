@@ -0,0 +1,228 @@
+package backy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/rawbytes"
+	"github.com/knadh/koanf/v2"
+	"github.com/rs/zerolog"
+)
+
+// writeConfigFiles writes files into a temporary directory and returns the path of the first file
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "backy.yml")
+}
+
+func loadTestConfig(t *testing.T, file string, opts *ConfigOpts) (*koanf.Koanf, error) {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := koanf.New(".")
+	if err := k.Load(rawbytes.Provider(data), yaml.Parser()); err != nil {
+		t.Fatal(err)
+	}
+	return k, opts.loadIncludes(k, file)
+}
+
+func TestLoadIncludes(t *testing.T) {
+	file := writeConfigFiles(t, map[string]string{
+		"backy.yml": `include: conf.d/*.yml
+commands:
+  echo:
+    cmd: echo
+notifications:
+  mail:
+    prod:
+      host: smtp.example.com
+`,
+		"conf.d/db.yml": `commands:
+  dumpDB:
+    cmd: pg_dump
+    host: db
+hosts:
+  db:
+    hostname: db.example.com
+cmdLists:
+  backups:
+    order: [dumpDB]
+notifications:
+  mail:
+    db:
+      host: smtp.example.com
+`,
+		"conf.d/web.yml": `include: ../shared/web-hosts.yml
+commands:
+  rotateLogs:
+    cmd: logrotate
+`,
+		"shared/web-hosts.yml": `hosts:
+  web:
+    hostname: web.example.com
+variables:
+  webRoot: /var/www
+`,
+		"conf.d/notes.txt": `not: included`,
+	})
+
+	k, err := loadTestConfig(t, file, &ConfigOpts{Logger: zerolog.Nop()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]string{
+		"commands.echo.cmd":            "echo",
+		"commands.dumpDB.cmd":          "pg_dump",
+		"commands.rotateLogs.cmd":      "logrotate",
+		"hosts.db.hostname":            "db.example.com",
+		"hosts.web.hostname":           "web.example.com",
+		"variables.webRoot":            "/var/www",
+		"notifications.mail.prod.host": "smtp.example.com",
+		"notifications.mail.db.host":   "smtp.example.com",
+	} {
+		if got := k.String(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if got := k.Strings("cmdLists.backups.order"); len(got) != 1 || got[0] != "dumpDB" {
+		t.Errorf("cmdLists.backups.order = %q, want [dumpDB]", got)
+	}
+	if k.Exists("include") || k.Exists("not") {
+		t.Error("include key or a file that does not match the glob was merged")
+	}
+}
+
+func TestLoadIncludesErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		files     map[string]string
+		hostsFile string
+		wantErr   string
+	}{
+		{
+			name: "duplicate command",
+			files: map[string]string{
+				"backy.yml": "include: [a.yml, b.yml]\n",
+				"a.yml":     "commands:\n  backup:\n    cmd: tar\n",
+				"b.yml":     "commands:\n  backup:\n    cmd: restic\n",
+			},
+			wantErr: "commands.backup is defined in",
+		},
+		{
+			name: "command defined in main file",
+			files: map[string]string{
+				"backy.yml": "include: a.yml\ncommands:\n  backup:\n    cmd: tar\n",
+				"a.yml":     "commands:\n  backup:\n    cmd: restic\n",
+			},
+			wantErr: "commands.backup is defined in",
+		},
+		{
+			name: "duplicate notification",
+			files: map[string]string{
+				"backy.yml": "include: a.yml\nnotifications:\n  mail:\n    prod:\n      host: a\n",
+				"a.yml":     "notifications:\n  mail:\n    prod:\n      host: b\n",
+			},
+			wantErr: "notifications.mail.prod is defined in",
+		},
+		{
+			name: "key only allowed in main file",
+			files: map[string]string{
+				"backy.yml": "include: a.yml\n",
+				"a.yml":     "logging:\n  verbose: true\n",
+			},
+			wantErr: "key logging can only be set in the main config file",
+		},
+		{
+			name: "cycle",
+			files: map[string]string{
+				"backy.yml": "include: a.yml\n",
+				"a.yml":     "include: backy.yml\n",
+			},
+			wantErr: "is included more than once",
+		},
+		{
+			name: "missing file",
+			files: map[string]string{
+				"backy.yml": "include: missing.yml\n",
+			},
+			wantErr: "could not fetch included config file",
+		},
+		{
+			name: "cmdLists with list file",
+			files: map[string]string{
+				"backy.yml": "include: a.yml\ncmdLists:\n  file: lists.yml\n",
+				"a.yml":     "cmdLists:\n  backups:\n    order: [backup]\n",
+			},
+			wantErr: "cmdLists can't be included when cmdLists.file is set",
+		},
+		{
+			name: "hosts with hosts file",
+			files: map[string]string{
+				"backy.yml": "include: a.yml\n",
+				"a.yml":     "hosts:\n  db:\n    hostname: db\n",
+			},
+			hostsFile: "hosts.yml",
+			wantErr:   "hosts can't be included when a hosts file is used",
+		},
+		{
+			name: "invalid include",
+			files: map[string]string{
+				"backy.yml": "include:\n  file: a.yml\n",
+			},
+			wantErr: "include must be a path or a list of paths",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &ConfigOpts{Logger: zerolog.Nop(), HostsFilePath: tt.hostsFile}
+			_, err := loadTestConfig(t, writeConfigFiles(t, tt.files), opts)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExpandInclude(t *testing.T) {
+	tests := []struct {
+		file    string
+		pattern string
+		want    string
+		wantErr bool
+	}{
+		{file: "/etc/backy/backy.yml", pattern: "conf.d/db.yml", want: "/etc/backy/conf.d/db.yml"},
+		{file: "/etc/backy/backy.yml", pattern: "/opt/backy/db.yml", want: "/opt/backy/db.yml"},
+		{file: "https://example.com/backy/backy.yml", pattern: "conf.d/db.yml", want: "https://example.com/backy/conf.d/db.yml"},
+		{file: "/etc/backy/backy.yml", pattern: "s3://bucket/db.yml", want: "s3://bucket/db.yml"},
+		{file: "https://example.com/backy/backy.yml", pattern: "conf.d/*.yml", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := expandInclude(tt.file, tt.pattern)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("expandInclude(%s, %s) did not fail", tt.file, tt.pattern)
+			}
+			continue
+		}
+		if err != nil || len(got) != 1 || got[0] != tt.want {
+			t.Errorf("expandInclude(%s, %s) = %q, %v, want %s", tt.file, tt.pattern, got, err, tt.want)
+		}
+	}
+}
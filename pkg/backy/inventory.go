@@ -0,0 +1,99 @@
+// inventory.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"git.andrewnw.xyz/CyberShell/backy/pkg/inventory"
+	"git.andrewnw.xyz/CyberShell/backy/pkg/logging"
+	"github.com/knadh/koanf/v2"
+)
+
+// loadInventory adds the hosts from the inventory sources to opts.Hosts.
+// The inventory key is read from the hosts file if it is set there, otherwise from the config file.
+func loadInventory(opts *ConfigOpts, backyKoanf, hostKoanf *koanf.Koanf) {
+	switch {
+	case hostKoanf.Exists("inventory"):
+		unmarshalConfigIntoStruct(hostKoanf, "inventory", &opts.Inventory, opts.Logger)
+	case backyKoanf.Exists("inventory"):
+		unmarshalConfigIntoStruct(backyKoanf, "inventory", &opts.Inventory, opts.Logger)
+	default:
+		return
+	}
+
+	if opts.ConfigDir == "" {
+		getConfigDir(opts)
+	}
+
+	for _, sourceConfig := range opts.Inventory {
+		if sourceConfig.Path != "" {
+			p, err := getFullPathWithHomeDir(sourceConfig.Path)
+			if err != nil {
+				logging.ExitWithMSG(fmt.Sprintf("error getting inventory path %s: %v", sourceConfig.Path, err), 1, &opts.Logger)
+			}
+			sourceConfig.Path = p
+		}
+
+		source, err := inventory.NewSource(sourceConfig, opts.Cache, opts.ConfigDir)
+		if err != nil {
+			logging.ExitWithMSG(err.Error(), 1, &opts.Logger)
+		}
+
+		hosts, err := source.Load()
+		var stale *inventory.StaleError
+		if errors.As(err, &stale) {
+			opts.Logger.Warn().Str("type", sourceConfig.Type).Str("source", stale.Source).Time("cachedAt", stale.CachedAt).Err(stale.Err).
+				Msg("inventory source failed to load, using the cached hosts")
+		} else if err != nil {
+			logging.ExitWithMSG(err.Error(), 1, &opts.Logger)
+		}
+
+		opts.Logger.Info().Str("type", sourceConfig.Type).Int("hosts", len(hosts)).Msg("loaded hosts from inventory")
+
+		for _, h := range hosts {
+			opts.addInventoryHost(h)
+		}
+	}
+}
+
+// addInventoryHost adds h to opts.Hosts.
+// If the host is already in the config, only the fields that are not set are filled and the groups and tags are added.
+func (opts *ConfigOpts) addInventoryHost(h inventory.Host) {
+	if opts.Hosts == nil {
+		opts.Hosts = make(map[string]*Host)
+	}
+
+	host, exists := opts.Hosts[h.Name]
+	if !exists {
+		host = &Host{Host: h.Name}
+		opts.Hosts[h.Name] = host
+	}
+
+	if host.HostName == "" {
+		host.HostName = h.HostName
+	}
+	if host.User == "" {
+		host.User = h.User
+	}
+	if host.Port == 0 {
+		host.Port = h.Port
+	}
+	if host.PrivateKeyPath == "" {
+		host.PrivateKeyPath = h.PrivateKeyPath
+	}
+	for _, g := range h.Groups {
+		if !slices.Contains(host.Groups, g) {
+			host.Groups = append(host.Groups, g)
+		}
+	}
+	for _, t := range h.Tags {
+		if !slices.Contains(host.Tags, t) {
+			host.Tags = append(host.Tags, t)
+		}
+	}
+}
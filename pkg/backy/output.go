@@ -0,0 +1,154 @@
+// output.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// hostColors are the ANSI colors given to hosts in turn
+var hostColors = []string{"\033[36m", "\033[33m", "\033[32m", "\033[35m", "\033[34m", "\033[31m"}
+
+const colorReset = "\033[0m"
+
+// outputMux writes the output of commands running at the same time to one writer.
+// Output is written in whole lines, so the lines of different hosts do not interleave.
+type outputMux struct {
+	mu     sync.Mutex
+	out    io.Writer
+	mode   CmdStdOutMode
+	color  bool
+	colors map[string]string
+}
+
+func newOutputMux(out io.Writer, mode CmdStdOutMode, color bool) *outputMux {
+	if mode == DefaultCmdStdOutMode {
+		mode = PrefixedCmdStdOutMode
+	}
+	return &outputMux{out: out, mode: mode, color: color, colors: make(map[string]string)}
+}
+
+// Writer returns a writer for the output of command cmd on host.
+// Close must be called when the command finishes, to print the last line, or the whole block in grouped mode.
+func (m *outputMux) Writer(host, cmd string) io.WriteCloser {
+	if m.mode == RawCmdStdOutMode {
+		return nopWriteCloser{m.out}
+	}
+
+	prefix := fmt.Sprintf("[%s] %s | ", host, cmd)
+	if m.color {
+		m.mu.Lock()
+		color, found := m.colors[host]
+		if !found {
+			color = hostColors[len(m.colors)%len(hostColors)]
+			m.colors[host] = color
+		}
+		m.mu.Unlock()
+		prefix = color + prefix + colorReset
+	}
+
+	return &prefixWriter{mux: m, prefix: []byte(prefix), grouped: m.mode == GroupedCmdStdOutMode}
+}
+
+// write writes p to the output without interleaving it with other writes
+func (m *outputMux) write(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, _ = m.out.Write(p)
+}
+
+// prefixWriter buffers output until a line is complete, and prefixes each line with the host and command.
+// In grouped mode, the lines are kept until Close.
+type prefixWriter struct {
+	mu      sync.Mutex
+	mux     *outputMux
+	prefix  []byte
+	grouped bool
+	line    []byte
+	block   []byte
+	closed  bool
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.line = append(w.line, p...)
+	var lines []byte
+	for {
+		i := bytes.IndexByte(w.line, '\n')
+		if i < 0 {
+			break
+		}
+		lines = append(lines, w.prefix...)
+		lines = append(lines, w.line[:i+1]...)
+		w.line = w.line[i+1:]
+	}
+
+	if len(lines) > 0 {
+		if w.grouped {
+			w.block = append(w.block, lines...)
+		} else {
+			w.mux.write(lines)
+		}
+	}
+	return len(p), nil
+}
+
+// Close writes the last line, if it does not end with a newline, and the block of grouped output
+func (w *prefixWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	var rest []byte
+	if len(w.line) > 0 {
+		rest = append(append(append(rest, w.prefix...), w.line...), '\n')
+		w.line = nil
+	}
+	if w.grouped {
+		rest = append(w.block, rest...)
+		w.block = nil
+	}
+	if len(rest) > 0 {
+		w.mux.write(rest)
+	}
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// cmdOutputWriter returns a writer for the output of command that writes to writers,
+// and to stdout if command output is printed to stdout.
+// The returned function must be called when the command finishes.
+func (opts *ConfigOpts) cmdOutputWriter(command *Command, writers ...io.Writer) (io.Writer, func()) {
+	if !IsCmdStdOutEnabled() {
+		return io.MultiWriter(writers...), func() {}
+	}
+
+	opts.stdOutOnce.Do(func() {
+		opts.stdOut = newOutputMux(os.Stdout, opts.CmdStdOutMode, opts.CmdStdOutColor)
+	})
+
+	stdOut := opts.stdOut.Writer(command.hostLabel(), command.Name)
+	redacted := newRedactWriter(stdOut, opts.Redact)
+
+	return io.MultiWriter(append([]io.Writer{redacted}, writers...)...), func() {
+		_ = redacted.Close()
+		_ = stdOut.Close()
+	}
+}
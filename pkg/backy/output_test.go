@@ -0,0 +1,120 @@
+package backy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOutputMux(t *testing.T) {
+	type write struct {
+		host, data string
+	}
+
+	tests := []struct {
+		name   string
+		mode   CmdStdOutMode
+		color  bool
+		writes []write
+		want   string
+	}{
+		{
+			name:   "prefixed by default",
+			writes: []write{{"web-1", "hello\nworld\n"}},
+			want:   "[web-1] deploy | hello\n[web-1] deploy | world\n",
+		},
+		{
+			name:   "lines are buffered until complete",
+			mode:   PrefixedCmdStdOutMode,
+			writes: []write{{"web-1", "hel"}, {"web-2", "other\n"}, {"web-1", "lo\nlast"}},
+			want:   "[web-2] deploy | other\n[web-1] deploy | hello\n[web-1] deploy | last\n",
+		},
+		{
+			name:   "grouped",
+			mode:   GroupedCmdStdOutMode,
+			writes: []write{{"web-1", "a\n"}, {"web-2", "b\n"}, {"web-1", "c\n"}},
+			want:   "[web-1] deploy | a\n[web-1] deploy | c\n[web-2] deploy | b\n",
+		},
+		{
+			name:   "raw",
+			mode:   RawCmdStdOutMode,
+			writes: []write{{"web-1", "a"}, {"web-2", "b\n"}},
+			want:   "ab\n",
+		},
+		{
+			name:   "colored per host",
+			color:  true,
+			writes: []write{{"web-1", "a\n"}, {"web-2", "b\n"}, {"web-1", "c\n"}},
+			want: hostColors[0] + "[web-1] deploy | " + colorReset + "a\n" +
+				hostColors[1] + "[web-2] deploy | " + colorReset + "b\n" +
+				hostColors[0] + "[web-1] deploy | " + colorReset + "c\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			mux := newOutputMux(&out, tt.mode, tt.color)
+
+			writers := make(map[string]io.WriteCloser)
+			var hosts []string
+			for _, w := range tt.writes {
+				if _, found := writers[w.host]; !found {
+					writers[w.host] = mux.Writer(w.host, "deploy")
+					hosts = append(hosts, w.host)
+				}
+				if _, err := writers[w.host].Write([]byte(w.data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, host := range hosts {
+				if err := writers[host].Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := out.String(); got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Run with -race to check that hosts writing at the same time do not interleave their lines
+func TestOutputMuxConcurrentWrites(t *testing.T) {
+	const hosts, lines = 8, 50
+
+	var out bytes.Buffer
+	mux := newOutputMux(&out, PrefixedCmdStdOutMode, false)
+
+	var wg sync.WaitGroup
+	for h := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := mux.Writer(fmt.Sprintf("web-%d", h), "deploy")
+			defer w.Close()
+			for l := range lines {
+				// write each line in two parts, so unbuffered output would interleave
+				fmt.Fprintf(w, "line %d ", l)
+				fmt.Fprintf(w, "of web-%d\n", h)
+			}
+		}()
+	}
+	wg.Wait()
+
+	got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(got) != hosts*lines {
+		t.Fatalf("got %d lines, want %d", len(got), hosts*lines)
+	}
+	for _, line := range got {
+		var host, of string
+		var n int
+		if _, err := fmt.Sscanf(line, "[%s deploy | line %d of %s", &host, &n, &of); err != nil || host != of+"]" {
+			t.Errorf("line %q is interleaved", line)
+		}
+	}
+}
@@ -8,11 +8,11 @@ import (
 	"strings"
 )
 
-const _PackageOperationName = "installupgradepurgeremovecheckVersionisInstalled"
+const _PackageOperationName = "installupgradepurgeremovecheckVersionisInstalledlistUpgradessecurityUpgrade"
 
-var _PackageOperationIndex = [...]uint8{0, 0, 7, 14, 19, 25, 37, 48}
+var _PackageOperationIndex = [...]uint8{0, 0, 7, 14, 19, 25, 37, 48, 60, 75}
 
-const _PackageOperationLowerName = "installupgradepurgeremovecheckversionisinstalled"
+const _PackageOperationLowerName = "installupgradepurgeremovecheckversionisinstalledlistupgradessecurityupgrade"
 
 func (i PackageOperation) String() string {
 	if i < 0 || i >= PackageOperation(len(_PackageOperationIndex)-1) {
@@ -32,9 +32,11 @@ func _PackageOperationNoOp() {
 	_ = x[PackageOperationRemove-(4)]
 	_ = x[PackageOperationCheckVersion-(5)]
 	_ = x[PackageOperationIsInstalled-(6)]
+	_ = x[PackageOperationListUpgrades-(7)]
+	_ = x[PackageOperationSecurityUpgrade-(8)]
 }
 
-var _PackageOperationValues = []PackageOperation{DefaultPO, PackageOperationInstall, PackageOperationUpgrade, PackageOperationPurge, PackageOperationRemove, PackageOperationCheckVersion, PackageOperationIsInstalled}
+var _PackageOperationValues = []PackageOperation{DefaultPO, PackageOperationInstall, PackageOperationUpgrade, PackageOperationPurge, PackageOperationRemove, PackageOperationCheckVersion, PackageOperationIsInstalled, PackageOperationListUpgrades, PackageOperationSecurityUpgrade}
 
 var _PackageOperationNameToValueMap = map[string]PackageOperation{
 	_PackageOperationName[0:0]:        DefaultPO,
@@ -51,6 +53,10 @@ var _PackageOperationNameToValueMap = map[string]PackageOperation{
 	_PackageOperationLowerName[25:37]: PackageOperationCheckVersion,
 	_PackageOperationName[37:48]:      PackageOperationIsInstalled,
 	_PackageOperationLowerName[37:48]: PackageOperationIsInstalled,
+	_PackageOperationName[48:60]:      PackageOperationListUpgrades,
+	_PackageOperationLowerName[48:60]: PackageOperationListUpgrades,
+	_PackageOperationName[60:75]:      PackageOperationSecurityUpgrade,
+	_PackageOperationLowerName[60:75]: PackageOperationSecurityUpgrade,
 }
 
 var _PackageOperationNames = []string{
@@ -61,6 +67,8 @@ var _PackageOperationNames = []string{
 	_PackageOperationName[19:25],
 	_PackageOperationName[25:37],
 	_PackageOperationName[37:48],
+	_PackageOperationName[48:60],
+	_PackageOperationName[60:75],
 }
 
 // PackageOperationString retrieves an enum value from the enum constants string name.
@@ -0,0 +1,139 @@
+// packagereport.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	packagemanagercommon "git.andrewnw.xyz/CyberShell/backy/pkg/pkgman/common"
+	"github.com/rs/zerolog"
+)
+
+// isPackageListOperation returns true if the command lists the available upgrades
+func (command *Command) isPackageListOperation() bool {
+	return command.Type == PackageCommandType &&
+		(command.PackageOperation == PackageOperationListUpgrades || command.PackageOperation == PackageOperationSecurityUpgrade)
+}
+
+// parsePackageUpgrades parses the output of a listUpgrades or securityUpgrade command
+// and records the packages for host.
+func (command *Command) parsePackageUpgrades(output, host string, opts *ConfigOpts, cmdCtxLogger zerolog.Logger) error {
+	pkgs, err := command.pkgMan.ParseUpgradesOutput(output)
+	if err != nil {
+		return fmt.Errorf("error parsing package upgrades output: %w", err)
+	}
+
+	if command.PackageOperation == PackageOperationSecurityUpgrade {
+		pkgs = slices.DeleteFunc(pkgs, func(p packagemanagercommon.Package) bool {
+			return !p.VersionCheck.Security
+		})
+	}
+
+	report := opts.addPackageReport(host, command.Name, pkgs)
+	cmdCtxLogger.Info().
+		Int("upgrades", report.Upgrades).
+		Int("security upgrades", report.SecurityUpgrades).
+		Msg("Package upgrades found")
+
+	for _, p := range pkgs {
+		cmdCtxLogger.Debug().
+			Str("package", p.Name).
+			Str("Installed", p.VersionCheck.Installed).
+			Str("Candidate", p.VersionCheck.Candidate).
+			Bool("security", p.VersionCheck.Security).
+			Send()
+	}
+	return nil
+}
+
+func (opts *ConfigOpts) addPackageReport(host, cmdName string, pkgs []packagemanagercommon.Package) PackageReport {
+	report := &PackageReport{
+		Host:     host,
+		CmdName:  cmdName,
+		Upgrades: len(pkgs),
+		Packages: pkgs,
+	}
+	for _, p := range pkgs {
+		if p.VersionCheck.Security {
+			report.SecurityUpgrades++
+		}
+	}
+
+	opts.packageReportsMu.Lock()
+	defer opts.packageReportsMu.Unlock()
+	if opts.packageReports == nil {
+		opts.packageReports = make(map[string]*PackageReport)
+	}
+	opts.packageReports[host+"/"+cmdName] = report
+
+	return *report
+}
+
+// PackageReports returns the latest package reports sorted by host and command.
+func (opts *ConfigOpts) PackageReports() []PackageReport {
+	opts.packageReportsMu.Lock()
+	defer opts.packageReportsMu.Unlock()
+
+	reports := make([]PackageReport, 0, len(opts.packageReports))
+	for _, r := range opts.packageReports {
+		reports = append(reports, *r)
+	}
+	slices.SortFunc(reports, func(a, b PackageReport) int {
+		if c := strings.Compare(a.Host, b.Host); c != 0 {
+			return c
+		}
+		return strings.Compare(a.CmdName, b.CmdName)
+	})
+	return reports
+}
+
+// packageReportsForCmds returns the package reports of the commands in cmds.
+// If host is not empty, only the reports of host are returned, for notifications sent for each host.
+func (opts *ConfigOpts) packageReportsForCmds(cmds []string, host string) []PackageReport {
+	var reports []PackageReport
+	for _, r := range opts.PackageReports() {
+		if slices.Contains(cmds, r.CmdName) && (host == "" || r.Host == host) {
+			reports = append(reports, r)
+		}
+	}
+	return reports
+}
+
+// WritePackageReport writes the reports to w.
+// format is one of table or json.
+func WritePackageReport(w io.Writer, reports []PackageReport, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(reports)
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "HOST\tCOMMAND\tPACKAGE\tINSTALLED\tCANDIDATE\tSECURITY")
+		var upgrades, securityUpgrades int
+		hosts := map[string]bool{}
+		for _, r := range reports {
+			hosts[r.Host] = true
+			upgrades += r.Upgrades
+			securityUpgrades += r.SecurityUpgrades
+			if len(r.Packages) == 0 {
+				fmt.Fprintf(tw, "%s\t%s\t-\t-\t-\t-\n", r.Host, r.CmdName)
+				continue
+			}
+			for _, p := range r.Packages {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%t\n", r.Host, r.CmdName, p.Name, p.VersionCheck.Installed, p.VersionCheck.Candidate, p.VersionCheck.Security)
+			}
+		}
+		fmt.Fprintf(tw, "\n%d hosts, %d upgrades, %d security upgrades\n", len(hosts), upgrades, securityUpgrades)
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown package report format %s; valid formats are table or json", format)
+	}
+}
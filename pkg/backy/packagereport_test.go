@@ -0,0 +1,41 @@
+package backy
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestPackageReportsForCmds(t *testing.T) {
+	opts := &ConfigOpts{Logger: zerolog.Nop()}
+	opts.addPackageReport("web-1", "upgrades", nil)
+	opts.addPackageReport("web-2", "upgrades", nil)
+	opts.addPackageReport("web-1", "other", nil)
+
+	tests := []struct {
+		name string
+		host string
+		want []string
+	}{
+		{name: "whole list", want: []string{"web-1/upgrades", "web-2/upgrades"}},
+		{name: "one host", host: "web-2", want: []string{"web-2/upgrades"}},
+		{name: "host without reports", host: "db-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, r := range opts.packageReportsForCmds([]string{"upgrades"}, tt.host) {
+				got = append(got, r.Host+"/"+r.CmdName)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("reports = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("reports = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+// pipeline.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	usermanagercommon "git.andrewnw.xyz/CyberShell/backy/pkg/usermanager/common"
+	"github.com/rs/zerolog"
+)
+
+// validatePipeline checks the stages of pipeline command
+func validatePipeline(command *Command, opts *ConfigOpts) error {
+	if len(command.Pipeline) < 2 {
+		return fmt.Errorf("pipeline command %s must have at least two commands", command.Name)
+	}
+	if command.Stdin != nil {
+		return fmt.Errorf("pipeline command %s can't have stdin; set stdin on its first command", command.Name)
+	}
+
+	for i, name := range command.Pipeline {
+		stage, found := opts.Cmds[name]
+		if !found {
+			return fmt.Errorf("command %s of pipeline %s not found", name, command.Name)
+		}
+		if stage.Type != DefaultCommandType {
+			return fmt.Errorf("command %s of pipeline %s is a %s command; only commands without a type can be in a pipeline", name, command.Name, stage.Type)
+		}
+		if len(stage.Hosts) > 0 {
+			return fmt.Errorf("command %s of pipeline %s has hosts; commands in a pipeline run on one host, set with host", name, command.Name)
+		}
+		if i > 0 && stage.Stdin != nil {
+			return fmt.Errorf("command %s of pipeline %s has stdin; only the first command can", name, command.Name)
+		}
+	}
+	return nil
+}
+
+// pipelineStage is a command of a pipeline that has been started
+type pipelineStage struct {
+	command *Command
+	wait    func() error
+	logger  zerolog.Logger
+}
+
+// runPipeline runs the commands of the pipeline command at the same time,
+// with the stdout of each command streamed to the stdin of the next.
+// Commands without a host run on the host of the pipeline, or locally.
+//
+// Returns the stdout of the last command. Like pipefail, if any command fails,
+// the error of the last command that failed is returned.
+func (opts *ConfigOpts) runPipeline(command *Command, cmdCtxLogger zerolog.Logger) ([]string, error) {
+	var cmdOutBuf bytes.Buffer
+
+	outWriters := []io.Writer{&cmdOutBuf}
+	if command.Output.File != "" {
+		file, err := os.Create(command.Output.File)
+		if err != nil {
+			return nil, fmt.Errorf("error creating output file: %w", err)
+		}
+		defer file.Close()
+		redacted := newRedactWriter(file, opts.Redact)
+		defer redacted.Close()
+		outWriters = append(outWriters, redacted)
+	}
+	cmdOutWriters, closeStdOut := opts.cmdOutputWriter(command, outWriters...)
+	defer closeStdOut()
+
+	cmdCtxLogger.Info().Msgf("Running pipeline %s: %s", command.Name, strings.Join(command.Pipeline, " | "))
+
+	var (
+		stages   []pipelineStage
+		readers  []*io.PipeReader
+		writers  []*io.PipeWriter
+		stdin    io.Reader
+		startErr error
+	)
+	for i, name := range command.Pipeline {
+		stage := *opts.Cmds[name]
+		if stage.Host == "" && !IsHostLocal(command.Host) {
+			stage.Host = command.Host
+			stage.RemoteHost = command.RemoteHost
+			// local commands run in the config directory by default, which is only on this machine
+			if stage.Dir == &opts.ConfigDir {
+				stage.Dir = nil
+			}
+		}
+		stage.hookEnv = command.hookEnv
+		stage.leases = command.leases
+		stageLogger := cmdCtxLogger.With().Str("pipeline-cmd", stage.Name).Str("host", stage.hostLabel()).Logger()
+
+		rendered, err := stage.renderTemplates(opts)
+		if err != nil {
+			startErr = err
+			break
+		}
+		stage = *rendered
+		stage.stderr = nil
+
+		if i == 0 && stage.Stdin != nil {
+			r, closeStdin, err := opts.stdinReader(&stage, stageLogger)
+			if err != nil {
+				startErr = err
+				break
+			}
+			defer closeStdin()
+			stdin = r
+		}
+
+		stdout := cmdOutWriters
+		var pw *io.PipeWriter
+		if i < len(command.Pipeline)-1 {
+			var pr *io.PipeReader
+			pr, pw = io.Pipe()
+			readers = append(readers, pr)
+			writers = append(writers, pw)
+			stdout = pw
+		}
+
+		stderr, closeStdErr := opts.stderrWriter(&stage, stageLogger)
+		wait, err := opts.startPipelineStage(&stage, stdin, stdout, stderr, stageLogger)
+		if err != nil {
+			closeStdErr()
+			startErr = fmt.Errorf("error starting command %s of pipeline %s: %w", stage.Name, command.Name, err)
+			break
+		}
+		stages = append(stages, pipelineStage{command: &stage, logger: stageLogger, wait: func() error {
+			defer closeStdErr()
+			return wait()
+		}})
+
+		if pw != nil {
+			stdin = readers[len(readers)-1]
+		}
+	}
+
+	// stop the commands that started, if one of them could not be
+	if startErr != nil {
+		for i := range writers {
+			_ = writers[i].CloseWithError(startErr)
+			_ = readers[i].CloseWithError(startErr)
+		}
+	}
+
+	errs := make([]error, len(stages))
+	done := make(chan int, len(stages))
+	for i, stage := range stages {
+		go func() {
+			errs[i] = stage.command.checkExitCode(stage.wait(), stage.logger)
+			// the next command reads to the end of the output, and the command before can't write any more
+			if i < len(writers) {
+				_ = writers[i].Close()
+			}
+			if i > 0 {
+				_ = readers[i-1].CloseWithError(fmt.Errorf("command %s of pipeline %s exited", stage.command.Name, command.Name))
+			}
+			done <- i
+		}()
+	}
+	for range stages {
+		<-done
+	}
+
+	command.stderr = nil
+	for _, stage := range stages {
+		command.stderr = append(command.stderr, stage.command.stderr...)
+	}
+	outputArr := logCommandOutput(command, cmdOutBuf, cmdCtxLogger, nil)
+
+	if startErr != nil {
+		return outputArr, startErr
+	}
+	for i := len(errs) - 1; i >= 0; i-- {
+		if errs[i] != nil {
+			cmdCtxLogger.Error().Err(errs[i]).Str("pipeline-cmd", stages[i].command.Name).Send()
+			return outputArr, fmt.Errorf("command %s of pipeline %s failed: %w", stages[i].command.Name, command.Name, errs[i])
+		}
+	}
+	return outputArr, nil
+}
+
+// startPipelineStage starts command, locally or on its host, with the given stdin, stdout and stderr.
+// The returned function waits for the command to exit.
+func (opts *ConfigOpts) startPipelineStage(command *Command, stdin io.Reader, stdout, stderr io.Writer, cmdCtxLogger zerolog.Logger) (func() error, error) {
+	envVars := environmentVars{
+		file:   command.Env,
+		env:    command.Environment,
+		vars:   command.hookEnv,
+		leases: command.leases,
+	}
+	argStr := strings.TrimSpace(command.Cmd + " " + strings.Join(command.Args, " "))
+
+	if IsHostLocal(command.Host) {
+		var localCMD *exec.Cmd
+		if command.Shell != "" {
+			localCMD = exec.Command(command.Shell, "-c", argStr)
+		} else {
+			localCMD = exec.Command(command.Cmd, command.Args...)
+		}
+		if command.Dir != nil {
+			localCMD.Dir = *command.Dir
+		}
+		injectEnvIntoLocalCMD(envVars, localCMD, cmdCtxLogger, opts)
+		localCMD.Stdin = stdin
+		localCMD.Stdout = stdout
+		localCMD.Stderr = stderr
+
+		cmdCtxLogger.Info().Msgf("Starting command %s on local machine", command.Name)
+		if err := localCMD.Start(); err != nil {
+			return nil, err
+		}
+		return localCMD.Wait, nil
+	}
+
+	opts.ensureRemoteHost(command, command.Host)
+	if err := command.RemoteHost.ensureConnected(opts); err != nil {
+		return nil, fmt.Errorf("failed to connect to host: %w", err)
+	}
+	session, releaseSession, err := command.RemoteHost.createSSHSession(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SSH session: %w", err)
+	}
+
+	if command.Shell != "" {
+		argStr = fmt.Sprintf("%s -c %s", command.Shell, usermanagercommon.ShellQuote(argStr))
+	}
+	if err := injectEnvIntoSSH(envVars, session, opts, cmdCtxLogger); err != nil {
+		cmdCtxLogger.Info().Err(fmt.Errorf("%v; appending env variables to beginning of command", err)).Send()
+		argStr = prependEnvVarsToCommand(envVars, opts, command.Cmd, command.Args, cmdCtxLogger)
+	}
+	if command.Dir != nil && *command.Dir != "" {
+		argStr = fmt.Sprintf("cd %s && %s", usermanagercommon.ShellQuote(*command.Dir), argStr)
+	}
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	cmdCtxLogger.Info().Msgf("Starting command %s on host %s", command.Name, command.Host)
+	if err := session.Start(argStr); err != nil {
+		session.Close()
+		releaseSession()
+		return nil, err
+	}
+	return func() error {
+		defer releaseSession()
+		defer session.Close()
+		return session.Wait()
+	}, nil
+}
@@ -0,0 +1,165 @@
+package backy
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestValidatePipeline(t *testing.T) {
+	cmds := map[string]*Command{
+		"dump":     {Name: "dump", Cmd: "pg_dump"},
+		"compress": {Name: "compress", Cmd: "zstd"},
+		"script":   {Name: "script", Cmd: "echo", Type: ScriptCommandType},
+		"fanout":   {Name: "fanout", Cmd: "cat", Hosts: []string{"web-1", "web-2"}},
+		"input":    {Name: "input", Cmd: "cat", Stdin: &CmdStdin{Content: "a"}},
+	}
+
+	tests := []struct {
+		name     string
+		pipeline []string
+		stdin    *CmdStdin
+		wantErr  string
+	}{
+		{name: "valid", pipeline: []string{"dump", "compress"}},
+		{name: "stdin on first command", pipeline: []string{"input", "compress"}},
+		{name: "one command", pipeline: []string{"dump"}, wantErr: "at least two commands"},
+		{name: "missing command", pipeline: []string{"dump", "missing"}, wantErr: "command missing of pipeline"},
+		{name: "typed command", pipeline: []string{"dump", "script"}, wantErr: "is a script command"},
+		{name: "hosts", pipeline: []string{"fanout", "compress"}, wantErr: "has hosts"},
+		{name: "stdin on later command", pipeline: []string{"dump", "input"}, wantErr: "only the first command can"},
+		{name: "stdin on pipeline", pipeline: []string{"dump", "compress"}, stdin: &CmdStdin{Content: "a"}, wantErr: "can't have stdin"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command := &Command{Name: tt.name, Type: PipelineCommandType, Pipeline: tt.pipeline, Stdin: tt.stdin}
+			err := validatePipeline(command, &ConfigOpts{Cmds: cmds})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validatePipeline: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validatePipeline error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunPipeline(t *testing.T) {
+	opts := newTestOpts(t)
+	dbA, _ := newTestHost(t, opts, "db-a")
+	dbB, _ := newTestHost(t, opts, "db-b")
+	dbC, serverC := newTestHost(t, opts, "db-c")
+	remoteDir := filepath.Join(serverC.Dir, "it's here")
+	if err := os.Mkdir(remoteDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.Cmds = map[string]*Command{
+		"unsorted":   {Name: "unsorted", Cmd: "printf", Args: []string{`b\na\n`}},
+		"sort":       {Name: "sort", Cmd: "sort"},
+		"dump":       {Name: "dump", Cmd: "printf", Args: []string{`'CREATE TABLE t;\nINSERT 1;\n'`}, Host: dbA.Host, RemoteHost: dbA},
+		"upper":      {Name: "upper", Cmd: "tr", Args: []string{"a-z", "A-Z"}},
+		"compress":   {Name: "compress", Cmd: "gzip", Args: []string{"-c"}},
+		"restore":    {Name: "restore", Cmd: "gunzip", Args: []string{"-c"}, Host: dbB.Host, RemoteHost: dbB},
+		"fail":       {Name: "fail", Cmd: "sh", Args: []string{"-c", "echo partial; echo broken >&2; exit 3"}},
+		"cat":        {Name: "cat", Cmd: "cat"},
+		"yes":        {Name: "yes", Cmd: "yes"},
+		"head":       {Name: "head", Cmd: "head", Args: []string{"-n", "2"}},
+		"hello":      {Name: "hello", Cmd: "echo", Args: []string{"hello"}},
+		"stdinInput": {Name: "stdinInput", Cmd: "cat", Stdin: &CmdStdin{Content: "from stdin\n"}},
+		"vanished":   {Name: "vanished", Cmd: "sh", Args: []string{"-c", "echo copied; exit 24"}, SuccessExitCodes: []int{24}},
+		"pwd":        {Name: "pwd", Cmd: "pwd", Dir: &remoteDir, Host: dbC.Host, RemoteHost: dbC},
+		"quoted":     {Name: "quoted", Cmd: "echo", Args: []string{`"it's"`}, Shell: "sh", Host: dbC.Host, RemoteHost: dbC},
+	}
+
+	tests := []struct {
+		name         string
+		pipeline     []string
+		host         *Host
+		want         []string
+		wantStderr   []string
+		wantExitCode int
+		wantErr      string
+	}{
+		{name: "local", pipeline: []string{"unsorted", "sort"}, want: []string{"a", "b"}},
+		{name: "remote to local", pipeline: []string{"dump", "upper"}, want: []string{"CREATE TABLE T;", "INSERT 1;"}},
+		{name: "host to host", pipeline: []string{"dump", "compress", "restore"}, want: []string{"CREATE TABLE t;", "INSERT 1;"}},
+		{name: "stdin of first command", pipeline: []string{"stdinInput", "upper"}, want: []string{"FROM STDIN"}},
+		{
+			name:         "failed command",
+			pipeline:     []string{"fail", "cat"},
+			want:         []string{"partial"},
+			wantStderr:   []string{"broken"},
+			wantExitCode: 3,
+			wantErr:      "command fail of pipeline",
+		},
+		{name: "successExitCodes of a command", pipeline: []string{"vanished", "cat"}, want: []string{"copied"}},
+		{name: "dir of a remote command", pipeline: []string{"pwd", "cat"}, want: []string{remoteDir}},
+		{name: "shell of a remote command", pipeline: []string{"quoted", "cat"}, want: []string{"it's"}},
+		{name: "commands run on the host of the pipeline", pipeline: []string{"hello", "upper"}, host: dbC, want: []string{"HELLO"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command := &Command{Name: tt.name, Type: PipelineCommandType, Pipeline: tt.pipeline}
+
+			var got []string
+			var err error
+			if tt.host != nil {
+				command.Host = tt.host.Host
+				command.RemoteHost = tt.host
+				got, err = command.RunCmdOnHost(zerolog.Nop(), opts)
+			} else {
+				got, err = command.RunCmd(zerolog.Nop(), opts)
+			}
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("running pipeline: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+			if !slices.Equal(command.stderr, tt.wantStderr) {
+				t.Errorf("stderr = %q, want %q", command.stderr, tt.wantStderr)
+			}
+			if command.exitCode != tt.wantExitCode {
+				t.Errorf("exit code = %d, want %d", command.exitCode, tt.wantExitCode)
+			}
+		})
+	}
+
+	if users := serverC.Users(); len(users) != 1 {
+		t.Errorf("db-c users = %v, want the commands of the pipeline run on db-c", users)
+	}
+
+	t.Run("stops when a command exits early", func(t *testing.T) {
+		command := &Command{Name: "early", Type: PipelineCommandType, Pipeline: []string{"yes", "head"}}
+
+		done := make(chan []string)
+		go func() {
+			got, _ := command.RunCmd(zerolog.Nop(), opts)
+			done <- got
+		}()
+		select {
+		case got := <-done:
+			if !slices.Equal(got, []string{"y", "y"}) {
+				t.Errorf("output = %q, want [y y]", got)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("pipeline did not finish after head exited")
+		}
+	})
+}
@@ -0,0 +1,246 @@
+package backy
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"git.andrewnw.xyz/CyberShell/backy/pkg/sshtest"
+)
+
+func TestParseProxyJump(t *testing.T) {
+	bastion := &Host{Host: "bastion"}
+
+	tests := []struct {
+		proxyJump string
+		want      []Host
+		wantErr   bool
+	}{
+		{proxyJump: "", want: nil},
+		{proxyJump: "none", want: nil},
+		{proxyJump: "bastion", want: []Host{{Host: "bastion"}}},
+		{proxyJump: "bastion, jump@10.0.0.2:2222", want: []Host{{Host: "bastion"}, {Host: "10.0.0.2", User: "jump", Port: 2222}}},
+		{proxyJump: "a,b,c", want: []Host{{Host: "a"}, {Host: "b"}, {Host: "c"}}},
+		{proxyJump: "admin@[fd00::1]:22", want: []Host{{Host: "fd00::1", User: "admin", Port: 22}}},
+		{proxyJump: "a,,b", wantErr: true},
+		{proxyJump: "a:port", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		hosts := map[string]*Host{"bastion": bastion}
+		got, err := parseProxyJump(tt.proxyJump, hosts)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("parseProxyJump(%q) error = %v, wantErr %v", tt.proxyJump, err, tt.wantErr)
+		}
+		if tt.wantErr {
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("parseProxyJump(%q) returned %d hosts, want %d", tt.proxyJump, len(got), len(tt.want))
+		}
+		for i, h := range got {
+			w := &tt.want[i]
+			if h.Host != w.Host || h.User != w.User || h.Port != w.Port {
+				t.Errorf("parseProxyJump(%q)[%d] = %s@%s:%d, want %s@%s:%d", tt.proxyJump, i, h.User, h.Host, h.Port, w.User, w.Host, w.Port)
+			}
+		}
+		if len(got) > 0 && got[0].Host == "bastion" && got[0] != bastion {
+			t.Errorf("parseProxyJump(%q) did not use the configured bastion host", tt.proxyJump)
+		}
+	}
+}
+
+// newProxyJumpTest starts an in-process SSH server for each host name
+func newProxyJumpTest(t *testing.T, names ...string) (*ConfigOpts, map[string]*sshtest.Server) {
+	t.Helper()
+
+	opts := newTestOpts(t)
+	servers := make(map[string]*sshtest.Server)
+	for _, name := range names {
+		_, servers[name] = newTestHost(t, opts, name)
+	}
+	return opts, servers
+}
+
+func TestProxyJumpChain(t *testing.T) {
+	opts, servers := newProxyJumpTest(t, "jump1", "jump2", "jump3", "target", "target2")
+	opts.Hosts["target"].ProxyJump = "jump1,jump2,jump3"
+	opts.Hosts["target2"].ProxyJump = "jump1,jump2,jump3"
+	getHostConfigs(opts)
+
+	for _, name := range []string{"target", "target2"} {
+		host := opts.Hosts[name]
+		if err := host.ConnectToHost(opts); err != nil {
+			t.Fatalf("ConnectToHost(%s): %v", name, err)
+		}
+		if ok := isClientAlive(host.SshClient, time.Second); !ok {
+			t.Fatalf("connection to %s is not alive", name)
+		}
+	}
+
+	// both targets go through the same pooled jump connections
+	for name, server := range servers {
+		if got := server.Connections(); got != 1 {
+			t.Errorf("%s accepted %d connections, want 1", name, got)
+		}
+		if users := server.Users(); len(users) != 1 || users[0] != name+"-user" {
+			t.Errorf("%s users = %v, want [%s-user]", name, users, name)
+		}
+	}
+
+	for _, name := range []string{"jump1", "jump2", "jump3"} {
+		if !opts.Hosts[name].isProxyHost {
+			t.Errorf("%s is not marked as a proxy host", name)
+		}
+	}
+}
+
+func TestProxyJumpChainFromSSHConfig(t *testing.T) {
+	opts, servers := newProxyJumpTest(t, "jump1", "jump2", "target")
+
+	sshConfig := opts.Hosts["target"].ConfigFilePath
+	if err := os.WriteFile(sshConfig, []byte("Host target\n  ProxyJump jump1,jump2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	host := opts.Hosts["target"]
+	if err := host.ConnectToHost(opts); err != nil {
+		t.Fatalf("ConnectToHost: %v", err)
+	}
+	if len(host.ProxyHost) != 2 {
+		t.Fatalf("got %d proxy hosts, want 2", len(host.ProxyHost))
+	}
+	for name, server := range servers {
+		if got := server.Connections(); got != 1 {
+			t.Errorf("%s accepted %d connections, want 1", name, got)
+		}
+	}
+}
+
+func TestProxyJumpChainErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, opts *ConfigOpts, servers map[string]*sshtest.Server)
+		wantErr []string
+	}{
+		{
+			name: "unknown host key of second hop",
+			setup: func(t *testing.T, opts *ConfigOpts, servers map[string]*sshtest.Server) {
+				if err := os.WriteFile(opts.Hosts["jump2"].KnownHostsFile, nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: []string{"proxy host jump2", "hop 2 of 2", "backy hosts trust jump2"},
+		},
+		{
+			name: "wrong key for first hop",
+			setup: func(t *testing.T, opts *ConfigOpts, servers map[string]*sshtest.Server) {
+				opts.Hosts["jump1"].PrivateKeyPath = opts.Hosts["jump2"].PrivateKeyPath
+			},
+			wantErr: []string{"proxy host jump1", "hop 1 of 2", "unable to authenticate"},
+		},
+		{
+			name: "unreachable target",
+			setup: func(t *testing.T, opts *ConfigOpts, servers map[string]*sshtest.Server) {
+				servers["target"].Close()
+			},
+			wantErr: []string{"host target through proxy host jump2"},
+		},
+		{
+			name: "missing hostname of hop",
+			setup: func(t *testing.T, opts *ConfigOpts, servers map[string]*sshtest.Server) {
+				opts.Hosts["target"].ProxyJump = "jump1,nowhere"
+				opts.Hosts["nowhere"] = &Host{Host: "nowhere", ConfigFilePath: opts.Hosts["target"].ConfigFilePath}
+			},
+			wantErr: []string{"proxy host nowhere (hop 2 of 2)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, servers := newProxyJumpTest(t, "jump1", "jump2", "target")
+			opts.Hosts["target"].ProxyJump = "jump1,jump2"
+			tt.setup(t, opts, servers)
+			getHostConfigs(opts)
+
+			err := opts.Hosts["target"].ConnectToHost(opts)
+			if err == nil {
+				t.Fatal("ConnectToHost succeeded, want error")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyJumpHandshakeTimeout(t *testing.T) {
+	opts, _ := newProxyJumpTest(t, "jump1", "target")
+
+	// the target accepts connections but never starts the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 1)
+	t.Cleanup(func() {
+		listener.Close()
+		for conn := range accepted {
+			conn.Close()
+		}
+	})
+	go func() {
+		defer close(accepted)
+		// keep the connection open until the test ends
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	target := opts.Hosts["target"]
+	addr := listener.Addr().(*net.TCPAddr)
+	target.HostName = addr.IP.String()
+	target.Port = uint16(addr.Port)
+	target.ProxyJump = "jump1"
+	if err := os.WriteFile(target.ConfigFilePath, []byte("Host target\n  ConnectTimeout 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	getHostConfigs(opts)
+
+	start := time.Now()
+	err = target.ConnectToHost(opts)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("error = %v, want a handshake timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("ConnectToHost took %v", elapsed)
+	}
+}
+
+func TestProxyJumpParallel(t *testing.T) {
+	opts, servers := newProxyJumpTest(t, "jump", "target1", "target2")
+	opts.Hosts["target1"].ProxyJump = "jump"
+	opts.Hosts["target2"].ProxyJump = "jump"
+	getHostConfigs(opts)
+
+	// both targets connect through the jump host at the same time, twice each
+	errs := make(chan error, 4)
+	for _, name := range []string{"target1", "target2", "target1", "target2"} {
+		go func() { errs <- opts.Hosts[name].ConnectToHost(opts) }()
+	}
+	for range 4 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, server := range servers {
+		if got := server.Connections(); got != 1 {
+			t.Errorf("%s accepted %d connections, want 1", name, got)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// redact.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// redactedSecret replaces the values of secrets
+const redactedSecret = "********"
+
+// minSecretLength is the length of the shortest value that is redacted.
+// Shorter values would mask too much of the text they are in.
+const minSecretLength = 4
+
+// secretRedactor masks the values of secrets in text
+type secretRedactor struct {
+	mu sync.RWMutex
+	// secrets are sorted longest first, so a secret that contains another is masked whole
+	secrets []string
+}
+
+func (r *secretRedactor) add(secret string) {
+	secret = strings.TrimSpace(secret)
+	if len(secret) < minSecretLength {
+		return
+	}
+
+	values := []string{secret}
+	// secrets are escaped in JSON logs
+	if escaped, err := json.Marshal(secret); err == nil {
+		values = append(values, string(escaped[1:len(escaped)-1]))
+	}
+	// output is redacted a line at a time, so the lines of secrets such as keys must be masked on their own
+	for _, line := range strings.Split(secret, "\n") {
+		if line = strings.TrimSpace(line); len(line) >= minSecretLength {
+			values = append(values, line)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range values {
+		if !slices.Contains(r.secrets, v) {
+			r.secrets = append(r.secrets, v)
+		}
+	}
+	slices.SortFunc(r.secrets, func(a, b string) int { return len(b) - len(a) })
+}
+
+func (r *secretRedactor) redact(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, redactedSecret)
+	}
+	return s
+}
+
+// addSecret adds values that are masked in logs, notifications and output.
+// Directives are skipped, as their values are added when they are resolved.
+func (opts *ConfigOpts) addSecret(values ...string) {
+	for _, v := range values {
+		if strings.HasPrefix(v, externDirectiveStart) && strings.HasSuffix(v, externDirectiveEnd) {
+			continue
+		}
+		opts.secrets.add(v)
+	}
+}
+
+// Redact masks the values of the secrets resolved so far in s
+func (opts *ConfigOpts) Redact(s string) string {
+	return opts.secrets.redact(s)
+}
+
+// redactStrings returns a copy of lines with secrets masked
+func (opts *ConfigOpts) redactStrings(lines []string) []string {
+	if lines == nil {
+		return nil
+	}
+	redacted := make([]string, len(lines))
+	for i, line := range lines {
+		redacted[i] = opts.Redact(line)
+	}
+	return redacted
+}
+
+// redactMsg masks secrets in a notification message
+func (t *msgTemplates) redactMsg(msg string) string {
+	if t.redact == nil {
+		return msg
+	}
+	return t.redact(msg)
+}
+
+// redactedError is an error with secrets masked in its message
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e *redactedError) Error() string { return e.msg }
+
+func (e *redactedError) Unwrap() error { return e.err }
+
+// redactError returns err with secrets masked in its message
+func (opts *ConfigOpts) redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := opts.Redact(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{err: err, msg: msg}
+}
+
+// redactWriter masks secrets in what is written to w.
+// Text is written a line at a time, so secrets are not split between writes.
+type redactWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	redact func(string) string
+	line   []byte
+}
+
+func newRedactWriter(w io.Writer, redact func(string) string) *redactWriter {
+	return &redactWriter{w: w, redact: redact}
+}
+
+func (w *redactWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.line = append(w.line, p...)
+	i := bytes.LastIndexByte(w.line, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	if _, err := io.WriteString(w.w, w.redact(string(w.line[:i+1]))); err != nil {
+		return 0, err
+	}
+	w.line = slices.Clone(w.line[i+1:])
+	return len(p), nil
+}
+
+// Close writes the rest of the text, if it does not end with a newline
+func (w *redactWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.line) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(w.w, w.redact(string(w.line)))
+	w.line = nil
+	return err
+}
@@ -0,0 +1,140 @@
+package backy
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestRedact(t *testing.T) {
+	opts := &ConfigOpts{}
+	opts.addSecret("hunter22", "hunter22-long", "abc", "%{vault:db}%", "line-one\nline-two", `quo"te`)
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "password is hunter22", want: "password is ********"},
+		{in: "hunter22-long", want: "********"},
+		{in: "abc is too short", want: "abc is too short"},
+		{in: "%{vault:db}%", want: "%{vault:db}%"},
+		{in: "key: line-two", want: "key: ********"},
+		{in: `{"password":"quo\"te"}`, want: `{"password":"********"}`},
+		{in: "nothing secret", want: "nothing secret"},
+	}
+
+	for _, tt := range tests {
+		if got := opts.Redact(tt.in); got != tt.want {
+			t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactWriter(t *testing.T) {
+	opts := &ConfigOpts{}
+	opts.addSecret("s3cr3t-token")
+
+	var buf bytes.Buffer
+	w := newRedactWriter(&buf, opts.Redact)
+	for _, p := range []string{"token=s3c", "r3t-", "token\nnext ", "s3cr3t-token"} {
+		if _, err := w.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := buf.String(); got != "token=********\n" {
+		t.Errorf("before close = %q", got)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "token=********\nnext ********" {
+		t.Errorf("after close = %q", got)
+	}
+}
+
+func TestRedactLogger(t *testing.T) {
+	opts := &ConfigOpts{}
+	opts.addSecret("db-pass\"word")
+
+	var buf bytes.Buffer
+	logger := zerolog.New(newRedactWriter(&buf, opts.Redact))
+	logger.Info().Str("ArgStr", `mysql -p'db-pass"word'`).Msg("running db-pass\"word")
+
+	if strings.Contains(buf.String(), "db-pass") {
+		t.Errorf("log has the secret: %s", buf.String())
+	}
+}
+
+func TestDirectiveValuesAreSecrets(t *testing.T) {
+	t.Setenv("BACKY_TEST_TOKEN", "env-token-value")
+	opts := &ConfigOpts{Logger: zerolog.Nop()}
+
+	if got := getExternalConfigDirectiveValue("%{env:BACKY_TEST_TOKEN}%", opts, AllowedExternalDirectiveAll); got != "env-token-value" {
+		t.Fatalf("directive value = %q", got)
+	}
+	if got := opts.Redact("curl -H 'token: env-token-value'"); got != "curl -H 'token: ********'" {
+		t.Errorf("Redact = %q", got)
+	}
+
+	getExternalConfigDirectiveValue("plain-value", opts, AllowedExternalDirectiveAll)
+	if got := opts.Redact("plain-value"); got != "plain-value" {
+		t.Errorf("value without directive was redacted: %q", got)
+	}
+}
+
+func TestCmdResultsAreRedacted(t *testing.T) {
+	opts := &ConfigOpts{}
+	opts.addSecret("p4ssw0rd")
+
+	cause := errors.New("exit status 1")
+	command := &Command{Name: "login", stderr: []string{"bad password p4ssw0rd"}}
+	opts.addCmdResult(newCmdResult("list", command, []string{"user:p4ssw0rd"}, errors.Join(errors.New("login p4ssw0rd failed"), cause), 0))
+
+	result := opts.CmdResults()[0]
+	if result.Output[0] != "user:********" || result.Stderr[0] != "bad password ********" {
+		t.Errorf("output = %q, stderr = %q", result.Output, result.Stderr)
+	}
+	if strings.Contains(result.Error.Error(), "p4ssw0rd") {
+		t.Errorf("error = %q", result.Error)
+	}
+	if !errors.Is(result.Error, cause) {
+		t.Error("redacted error does not wrap the error of the command")
+	}
+	if command.stderr[0] != "bad password p4ssw0rd" {
+		t.Error("stderr of the command was changed")
+	}
+}
+
+func TestOutputFileIsRedacted(t *testing.T) {
+	opts := newTestOpts(t)
+	opts.addSecret("file-secret")
+	opts.Cmds = map[string]*Command{
+		"print": {Name: "print", Cmd: "echo", Args: []string{"value file-secret"}},
+		"cat":   {Name: "cat", Cmd: "cat"},
+	}
+
+	outFile := filepath.Join(t.TempDir(), "out.txt")
+	command := &Command{Name: "write", Type: PipelineCommandType, Pipeline: []string{"print", "cat"}}
+	command.Output.File = outFile
+
+	got, err := command.RunCmd(zerolog.Nop(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []string{"value file-secret"}) {
+		t.Errorf("output = %q, want the output of the command as is", got)
+	}
+	written, err := os.ReadFile(outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != "value ********\n" {
+		t.Errorf("output file = %q", written)
+	}
+}
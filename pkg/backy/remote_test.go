@@ -0,0 +1,301 @@
+package backy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"git.andrewnw.xyz/CyberShell/backy/pkg/pkgman"
+	packagemanagercommon "git.andrewnw.xyz/CyberShell/backy/pkg/pkgman/common"
+	"git.andrewnw.xyz/CyberShell/backy/pkg/remotefetcher"
+	"git.andrewnw.xyz/CyberShell/backy/pkg/sshtest"
+	"github.com/rs/zerolog"
+)
+
+// newTestOpts returns options for connecting to in-process SSH servers, without an ssh-agent
+func newTestOpts(t *testing.T) *ConfigOpts {
+	t.Helper()
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	opts := &ConfigOpts{
+		Hosts:  make(map[string]*Host),
+		Logger: zerolog.Nop(),
+	}
+	t.Cleanup(opts.CloseHostConnections)
+	return opts
+}
+
+// newTestHost starts an in-process SSH server and adds it to opts as host name.
+// The host has its own user, key, known_hosts file and empty ssh config file.
+func newTestHost(t *testing.T, opts *ConfigOpts, name string, serverOpts ...sshtest.Option) (*Host, *sshtest.Server) {
+	t.Helper()
+
+	dir := t.TempDir()
+	user := name + "-user"
+	keyPath := filepath.Join(dir, "id_ed25519")
+	signer := sshtest.WriteKey(t, keyPath)
+
+	server := sshtest.NewServer(t, append([]sshtest.Option{sshtest.WithAuthorizedKey(user, signer.PublicKey())}, serverOpts...)...)
+
+	knownHosts := filepath.Join(dir, "known_hosts")
+	sshtest.WriteKnownHosts(t, knownHosts, server)
+	sshConfig := filepath.Join(dir, "config")
+	if err := os.WriteFile(sshConfig, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	host := &Host{
+		Host:           name,
+		HostName:       server.Host(),
+		Port:           server.Port(),
+		User:           user,
+		PrivateKeyPath: keyPath,
+		KnownHostsFile: knownHosts,
+		ConfigFilePath: sshConfig,
+		IdentityAgent:  "none",
+	}
+	opts.Hosts[name] = host
+
+	return host, server
+}
+
+func TestRunCmdOnHost(t *testing.T) {
+	tests := []struct {
+		name         string
+		command      Command
+		want         []string
+		wantStderr   []string
+		wantExitCode int
+		wantErr      string
+	}{
+		{name: "command with args", command: Command{Cmd: "echo", Args: []string{"hello", "world"}}, want: []string{"hello world"}},
+		{name: "runs in sandbox", command: Command{Cmd: "sh", Args: []string{"-c", "'touch created && ls'"}}, want: []string{"created"}},
+		{name: "shell", command: Command{Cmd: "echo", Args: []string{"$((1 + 2))"}, Shell: "sh"}, want: []string{"3"}},
+		{name: "stderr is collected separately", command: Command{Cmd: "echo", Args: []string{"oops", ">&2"}}, wantStderr: []string{"oops"}},
+		{name: "failure", command: Command{Cmd: "exit", Args: []string{"3"}}, wantExitCode: 3, wantErr: "exited with status 3"},
+		{name: "success exit code", command: Command{Cmd: "exit", Args: []string{"24"}, SuccessExitCodes: []int{24}}, wantExitCode: 24},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := newTestOpts(t)
+			host, server := newTestHost(t, opts, "remote")
+
+			command := tt.command
+			command.Name = tt.name
+			command.Host = host.Host
+			command.RemoteHost = host
+
+			got, err := command.RunCmdOnHost(zerolog.Nop(), opts)
+			if command.exitCode != tt.wantExitCode {
+				t.Errorf("exit code = %d, want %d", command.exitCode, tt.wantExitCode)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("RunCmdOnHost error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RunCmdOnHost: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+			if !slices.Equal(command.stderr, tt.wantStderr) {
+				t.Errorf("stderr = %q, want %q", command.stderr, tt.wantStderr)
+			}
+			if users := server.Users(); len(users) != 1 || users[0] != "remote-user" {
+				t.Errorf("server users = %v, want [remote-user]", users)
+			}
+		})
+	}
+}
+
+func TestRunCmdOnHostScripts(t *testing.T) {
+	scriptFile := filepath.Join(t.TempDir(), "script.sh")
+	if err := os.WriteFile(scriptFile, []byte("echo from file\necho \"$GREETING\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		command   Command
+		want      []string
+		wantShell bool
+	}{
+		{
+			name:      "script",
+			command:   Command{Type: ScriptCommandType, Cmd: "echo", Args: []string{"\"$GREETING\""}, Environment: []string{"GREETING=hello"}},
+			want:      []string{"hello"},
+			wantShell: true,
+		},
+		{
+			name:      "scriptFile",
+			command:   Command{Type: ScriptFileCommandType, Cmd: scriptFile, Environment: []string{"GREETING=hello"}},
+			want:      []string{"from file", "hello"},
+			wantShell: true,
+		},
+		{
+			name:    "remoteScript",
+			command: Command{Type: RemoteScriptCommandType, Cmd: scriptFile, Fetcher: &remotefetcher.LocalFetcher{}, Environment: []string{"GREETING=hello"}},
+			want:    []string{"from file", "hello"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := newTestOpts(t)
+			host, server := newTestHost(t, opts, "remote")
+
+			command := tt.command
+			command.Name = tt.name
+			command.Host = host.Host
+			command.RemoteHost = host
+
+			got, err := command.RunCmdOnHost(zerolog.Nop(), opts)
+			if err != nil {
+				t.Fatalf("RunCmdOnHost: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+
+			execs := server.Execs()
+			if len(execs) != 1 {
+				t.Fatalf("server ran %d commands, want 1", len(execs))
+			}
+			if isShell := execs[0].Command == ""; isShell != tt.wantShell {
+				t.Errorf("command %q ran as shell = %v, want %v", execs[0].Command, isShell, tt.wantShell)
+			}
+			if tt.wantShell && !strings.Contains(execs[0].Input(), "export GREETING=hello") {
+				t.Errorf("script %q does not export the environment", execs[0].Input())
+			}
+		})
+	}
+}
+
+func TestRunCmdOnHostEnv(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(envFile, []byte("FROM_FILE=file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		rejectEnv bool
+		wantEnv   map[string]string
+	}{
+		{name: "setenv", wantEnv: map[string]string{"FOO": "bar", "FROM_FILE": "file"}},
+		// servers that do not accept the variables get them prepended to the command
+		{name: "prepended", rejectEnv: true, wantEnv: map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var serverOpts []sshtest.Option
+			if tt.rejectEnv {
+				serverOpts = append(serverOpts, sshtest.WithEnvRejected())
+			}
+			opts := newTestOpts(t)
+			host, server := newTestHost(t, opts, "remote", serverOpts...)
+
+			command := Command{
+				Name:        tt.name,
+				Host:        host.Host,
+				RemoteHost:  host,
+				Cmd:         "echo",
+				Args:        []string{"$FOO", "$FROM_FILE"},
+				Environment: []string{"FOO=bar"},
+				Env:         envFile,
+			}
+
+			got, err := command.RunCmdOnHost(zerolog.Nop(), opts)
+			if err != nil {
+				t.Fatalf("RunCmdOnHost: %v", err)
+			}
+			if want := []string{"bar file"}; !slices.Equal(got, want) {
+				t.Errorf("output = %q, want %q", got, want)
+			}
+
+			execs := server.Execs()
+			if len(execs) != 1 {
+				t.Fatalf("server ran %d commands, want 1", len(execs))
+			}
+			for k, v := range tt.wantEnv {
+				if execs[0].Env[k] != v {
+					t.Errorf("env %s = %q, want %q", k, execs[0].Env[k], v)
+				}
+			}
+			if len(execs[0].Env) != len(tt.wantEnv) {
+				t.Errorf("env = %v, want %v", execs[0].Env, tt.wantEnv)
+			}
+		})
+	}
+}
+
+func TestRunCmdOnHostPackageCommands(t *testing.T) {
+	nginx := []packagemanagercommon.Package{{Name: "nginx"}, {Name: "curl"}}
+
+	tests := []struct {
+		manager   string
+		auth      string
+		operation PackageOperation
+		want      string
+	}{
+		{manager: "apt", operation: PackageOperationInstall, want: "apt-get update && apt-get install -y nginx curl"},
+		{manager: "apt", operation: PackageOperationRemove, want: "apt-get remove -y nginx curl"},
+		{manager: "apt", auth: "sudo", operation: PackageOperationInstall, want: "sudo apt-get update && sudo apt-get install -y nginx curl"},
+		{manager: "dnf", operation: PackageOperationInstall, want: "dnf install -y nginx curl"},
+		{manager: "dnf", operation: PackageOperationUpgrade, want: "dnf update -y nginx curl"},
+		{manager: "yum", operation: PackageOperationRemove, want: "yum remove -y nginx curl"},
+	}
+
+	for _, tt := range tests {
+		name := fmt.Sprintf("%s %s %s", tt.auth, tt.manager, tt.operation)
+		t.Run(TS(name), func(t *testing.T) {
+			// package managers are not run in the sandbox, the server only records the commands
+			handler := func(e *sshtest.Exec) int {
+				fmt.Fprintln(e.Stdout, "done")
+				return 0
+			}
+			opts := newTestOpts(t)
+			host, server := newTestHost(t, opts, "remote", sshtest.WithHandler(handler))
+
+			authOpt := pkgman.WithoutAuth()
+			if tt.auth != "" {
+				authOpt = pkgman.WithAuth(tt.auth)
+			}
+			pkgMan, err := pkgman.PackageManagerFactory(tt.manager, authOpt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			command := Command{
+				Name:             name,
+				Type:             PackageCommandType,
+				Host:             host.Host,
+				RemoteHost:       host,
+				PackageManager:   tt.manager,
+				PackageOperation: tt.operation,
+				Packages:         nginx,
+				pkgMan:           pkgMan,
+			}
+
+			if _, err := command.RunCmdOnHost(zerolog.Nop(), opts); err != nil {
+				t.Fatalf("RunCmdOnHost: %v", err)
+			}
+
+			commands := server.Commands()
+			if len(commands) != 1 {
+				t.Fatalf("server ran %q, want 1 command", commands)
+			}
+			if got := strings.Join(strings.Fields(commands[0]), " "); got != tt.want {
+				t.Errorf("command = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
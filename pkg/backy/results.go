@@ -0,0 +1,254 @@
+// results.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// hostLabel returns the host command runs on, or local for the local machine
+func (command *Command) hostLabel() string {
+	if command.Host == "" {
+		return "local"
+	}
+	return command.Host
+}
+
+func newCmdResult(list string, command *Command, output []string, err error, duration time.Duration) CmdResult {
+	result := CmdResult{
+		CmdName:  command.Name,
+		ListName: list,
+		Host:     command.hostLabel(),
+		Status:   HostResultSucceeded,
+		Duration: duration,
+		ExitCode: command.exitCode,
+		Output:   output,
+		Stderr:   command.stderr,
+		Error:    err,
+	}
+	if err != nil {
+		result.Status = HostResultFailed
+	}
+	return result
+}
+
+// runCmd runs command with RunCmd, and records its result for list.
+// Commands with hosts record a result for each host.
+func (opts *ConfigOpts) runCmd(list string, command *Command, cmdCtxLogger zerolog.Logger) ([]string, error) {
+	if command.Host == "" && command.Hosts != nil {
+		results := opts.execCommandOnHosts(list, command)
+		for _, r := range results {
+			opts.addCmdResult(r)
+		}
+		return hostsResultsOutput(command, results, cmdCtxLogger)
+	}
+
+	start := time.Now()
+	output, err := command.RunCmd(cmdCtxLogger, opts)
+	opts.addCmdResult(newCmdResult(list, command, output, err, time.Since(start)))
+	return output, err
+}
+
+// runCmdOnHost runs command with RunCmdOnHost, and records its result for list
+func (opts *ConfigOpts) runCmdOnHost(list string, command *Command, cmdCtxLogger zerolog.Logger) ([]string, error) {
+	start := time.Now()
+	output, err := command.RunCmdOnHost(cmdCtxLogger, opts)
+	opts.addCmdResult(newCmdResult(list, command, output, err, time.Since(start)))
+	return output, err
+}
+
+// hostsResultsOutput returns the output of command on all of its hosts,
+// and an error if it failed on any of them
+func hostsResultsOutput(command *Command, results []CmdResult, cmdCtxLogger zerolog.Logger) ([]string, error) {
+	var outputArr []string
+	failed := 0
+	for _, r := range results {
+		outputArr = append(outputArr, r.Output...)
+		if r.Error != nil {
+			failed++
+			cmdCtxLogger.Err(r.Error).Str("host", r.Host).Send()
+		}
+	}
+	if failed > 0 {
+		return outputArr, fmt.Errorf("command %s failed on %d of %d hosts", command.Name, failed, len(results))
+	}
+	return outputArr, nil
+}
+
+func (opts *ConfigOpts) addCmdResult(result CmdResult) {
+	result.Output = opts.redactStrings(result.Output)
+	result.Stderr = opts.redactStrings(result.Stderr)
+	result.Error = opts.redactError(result.Error)
+
+	opts.cmdResultsMu.Lock()
+	defer opts.cmdResultsMu.Unlock()
+	opts.cmdResults = append(opts.cmdResults, result)
+}
+
+// CmdResults returns the results of the commands run so far, in the order they finished
+func (opts *ConfigOpts) CmdResults() []CmdResult {
+	opts.cmdResultsMu.Lock()
+	defer opts.cmdResultsMu.Unlock()
+	return append([]CmdResult(nil), opts.cmdResults...)
+}
+
+type cmdResultJSON struct {
+	List            string   `json:"list,omitempty"`
+	Command         string   `json:"command"`
+	Host            string   `json:"host"`
+	Status          string   `json:"status"`
+	DurationSeconds float64  `json:"durationSeconds"`
+	ExitCode        int      `json:"exitCode"`
+	Output          []string `json:"output"`
+	Stderr          []string `json:"stderr"`
+	Error           string   `json:"error,omitempty"`
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// WriteCmdResults writes a summary of results to w.
+// format is one of table, json or junit.
+// In JUnit XML, each list is a test suite, and each command run on a host is a test case.
+func WriteCmdResults(w io.Writer, results []CmdResult, format string) error {
+	switch format {
+	case "json":
+		out := make([]cmdResultJSON, 0, len(results))
+		for _, r := range results {
+			res := cmdResultJSON{
+				List:            r.ListName,
+				Command:         r.CmdName,
+				Host:            r.Host,
+				Status:          r.Status.String(),
+				DurationSeconds: r.Duration.Seconds(),
+				ExitCode:        r.ExitCode,
+				Output:          r.Output,
+				Stderr:          r.Stderr,
+			}
+			if res.Output == nil {
+				res.Output = []string{}
+			}
+			if res.Stderr == nil {
+				res.Stderr = []string{}
+			}
+			if r.Error != nil {
+				res.Error = r.Error.Error()
+			}
+			out = append(out, res)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	case "junit":
+		suites := junitTestSuites{Name: "backy"}
+		suiteIndex := make(map[string]int)
+		var suiteTimes []time.Duration
+		var total time.Duration
+		for _, r := range results {
+			name := r.ListName
+			if name == "" {
+				name = "commands"
+			}
+			i, found := suiteIndex[name]
+			if !found {
+				i = len(suites.Suites)
+				suiteIndex[name] = i
+				suites.Suites = append(suites.Suites, junitTestSuite{Name: name})
+				suiteTimes = append(suiteTimes, 0)
+			}
+
+			testCase := junitTestCase{
+				Name:      r.CmdName,
+				ClassName: r.Host,
+				Time:      junitSeconds(r.Duration),
+				SystemOut: strings.Join(r.Output, "\n"),
+				SystemErr: strings.Join(r.Stderr, "\n"),
+			}
+			if r.Status == HostResultFailed {
+				testCase.Failure = &junitFailure{Message: fmt.Sprint(r.Error), Type: fmt.Sprintf("exit code %d", r.ExitCode)}
+				suites.Suites[i].Failures++
+				suites.Failures++
+			}
+			suites.Suites[i].Cases = append(suites.Suites[i].Cases, testCase)
+			suites.Suites[i].Tests++
+			suites.Tests++
+			suiteTimes[i] += r.Duration
+			total += r.Duration
+		}
+		suites.Time = junitSeconds(total)
+		for i := range suites.Suites {
+			suites.Suites[i].Time = junitSeconds(suiteTimes[i])
+		}
+
+		if _, err := io.WriteString(w, xml.Header); err != nil {
+			return err
+		}
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		if err := enc.Encode(suites); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "\n")
+		return err
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "LIST\tHOST\tCOMMAND\tSTATUS\tEXIT CODE\tDURATION")
+		failed := 0
+		for _, r := range results {
+			list := r.ListName
+			if list == "" {
+				list = "-"
+			}
+			if r.Status == HostResultFailed {
+				failed++
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", list, r.Host, r.CmdName, r.Status, r.ExitCode, r.Duration.Round(time.Millisecond))
+		}
+		fmt.Fprintf(tw, "\n%d commands, %d succeeded, %d failed\n", len(results), len(results)-failed, failed)
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format %s; valid formats are table, json or junit", format)
+	}
+}
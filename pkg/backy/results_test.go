@@ -0,0 +1,120 @@
+package backy
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestRunCmdRecordsResults(t *testing.T) {
+	opts := newTestOpts(t)
+	web1, _ := newTestHost(t, opts, "web-1")
+	web2, _ := newTestHost(t, opts, "web-2")
+
+	hello := &Command{Name: "hello", Cmd: "echo", Args: []string{"hello"}, Hosts: []string{web1.Host, web2.Host}}
+	fail := &Command{Name: "fail", Cmd: "exit", Args: []string{"4"}, Host: web1.Host, RemoteHost: web1}
+
+	if _, err := opts.runCmd("deploy", hello, zerolog.Nop()); err != nil {
+		t.Fatalf("runCmd(hello): %v", err)
+	}
+	if _, err := opts.runCmd("deploy", fail, zerolog.Nop()); err == nil {
+		t.Fatal("runCmd(fail) did not fail")
+	}
+
+	results := opts.CmdResults()
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3: %+v", len(results), results)
+	}
+	for i, want := range []CmdResult{
+		{ListName: "deploy", CmdName: "hello", Host: "web-1", Status: HostResultSucceeded, Output: []string{"hello"}},
+		{ListName: "deploy", CmdName: "hello", Host: "web-2", Status: HostResultSucceeded, Output: []string{"hello"}},
+		{ListName: "deploy", CmdName: "fail", Host: "web-1", Status: HostResultFailed, ExitCode: 4},
+	} {
+		got := results[i]
+		if got.ListName != want.ListName || got.CmdName != want.CmdName || got.Host != want.Host ||
+			got.Status != want.Status || got.ExitCode != want.ExitCode || strings.Join(got.Output, "\n") != strings.Join(want.Output, "\n") {
+			t.Errorf("result %d = %+v, want %+v", i, got, want)
+		}
+		if got.Duration <= 0 {
+			t.Errorf("result %d has no duration", i)
+		}
+	}
+}
+
+func TestWriteCmdResults(t *testing.T) {
+	results := []CmdResult{
+		{ListName: "backup", CmdName: "dump", Host: "db-1", Status: HostResultSucceeded, Duration: 1500 * time.Millisecond, Output: []string{"dumped"}},
+		{ListName: "backup", CmdName: "sync", Host: "db-1", Status: HostResultFailed, Duration: time.Second, ExitCode: 24, Error: errors.New("exited with status 24")},
+		{CmdName: "uptime", Host: "local", Status: HostResultSucceeded, Duration: 10 * time.Millisecond},
+	}
+
+	t.Run("json", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := WriteCmdResults(&out, results, "json"); err != nil {
+			t.Fatal(err)
+		}
+		var got []cmdResultJSON
+		if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+			t.Fatalf("invalid JSON %s: %v", out.String(), err)
+		}
+		want := cmdResultJSON{List: "backup", Command: "sync", Host: "db-1", Status: "failed", DurationSeconds: 1, ExitCode: 24, Error: "exited with status 24"}
+		if len(got) != 3 || got[1].List != want.List || got[1].Command != want.Command || got[1].Status != want.Status ||
+			got[1].DurationSeconds != want.DurationSeconds || got[1].ExitCode != want.ExitCode || got[1].Error != want.Error {
+			t.Errorf("results = %+v, want second result %+v", got, want)
+		}
+	})
+
+	t.Run("junit", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := WriteCmdResults(&out, results, "junit"); err != nil {
+			t.Fatal(err)
+		}
+		var got junitTestSuites
+		if err := xml.Unmarshal(out.Bytes(), &got); err != nil {
+			t.Fatalf("invalid XML %s: %v", out.String(), err)
+		}
+		if got.Tests != 3 || got.Failures != 1 || len(got.Suites) != 2 {
+			t.Fatalf("testsuites = %+v, want 3 tests, 1 failure and 2 suites", got)
+		}
+		backup := got.Suites[0]
+		if backup.Name != "backup" || backup.Tests != 2 || backup.Failures != 1 || backup.Time != "2.500" {
+			t.Errorf("suite = %+v, want backup with 2 tests, 1 failure in 2.500s", backup)
+		}
+		if f := backup.Cases[1].Failure; f == nil || f.Type != "exit code 24" || f.Message != "exited with status 24" {
+			t.Errorf("failure = %+v", f)
+		}
+		if backup.Cases[0].ClassName != "db-1" || backup.Cases[0].SystemOut != "dumped" {
+			t.Errorf("test case = %+v", backup.Cases[0])
+		}
+		if got.Suites[1].Name != "commands" {
+			t.Errorf("commands without a list are in suite %s, want commands", got.Suites[1].Name)
+		}
+	})
+
+	t.Run("table", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := WriteCmdResults(&out, results, "table"); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if fields := strings.Fields(lines[2]); strings.Join(fields, " ") != "backup db-1 sync failed 24 1s" {
+			t.Errorf("row = %q", lines[2])
+		}
+		if fields := strings.Fields(lines[3]); fields[0] != "-" {
+			t.Errorf("commands without a list have list %q, want -", fields[0])
+		}
+		if last := lines[len(lines)-1]; last != "3 commands, 2 succeeded, 1 failed" {
+			t.Errorf("totals = %q", last)
+		}
+	})
+
+	if err := WriteCmdResults(&bytes.Buffer{}, results, "yaml"); err == nil {
+		t.Error("unknown format did not return an error")
+	}
+}
@@ -0,0 +1,212 @@
+// rolling.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseBatchSize returns the number of hosts in a batch of a rolling list run on total hosts.
+// size is a count or a percentage of the hosts, rounded up. The default is one host.
+func parseBatchSize(size string, total int) (int, error) {
+	size = TS(size)
+	if size == "" {
+		return 1, nil
+	}
+
+	if percent, isPercent := strings.CutSuffix(size, "%"); isPercent {
+		p, err := strconv.ParseFloat(TS(percent), 64)
+		if err != nil || p <= 0 || p > 100 {
+			return 0, fmt.Errorf("invalid batchSize %q, percentages must be greater than 0%% and at most 100%%", size)
+		}
+		return max(1, int(math.Ceil(float64(total)*p/100))), nil
+	}
+
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid batchSize %q, must be a positive number or a percentage", size)
+	}
+	return n, nil
+}
+
+// rolloutHalted returns true if failed hosts out of total exceed the list's failure thresholds
+func (list *CmdList) rolloutHalted(failed, total int) bool {
+	if failed == 0 {
+		return false
+	}
+	if list.MaxFailures == 0 && list.MaxFailPercentage == 0 {
+		return true
+	}
+	if list.MaxFailures > 0 && failed > list.MaxFailures {
+		return true
+	}
+	return list.MaxFailPercentage > 0 && float64(failed)*100/float64(total) > list.MaxFailPercentage
+}
+
+// validateRollingList checks the rolling settings of list
+func validateRollingList(list *CmdList) error {
+	if list.Strategy != RollingListStrategy {
+		if list.BatchSize != "" || list.PauseBetweenBatches != 0 || list.MaxFailures != 0 || list.MaxFailPercentage != 0 {
+			return fmt.Errorf("list %s: batchSize, pauseBetweenBatches, maxFailures and maxFailPercentage require strategy: rolling", list.Name)
+		}
+		return nil
+	}
+	if _, err := parseBatchSize(list.BatchSize, 1); err != nil {
+		return fmt.Errorf("list %s: %w", list.Name, err)
+	}
+	if list.MaxFailures < 0 {
+		return fmt.Errorf("list %s: maxFailures must not be negative", list.Name)
+	}
+	if list.MaxFailPercentage < 0 || list.MaxFailPercentage > 100 {
+		return fmt.Errorf("list %s: maxFailPercentage must be between 0 and 100", list.Name)
+	}
+	return nil
+}
+
+// runListRolling runs list on hosts in batches. The hosts of a batch run the list in parallel, up to maxParallel at a time,
+// and the next batch starts once the whole batch has finished.
+// When the failures exceed the list's thresholds, the remaining hosts are skipped.
+func (opts *ConfigOpts) runListRolling(msgTemps *msgTemplates, list *CmdList, hosts []*Host) []HostResult {
+	var listHosts []*Host
+	for _, host := range hosts {
+		if list.runsOnHost(host, opts) {
+			listHosts = append(listHosts, host)
+		}
+	}
+
+	results := make([]HostResult, len(listHosts))
+	size, err := parseBatchSize(list.BatchSize, len(listHosts))
+	if err != nil {
+		// the batch size is validated when the config is loaded
+		size = 1
+	}
+	batches := (len(listHosts) + size - 1) / size
+
+	failed := 0
+	halted := false
+	for batch, start := 1, 0; start < len(listHosts); batch, start = batch+1, start+size {
+		end := min(start+size, len(listHosts))
+
+		if halted {
+			for i := start; i < end; i++ {
+				results[i] = HostResult{Host: listHosts[i].Host, List: list.Name, Status: HostResultSkipped}
+			}
+			continue
+		}
+
+		opts.Logger.Info().Str("list", list.Name).Msgf("Running batch %d of %d on %d hosts", batch, batches, end-start)
+
+		runParallel(end-start, opts.maxParallel(), func(i int) {
+			results[start+i] = opts.runListOnHost(msgTemps, list, listHosts[start+i])
+		})
+
+		for _, result := range results[start:end] {
+			if result.Status == HostResultFailed {
+				failed++
+			}
+		}
+
+		if list.rolloutHalted(failed, len(listHosts)) {
+			opts.Logger.Error().Str("list", list.Name).Msgf("Halting rollout: %d of %d hosts failed", failed, len(listHosts))
+			halted = true
+			continue
+		}
+
+		if end < len(listHosts) && list.PauseBetweenBatches > 0 {
+			opts.Logger.Info().Str("list", list.Name).Msgf("Pausing %s before the next batch", list.PauseBetweenBatches)
+			time.Sleep(list.PauseBetweenBatches)
+		}
+	}
+
+	opts.logHostResults(list, results)
+
+	return results
+}
+
+// runListOnHost runs the commands of list in order on host, and stops at the first failure
+func (opts *ConfigOpts) runListOnHost(msgTemps *msgTemplates, list *CmdList, host *Host) HostResult {
+	result := HostResult{Host: host.Host, List: list.Name, Status: HostResultSucceeded}
+	start := time.Now()
+
+	var cmdsRan []string
+	var outStructArr []outStruct
+	var commandExecuted *Command
+
+	for _, cmd := range list.Order {
+		// each host runs its own copy of the command
+		cmdToRun := *opts.Cmds[cmd]
+		cmdToRun.Host = host.Host
+		cmdToRun.RemoteHost = host
+		cmdToRun.Hosts = nil
+		commandExecuted = &cmdToRun
+
+		cmdLogger := cmdToRun.GenerateLogger(opts)
+		cmdLogger.Info().Str("list", list.Name).Str("cmd", cmdToRun.Name).Send()
+
+		outputArr, runErr := opts.runCmd(list.Name, &cmdToRun, cmdLogger)
+		cmdsRan = append(cmdsRan, cmd)
+
+		if runErr != nil {
+			cmdLogger.Err(runErr).Send()
+			cmdToRun.ExecuteHooks("error", opts)
+
+			if list.NotifyConfig != nil {
+				notifyError(cmdLogger, msgTemps, list, cmdsRan, outStructArr, opts.packageReportsForCmds(cmdsRan, host.Host), runErr, &cmdToRun)
+			}
+
+			result.Status = HostResultFailed
+			result.FailedCmd = cmd
+			result.Error = runErr
+			break
+		}
+
+		if list.GetCommandOutputInNotificationsOnSuccess || cmdToRun.Output.InList {
+			outStructArr = append(outStructArr, outStruct{
+				CmdName:     cmdToRun.Name,
+				CmdExecuted: cmdToRun.Name,
+				Output:      outputArr,
+				Stderr:      cmdToRun.stderr,
+				ExitCode:    cmdToRun.exitCode,
+			})
+		}
+	}
+
+	result.Duration = time.Since(start)
+
+	if commandExecuted == nil {
+		return result
+	}
+
+	if result.Status == HostResultSucceeded {
+		if list.NotifyConfig != nil && list.Notify.OnFailure {
+			notifySuccess(opts.Logger, msgTemps, list, cmdsRan, outStructArr, opts.packageReportsForCmds(cmdsRan, host.Host))
+		}
+		commandExecuted.ExecuteHooks("success", opts)
+	}
+	commandExecuted.ExecuteHooks("final", opts)
+
+	return result
+}
+
+// logHostResults logs the result of list on each host, followed by the totals
+func (opts *ConfigOpts) logHostResults(list *CmdList, results []HostResult) {
+	counts := make(map[HostResultStatus]int)
+	for _, r := range results {
+		counts[r.Status]++
+
+		event := opts.Logger.Info()
+		if r.Status == HostResultFailed {
+			event = opts.Logger.Error().Str("failedCmd", r.FailedCmd).AnErr("error", r.Error)
+		}
+		event.Str("list", r.List).Str("host", r.Host).Str("status", r.Status.String()).Dur("duration", r.Duration).Msg("Host summary")
+	}
+
+	opts.Logger.Info().Str("list", list.Name).Msgf("%d hosts succeeded, %d failed, %d skipped",
+		counts[HostResultSucceeded], counts[HostResultFailed], counts[HostResultSkipped])
+}
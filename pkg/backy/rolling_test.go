@@ -0,0 +1,157 @@
+package backy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"git.andrewnw.xyz/CyberShell/backy/pkg/sshtest"
+)
+
+func TestParseBatchSize(t *testing.T) {
+	tests := []struct {
+		size    string
+		total   int
+		want    int
+		wantErr bool
+	}{
+		{size: "", total: 10, want: 1},
+		{size: "3", total: 10, want: 3},
+		{size: "25%", total: 10, want: 3},
+		{size: "10%", total: 4, want: 1},
+		{size: "100%", total: 7, want: 7},
+		{size: " 50 % ", total: 5, want: 3},
+		{size: "0", wantErr: true},
+		{size: "-2", wantErr: true},
+		{size: "0%", wantErr: true},
+		{size: "150%", wantErr: true},
+		{size: "half", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseBatchSize(tt.size, tt.total)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseBatchSize(%q, %d) error = %v, wantErr %v", tt.size, tt.total, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseBatchSize(%q, %d) = %d, want %d", tt.size, tt.total, got, tt.want)
+		}
+	}
+}
+
+func TestRolloutHalted(t *testing.T) {
+	tests := []struct {
+		maxFailures       int
+		maxFailPercentage float64
+		failed, total     int
+		want              bool
+	}{
+		{failed: 0, total: 10, want: false},
+		{failed: 1, total: 10, want: true},
+		{maxFailures: 2, failed: 2, total: 10, want: false},
+		{maxFailures: 2, failed: 3, total: 10, want: true},
+		{maxFailPercentage: 25, failed: 2, total: 10, want: false},
+		{maxFailPercentage: 25, failed: 3, total: 10, want: true},
+		{maxFailures: 5, maxFailPercentage: 10, failed: 2, total: 10, want: true},
+	}
+
+	for _, tt := range tests {
+		list := &CmdList{MaxFailures: tt.maxFailures, MaxFailPercentage: tt.maxFailPercentage}
+		if got := list.rolloutHalted(tt.failed, tt.total); got != tt.want {
+			t.Errorf("rolloutHalted(%d, %d) with maxFailures %d, maxFailPercentage %v = %v, want %v",
+				tt.failed, tt.total, tt.maxFailures, tt.maxFailPercentage, got, tt.want)
+		}
+	}
+}
+
+func TestRunListRolling(t *testing.T) {
+	const (
+		ok      = HostResultSucceeded
+		failed  = HostResultFailed
+		skipped = HostResultSkipped
+	)
+
+	tests := []struct {
+		name        string
+		list        CmdList
+		failOnHosts []int
+		want        []HostResultStatus
+	}{
+		{
+			name:        "first failure halts",
+			list:        CmdList{BatchSize: "2"},
+			failOnHosts: []int{2},
+			want:        []HostResultStatus{ok, ok, failed, ok, skipped},
+		},
+		{
+			name:        "maxFailures",
+			list:        CmdList{BatchSize: "2", MaxFailures: 1},
+			failOnHosts: []int{0, 2},
+			want:        []HostResultStatus{failed, ok, failed, ok, skipped},
+		},
+		{
+			name:        "maxFailPercentage",
+			list:        CmdList{BatchSize: "40%", MaxFailPercentage: 20},
+			failOnHosts: []int{0},
+			want:        []HostResultStatus{failed, ok, ok, ok, ok},
+		},
+		{
+			name: "one host at a time with pause",
+			list: CmdList{PauseBetweenBatches: time.Millisecond},
+			want: []HostResultStatus{ok, ok, ok, ok, ok},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := newTestOpts(t)
+			opts.Cmds = map[string]*Command{
+				"check": {Name: "check", Cmd: "test", Args: []string{"!", "-f", "fail"}},
+			}
+
+			var hosts []*Host
+			var servers []*sshtest.Server
+			for i := range tt.want {
+				host, server := newTestHost(t, opts, fmt.Sprintf("web-%d", i))
+				hosts = append(hosts, host)
+				servers = append(servers, server)
+			}
+			for _, i := range tt.failOnHosts {
+				if err := os.WriteFile(filepath.Join(servers[i].Dir, "fail"), nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			list := tt.list
+			list.Name = "deploy"
+			list.Order = []string{"check"}
+			list.Strategy = RollingListStrategy
+			if err := validateRollingList(&list); err != nil {
+				t.Fatal(err)
+			}
+
+			results := opts.runListRolling(nil, &list, hosts)
+
+			var got []HostResultStatus
+			for i, r := range results {
+				got = append(got, r.Status)
+				if r.Host != hosts[i].Host {
+					t.Errorf("result %d is for host %s, want %s", i, r.Host, hosts[i].Host)
+				}
+				if r.Status == failed && (r.FailedCmd != "check" || r.Error == nil) {
+					t.Errorf("failed result %+v has no command or error", r)
+				}
+				if ran := servers[i].Connections() > 0; ran != (r.Status != skipped) {
+					t.Errorf("host %s has status %s, but connected = %v", r.Host, r.Status, ran)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("statuses = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -7,10 +7,13 @@ package backy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/user"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -21,14 +24,13 @@ import (
 	"github.com/pkg/sftp"
 	"github.com/rs/zerolog"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 var PrivateKeyExtraInfoErr = errors.New("Private key may be encrypted. \nIf encrypted, make sure the password is specified correctly in the correct section. This may be done in one of two ways: \n Using external directives - see docs \n privatekeypassword: password (not recommended). \n ")
 var TS = strings.TrimSpace
 
 type RemoteHostCommandExecutor interface {
-	RunCmdOnHost(command *Command, commandSession *ssh.Session, cmdCtxLogger zerolog.Logger, cmdOutBuf bytes.Buffer) ([]string, error)
+	RunCmdOnHost(command *Command, commandSession *ssh.Session, cmdCtxLogger zerolog.Logger, cmdOutBuf *bytes.Buffer) ([]string, error)
 }
 
 // ConnectToHost connects to a host by looking up the config values in the file ~/.ssh/config
@@ -36,18 +38,91 @@ type RemoteHostCommandExecutor interface {
 // remoteHost is modified directly. The *ssh.Client is returned as part of remoteHost,
 // If configFile is empty, any required configuration is looked up in the default config files
 // If any value is not found, defaults are used
+// Lists running at the same time share hosts, so connecting to a host is serialized.
 func (remoteHost *Host) ConnectToHost(opts *ConfigOpts) error {
+	remoteHost.connectMu.Lock()
+	defer remoteHost.connectMu.Unlock()
+	return remoteHost.connect(opts)
+}
 
-	var connectErr error
+// ensureConnected connects to the host if it is not connected yet
+func (remoteHost *Host) ensureConnected(opts *ConfigOpts) error {
+	remoteHost.connectMu.Lock()
+	defer remoteHost.connectMu.Unlock()
+	if remoteHost.SshClient != nil {
+		return nil
+	}
+	return remoteHost.connect(opts)
+}
 
-	if TS(remoteHost.ConfigFilePath) == "" {
-		remoteHost.useDefaultConfig = true
+// connect connects to the host, reusing the pooled connection if there is one.
+// connectMu must be held.
+func (remoteHost *Host) connect(opts *ConfigOpts) error {
+	if err := remoteHost.resolveConnectionConfig(opts); err != nil {
+		return err
+	}
+
+	pool := opts.connectionPool()
+	poolKey := remoteHost.poolKey()
+	unlock := pool.lockKey(poolKey)
+	defer unlock()
+
+	if client := pool.get(poolKey); client != nil {
+		opts.Logger.Debug().Msgf("Reusing connection to host %s", remoteHost.HostName)
+		remoteHost.setClient(client)
+		opts.setHost(remoteHost)
+		return nil
+	}
+
+	client, connectErr := remoteHost.ConnectThroughBastion(opts)
+	if connectErr != nil {
+		return connectErr
+	}
+	if client != nil {
+		remoteHost.setClient(pool.put(poolKey, client, remoteHost.proxyPoolKeys()...))
+		opts.setHost(remoteHost)
+		return nil
+	}
+
+	opts.Logger.Info().Msgf("Connecting to host %s", remoteHost.HostName)
+	client, connectErr = remoteHost.connectVia(nil)
+	if connectErr != nil {
+		return connectErr
+	}
+	startServerAliveChecks(client, remoteHost.serverAliveInterval, remoteHost.serverAliveCountMax, opts.Logger)
+	remoteHost.setClient(pool.put(poolKey, client))
+
+	opts.setHost(remoteHost)
+	return nil
+}
+
+// setClient sets the host's client if it changed.
+// Sessions are opened on SshClient without holding connectMu, so it is only written when the connection is new.
+func (remoteHost *Host) setClient(client *ssh.Client) {
+	if remoteHost.SshClient != client {
+		remoteHost.SshClient = client
 	}
+}
 
-	khPathErr := remoteHost.GetKnownHosts()
+// setHost adds host to opts.Hosts if it is not there yet
+func (opts *ConfigOpts) setHost(host *Host) {
+	opts.hostsMu.Lock()
+	defer opts.hostsMu.Unlock()
 
-	if khPathErr != nil {
-		return khPathErr
+	if opts.Hosts == nil {
+		opts.Hosts = make(map[string]*Host)
+	}
+	if opts.Hosts[host.Host] != host {
+		opts.Hosts[host.Host] = host
+	}
+}
+
+// resolveConnectionConfig looks up the host's connection settings in the backy and ssh config files,
+// and sets up the ClientConfig, including the ProxyJump hosts
+func (remoteHost *Host) resolveConnectionConfig(opts *ConfigOpts) error {
+
+	if TS(remoteHost.ConfigFilePath) == "" {
+		remoteHost.useDefaultConfig = true
 	}
 
 	if remoteHost.ClientConfig == nil {
@@ -75,10 +150,11 @@ func (remoteHost *Host) ConnectToHost(opts *ConfigOpts) error {
 			return sshConfigFileOpenErr
 		}
 	}
+	defer configFile.Close()
 	remoteHost.SSHConfigFile = &sshConfigFile{}
 	remoteHost.SSHConfigFile.DefaultUserSettings = ssh_config.DefaultUserSettings
 	var decodeErr error
-	remoteHost.SSHConfigFile.SshConfigFile, decodeErr = ssh_config.Decode(configFile)
+	remoteHost.SSHConfigFile.SshConfigFile, decodeErr = decodeSSHConfig(configFile, opts.Logger)
 	if decodeErr != nil {
 		return decodeErr
 	}
@@ -89,13 +165,14 @@ func (remoteHost *Host) ConnectToHost(opts *ConfigOpts) error {
 		return err
 	}
 
-	if remoteHost.ProxyHost != nil {
-		for _, proxyHost := range remoteHost.ProxyHost {
-			err := proxyHost.GetProxyJumpConfig(opts.Hosts, opts)
-			opts.Logger.Info().Msgf("Proxy host: %s", proxyHost.Host)
-			if err != nil {
-				return err
-			}
+	for i, proxyHost := range remoteHost.ProxyHost {
+		opts.Logger.Debug().Msgf("Proxy host %d of %d for host %s: %s", i+1, len(remoteHost.ProxyHost), remoteHost.Host, proxyHost.Host)
+		// proxy hosts are shared by the hosts that go through them
+		proxyHost.connectMu.Lock()
+		err := proxyHost.GetProxyJumpConfig(opts.Hosts, opts)
+		proxyHost.connectMu.Unlock()
+		if err != nil {
+			return errors.Wrapf(err, "proxy host %s (hop %d of %d) of host %s", proxyHost.Host, i+1, len(remoteHost.ProxyHost), remoteHost.Host)
 		}
 	}
 
@@ -115,33 +192,27 @@ func (remoteHost *Host) ConnectToHost(opts *ConfigOpts) error {
 		return errors.Errorf("No hostname found or specified for host %s", remoteHost.Host)
 	}
 
-	err = remoteHost.GetAuthMethods(opts)
+	err = remoteHost.GetSSHConfigDirectives()
 	if err != nil {
 		return err
 	}
 
-	hostKeyCallback, err := knownhosts.New(remoteHost.KnownHostsFile)
+	err = remoteHost.GetKnownHosts()
 	if err != nil {
-		return errors.Wrap(err, "could not create hostkeycallback function")
+		return err
 	}
-	remoteHost.ClientConfig.HostKeyCallback = hostKeyCallback
 
-	remoteHost.SshClient, connectErr = remoteHost.ConnectThroughBastion(opts.Logger)
-	if connectErr != nil {
-		return connectErr
-	}
-	if remoteHost.SshClient != nil {
-		opts.Hosts[remoteHost.Host] = remoteHost
-		return nil
+	err = remoteHost.GetAuthMethods(opts)
+	if err != nil {
+		return err
 	}
 
-	opts.Logger.Info().Msgf("Connecting to host %s", remoteHost.HostName)
-	remoteHost.SshClient, connectErr = ssh.Dial("tcp", remoteHost.HostName, remoteHost.ClientConfig)
-	if connectErr != nil {
-		return connectErr
+	hostKeyCallback, err := remoteHost.hostKeyCallback(opts.Logger)
+	if err != nil {
+		return err
 	}
+	remoteHost.ClientConfig.HostKeyCallback = hostKeyCallback
 
-	opts.Hosts[remoteHost.Host] = remoteHost
 	return nil
 }
 
@@ -168,6 +239,8 @@ func (remoteHost *Host) GetSshUserFromConfig() {
 
 func (remoteHost *Host) GetAuthMethods(opts *ConfigOpts) error {
 	var signer ssh.Signer
+	var signers []ssh.Signer
+	var authMethods []ssh.AuthMethod
 	var err error
 	var privateKey []byte
 
@@ -177,48 +250,90 @@ func (remoteHost *Host) GetAuthMethods(opts *ConfigOpts) error {
 
 	remoteHost.PrivateKeyPath = strings.TrimSpace(remoteHost.PrivateKeyPath)
 
+	remoteHost.GetAgentSettingsFromConfig()
+
+	agentClient, agentErr := remoteHost.getAgent()
+	if agentErr != nil {
+		opts.Logger.Warn().Err(agentErr).Str("Host", remoteHost.Host).Send()
+	}
+
 	if remoteHost.PrivateKeyPath != "" {
 
 		privateKey, err = os.ReadFile(remoteHost.PrivateKeyPath)
 
-		if err != nil {
+		// the agent may hold the key instead
+		if os.IsNotExist(err) && agentClient != nil {
+			opts.Logger.Debug().Str("Host", remoteHost.Host).Msgf("private key %s not found, using ssh-agent", remoteHost.PrivateKeyPath)
+		} else if err != nil {
 			return err
-		}
+		} else {
 
-		remoteHost.PrivateKeyPassword = GetPrivateKeyPassword(remoteHost.PrivateKeyPassword, opts)
+			remoteHost.PrivateKeyPassword = GetPrivateKeyPassword(remoteHost.PrivateKeyPassword, opts)
+			opts.addSecret(remoteHost.PrivateKeyPassword)
 
-		if remoteHost.PrivateKeyPassword == "" {
+			if remoteHost.PrivateKeyPassword == "" {
 
-			signer, err = ssh.ParsePrivateKey(privateKey)
+				signer, err = ssh.ParsePrivateKey(privateKey)
 
-			if err != nil {
-				return errors.Errorf("Failed to open private key file %s: %v \n\n %v", remoteHost.PrivateKeyPath, err, PrivateKeyExtraInfoErr)
-			}
+				if err != nil {
+					return errors.Errorf("Failed to open private key file %s: %v \n\n %v", remoteHost.PrivateKeyPath, err, PrivateKeyExtraInfoErr)
+				}
+			} else {
 
-			remoteHost.ClientConfig.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
-		} else {
+				signer, err = ssh.ParsePrivateKeyWithPassphrase(privateKey, []byte(remoteHost.PrivateKeyPassword))
 
-			signer, err = ssh.ParsePrivateKeyWithPassphrase(privateKey, []byte(remoteHost.PrivateKeyPassword))
+				if err != nil {
+					return errors.Errorf("Failed to open private key file %s: %v \n\n %v", remoteHost.PrivateKeyPath, err, PrivateKeyExtraInfoErr)
+				}
+			}
 
+			certSigner, err := remoteHost.getCertSigner(signer)
 			if err != nil {
-				return errors.Errorf("Failed to open private key file %s: %v \n\n %v", remoteHost.PrivateKeyPath, err, PrivateKeyExtraInfoErr)
+				return err
 			}
 
-			remoteHost.ClientConfig.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+			// offer the certificate before the plain key
+			if certSigner != signer {
+				signers = append(signers, certSigner)
+			}
+			signers = append(signers, signer)
 		}
 	}
 
+	// with IdentitiesOnly, only agent keys matching the identity file are offered
+	var identityKeys []ssh.PublicKey
+	if remoteHost.identitiesOnly {
+		identityKeys = remoteHost.identityPublicKeys(signer)
+	}
+
+	// all public keys have to be in one auth method, as the client only tries each method once
+	if agentClient != nil {
+		authMethods = append(authMethods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			agentSigners, err := agentClient.Signers()
+			if err != nil {
+				return signers, nil
+			}
+			if remoteHost.identitiesOnly {
+				agentSigners = filterSignersByKeys(agentSigners, identityKeys)
+			}
+			return slices.Concat(signers, agentSigners), nil
+		}))
+	} else if len(signers) > 0 {
+		authMethods = append(authMethods, ssh.PublicKeys(signers...))
+	}
+
 	if remoteHost.Password != "" {
 
-		opts.Logger.Debug().Str("password", remoteHost.Password).Str("Host", remoteHost.Host).Send()
+		opts.Logger.Debug().Str("Host", remoteHost.Host).Msg("using password authentication")
 
 		remoteHost.Password = GetPassword(remoteHost.Password, opts)
+		opts.addSecret(remoteHost.Password)
 
-		// opts.Logger.Debug().Str("actual password", remoteHost.Password).Str("Host", remoteHost.Host).Send()
-
-		remoteHost.ClientConfig.Auth = append(remoteHost.ClientConfig.Auth, ssh.Password(remoteHost.Password))
+		authMethods = append(authMethods, ssh.Password(remoteHost.Password))
 	}
 
+	remoteHost.ClientConfig.Auth = authMethods
+
 	return nil
 }
 
@@ -290,46 +405,133 @@ func (remoteHost *Host) GetHostName() {
 	}
 }
 
-func (remoteHost *Host) ConnectThroughBastion(log zerolog.Logger) (*ssh.Client, error) {
-	if remoteHost.ProxyHost == nil {
+// ConnectThroughBastion connects to the host through its ProxyJump hosts, one hop at a time.
+// Each hop is connected to through the hop before it, with its own user, keys, known_hosts and port.
+// The connection to each hop is pooled, so hosts behind the same jump hosts share them.
+// nil is returned if the host has no ProxyJump hosts.
+func (remoteHost *Host) ConnectThroughBastion(opts *ConfigOpts) (*ssh.Client, error) {
+	if len(remoteHost.ProxyHost) == 0 {
 		return nil, nil
 	}
+	log := opts.Logger
+	hops := len(remoteHost.ProxyHost)
+
+	var via *ssh.Client
+	var viaKey string
+	for i, proxyHost := range remoteHost.ProxyHost {
+		hopKey := chainPoolKey(remoteHost.ProxyHost[:i+1])
 
-	log.Info().Msgf("Connecting to proxy host %s", remoteHost.ProxyHost[0].HostName)
+		client, err := proxyHost.connectHop(opts, via, hopKey, viaKey, i+1, hops)
+		if err != nil {
+			return nil, err
+		}
 
-	// connect to the bastion host
-	bClient, err := ssh.Dial("tcp", remoteHost.ProxyHost[0].HostName, remoteHost.ProxyHost[0].ClientConfig)
+		via = client
+		viaKey = hopKey
+	}
+
+	log.Info().Msgf("Connecting to host %s", remoteHost.HostName)
+	sClient, err := remoteHost.connectVia(via)
 	if err != nil {
-		return nil, err
+		last := remoteHost.ProxyHost[hops-1]
+		return nil, errors.Wrapf(err, "could not connect to host %s through proxy host %s", remoteHost.Host, last.Host)
+	}
+	startServerAliveChecks(sClient, remoteHost.serverAliveInterval, remoteHost.serverAliveCountMax, log)
+
+	return sClient, nil
+}
+
+// connectHop returns the pooled connection to the proxy host at hopKey, connecting through via if there is none.
+// Other hosts can go through the same proxy host at the same time, so it is connected to while holding its locks.
+func (proxyHost *Host) connectHop(opts *ConfigOpts, via *ssh.Client, hopKey, viaKey string, hop, hops int) (*ssh.Client, error) {
+	proxyHost.connectMu.Lock()
+	defer proxyHost.connectMu.Unlock()
+
+	pool := opts.connectionPool()
+	unlock := pool.lockKey(hopKey)
+	defer unlock()
+
+	// reuse the connection to the hop if other hosts already go through it
+	client := pool.get(hopKey)
+	if client == nil {
+		opts.Logger.Info().Msgf("Connecting to proxy host %s (hop %d of %d)", proxyHost.HostName, hop, hops)
+
+		var err error
+		client, err = proxyHost.connectVia(via)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not connect to proxy host %s (%s, hop %d of %d)", proxyHost.Host, proxyHost.HostName, hop, hops)
+		}
+		startServerAliveChecks(client, proxyHost.serverAliveInterval, proxyHost.serverAliveCountMax, opts.Logger)
+		if viaKey == "" {
+			client = pool.put(hopKey, client)
+		} else {
+			client = pool.put(hopKey, client, viaKey)
+		}
 	}
-	remoteHost.ProxyHost[0].SshClient = bClient
+	proxyHost.setClient(client)
+
+	return client, nil
+}
 
-	// Dial a connection to the service host, from the bastion
-	conn, err := bClient.Dial("tcp", remoteHost.HostName)
+// connectVia connects to the host through via, or directly if via is nil
+func (remoteHost *Host) connectVia(via *ssh.Client) (*ssh.Client, error) {
+	if via == nil {
+		if remoteHost.proxyCommand != "" {
+			return remoteHost.connectThroughProxyCommand()
+		}
+		return ssh.Dial("tcp", remoteHost.HostName, remoteHost.ClientConfig)
+	}
+
+	conn, err := dialVia(via, remoteHost.HostName, remoteHost.ClientConfig.Timeout)
 	if err != nil {
 		return nil, err
 	}
-	log.Info().Msgf("Connecting to host %s", remoteHost.HostName)
-	ncc, chans, reqs, err := ssh.NewClientConn(conn, remoteHost.HostName, remoteHost.ClientConfig)
+	return newClientConn(conn, remoteHost.HostName, remoteHost.ClientConfig)
+}
+
+// dialVia opens a connection to addr through via, giving up after timeout if it is not zero
+func dialVia(via *ssh.Client, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return via.DialContext(ctx, "tcp", addr)
+}
+
+// newClientConn runs the SSH handshake on conn.
+// Connections through jump hosts and ProxyCommands don't support deadlines,
+// so conn is closed if the handshake takes longer than the config's Timeout.
+func newClientConn(conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var timer *time.Timer
+	if config.Timeout > 0 {
+		timer = time.AfterFunc(config.Timeout, func() { conn.Close() })
+	}
+
+	ncc, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	// the timer closed conn if it could not be stopped
+	timedOut := timer != nil && !timer.Stop()
+	if err == nil && timedOut {
+		ncc.Close()
+	}
+	if timedOut {
+		return nil, errors.Errorf("ssh handshake with %s timed out after %s", addr, config.Timeout)
+	}
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	sClient := ssh.NewClient(ncc, chans, reqs)
-
-	return sClient, nil
+	return ssh.NewClient(ncc, chans, reqs), nil
 }
 
-// GetKnownHosts resolves the host's KnownHosts file if it is defined
-// if not defined, the default location for this file is used
-func (remoteHost *Host) GetKnownHosts() error {
-	var knownHostsFileErr error
-	if TS(remoteHost.KnownHostsFile) != "" {
-		remoteHost.KnownHostsFile, knownHostsFileErr = getFullPathWithHomeDir(remoteHost.KnownHostsFile)
-		return knownHostsFileErr
+// proxyPoolKeys returns the pool key of the last proxy connection the host goes through
+func (remoteHost *Host) proxyPoolKeys() []string {
+	if len(remoteHost.ProxyHost) == 0 {
+		return nil
 	}
-	remoteHost.KnownHostsFile, knownHostsFileErr = getFullPathWithHomeDir("~/.ssh/known_hosts")
-	return knownHostsFileErr
+	return []string{chainPoolKey(remoteHost.ProxyHost)}
 }
 
 func GetPrivateKeyPassword(key string, opts *ConfigOpts) string {
@@ -341,30 +543,71 @@ func GetPassword(pass string, opts *ConfigOpts) string {
 	return getExternalConfigDirectiveValue(pass, opts, AllowedExternalDirectiveAll)
 }
 
+// GetProxyJumpFromConfig sets the ProxyJump hosts of the host.
+// ProxyJump is looked up in the ssh config file if it is not set in the backy config.
+// It is a comma-separated list of hosts, connected to in order.
 func (remoteHost *Host) GetProxyJumpFromConfig(hosts map[string]*Host) error {
 
-	proxyJump, _ := remoteHost.SSHConfigFile.SshConfigFile.Get(remoteHost.Host, "ProxyJump")
-	if proxyJump == "" {
-		proxyJump = remoteHost.SSHConfigFile.DefaultUserSettings.Get(remoteHost.Host, "ProxyJump")
+	if remoteHost.ProxyHost != nil {
+		return nil
 	}
-	if remoteHost.ProxyJump == "" && proxyJump != "" {
-		remoteHost.ProxyJump = proxyJump
+
+	if TS(remoteHost.ProxyJump) == "" {
+		remoteHost.ProxyJump = remoteHost.getSSHConfigValue("ProxyJump")
 	}
-	proxyJumpHosts := strings.Split(remoteHost.ProxyJump, ",")
-	if remoteHost.ProxyHost == nil && len(proxyJumpHosts) == 1 {
-		remoteHost.ProxyJump = proxyJump
-		proxyHost, proxyHostFound := hosts[proxyJump]
-		if proxyHostFound {
-			remoteHost.ProxyHost = append(remoteHost.ProxyHost, proxyHost)
-		} else {
-			if proxyJump != "" {
-				newProxy := &Host{Host: proxyJump}
-				remoteHost.ProxyHost = append(remoteHost.ProxyHost, newProxy)
+
+	proxyHosts, err := parseProxyJump(remoteHost.ProxyJump, hosts)
+	if err != nil {
+		return errors.Wrapf(err, "host %s", remoteHost.Host)
+	}
+	remoteHost.ProxyHost = proxyHosts
+
+	return nil
+}
+
+// parseProxyJump returns the hosts of a ProxyJump list.
+// Each entry is the name of a host in hosts or a [user@]host[:port] spec,
+// which is added to hosts so its settings are looked up in the ssh config file.
+// "none" disables ProxyJump, as in ssh.
+func parseProxyJump(proxyJump string, hosts map[string]*Host) ([]*Host, error) {
+	proxyJump = TS(proxyJump)
+	if proxyJump == "" || strings.EqualFold(proxyJump, "none") {
+		return nil, nil
+	}
+
+	var proxyHosts []*Host
+	for _, spec := range strings.Split(proxyJump, ",") {
+		spec = TS(spec)
+		if spec == "" {
+			return nil, errors.Errorf("empty host in ProxyJump %q", proxyJump)
+		}
+
+		if proxyHost, found := hosts[spec]; found {
+			proxyHosts = append(proxyHosts, proxyHost)
+			continue
+		}
+
+		proxyHost := &Host{Host: spec}
+		if user, host, found := strings.Cut(spec, "@"); found {
+			proxyHost.User = user
+			proxyHost.Host = host
+		}
+		if host, port, err := net.SplitHostPort(proxyHost.Host); err == nil {
+			portNum, err := strconv.ParseUint(port, 10, 16)
+			if err != nil {
+				return nil, errors.Errorf("invalid port %q in ProxyJump host %s", port, spec)
 			}
+			proxyHost.Host = host
+			proxyHost.Port = uint16(portNum)
 		}
+
+		if hosts != nil {
+			hosts[spec] = proxyHost
+		}
+		proxyHosts = append(proxyHosts, proxyHost)
 	}
 
-	return nil
+	return proxyHosts, nil
 }
 
 func (remoteHost *Host) GetProxyJumpConfig(hosts map[string]*Host, opts *ConfigOpts) error {
@@ -373,18 +616,17 @@ func (remoteHost *Host) GetProxyJumpConfig(hosts map[string]*Host, opts *ConfigO
 		remoteHost.useDefaultConfig = true
 	}
 
-	khPathErr := remoteHost.GetKnownHosts()
-
-	if khPathErr != nil {
-		return khPathErr
-	}
 	if remoteHost.ClientConfig == nil {
 		remoteHost.ClientConfig = &ssh.ClientConfig{}
 	}
 	var configFile *os.File
 	var sshConfigFileOpenErr error
 	if !remoteHost.useDefaultConfig {
-
+		var err error
+		remoteHost.ConfigFilePath, err = getFullPathWithHomeDir(remoteHost.ConfigFilePath)
+		if err != nil {
+			return err
+		}
 		configFile, sshConfigFileOpenErr = os.Open(remoteHost.ConfigFilePath)
 		if sshConfigFileOpenErr != nil {
 			return sshConfigFileOpenErr
@@ -396,10 +638,11 @@ func (remoteHost *Host) GetProxyJumpConfig(hosts map[string]*Host, opts *ConfigO
 			return sshConfigFileOpenErr
 		}
 	}
+	defer configFile.Close()
 	remoteHost.SSHConfigFile = &sshConfigFile{}
 	remoteHost.SSHConfigFile.DefaultUserSettings = ssh_config.DefaultUserSettings
 	var decodeErr error
-	remoteHost.SSHConfigFile.SshConfigFile, decodeErr = ssh_config.Decode(configFile)
+	remoteHost.SSHConfigFile.SshConfigFile, decodeErr = decodeSSHConfig(configFile, opts.Logger)
 	if decodeErr != nil {
 		return decodeErr
 	}
@@ -412,33 +655,66 @@ func (remoteHost *Host) GetProxyJumpConfig(hosts map[string]*Host, opts *ConfigO
 	if remoteHost.HostName == "" {
 		return errors.Errorf("No hostname found or specified for host %s", remoteHost.Host)
 	}
-	err := remoteHost.GetAuthMethods(opts)
+	remoteHost.ClientConfig.Timeout = time.Second * 30
+	err := remoteHost.GetSSHConfigDirectives()
+	if err != nil {
+		return err
+	}
+	err = remoteHost.GetKnownHosts()
+	if err != nil {
+		return err
+	}
+	err = remoteHost.GetAuthMethods(opts)
 	if err != nil {
 		return err
 	}
 
-	// TODO: Add value/option to config for host key and add bool to check for host key
-	hostKeyCallback, err := knownhosts.New(remoteHost.KnownHostsFile)
+	hostKeyCallback, err := remoteHost.hostKeyCallback(opts.Logger)
 	if err != nil {
-		return fmt.Errorf("could not create hostkeycallback function: %v", err)
+		return err
 	}
 	remoteHost.ClientConfig.HostKeyCallback = hostKeyCallback
-	hosts[remoteHost.Host] = remoteHost
+	opts.setHost(remoteHost)
 
 	return nil
 }
 
+// RunCmdOnHost runs command on its RemoteHost.
+// Returns the stdout as a slice and an error, if any.
+// Exit codes in SuccessExitCodes do not return an error.
+// Commands with Template set are rendered for the host before they run.
 func (command *Command) RunCmdOnHost(cmdCtxLogger zerolog.Logger, opts *ConfigOpts) ([]string, error) {
+	command.stderr = nil
+	// the run has its own leases, so they are not shared with other runs of the command
+	run := *command
+	run.leases = &vaultLeases{}
+	defer run.leases.revoke(opts, cmdCtxLogger)
+	toRun, err := run.renderTemplates(opts)
+	if err != nil {
+		cmdCtxLogger.Err(err).Send()
+		return nil, command.checkExitCode(err, cmdCtxLogger)
+	}
+	outputArr, err := toRun.runOnHost(cmdCtxLogger, opts)
+	command.stderr = toRun.stderr
+	return outputArr, command.checkExitCode(err, cmdCtxLogger)
+}
+
+func (command *Command) runOnHost(cmdCtxLogger zerolog.Logger, opts *ConfigOpts) ([]string, error) {
 	var (
 		ArgsStr       string
 		cmdOutBuf     bytes.Buffer
 		cmdOutWriters io.Writer
 
 		envVars = environmentVars{
-			file: command.Env,
-			env:  command.Environment,
+			file:   command.Env,
+			env:    command.Environment,
+			vars:   command.hookEnv,
+			leases: command.leases,
 		}
 	)
+	if command.Type == PipelineCommandType {
+		return opts.runPipeline(command, cmdCtxLogger)
+	}
 	command = getCommandTypeAndSetCommandInfo(command)
 
 	// Prepare command arguments
@@ -458,26 +734,39 @@ func (command *Command) RunCmdOnHost(cmdCtxLogger zerolog.Logger, opts *ConfigOp
 		cmdCtxLogger.Err(fmt.Errorf("remote host is not defined for command %s", command.Name)).Send()
 		return nil, fmt.Errorf("remote host is not defined for command %s", command.Name)
 	}
-	if command.RemoteHost.SshClient == nil {
-		if err := command.RemoteHost.ConnectToHost(opts); err != nil {
-			return nil, fmt.Errorf("failed to connect to host: %w", err)
-		}
+	if err := command.RemoteHost.ensureConnected(opts); err != nil {
+		return nil, fmt.Errorf("failed to connect to host: %w", err)
+	}
+
+	if err := command.RemoteHost.openForwards(cmdCtxLogger, opts); err != nil {
+		return nil, err
+	}
+	closeForwards, err := command.openForwards(cmdCtxLogger, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer closeForwards()
+
+	if command.Type == UserCommandType && command.UserOperation == "ensure" {
+		return command.ensureUser(cmdCtxLogger, opts)
 	}
 
 	// Create new SSH session
-	commandSession, err := command.RemoteHost.createSSHSession(opts)
+	commandSession, releaseSession, err := command.RemoteHost.createSSHSession(opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create SSH session: %w", err)
 	}
+	defer releaseSession()
 	defer commandSession.Close()
 
 	// Set output writers
-	cmdOutWriters = io.MultiWriter(&cmdOutBuf)
-	if IsCmdStdOutEnabled() {
-		cmdOutWriters = io.MultiWriter(os.Stdout, &cmdOutBuf)
-	}
+	var closeStdOut func()
+	cmdOutWriters, closeStdOut = opts.cmdOutputWriter(command, &cmdOutBuf)
+	defer closeStdOut()
+	errWriters, closeStdErr := opts.stderrWriter(command, cmdCtxLogger)
+	defer closeStdErr()
 	commandSession.Stdout = cmdOutWriters
-	commandSession.Stderr = cmdOutWriters
+	commandSession.Stderr = errWriters
 
 	command.ArgStr = fmt.Sprintf("%s %s", command.Cmd, ArgsStr)
 	//! environment vars and SSH:
@@ -498,8 +787,8 @@ func (command *Command) RunCmdOnHost(cmdCtxLogger zerolog.Logger, opts *ConfigOp
 	case ScriptFileCommandType:
 		return command.runScriptFile(commandSession, cmdCtxLogger, &cmdOutBuf)
 	case PackageCommandType:
-		var remoteHostPackageExecutor RemoteHostPackageExecutor
-		return remoteHostPackageExecutor.RunCmdOnHost(command, commandSession, cmdCtxLogger, cmdOutBuf)
+		remoteHostPackageExecutor := RemoteHostPackageExecutor{opts: opts}
+		return remoteHostPackageExecutor.RunCmdOnHost(command, commandSession, cmdCtxLogger, &cmdOutBuf)
 	default:
 		if command.Shell != "" {
 			command.ArgStr = fmt.Sprintf("%s -c '%s'", command.Shell, command.ArgStr)
@@ -515,7 +804,11 @@ func (command *Command) RunCmdOnHost(cmdCtxLogger zerolog.Logger, opts *ConfigOp
 		if command.Type == UserCommandType && command.UserOperation == "password" {
 			// cmdCtxLogger.Debug().Msgf("adding stdin")
 
-			userNamePass := fmt.Sprintf("%s:%s", command.Username, command.UserPassword)
+			userNamePass, err := io.ReadAll(command.stdin)
+			if err != nil {
+				return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), fmt.Errorf("error reading password input: %v", err)
+			}
+			_, _ = command.stdin.Seek(0, io.SeekStart)
 			client, err := sftp.NewClient(command.RemoteHost.SshClient)
 			if err != nil {
 				return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), fmt.Errorf("error creating sftp client: %v", err)
@@ -527,12 +820,12 @@ func (command *Command) RunCmdOnHost(cmdCtxLogger zerolog.Logger, opts *ConfigOp
 				return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), fmt.Errorf("error creating file /tmp/%s: %v", uuidFile.String(), passFileErr)
 			}
 
-			_, err = passFile.Write([]byte(userNamePass))
+			_, err = passFile.Write(userNamePass)
 			if err != nil {
 				return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), fmt.Errorf("error writing to file /tmp/%s: %v", uuidFile.String(), err)
 			}
 
-			ArgsStr = fmt.Sprintf("cat %s | chpasswd", passFilePath)
+			ArgsStr = fmt.Sprintf("cat %s | %s", passFilePath, command.ArgStr)
 			command.ArgStr = ArgsStr
 			defer passFile.Close()
 
@@ -542,68 +835,18 @@ func (command *Command) RunCmdOnHost(cmdCtxLogger zerolog.Logger, opts *ConfigOp
 
 			defer rmFileFunc()
 		}
+		if command.Stdin != nil {
+			stdin, closeStdin, err := opts.stdinReader(command, cmdCtxLogger)
+			if err != nil {
+				return nil, err
+			}
+			defer closeStdin()
+			commandSession.Stdin = stdin
+		}
 		if err := commandSession.Run(command.ArgStr); err != nil {
 			return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), fmt.Errorf("error running command: %w", err)
 		}
 
-		if command.Type == UserCommandType {
-
-			// REFACTOR IF/WHEN WINDOWS SUPPORT IS ADDED
-
-			if command.UserOperation == "add" {
-				if command.UserSshPubKeys != nil {
-					var (
-						f        *sftp.File
-						err      error
-						userHome []byte
-						client   *sftp.Client
-					)
-
-					cmdCtxLogger.Info().Msg("adding SSH Keys")
-
-					commandSession, _ = command.RemoteHost.createSSHSession(opts)
-					userHome, err = commandSession.CombinedOutput(fmt.Sprintf("grep \"%s\" /etc/passwd | cut -d: -f6", command.Username))
-					if err != nil {
-						return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), fmt.Errorf("error finding user home from /etc/passwd: %v", err)
-					}
-
-					command.UserHome = strings.TrimSpace(string(userHome))
-					userSshDir := fmt.Sprintf("%s/.ssh", command.UserHome)
-					client, err = sftp.NewClient(command.RemoteHost.SshClient)
-					if err != nil {
-						return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), fmt.Errorf("error creating sftp client: %v", err)
-					}
-
-					err = client.MkdirAll(userSshDir)
-					if err != nil {
-						return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), fmt.Errorf("error creating directory %s: %v", userSshDir, err)
-					}
-					_, err = client.Create(fmt.Sprintf("%s/authorized_keys", userSshDir))
-					if err != nil {
-						return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), fmt.Errorf("error opening file %s/authorized_keys: %v", userSshDir, err)
-					}
-					f, err = client.OpenFile(fmt.Sprintf("%s/authorized_keys", userSshDir), os.O_APPEND|os.O_CREATE|os.O_WRONLY)
-					if err != nil {
-						return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), fmt.Errorf("error opening file %s/authorized_keys: %v", userSshDir, err)
-					}
-					defer f.Close()
-					for _, k := range command.UserSshPubKeys {
-						buf := bytes.NewBufferString(k)
-						cmdCtxLogger.Info().Str("key", k).Msg("adding SSH key")
-						if _, err := f.ReadFrom(buf); err != nil {
-							return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), fmt.Errorf("error adding to authorized keys: %v", err)
-						}
-					}
-
-					commandSession, _ = command.RemoteHost.createSSHSession(opts)
-					_, err = commandSession.CombinedOutput(fmt.Sprintf("chown -R %s:%s %s", command.Username, command.Username, userHome))
-					if err != nil {
-						return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), err
-					}
-
-				}
-			}
-		}
 	}
 
 	return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), nil
@@ -730,7 +973,11 @@ func (command *Command) prepareScriptFileBuffer() (*bytes.Buffer, error) {
 	if err != nil {
 		return nil, err
 	}
-	buffer.Write(scriptBuffer.Bytes())
+	script, err := command.renderScript(scriptBuffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	buffer.Write(script)
 
 	return &buffer, nil
 }
@@ -741,6 +988,9 @@ func (command *Command) runRemoteScript(session *ssh.Session, cmdCtxLogger zerol
 	if err != nil {
 		return nil, err
 	}
+	if script, err = command.renderScript(script); err != nil {
+		return nil, err
+	}
 	if command.Shell == "" {
 		command.Shell = "sh"
 	}
@@ -789,17 +1039,60 @@ func collectOutput(buf *bytes.Buffer, commandName string, logger zerolog.Logger,
 }
 
 // createSSHSession attempts to create a new SSH session and retries on failure.
-func (h *Host) createSSHSession(opts *ConfigOpts) (*ssh.Session, error) {
-	session, err := h.SshClient.NewSession()
-	if err == nil {
-		return session, nil
+// The pooled connection is kept open until the returned function is called after the session is closed.
+func (h *Host) createSSHSession(opts *ConfigOpts) (*ssh.Session, func(), error) {
+	pool := opts.connectionPool()
+	poolKey := h.poolKey()
+	client := h.SshClient
+	session, err := client.NewSession()
+
+	// The server can refuse sessions on a working connection, as sshd does above MaxSessions,
+	// so wait for another session on the connection to be released and try again
+	alive := true
+	for retries := 0; err != nil; {
+		if alive = isClientAlive(client, pool.aliveWait()); !alive {
+			break
+		}
+		if !pool.waitForSession(poolKey) {
+			// no sessions are open, but the server may not have closed the last one yet
+			if retries++; retries > sshSessionRetries {
+				break
+			}
+			time.Sleep(time.Duration(retries) * 100 * time.Millisecond)
+		}
+		session, err = client.NewSession()
+	}
+	if err != nil && alive {
+		return nil, nil, fmt.Errorf("session creation failed on host %s: %v", h.Host, err)
 	}
 
-	// Retry connection and session creation
-	if connErr := h.ConnectToHost(opts); connErr != nil {
-		return nil, fmt.Errorf("session creation failed: %v, connection retry failed: %v", err, connErr)
+	if err != nil {
+		// The pooled connection is broken, so drop it and reconnect
+		pool.remove(poolKey)
+		if connErr := h.ConnectToHost(opts); connErr != nil {
+			return nil, nil, fmt.Errorf("session creation failed: %v, connection retry failed: %v", err, connErr)
+		}
+		session, err = h.SshClient.NewSession()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	release := pool.acquireSession(poolKey)
+	if err := h.forwardAgentOnSession(session); err != nil {
+		release()
+		return nil, nil, err
+	}
+	return session, release, nil
+}
+
+// forwardAgentOnSession requests agent forwarding and closes the session if that fails
+func (h *Host) forwardAgentOnSession(session *ssh.Session) error {
+	if err := h.forwardAgent(session); err != nil {
+		session.Close()
+		return fmt.Errorf("agent forwarding failed: %v", err)
 	}
-	return h.SshClient.NewSession()
+	return nil
 }
 
 func (h *Host) DetectOS(opts *ConfigOpts) (string, error) {
@@ -808,11 +1101,12 @@ func (h *Host) DetectOS(opts *ConfigOpts) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	var session *ssh.Session
-	session, err = h.createSSHSession(opts)
+	session, release, err := h.createSSHSession(opts)
 	if err != nil {
 		return "", err
 	}
+	defer release()
+	defer session.Close()
 	// Execute the "uname -a" command on the remote machine
 	output, err := session.CombinedOutput("uname")
 	if err != nil {
@@ -829,7 +1123,6 @@ func DoesHostHaveHostName(host string) (bool, string) {
 	if err != nil {
 		return false, ""
 	}
-	println(HostName)
 	return HostName != "", HostName
 }
 
@@ -838,9 +1131,12 @@ func IsHostLocal(host string) bool {
 	return host == "127.0.0.1" || host == "localhost" || host == ""
 }
 
-type RemoteHostPackageExecutor struct{}
+type RemoteHostPackageExecutor struct {
+	// opts is used to record the results of listUpgrades and securityUpgrade
+	opts *ConfigOpts
+}
 
-func (r RemoteHostPackageExecutor) RunCmdOnHost(command *Command, commandSession *ssh.Session, cmdCtxLogger zerolog.Logger, cmdOutBuf bytes.Buffer) ([]string, error) {
+func (r RemoteHostPackageExecutor) RunCmdOnHost(command *Command, commandSession *ssh.Session, cmdCtxLogger zerolog.Logger, cmdOutBuf *bytes.Buffer) ([]string, error) {
 	var ArgsStr string
 	// Prepare command arguments
 	for _, v := range command.Args {
@@ -854,7 +1150,7 @@ func (r RemoteHostPackageExecutor) RunCmdOnHost(command *Command, commandSession
 		// Compare versions
 		// Check if a specific version is specified
 		commandSession.Stdout = nil
-		return checkPackageVersion(cmdCtxLogger, command, commandSession, cmdOutBuf)
+		return checkPackageVersion(cmdCtxLogger, command, commandSession, *cmdOutBuf)
 	}
 	if command.Shell != "" {
 		ArgsStr = fmt.Sprintf("%s -c '%s'", command.Shell, command.ArgStr)
@@ -864,7 +1160,13 @@ func (r RemoteHostPackageExecutor) RunCmdOnHost(command *Command, commandSession
 	cmdCtxLogger.Debug().Str("cmd + args", ArgsStr).Send()
 	// Run simple command
 	if err := commandSession.Run(ArgsStr); err != nil {
-		return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), fmt.Errorf("error running command: %w", err)
+		return collectOutput(cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), fmt.Errorf("error running command: %w", err)
 	}
-	return collectOutput(&cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), nil
+
+	if command.isPackageListOperation() {
+		output := cmdOutBuf.String()
+		outputArr := collectOutput(cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog)
+		return outputArr, command.parsePackageUpgrades(output, command.Host, r.opts, cmdCtxLogger)
+	}
+	return collectOutput(cmdOutBuf, command.Name, cmdCtxLogger, command.Output.ToLog), nil
 }
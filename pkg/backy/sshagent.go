@@ -0,0 +1,124 @@
+// sshagent.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// GetAgentSettingsFromConfig fills IdentityAgent, ForwardAgent and CertificateFile
+// from the ssh config file if they are not set in the backy config
+func (remoteHost *Host) GetAgentSettingsFromConfig() {
+	if TS(remoteHost.IdentityAgent) == "" {
+		remoteHost.IdentityAgent = remoteHost.getSSHConfigValue("IdentityAgent")
+	}
+
+	if !remoteHost.ForwardAgent {
+		remoteHost.ForwardAgent = strings.EqualFold(remoteHost.getSSHConfigValue("ForwardAgent"), "yes")
+	}
+
+	if TS(remoteHost.CertPath) == "" {
+		remoteHost.CertPath = remoteHost.getSSHConfigValue("CertificateFile")
+	}
+}
+
+// getAgent connects to the host's ssh-agent.
+// The socket is IdentityAgent if set, SSH_AUTH_SOCK otherwise.
+// nil is returned if no agent is configured.
+func (remoteHost *Host) getAgent() (agent.ExtendedAgent, error) {
+	if remoteHost.agentClient != nil {
+		return remoteHost.agentClient, nil
+	}
+
+	socket := TS(remoteHost.IdentityAgent)
+	if strings.EqualFold(socket, "none") {
+		return nil, nil
+	}
+	if socket == "" || socket == "SSH_AUTH_SOCK" {
+		socket = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if socket == "" {
+		return nil, nil
+	}
+
+	socket, err := getFullPathWithHomeDir(os.ExpandEnv(socket))
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not connect to ssh-agent at %s", socket)
+	}
+
+	remoteHost.agentClient = agent.NewClient(conn)
+	return remoteHost.agentClient, nil
+}
+
+// getCertSigner wraps signer with the host's OpenSSH certificate.
+// If no certificate file is set, the certificate next to the private key (key-cert.pub) is used if it exists.
+func (remoteHost *Host) getCertSigner(signer ssh.Signer) (ssh.Signer, error) {
+	certPath := TS(remoteHost.CertPath)
+	explicit := certPath != ""
+	if !explicit {
+		certPath = remoteHost.PrivateKeyPath + "-cert.pub"
+	}
+
+	certPath, err := getFullPathWithHomeDir(certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	certBytes, err := os.ReadFile(certPath)
+	if err != nil {
+		if !explicit && os.IsNotExist(err) {
+			return signer, nil
+		}
+		return nil, errors.Wrapf(err, "could not read certificate file %s", certPath)
+	}
+
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse certificate file %s", certPath)
+	}
+
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an SSH certificate", certPath)
+	}
+
+	remoteHost.CertPath = certPath
+
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// forwardAgent forwards the host's ssh-agent on session if forwardAgent is enabled
+func (remoteHost *Host) forwardAgent(session *ssh.Session) error {
+	if !remoteHost.ForwardAgent {
+		return nil
+	}
+
+	agentClient, err := remoteHost.getAgent()
+	if err != nil {
+		return err
+	}
+	if agentClient == nil {
+		return fmt.Errorf("forwardAgent is set for host %s, but no ssh-agent is available", remoteHost.Host)
+	}
+
+	// the handler is registered once per client
+	if err := agent.ForwardToAgent(remoteHost.SshClient, agentClient); err != nil && !strings.Contains(err.Error(), "already have handler") {
+		return err
+	}
+
+	return agent.RequestAgentForwarding(session)
+}
@@ -0,0 +1,242 @@
+package backy
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.andrewnw.xyz/CyberShell/backy/pkg/sshtest"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveAgent serves keyring on a unix socket, as ssh-agent does, and returns the socket's path
+func serveAgent(t *testing.T, keyring agent.Agent) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	return socket
+}
+
+// agentWithKey returns a keyring holding the private key in file
+func agentWithKey(t *testing.T, file string) agent.Agent {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.ParseRawPrivateKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+// writeCert signs the public key of signer for principal with ca and writes the certificate to file
+func writeCert(t *testing.T, file string, ca, signer ssh.Signer, principal string) {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           principal,
+		ValidPrincipals: []string{principal},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAgentAuth(t *testing.T) {
+	opts := newTestOpts(t)
+	host, server := newTestHost(t, opts, "web")
+
+	// the authorized key is only in the agent
+	host.IdentityAgent = serveAgent(t, agentWithKey(t, host.PrivateKeyPath))
+	host.PrivateKeyPath = filepath.Join(t.TempDir(), "id_ed25519")
+
+	if err := host.ConnectToHost(opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.Connections(); got != 1 {
+		t.Errorf("connections = %d, want 1", got)
+	}
+}
+
+func TestAgentAuthWithKeyFile(t *testing.T) {
+	opts := newTestOpts(t)
+	host, _ := newTestHost(t, opts, "web")
+
+	// the agent holds an unauthorized key, so the key file has to be offered as well
+	otherFile := filepath.Join(t.TempDir(), "other")
+	sshtest.WriteKey(t, otherFile)
+	host.IdentityAgent = serveAgent(t, agentWithKey(t, otherFile))
+
+	if err := host.ConnectToHost(opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertAuth(t *testing.T) {
+	_, ca := sshtest.NewKey(t)
+
+	tests := []struct {
+		name     string
+		certPath func(keyPath string) (file, certPath string)
+	}{
+		{
+			name:     "certificate next to the key",
+			certPath: func(keyPath string) (string, string) { return keyPath + "-cert.pub", "" },
+		},
+		{
+			name: "certificatePath",
+			certPath: func(keyPath string) (string, string) {
+				file := filepath.Join(filepath.Dir(keyPath), "user-cert.pub")
+				return file, file
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := newTestOpts(t)
+			host, server := newTestHost(t, opts, "db", sshtest.WithCertAuthority(ca.PublicKey()))
+
+			// the key is not authorized, only its certificate is
+			host.PrivateKeyPath = filepath.Join(t.TempDir(), "id_ed25519")
+			signer := sshtest.WriteKey(t, host.PrivateKeyPath)
+			file, certPath := tt.certPath(host.PrivateKeyPath)
+			writeCert(t, file, ca, signer, host.User)
+			host.CertPath = certPath
+
+			if err := host.ConnectToHost(opts); err != nil {
+				t.Fatal(err)
+			}
+			if host.CertPath != file {
+				t.Errorf("CertPath = %s, want %s", host.CertPath, file)
+			}
+			if got := server.Connections(); got != 1 {
+				t.Errorf("connections = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestGetCertSigner(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "id_ed25519")
+	signer := sshtest.WriteKey(t, keyPath)
+
+	host := &Host{PrivateKeyPath: keyPath}
+	got, err := host.getCertSigner(signer)
+	if err != nil || got != signer {
+		t.Errorf("without a certificate = %v, %v, want the key's signer", got, err)
+	}
+
+	host.CertPath = filepath.Join(dir, "missing-cert.pub")
+	if _, err := host.getCertSigner(signer); err == nil || !strings.Contains(err.Error(), "could not read certificate file") {
+		t.Errorf("missing certificatePath error = %v", err)
+	}
+
+	host.CertPath = filepath.Join(dir, "plain.pub")
+	if err := os.WriteFile(host.CertPath, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := host.getCertSigner(signer); err == nil || !strings.Contains(err.Error(), "is not an SSH certificate") {
+		t.Errorf("public key as certificate error = %v", err)
+	}
+}
+
+func TestForwardAgent(t *testing.T) {
+	opts := newTestOpts(t)
+	host, _ := newTestHost(t, opts, "web", sshtest.WithHandler(func(e *sshtest.Exec) int {
+		if !e.ForwardAgent {
+			fmt.Fprintln(e.Stdout, "agent not forwarded")
+			return 1
+		}
+		forwarded, err := e.Agent()
+		if err != nil {
+			fmt.Fprintln(e.Stderr, err)
+			return 1
+		}
+		keys, err := forwarded.List()
+		if err != nil {
+			fmt.Fprintln(e.Stderr, err)
+			return 1
+		}
+		for _, k := range keys {
+			fmt.Fprintln(e.Stdout, ssh.FingerprintSHA256(k))
+		}
+		return 0
+	}))
+
+	keyring := agentWithKey(t, host.PrivateKeyPath)
+	keys, err := keyring.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.IdentityAgent = serveAgent(t, keyring)
+	host.ForwardAgent = true
+
+	if err := host.ConnectToHost(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// the agent is forwarded on every session of the connection
+	for range 2 {
+		session, release, err := host.createSSHSession(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := session.Output("ssh-add -l")
+		session.Close()
+		release()
+		if err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+		if want := ssh.FingerprintSHA256(keys[0]) + "\n"; string(out) != want {
+			t.Errorf("forwarded keys = %q, want %q", out, want)
+		}
+	}
+}
+
+func TestForwardAgentWithoutAgent(t *testing.T) {
+	opts := newTestOpts(t)
+	host, _ := newTestHost(t, opts, "web")
+	host.ForwardAgent = true
+
+	if err := host.ConnectToHost(opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := host.createSSHSession(opts); err == nil || !strings.Contains(err.Error(), "no ssh-agent is available") {
+		t.Errorf("error = %v, want no ssh-agent is available", err)
+	}
+}
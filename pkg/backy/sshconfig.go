@@ -0,0 +1,625 @@
+// sshconfig.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kevinburke/ssh_config"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// knownHostsMu guards appends to known_hosts files
+var knownHostsMu sync.Mutex
+
+// maxSSHConfigIncludeDepth is how deep Include directives can be nested, the same as the parser's limit
+const maxSSHConfigIncludeDepth = 5
+
+// decodeSSHConfig decodes an ssh config file.
+// Match blocks are not supported by the parser, so they are rewritten first,
+// in the file and in the files it includes.
+func decodeSSHConfig(r io.Reader, logger zerolog.Logger) (*ssh_config.Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	rewriter := &sshConfigRewriter{logger: logger}
+	defer rewriter.cleanup()
+
+	data, err = rewriter.rewrite(data, "ssh config", 0)
+	if err != nil {
+		return nil, err
+	}
+	return ssh_config.DecodeBytes(data)
+}
+
+// sshConfigRewriter rewrites Match blocks in an ssh config file and the files it includes.
+// The parser reads included files itself, so the rewritten included files are written to a temporary directory,
+// and the Include directives are changed to point to them.
+type sshConfigRewriter struct {
+	logger zerolog.Logger
+	// dir holds the rewritten included files, it is created when the first file is included
+	dir   string
+	files int
+}
+
+// cleanup removes the rewritten included files
+func (rw *sshConfigRewriter) cleanup() {
+	if rw.dir != "" {
+		os.RemoveAll(rw.dir)
+	}
+}
+
+// rewrite turns Match blocks into Host blocks.
+// "Match all" becomes "Host *", and "Match host" or "Match originalhost" with one list of patterns becomes a Host block with the same patterns.
+// Blocks with any other criteria are never matched, and a warning is logged.
+// name is the file the data was read from, used in warnings.
+func (rw *sshConfigRewriter) rewrite(data []byte, name string, depth int) ([]byte, error) {
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		keyword, args, _ := strings.Cut(strings.Replace(trimmed, "=", " ", 1), " ")
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+
+		if strings.EqualFold(keyword, "Include") {
+			files, err := rw.include(strings.Fields(args), depth+1)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s line %d: could not include %s", name, lineNum, strings.TrimSpace(args))
+			}
+			if len(files) > 0 {
+				out.WriteString(indent + "Include " + strings.Join(files, " ") + "\n")
+			}
+			continue
+		}
+
+		if !strings.EqualFold(keyword, "Match") {
+			out.WriteString(line + "\n")
+			continue
+		}
+
+		criteria := strings.Fields(args)
+		switch {
+		case len(criteria) == 1 && strings.EqualFold(criteria[0], "all"):
+			out.WriteString(indent + "Host *\n")
+		case len(criteria) == 2 && (strings.EqualFold(criteria[0], "host") || strings.EqualFold(criteria[0], "originalhost")):
+			out.WriteString(indent + "Host " + strings.Join(strings.Split(criteria[1], ","), " ") + "\n")
+		default:
+			rw.logger.Warn().Str("file", name).Int("line", lineNum).Msgf("%q is not supported, the settings in this Match block are ignored", trimmed)
+			out.WriteString(indent + "Host !*\n")
+		}
+	}
+	return out.Bytes(), scanner.Err()
+}
+
+// include rewrites the files that match patterns and returns the paths of the rewritten files.
+// Relative patterns are relative to ~/.ssh, as in ssh_config(5).
+func (rw *sshConfigRewriter) include(patterns []string, depth int) ([]string, error) {
+	if depth > maxSSHConfigIncludeDepth {
+		return nil, errors.Errorf("Include directives are nested more than %d deep", maxSSHConfigIncludeDepth)
+	}
+
+	var files []string
+	for _, pattern := range patterns {
+		pattern, err := getFullPathWithHomeDir(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if !filepath.IsAbs(pattern) {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			pattern = filepath.Join(home, ".ssh", pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			data, err := os.ReadFile(match)
+			if err != nil {
+				return nil, err
+			}
+			data, err = rw.rewrite(data, match, depth)
+			if err != nil {
+				return nil, err
+			}
+			file, err := rw.write(data)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// write writes a rewritten included file to the temporary directory and returns its path
+func (rw *sshConfigRewriter) write(data []byte) (string, error) {
+	if rw.dir == "" {
+		dir, err := os.MkdirTemp("", "backy-ssh-config")
+		if err != nil {
+			return "", err
+		}
+		rw.dir = dir
+	}
+	rw.files++
+	file := filepath.Join(rw.dir, strconv.Itoa(rw.files))
+	return file, os.WriteFile(file, data, 0600)
+}
+
+// getSSHConfigValue looks up key for the host in the ssh config file,
+// then in the default user settings.
+// Values that are only the parser's built-in defaults are returned as empty.
+func (remoteHost *Host) getSSHConfigValue(key string) string {
+	if remoteHost.SSHConfigFile == nil {
+		return ""
+	}
+	var value string
+	if remoteHost.SSHConfigFile.SshConfigFile != nil {
+		value, _ = remoteHost.SSHConfigFile.SshConfigFile.Get(remoteHost.Host, key)
+	}
+	if value == "" && remoteHost.SSHConfigFile.DefaultUserSettings != nil {
+		value = remoteHost.SSHConfigFile.DefaultUserSettings.Get(remoteHost.Host, key)
+		if value == ssh_config.Default(key) {
+			value = ""
+		}
+	}
+	return TS(value)
+}
+
+// GetSSHConfigDirectives applies the ssh config directives that are not looked up elsewhere:
+// StrictHostKeyChecking, ConnectTimeout, ServerAliveInterval, ServerAliveCountMax,
+// Ciphers, MACs, KexAlgorithms, HostKeyAlgorithms, ProxyCommand and IdentitiesOnly
+func (remoteHost *Host) GetSSHConfigDirectives() error {
+	if remoteHost.ClientConfig == nil {
+		remoteHost.ClientConfig = &ssh.ClientConfig{}
+	}
+
+	remoteHost.strictHostKeyChecking = strings.ToLower(remoteHost.getSSHConfigValue("StrictHostKeyChecking"))
+
+	if timeout := remoteHost.getSSHConfigValue("ConnectTimeout"); timeout != "" {
+		seconds, err := strconv.Atoi(timeout)
+		if err != nil {
+			return errors.Errorf("invalid ConnectTimeout %q for host %s", timeout, remoteHost.Host)
+		}
+		remoteHost.ClientConfig.Timeout = time.Duration(seconds) * time.Second
+	}
+
+	if interval := remoteHost.getSSHConfigValue("ServerAliveInterval"); interval != "" {
+		seconds, err := strconv.Atoi(interval)
+		if err != nil {
+			return errors.Errorf("invalid ServerAliveInterval %q for host %s", interval, remoteHost.Host)
+		}
+		remoteHost.serverAliveInterval = time.Duration(seconds) * time.Second
+	}
+
+	remoteHost.serverAliveCountMax = 3
+	if countMax := remoteHost.getSSHConfigValue("ServerAliveCountMax"); countMax != "" {
+		count, err := strconv.Atoi(countMax)
+		if err != nil {
+			return errors.Errorf("invalid ServerAliveCountMax %q for host %s", countMax, remoteHost.Host)
+		}
+		remoteHost.serverAliveCountMax = count
+	}
+
+	supported := ssh.SupportedAlgorithms()
+	if ciphers := remoteHost.getSSHConfigValue("Ciphers"); ciphers != "" {
+		remoteHost.ClientConfig.Ciphers = parseAlgorithmList(ciphers, supported.Ciphers)
+	}
+	if macs := remoteHost.getSSHConfigValue("MACs"); macs != "" {
+		remoteHost.ClientConfig.MACs = parseAlgorithmList(macs, supported.MACs)
+	}
+	if kex := remoteHost.getSSHConfigValue("KexAlgorithms"); kex != "" {
+		remoteHost.ClientConfig.KeyExchanges = parseAlgorithmList(kex, supported.KeyExchanges)
+	}
+	if hostKeyAlgos := remoteHost.getSSHConfigValue("HostKeyAlgorithms"); hostKeyAlgos != "" {
+		remoteHost.ClientConfig.HostKeyAlgorithms = parseAlgorithmList(hostKeyAlgos, supported.HostKeys)
+	}
+
+	remoteHost.proxyCommand = remoteHost.getSSHConfigValue("ProxyCommand")
+	if strings.EqualFold(remoteHost.proxyCommand, "none") {
+		remoteHost.proxyCommand = ""
+	}
+
+	remoteHost.identitiesOnly = strings.EqualFold(remoteHost.getSSHConfigValue("IdentitiesOnly"), "yes")
+
+	return nil
+}
+
+// parseAlgorithmList parses an algorithm list the way ssh_config(5) does.
+// A leading + appends to the defaults, - removes matching algorithms from the defaults,
+// and ^ puts the algorithms at the head of the defaults.
+func parseAlgorithmList(value string, defaults []string) []string {
+	value = TS(value)
+	if value == "" {
+		return nil
+	}
+
+	prefix := value[0]
+	if prefix == '+' || prefix == '-' || prefix == '^' {
+		value = value[1:]
+	}
+	algos := strings.Split(value, ",")
+
+	switch prefix {
+	case '+':
+		result := append([]string{}, defaults...)
+		for _, a := range algos {
+			if !slices.Contains(result, a) {
+				result = append(result, a)
+			}
+		}
+		return result
+	case '-':
+		var result []string
+		for _, d := range defaults {
+			removed := false
+			for _, a := range algos {
+				if matched, _ := path.Match(a, d); matched {
+					removed = true
+					break
+				}
+			}
+			if !removed {
+				result = append(result, d)
+			}
+		}
+		return result
+	case '^':
+		result := append([]string{}, algos...)
+		for _, d := range defaults {
+			if !slices.Contains(result, d) {
+				result = append(result, d)
+			}
+		}
+		return result
+	}
+
+	return algos
+}
+
+// GetKnownHosts resolves the host's KnownHosts file if it is defined.
+// If not defined, UserKnownHostsFile from the ssh config file is used, then the default location.
+// The first file is the one new keys are written to.
+func (remoteHost *Host) GetKnownHosts() error {
+	var knownHostsFileErr error
+	if TS(remoteHost.KnownHostsFile) != "" {
+		remoteHost.KnownHostsFile, knownHostsFileErr = getFullPathWithHomeDir(remoteHost.KnownHostsFile)
+		if len(remoteHost.knownHostsFiles) == 0 || remoteHost.knownHostsFiles[0] != remoteHost.KnownHostsFile {
+			remoteHost.knownHostsFiles = []string{remoteHost.KnownHostsFile}
+		}
+		return knownHostsFileErr
+	}
+
+	files := strings.Fields(remoteHost.getSSHConfigValue("UserKnownHostsFile"))
+	if len(files) == 0 {
+		files = []string{"~/.ssh/known_hosts"}
+	}
+
+	remoteHost.knownHostsFiles = nil
+	for i, f := range files {
+		f, knownHostsFileErr = getFullPathWithHomeDir(f)
+		if knownHostsFileErr != nil {
+			return knownHostsFileErr
+		}
+		// the first file is kept even if missing so that it can be created
+		if _, err := os.Stat(f); i > 0 && err != nil {
+			continue
+		}
+		remoteHost.knownHostsFiles = append(remoteHost.knownHostsFiles, f)
+	}
+	remoteHost.KnownHostsFile = remoteHost.knownHostsFiles[0]
+
+	return nil
+}
+
+// hostKeyCallback returns the host key callback for the host's hostKeyPolicy, or StrictHostKeyChecking if no policy is set.
+// strict, yes and ask only accept keys in the known_hosts files.
+// tofu and accept-new append keys of unknown hosts, and reject changed keys.
+// no and off also accept changed keys.
+func (remoteHost *Host) hostKeyCallback(logger zerolog.Logger) (ssh.HostKeyCallback, error) {
+	policy := remoteHost.strictHostKeyChecking
+	switch strings.ToLower(TS(remoteHost.HostKeyPolicy)) {
+	case "":
+	case "strict":
+		policy = "yes"
+	case "tofu":
+		policy = "accept-new"
+	default:
+		return nil, errors.Errorf("invalid hostKeyPolicy %q for host %s, must be strict or tofu", remoteHost.HostKeyPolicy, remoteHost.Host)
+	}
+
+	switch policy {
+	case "accept-new":
+		return acceptNewHostKeyCallback(remoteHost.knownHostsFiles, false, logger), nil
+	case "no", "off":
+		return acceptNewHostKeyCallback(remoteHost.knownHostsFiles, true, logger), nil
+	}
+
+	return remoteHost.strictHostKeyCallback()
+}
+
+// strictHostKeyCallback only accepts keys in the host's known_hosts files.
+// Missing files are treated as empty, so that unknown hosts get a helpful error.
+func (remoteHost *Host) strictHostKeyCallback() (ssh.HostKeyCallback, error) {
+	var callback ssh.HostKeyCallback
+	if existing := existingFiles(remoteHost.knownHostsFiles); len(existing) > 0 {
+		var err error
+		callback, err = knownhosts.New(existing...)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create hostkeycallback function")
+		}
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := error(&knownhosts.KeyError{})
+		if callback != nil {
+			err = callback(hostname, remote, key)
+		}
+		return remoteHost.hostKeyError(hostname, key, err)
+	}, nil
+}
+
+// hostKeyError explains known_hosts errors and how to fix them
+func (remoteHost *Host) hostKeyError(hostname string, key ssh.PublicKey, err error) error {
+	var keyErr *knownhosts.KeyError
+	if err == nil || !errors.As(err, &keyErr) {
+		return err
+	}
+
+	if len(keyErr.Want) == 0 {
+		return errors.Errorf("host key %s %s of %s is not in %s. Run `backy hosts trust %s` to add it, or set hostKeyPolicy: tofu on the host",
+			key.Type(), ssh.FingerprintSHA256(key), hostname, strings.Join(remoteHost.knownHostsFiles, ", "), remoteHost.Host)
+	}
+
+	known := keyErr.Want[0]
+	return errors.Errorf("host key of %s has changed to %s %s, the known key is at %s:%d. Someone could be intercepting the connection. If the change is expected, remove the old key and run `backy hosts trust %s`",
+		hostname, key.Type(), ssh.FingerprintSHA256(key), known.Filename, known.Line, remoteHost.Host)
+}
+
+// existingFiles returns the files that exist
+func existingFiles(files []string) []string {
+	var existing []string
+	for _, f := range files {
+		if _, err := os.Stat(f); err == nil {
+			existing = append(existing, f)
+		}
+	}
+	return existing
+}
+
+// acceptNewHostKeyCallback checks keys against files and appends keys of unknown hosts to the first file.
+// If allowChanged is true, keys that do not match the known key are accepted with a warning.
+func acceptNewHostKeyCallback(files []string, allowChanged bool, logger zerolog.Logger) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		knownHostsMu.Lock()
+		defer knownHostsMu.Unlock()
+
+		if existing := existingFiles(files); len(existing) > 0 {
+			callback, err := knownhosts.New(existing...)
+			if err != nil {
+				return errors.Wrap(err, "could not create hostkeycallback function")
+			}
+			err = callback(hostname, remote, key)
+			if err == nil {
+				return nil
+			}
+
+			var keyErr *knownhosts.KeyError
+			if !errors.As(err, &keyErr) {
+				return err
+			}
+			if len(keyErr.Want) > 0 {
+				if !allowChanged {
+					return err
+				}
+				logger.Warn().Str("host", hostname).Str("fingerprint", ssh.FingerprintSHA256(key)).Msg("host key changed, connecting anyway because StrictHostKeyChecking is no")
+				return nil
+			}
+		}
+
+		logger.Info().Str("host", hostname).Str("fingerprint", ssh.FingerprintSHA256(key)).Msgf("adding host key to %s", files[0])
+		return appendKnownHost(files[0], hostname, key)
+	}
+}
+
+// appendKnownHost adds the key for hostname to the known_hosts file, creating it if needed
+func appendKnownHost(file, hostname string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	return err
+}
+
+// identityPublicKeys returns the public keys of the host's identity file.
+// signer is the parsed private key, which may be nil if only the agent holds it.
+func (remoteHost *Host) identityPublicKeys(signer ssh.Signer) []ssh.PublicKey {
+	var keys []ssh.PublicKey
+	if signer != nil {
+		keys = append(keys, signer.PublicKey())
+	}
+	if pubKeyBytes, err := os.ReadFile(remoteHost.PrivateKeyPath + ".pub"); err == nil {
+		if pubKey, _, _, _, err := ssh.ParseAuthorizedKey(pubKeyBytes); err == nil {
+			keys = append(keys, pubKey)
+		}
+	}
+	return keys
+}
+
+// filterSignersByKeys returns the signers whose public key, or certified key, is in keys
+func filterSignersByKeys(signers []ssh.Signer, keys []ssh.PublicKey) []ssh.Signer {
+	var filtered []ssh.Signer
+	for _, s := range signers {
+		pubKey := s.PublicKey()
+		if cert, ok := pubKey.(*ssh.Certificate); ok {
+			pubKey = cert.Key
+		}
+		for _, k := range keys {
+			if bytes.Equal(pubKey.Marshal(), k.Marshal()) {
+				filtered = append(filtered, s)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// startServerAliveChecks sends keepalives on client every interval,
+// and closes the connection when countMax keepalives in a row are not answered
+func startServerAliveChecks(client *ssh.Client, interval time.Duration, countMax int, logger zerolog.Logger) {
+	if interval <= 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(done)
+	}()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		missed := 0
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				reply := make(chan error, 1)
+				go func() {
+					_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+					reply <- err
+				}()
+
+				select {
+				case err := <-reply:
+					if err != nil {
+						return
+					}
+					missed = 0
+				case <-time.After(interval):
+					missed++
+					if missed >= countMax {
+						logger.Warn().Msgf("Server %s did not answer %d keepalives, closing connection", client.RemoteAddr(), missed)
+						client.Close()
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// expandProxyCommand expands the %h, %p, %r, %n and %% tokens in a ProxyCommand
+func expandProxyCommand(command, alias, hostname string, port uint16, user string) string {
+	replacer := strings.NewReplacer(
+		"%%", "%",
+		"%h", hostname,
+		"%p", strconv.Itoa(int(port)),
+		"%r", user,
+		"%n", alias,
+	)
+	return replacer.Replace(command)
+}
+
+// dialProxyCommand starts the host's ProxyCommand and returns a connection over its stdin and stdout
+func (remoteHost *Host) dialProxyCommand() (net.Conn, error) {
+	hostname, _, err := net.SplitHostPort(remoteHost.HostName)
+	if err != nil {
+		hostname = remoteHost.HostName
+	}
+
+	command := expandProxyCommand(remoteHost.proxyCommand, remoteHost.Host, hostname, remoteHost.Port, remoteHost.User)
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "could not start ProxyCommand %q", command)
+	}
+
+	return &proxyCommandConn{cmd: cmd, stdin: stdin, stdout: stdout, addr: remoteHost.HostName}, nil
+}
+
+// connectThroughProxyCommand opens an SSH connection over the host's ProxyCommand
+func (remoteHost *Host) connectThroughProxyCommand() (*ssh.Client, error) {
+	conn, err := remoteHost.dialProxyCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	return newClientConn(conn, remoteHost.HostName, remoteHost.ClientConfig)
+}
+
+// proxyCommandConn is a net.Conn over the stdin and stdout of a ProxyCommand
+type proxyCommandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.Reader
+	// addr is the host:port the command connects to, used for known_hosts checks
+	addr string
+}
+
+func (c *proxyCommandConn) Read(b []byte) (int, error)  { return c.stdout.Read(b) }
+func (c *proxyCommandConn) Write(b []byte) (int, error) { return c.stdin.Write(b) }
+
+func (c *proxyCommandConn) Close() error {
+	c.stdin.Close()
+	if c.cmd.Process != nil {
+		_ = c.cmd.Process.Kill()
+	}
+	_ = c.cmd.Wait()
+	return nil
+}
+
+func (c *proxyCommandConn) LocalAddr() net.Addr                { return proxyCommandAddr(c.addr) }
+func (c *proxyCommandConn) RemoteAddr() net.Addr               { return proxyCommandAddr(c.addr) }
+func (c *proxyCommandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *proxyCommandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *proxyCommandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type proxyCommandAddr string
+
+func (a proxyCommandAddr) Network() string { return "proxycommand" }
+func (a proxyCommandAddr) String() string  { return string(a) }
@@ -0,0 +1,361 @@
+package backy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/ssh"
+)
+
+// loadTestSSHConfig returns a host that only reads the given file from testdata/ssh_config
+func loadTestSSHConfig(t *testing.T, file, host string) *Host {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", "ssh_config", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cfg, err := decodeSSHConfig(f, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("decodeSSHConfig(%s): %v", file, err)
+	}
+	return &Host{Host: host, SSHConfigFile: &sshConfigFile{SshConfigFile: cfg}}
+}
+
+func TestGetSSHConfigDirectives(t *testing.T) {
+	supported := ssh.SupportedAlgorithms()
+
+	tests := []struct {
+		host             string
+		strict           string
+		timeout          time.Duration
+		aliveInterval    time.Duration
+		aliveCountMax    int
+		ciphers          []string
+		kex              []string
+		hostKeyAlgosHead string
+		proxyCommand     string
+		identitiesOnly   bool
+	}{
+		{host: "strict", strict: "yes", timeout: 5 * time.Second, aliveCountMax: 3},
+		{host: "accept", strict: "accept-new", aliveInterval: 15 * time.Second, aliveCountMax: 5},
+		{
+			host:             "algos",
+			aliveCountMax:    3,
+			ciphers:          []string{"aes256-gcm@openssh.com", "aes128-ctr"},
+			kex:              append(slices.Clone(supported.KeyExchanges), "diffie-hellman-group1-sha1"),
+			hostKeyAlgosHead: "ssh-ed25519",
+		},
+		{
+			host:           "proxied",
+			aliveCountMax:  3,
+			proxyCommand:   "nc -X connect -x proxy.example.com:3128 %h %p",
+			identitiesOnly: true,
+		},
+		{host: "noproxy", strict: "no", aliveCountMax: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			h := loadTestSSHConfig(t, "directives", tt.host)
+			if err := h.GetSSHConfigDirectives(); err != nil {
+				t.Fatal(err)
+			}
+
+			if h.strictHostKeyChecking != tt.strict {
+				t.Errorf("strictHostKeyChecking = %q, want %q", h.strictHostKeyChecking, tt.strict)
+			}
+			if h.ClientConfig.Timeout != tt.timeout {
+				t.Errorf("Timeout = %v, want %v", h.ClientConfig.Timeout, tt.timeout)
+			}
+			if h.serverAliveInterval != tt.aliveInterval {
+				t.Errorf("serverAliveInterval = %v, want %v", h.serverAliveInterval, tt.aliveInterval)
+			}
+			if h.serverAliveCountMax != tt.aliveCountMax {
+				t.Errorf("serverAliveCountMax = %d, want %d", h.serverAliveCountMax, tt.aliveCountMax)
+			}
+			if !slices.Equal(h.ClientConfig.Ciphers, tt.ciphers) {
+				t.Errorf("Ciphers = %v, want %v", h.ClientConfig.Ciphers, tt.ciphers)
+			}
+			if !slices.Equal(h.ClientConfig.KeyExchanges, tt.kex) {
+				t.Errorf("KeyExchanges = %v, want %v", h.ClientConfig.KeyExchanges, tt.kex)
+			}
+			if tt.hostKeyAlgosHead != "" {
+				if len(h.ClientConfig.HostKeyAlgorithms) == 0 || h.ClientConfig.HostKeyAlgorithms[0] != tt.hostKeyAlgosHead {
+					t.Errorf("HostKeyAlgorithms = %v, want %s first", h.ClientConfig.HostKeyAlgorithms, tt.hostKeyAlgosHead)
+				}
+			}
+			if h.proxyCommand != tt.proxyCommand {
+				t.Errorf("proxyCommand = %q, want %q", h.proxyCommand, tt.proxyCommand)
+			}
+			if h.identitiesOnly != tt.identitiesOnly {
+				t.Errorf("identitiesOnly = %v, want %v", h.identitiesOnly, tt.identitiesOnly)
+			}
+		})
+	}
+}
+
+func TestGetSSHConfigDirectivesMACsRemoval(t *testing.T) {
+	h := loadTestSSHConfig(t, "directives", "algos")
+	if err := h.GetSSHConfigDirectives(); err != nil {
+		t.Fatal(err)
+	}
+	for _, mac := range h.ClientConfig.MACs {
+		if strings.HasPrefix(mac, "hmac-sha1") {
+			t.Errorf("MACs = %v, want hmac-sha1* removed", h.ClientConfig.MACs)
+		}
+	}
+	if len(h.ClientConfig.MACs) == 0 {
+		t.Error("MACs is empty, want the defaults without hmac-sha1*")
+	}
+}
+
+func TestMatchBlocks(t *testing.T) {
+	tests := []struct {
+		host          string
+		user          string
+		timeout       string
+		aliveInterval string
+	}{
+		{host: "db-1", user: "postgres", timeout: "7", aliveInterval: "30"},
+		{host: "db-test", aliveInterval: "30"},
+		{host: "web", user: "www", aliveInterval: "30"},
+		{host: "other", aliveInterval: "30"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			h := loadTestSSHConfig(t, "match", tt.host)
+			if got := h.getSSHConfigValue("User"); got != tt.user {
+				t.Errorf("User = %q, want %q", got, tt.user)
+			}
+			if got := h.getSSHConfigValue("ConnectTimeout"); got != tt.timeout {
+				t.Errorf("ConnectTimeout = %q, want %q", got, tt.timeout)
+			}
+			if got := h.getSSHConfigValue("ServerAliveInterval"); got != tt.aliveInterval {
+				t.Errorf("ServerAliveInterval = %q, want %q", got, tt.aliveInterval)
+			}
+		})
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	included := filepath.Join(dir, "included")
+	if err := os.WriteFile(included, []byte("Host inc\n    HostName inc.example.com\n    ConnectTimeout 9\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := decodeSSHConfig(strings.NewReader("Include "+included+"\n"), zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &Host{Host: "inc", SSHConfigFile: &sshConfigFile{SshConfigFile: cfg}}
+	if err := h.GetSSHConfigDirectives(); err != nil {
+		t.Fatal(err)
+	}
+	if h.ClientConfig.Timeout != 9*time.Second {
+		t.Errorf("Timeout = %v, want 9s", h.ClientConfig.Timeout)
+	}
+}
+
+func TestIncludeWithMatch(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	if err := os.Mkdir(filepath.Join(dir, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	nested := filepath.Join(dir, ".ssh", "nested")
+	if err := os.WriteFile(nested, []byte("Match originalhost web\n    User www\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// relative includes are relative to ~/.ssh
+	included := filepath.Join(dir, "included")
+	if err := os.WriteFile(included, []byte("Include nested\n\nMatch host db\n    User postgres\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := decodeSSHConfig(strings.NewReader("Include "+filepath.Join(dir, "inc*")+"\n"), zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for host, want := range map[string]string{"db": "postgres", "web": "www", "other": ""} {
+		h := &Host{Host: host, SSHConfigFile: &sshConfigFile{SshConfigFile: cfg}}
+		if got := h.getSSHConfigValue("User"); got != want {
+			t.Errorf("%s: User = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestUnsupportedMatchWarning(t *testing.T) {
+	var logs strings.Builder
+	config := "Match exec \"true\"\n    User nobody\n"
+	if _, err := decodeSSHConfig(strings.NewReader(config), zerolog.New(&logs)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), `"line":1`) || !strings.Contains(logs.String(), "is not supported") {
+		t.Errorf("logs = %s, want a warning for line 1", logs.String())
+	}
+}
+
+func TestGetKnownHostsFromConfig(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	h := loadTestSSHConfig(t, "directives", "accept")
+	if err := h.GetKnownHosts(); err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(home, ".ssh", "backy_known_hosts")
+	if h.KnownHostsFile != want {
+		t.Errorf("KnownHostsFile = %q, want %q", h.KnownHostsFile, want)
+	}
+
+	h = loadTestSSHConfig(t, "directives", "strict")
+	h.KnownHostsFile = "/etc/backy/known_hosts"
+	if err := h.GetKnownHosts(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(h.knownHostsFiles, []string{"/etc/backy/known_hosts"}) {
+		t.Errorf("knownHostsFiles = %v, want the configured file only", h.knownHostsFiles)
+	}
+}
+
+func TestAcceptNewHostKeyCallback(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "ssh", "known_hosts")
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+
+	newKey := func() ssh.PublicKey {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	key, otherKey := newKey(), newKey()
+
+	acceptNew := acceptNewHostKeyCallback([]string{knownHosts}, false, zerolog.Nop())
+
+	if err := acceptNew("example.com:22", remote, key); err != nil {
+		t.Fatalf("unknown host: %v", err)
+	}
+	data, err := os.ReadFile(knownHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "example.com ssh-ed25519 ") {
+		t.Errorf("known_hosts = %q, want an example.com entry", data)
+	}
+
+	if err := acceptNew("example.com:22", remote, key); err != nil {
+		t.Errorf("known host: %v", err)
+	}
+	if err := acceptNew("example.com:22", remote, otherKey); err == nil {
+		t.Error("changed key was accepted with accept-new")
+	}
+
+	noCheck := acceptNewHostKeyCallback([]string{knownHosts}, true, zerolog.Nop())
+	if err := noCheck("example.com:22", remote, otherKey); err != nil {
+		t.Errorf("changed key with StrictHostKeyChecking no: %v", err)
+	}
+}
+
+func TestParseAlgorithmList(t *testing.T) {
+	defaults := []string{"a", "b-1", "b-2", "c"}
+
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{value: "x,a", want: []string{"x", "a"}},
+		{value: "+x,a", want: []string{"a", "b-1", "b-2", "c", "x"}},
+		{value: "-b-*", want: []string{"a", "c"}},
+		{value: "^c,x", want: []string{"c", "x", "a", "b-1", "b-2"}},
+		{value: "", want: nil},
+	}
+
+	for _, tt := range tests {
+		if got := parseAlgorithmList(tt.value, defaults); !slices.Equal(got, tt.want) {
+			t.Errorf("parseAlgorithmList(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestExpandProxyCommand(t *testing.T) {
+	got := expandProxyCommand("ssh -W %h:%p %r@jump # %n 100%%", "db", "10.0.0.5", 2222, "backup")
+	want := "ssh -W 10.0.0.5:2222 backup@jump # db 100%"
+	if got != want {
+		t.Errorf("expandProxyCommand() = %q, want %q", got, want)
+	}
+}
+
+func TestFilterSignersByKeys(t *testing.T) {
+	var signers []ssh.Signer
+	for i := 0; i < 2; i++ {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers = append(signers, signer)
+	}
+
+	filtered := filterSignersByKeys(signers, []ssh.PublicKey{signers[1].PublicKey()})
+	if len(filtered) != 1 || filtered[0] != signers[1] {
+		t.Errorf("filterSignersByKeys() returned %d signers, want only the identity's signer", len(filtered))
+	}
+}
+
+func TestHostKeyPolicy(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &Host{Host: "new-host", knownHostsFiles: []string{knownHosts}, strictHostKeyChecking: "accept-new", HostKeyPolicy: "strict"}
+	strict, err := h.hostKeyCallback(zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = strict("new-host:22", remote, key)
+	if err == nil || !strings.Contains(err.Error(), "backy hosts trust new-host") {
+		t.Errorf("strict policy error = %v, want a hint to run backy hosts trust", err)
+	}
+
+	h.HostKeyPolicy = "tofu"
+	tofu, err := h.hostKeyCallback(zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tofu("new-host:22", remote, key); err != nil {
+		t.Errorf("tofu policy: %v", err)
+	}
+	h.HostKeyPolicy = "sometimes"
+	if _, err := h.hostKeyCallback(zerolog.Nop()); err == nil {
+		t.Error("invalid hostKeyPolicy was accepted")
+	}
+}
@@ -0,0 +1,378 @@
+// sshpool.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultSSHKeepAlive   = 30 * time.Second
+	defaultSSHIdleTimeout = 10 * time.Minute
+	// maxSSHAliveWait is the longest a connection check waits for the keepalive reply
+	maxSSHAliveWait = 5 * time.Second
+	// sshSessionRetries is how many times a refused session is retried when no other sessions are open on the connection
+	sshSessionRetries = 3
+)
+
+type (
+	// SSHPoolOpts configures how long pooled SSH connections are kept open
+	SSHPoolOpts struct {
+		// KeepAlive is the interval between keepalive requests
+		KeepAlive time.Duration `yaml:"keepAlive,omitempty"`
+		// IdleTimeout closes connections that have not been used for this long.
+		// Connections with open sessions or forwards are not closed.
+		IdleTimeout time.Duration `yaml:"idleTimeout,omitempty"`
+		// Disabled closes connections after every run
+		Disabled bool `yaml:"disabled,omitempty"`
+	}
+
+	// sshPool holds SSH clients keyed by host and ProxyJump chain.
+	// Clients are reused across commands, lists, and cron runs.
+	sshPool struct {
+		mu    sync.Mutex
+		conns map[string]*pooledConn
+		// connecting holds a lock for each key, so that only one client is connected per key at a time
+		connecting map[string]*sync.Mutex
+		opts       SSHPoolOpts
+		logger     zerolog.Logger
+		stop       chan struct{}
+		running    bool
+		// reap starts closing idle and dead connections in the background when the first one is added
+		reap bool
+	}
+
+	pooledConn struct {
+		client   *ssh.Client
+		lastUsed time.Time
+		// via holds the keys of the proxy connections this client depends on
+		via []string
+		// active is the number of sessions and forwards open on the client
+		active int
+		// sessions is the number of sessions open on the client
+		sessions int
+		// released is closed and replaced when a session is released
+		released chan struct{}
+		// closing is set when the client is removed while in use, it is closed when the last user releases it
+		closing bool
+	}
+)
+
+func newSSHPool(opts SSHPoolOpts, logger zerolog.Logger, reap bool) *sshPool {
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = defaultSSHKeepAlive
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = defaultSSHIdleTimeout
+	}
+	return &sshPool{
+		conns:      make(map[string]*pooledConn),
+		connecting: make(map[string]*sync.Mutex),
+		opts:       opts,
+		logger:     logger,
+		reap:       reap,
+	}
+}
+
+// lockKey locks connecting to key and returns the function that unlocks it.
+// It is held from get until put, so that callers for the same key share one client.
+func (p *sshPool) lockKey(key string) func() {
+	p.mu.Lock()
+	lock, ok := p.connecting[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		p.connecting[key] = lock
+	}
+	p.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// connectionPool returns the SSH connection pool, creating it on first use.
+// Idle connections are only closed in the background in cron mode, as other runs close them when they end.
+func (opts *ConfigOpts) connectionPool() *sshPool {
+	opts.connPoolOnce.Do(func() {
+		opts.connPool = newSSHPool(opts.SSHPool, opts.Logger, opts.cronEnabled && !opts.SSHPool.Disabled)
+	})
+	return opts.connPool
+}
+
+// poolKey returns the key of the host in the connection pool.
+// The key includes the user, address, and ProxyJump chain.
+func (remoteHost *Host) poolKey() string {
+	return chainPoolKey(append(append([]*Host{}, remoteHost.ProxyHost...), remoteHost))
+}
+
+// chainPoolKey returns the pool key of the last host of hops, reached through the hosts before it
+func chainPoolKey(hops []*Host) string {
+	keys := make([]string, len(hops))
+	for i, hop := range hops {
+		keys[i] = fmt.Sprintf("%s@%s", hop.User, hop.HostName)
+	}
+	return strings.Join(keys, ">")
+}
+
+// get returns a live pooled client for key, or nil
+func (p *sshPool) get(key string) *ssh.Client {
+	p.mu.Lock()
+	conn, ok := p.conns[key]
+	p.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if !isClientAlive(conn.client, p.aliveWait()) {
+		p.logger.Debug().Str("connection", key).Msg("pooled SSH connection is dead, reconnecting")
+		p.remove(key)
+		return nil
+	}
+
+	p.touch(key)
+	return conn.client
+}
+
+// put adds client to the pool.
+// If another client was added for key in the meantime, client is closed and the pooled one is returned.
+func (p *sshPool) put(key string, client *ssh.Client, via ...string) *ssh.Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if existing, ok := p.conns[key]; ok && existing.client != client {
+		client.Close()
+		existing.lastUsed = time.Now()
+		return existing.client
+	}
+
+	p.conns[key] = &pooledConn{client: client, lastUsed: time.Now(), via: via, released: make(chan struct{})}
+
+	if p.reap && !p.running {
+		p.running = true
+		p.stop = make(chan struct{})
+		go p.maintain(p.stop)
+	}
+
+	return client
+}
+
+// acquire marks the client for key as in use by a forward, so it is not closed while idle.
+// The returned function releases it.
+func (p *sshPool) acquire(key string) func() {
+	return p.acquireConn(key, false)
+}
+
+// acquireSession marks the client for key as in use by a session.
+// The returned function releases it, and wakes callers waiting in waitForSession.
+func (p *sshPool) acquireSession(key string) func() {
+	return p.acquireConn(key, true)
+}
+
+func (p *sshPool) acquireConn(key string, session bool) func() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conn, ok := p.conns[key]
+	if !ok {
+		return func() {}
+	}
+	conn.active++
+	if session {
+		conn.sessions++
+	}
+	p.touchLocked(key, time.Now())
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			conn.active--
+			if session {
+				conn.sessions--
+				close(conn.released)
+				conn.released = make(chan struct{})
+			}
+			p.touchLocked(key, time.Now())
+			if conn.closing && conn.active == 0 {
+				conn.client.Close()
+			}
+		})
+	}
+}
+
+// waitForSession waits until a session on the client for key is released.
+// It returns false without waiting if no sessions are open.
+func (p *sshPool) waitForSession(key string) bool {
+	p.mu.Lock()
+	conn, ok := p.conns[key]
+	if !ok || conn.sessions == 0 {
+		p.mu.Unlock()
+		return false
+	}
+	released := conn.released
+	p.mu.Unlock()
+
+	<-released
+	return true
+}
+
+// inUseLocked returns the keys of the connections with open sessions or forwards,
+// and of the proxy connections that pooled connections go through
+func (p *sshPool) inUseLocked() map[string]bool {
+	inUse := make(map[string]bool)
+	var mark func(key string)
+	mark = func(key string) {
+		if inUse[key] {
+			return
+		}
+		inUse[key] = true
+		if conn, ok := p.conns[key]; ok {
+			for _, v := range conn.via {
+				mark(v)
+			}
+		}
+	}
+	for key, conn := range p.conns {
+		if conn.active > 0 {
+			mark(key)
+		}
+		for _, v := range conn.via {
+			mark(v)
+		}
+	}
+	return inUse
+}
+
+// touch marks key and the proxy connections it goes through as used
+func (p *sshPool) touch(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.touchLocked(key, time.Now())
+}
+
+func (p *sshPool) touchLocked(key string, now time.Time) {
+	conn, ok := p.conns[key]
+	if !ok {
+		return
+	}
+	conn.lastUsed = now
+	for _, v := range conn.via {
+		p.touchLocked(v, now)
+	}
+}
+
+// remove removes the client for key from the pool and closes it.
+// A client with open sessions or forwards is closed when the last one is released instead.
+func (p *sshPool) remove(key string) {
+	p.mu.Lock()
+	conn, ok := p.conns[key]
+	delete(p.conns, key)
+	inUse := ok && conn.active > 0
+	if inUse {
+		conn.closing = true
+	}
+	p.mu.Unlock()
+
+	if ok && !inUse {
+		conn.client.Close()
+	}
+}
+
+// maintain sends keepalives and closes idle or dead connections until stop is closed
+func (p *sshPool) maintain(stop chan struct{}) {
+	ticker := time.NewTicker(p.opts.KeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			conns := make(map[string]*pooledConn, len(p.conns))
+			for k, v := range p.conns {
+				conns[k] = v
+			}
+			inUse := p.inUseLocked()
+			p.mu.Unlock()
+
+			for key, conn := range conns {
+				p.mu.Lock()
+				idle := time.Since(conn.lastUsed)
+				p.mu.Unlock()
+
+				if !inUse[key] && idle > p.opts.IdleTimeout {
+					p.logger.Info().Msgf("Closing idle connection %s", key)
+					p.remove(key)
+					continue
+				}
+
+				if !isClientAlive(conn.client, p.aliveWait()) {
+					p.logger.Info().Msgf("Connection %s stopped responding to keepalives", key)
+					p.remove(key)
+				}
+			}
+		}
+	}
+}
+
+// closeAll closes every pooled connection, targets before the proxies they go through
+func (p *sshPool) closeAll() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = make(map[string]*pooledConn)
+	if p.running {
+		close(p.stop)
+		p.running = false
+	}
+	p.mu.Unlock()
+
+	for key, conn := range conns {
+		if len(conn.via) == 0 {
+			continue
+		}
+		p.logger.Info().Msgf("Closing host connection %s", key)
+		conn.client.Close()
+	}
+	for key, conn := range conns {
+		if len(conn.via) != 0 {
+			continue
+		}
+		p.logger.Info().Msgf("Closing host connection %s", key)
+		conn.client.Close()
+	}
+}
+
+// aliveWait returns how long connection checks wait for the keepalive reply
+func (p *sshPool) aliveWait() time.Duration {
+	return min(p.opts.KeepAlive, maxSSHAliveWait)
+}
+
+// isClientAlive sends a keepalive request to check that the connection still works.
+// The connection is treated as dead if there is no reply within timeout, as half-open connections never reply.
+func isClientAlive(client *ssh.Client, timeout time.Duration) bool {
+	if client == nil {
+		return false
+	}
+
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		reply <- err
+	}()
+
+	select {
+	case err := <-reply:
+		return err == nil
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,215 @@
+package backy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.andrewnw.xyz/CyberShell/backy/pkg/sshtest"
+)
+
+func TestSSHPoolReuse(t *testing.T) {
+	opts := newTestOpts(t)
+	host, server := newTestHost(t, opts, "web")
+
+	for range 3 {
+		if err := host.ConnectToHost(opts); err != nil {
+			t.Fatal(err)
+		}
+		session, release, err := host.createSSHSession(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out, err := session.CombinedOutput("echo ok"); err != nil || string(out) != "ok\n" {
+			t.Errorf("output = %q, %v", out, err)
+		}
+		session.Close()
+		release()
+	}
+
+	if got := server.Connections(); got != 1 {
+		t.Errorf("connections = %d, want the pooled connection reused", got)
+	}
+	if opts.connectionPool().running {
+		t.Error("idle connections are closed in the background outside of cron mode")
+	}
+}
+
+func TestSSHPoolReconnect(t *testing.T) {
+	opts := newTestOpts(t)
+	host, server := newTestHost(t, opts, "web")
+
+	if err := host.ConnectToHost(opts); err != nil {
+		t.Fatal(err)
+	}
+	host.SshClient.Close()
+
+	// the dead client is dropped when a session can't be opened on it
+	session, release, err := host.createSSHSession(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	defer session.Close()
+	if out, err := session.CombinedOutput("echo ok"); err != nil || string(out) != "ok\n" {
+		t.Errorf("output = %q, %v", out, err)
+	}
+
+	// and a dead pooled client is not handed out
+	host.SshClient.Close()
+	if err := host.ConnectToHost(opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.Connections(); got != 3 {
+		t.Errorf("connections = %d, want a new connection for each dead client", got)
+	}
+}
+
+func TestSSHPoolKeepsActiveConnections(t *testing.T) {
+	opts := newTestOpts(t)
+	opts.cronEnabled = true
+	opts.SSHPool = SSHPoolOpts{KeepAlive: 10 * time.Millisecond, IdleTimeout: 50 * time.Millisecond}
+	host, _ := newTestHost(t, opts, "db")
+
+	if err := host.ConnectToHost(opts); err != nil {
+		t.Fatal(err)
+	}
+	session, release, err := host.createSSHSession(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the session runs for several idle timeouts
+	if out, err := session.CombinedOutput("sleep 0.5; echo done"); err != nil || string(out) != "done\n" {
+		t.Fatalf("long-running session = %q, %v", out, err)
+	}
+	session.Close()
+	if opts.connectionPool().get(host.poolKey()) == nil {
+		t.Fatal("connection with an open session was closed while idle")
+	}
+	release()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		pool := opts.connectionPool()
+		pool.mu.Lock()
+		_, found := pool.conns[host.poolKey()]
+		pool.mu.Unlock()
+		if !found {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Error("idle connection was not closed after its session was released")
+}
+
+func TestSSHPoolParallelLists(t *testing.T) {
+	opts := newTestOpts(t)
+	host, server := newTestHost(t, opts, "web")
+
+	opts.Cmds = make(map[string]*Command)
+	opts.CmdConfigLists = make(map[string]*CmdList)
+	for _, list := range []string{"backups", "reports"} {
+		var order []string
+		for i := range 3 {
+			name := fmt.Sprintf("%s-%d", list, i)
+			opts.Cmds[name] = &Command{Name: name, Cmd: "touch", Args: []string{name}, Host: "web", RemoteHost: host}
+			order = append(order, name)
+		}
+		opts.CmdConfigLists[list] = &CmdList{Name: list, Order: order}
+	}
+
+	opts.RunListConfig("")
+
+	for name := range opts.Cmds {
+		if _, err := os.Stat(filepath.Join(server.Dir, name)); err != nil {
+			t.Errorf("command %s did not run: %v", name, err)
+		}
+	}
+	if got := server.Connections(); got != 1 {
+		t.Errorf("connections = %d, want both lists to share one connection", got)
+	}
+}
+
+func TestSSHPoolStalledConnection(t *testing.T) {
+	opts := newTestOpts(t)
+	opts.SSHPool = SSHPoolOpts{KeepAlive: 100 * time.Millisecond}
+	host, server := newTestHost(t, opts, "web", sshtest.WithStalledRequests())
+
+	if err := host.ConnectToHost(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pooled connection never answers keepalives, so it is replaced instead of blocking
+	done := make(chan error, 1)
+	go func() { done <- host.ConnectToHost(opts) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ConnectToHost blocked on a connection that does not answer keepalives")
+	}
+	if got := server.Connections(); got != 2 {
+		t.Errorf("connections = %d, want the stalled connection replaced", got)
+	}
+}
+
+func TestSSHPoolWaitsForSession(t *testing.T) {
+	opts := newTestOpts(t)
+	host, server := newTestHost(t, opts, "web", sshtest.WithMaxSessions(1))
+
+	if err := host.ConnectToHost(opts); err != nil {
+		t.Fatal(err)
+	}
+	first, releaseFirst, err := host.createSSHSession(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = first.CombinedOutput("sleep 0.3")
+		first.Close()
+		releaseFirst()
+	}()
+
+	// the server refuses a second session until the first one is closed
+	second, release, err := host.createSSHSession(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	defer second.Close()
+	if out, err := second.CombinedOutput("echo ok"); err != nil || string(out) != "ok\n" {
+		t.Errorf("output = %q, %v", out, err)
+	}
+	if got := server.Connections(); got != 1 {
+		t.Errorf("connections = %d, want the connection kept while waiting for a session", got)
+	}
+}
+
+func TestSSHPoolRemoveInUse(t *testing.T) {
+	opts := newTestOpts(t)
+	host, _ := newTestHost(t, opts, "web")
+
+	if err := host.ConnectToHost(opts); err != nil {
+		t.Fatal(err)
+	}
+	pool := opts.connectionPool()
+	release := pool.acquireSession(host.poolKey())
+
+	// the connection is not closed while a session uses it
+	pool.remove(host.poolKey())
+	session, err := host.SshClient.NewSession()
+	if err != nil {
+		t.Fatalf("connection in use was closed: %v", err)
+	}
+	session.Close()
+
+	release()
+	if _, err := host.SshClient.NewSession(); err == nil {
+		t.Error("removed connection was not closed after its last session was released")
+	}
+}
@@ -0,0 +1,120 @@
+// stdin.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// stdinCommandName is the name of the command read from stdin by AddStdinCommand
+const stdinCommandName = "stdin"
+
+// validateStdin checks the stdin of command, and resolves the path of its file
+func validateStdin(command *Command, opts *ConfigOpts) error {
+	stdin := command.Stdin
+
+	set := 0
+	for _, v := range []string{stdin.File, stdin.Content, stdin.FromCommand} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("stdin of command %s must have one of file, content or fromCommand", command.Name)
+	}
+
+	switch command.Type {
+	case ScriptCommandType, ScriptFileCommandType, RemoteScriptCommandType, PackageCommandType, UserCommandType:
+		return fmt.Errorf("stdin is not supported for %s command %s", command.Type, command.Name)
+	}
+
+	if stdin.File != "" {
+		path, err := getFullPathWithHomeDir(replaceVarInString(opts.Vars, stdin.File, opts.Logger))
+		if err != nil {
+			return err
+		}
+		stdin.File = path
+	}
+
+	// follow fromCommand, so commands do not read the output of each other forever
+	seen := map[string]bool{command.Name: true}
+	for from := stdin.FromCommand; from != ""; {
+		fromCmd, found := opts.Cmds[from]
+		if !found {
+			return fmt.Errorf("stdin of command %s: command %s not found", command.Name, from)
+		}
+		if seen[from] {
+			return fmt.Errorf("stdin of command %s: command %s reads its own output", command.Name, from)
+		}
+		seen[from] = true
+
+		from = ""
+		if fromCmd.Stdin != nil {
+			from = fromCmd.Stdin.FromCommand
+		}
+	}
+	return nil
+}
+
+// stdinReader returns the stdin of command.
+// The command of fromCommand is run, and its output is returned.
+// fromCommand is line-oriented text: the output lines are joined with newlines, so the input is not
+// byte-exact, and all of it is held in memory. Pipelines stream bytes between commands instead.
+// The returned function must be called once the command has run.
+func (opts *ConfigOpts) stdinReader(command *Command, cmdCtxLogger zerolog.Logger) (io.Reader, func(), error) {
+	stdin := command.Stdin
+	switch {
+	case stdin.File != "":
+		file, err := os.Open(stdin.File)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error opening stdin of command %s: %w", command.Name, err)
+		}
+		return file, func() { _ = file.Close() }, nil
+	case stdin.FromCommand != "":
+		fromCmd := *opts.Cmds[stdin.FromCommand]
+		cmdCtxLogger.Info().Msgf("Running command %s for the stdin of %s", fromCmd.Name, command.Name)
+		output, err := fromCmd.RunCmd(fromCmd.GenerateLogger(opts), opts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error running command %s for the stdin of %s: %w", fromCmd.Name, command.Name, err)
+		}
+		var input string
+		if len(output) > 0 {
+			input = strings.Join(output, "\n") + "\n"
+		}
+		return strings.NewReader(input), func() {}, nil
+	default:
+		return strings.NewReader(stdin.Content), func() {}, nil
+	}
+}
+
+// AddStdinCommand adds a command that runs the script read from r with sh.
+// Returns the name of the command.
+func (opts *ConfigOpts) AddStdinCommand(r io.Reader) (string, error) {
+	if _, found := opts.Cmds[stdinCommandName]; found {
+		return "", fmt.Errorf("command %s is already defined in the config file", stdinCommandName)
+	}
+	script, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("error reading commands from stdin: %w", err)
+	}
+	if len(strings.TrimSpace(string(script))) == 0 {
+		return "", fmt.Errorf("no commands were given on stdin")
+	}
+
+	if opts.Cmds == nil {
+		opts.Cmds = make(map[string]*Command)
+	}
+	opts.Cmds[stdinCommandName] = &Command{
+		Name:  stdinCommandName,
+		Cmd:   "sh",
+		Stdin: &CmdStdin{Content: string(script)},
+	}
+	return stdinCommandName, nil
+}
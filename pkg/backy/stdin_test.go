@@ -0,0 +1,136 @@
+package backy
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestValidateStdin(t *testing.T) {
+	cmds := map[string]*Command{
+		"dump":  {Name: "dump", Cmd: "pg_dump"},
+		"loopA": {Name: "loopA", Cmd: "cat", Stdin: &CmdStdin{FromCommand: "loopB"}},
+		"loopB": {Name: "loopB", Cmd: "cat", Stdin: &CmdStdin{FromCommand: "loopA"}},
+	}
+
+	tests := []struct {
+		name    string
+		command Command
+		wantErr string
+	}{
+		{name: "content", command: Command{Cmd: "psql", Stdin: &CmdStdin{Content: "SELECT 1;"}}},
+		{name: "fromCommand", command: Command{Cmd: "psql", Stdin: &CmdStdin{FromCommand: "dump"}}},
+		{name: "nothing set", command: Command{Cmd: "psql", Stdin: &CmdStdin{}}, wantErr: "must have one of"},
+		{name: "two set", command: Command{Cmd: "psql", Stdin: &CmdStdin{Content: "SELECT 1;", File: "query.sql"}}, wantErr: "must have one of"},
+		{name: "script", command: Command{Cmd: "echo", Type: ScriptCommandType, Stdin: &CmdStdin{Content: "a"}}, wantErr: "not supported for script command"},
+		{name: "missing command", command: Command{Cmd: "psql", Stdin: &CmdStdin{FromCommand: "missing"}}, wantErr: "command missing not found"},
+		{name: "own output", command: Command{Cmd: "psql", Stdin: &CmdStdin{FromCommand: "loopA"}}, wantErr: "reads its own output"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &ConfigOpts{Cmds: cmds, Logger: zerolog.Nop()}
+			command := tt.command
+			command.Name = tt.name
+
+			err := validateStdin(&command, opts)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validateStdin: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validateStdin error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunCmdStdin(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "query.sql")
+	if err := os.WriteFile(file, []byte("SELECT 1;\nSELECT 2;\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		stdin CmdStdin
+		want  []string
+	}{
+		{name: "content", stdin: CmdStdin{Content: "SELECT 1;\n"}, want: []string{"SELECT 1;"}},
+		{name: "file", stdin: CmdStdin{File: file}, want: []string{"SELECT 1;", "SELECT 2;"}},
+		{name: "fromCommand", stdin: CmdStdin{FromCommand: "dump"}, want: []string{"dumped 1", "dumped 2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Run("local", func(t *testing.T) {
+				opts := newTestOpts(t)
+				opts.Cmds = map[string]*Command{
+					"dump": {Name: "dump", Cmd: "printf", Args: []string{`dumped 1\ndumped 2`}},
+				}
+				stdin := tt.stdin
+				command := &Command{Name: "psql", Cmd: "cat", Stdin: &stdin}
+
+				got, err := command.RunCmd(zerolog.Nop(), opts)
+				if err != nil {
+					t.Fatalf("RunCmd: %v", err)
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("output = %q, want %q", got, tt.want)
+				}
+			})
+
+			t.Run("remote", func(t *testing.T) {
+				opts := newTestOpts(t)
+				host, _ := newTestHost(t, opts, "db-1")
+				opts.Cmds = map[string]*Command{
+					"dump": {Name: "dump", Cmd: "printf", Args: []string{`dumped 1\ndumped 2`}},
+				}
+				stdin := tt.stdin
+				command := &Command{Name: "psql", Cmd: "cat", Host: host.Host, RemoteHost: host, Stdin: &stdin}
+
+				got, err := command.RunCmdOnHost(zerolog.Nop(), opts)
+				if err != nil {
+					t.Fatalf("RunCmdOnHost: %v", err)
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("output = %q, want %q", got, tt.want)
+				}
+			})
+		})
+	}
+}
+
+func TestAddStdinCommand(t *testing.T) {
+	opts := newTestOpts(t)
+	host, _ := newTestHost(t, opts, "web-1")
+
+	name, err := opts.AddStdinCommand(strings.NewReader("echo one\necho two >&2\necho three\n"))
+	if err != nil {
+		t.Fatalf("AddStdinCommand: %v", err)
+	}
+
+	opts.ExecCmdsOnHosts([]string{name}, []string{host.Host, "localhost"})
+	results := opts.CmdResults()
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	for _, r := range results {
+		if r.Status != HostResultSucceeded || !slices.Equal(r.Output, []string{"one", "three"}) || !slices.Equal(r.Stderr, []string{"two"}) {
+			t.Errorf("result = %+v, want output [one three] and stderr [two]", r)
+		}
+	}
+
+	if _, err := opts.AddStdinCommand(strings.NewReader("echo again")); err == nil {
+		t.Error("adding the stdin command twice did not fail")
+	}
+	if _, err := (&ConfigOpts{}).AddStdinCommand(strings.NewReader("\n")); err == nil {
+		t.Error("empty stdin did not fail")
+	}
+}
@@ -0,0 +1,171 @@
+// template.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	usermanagercommon "git.andrewnw.xyz/CyberShell/backy/pkg/usermanager/common"
+)
+
+// cmdTemplate renders the fields of a command with text/template
+type cmdTemplate struct {
+	funcs template.FuncMap
+	data  templateData
+}
+
+// templateData is the data templates are executed with
+type templateData struct {
+	Name string            // Name of the command
+	Vars map[string]string // Variables of the config file
+}
+
+// templateHost is the host a command runs on, as returned by the host function
+type templateHost struct {
+	Name     string // Host of the command, or local
+	HostName string
+	User     string
+	Port     uint16
+}
+
+// newCmdTemplate returns the template functions and data of command.
+// The time of now is the time the template was made, so all fields of a run have the same time.
+func (opts *ConfigOpts) newCmdTemplate(command *Command) *cmdTemplate {
+	start := time.Now()
+
+	host := templateHost{Name: command.hostLabel()}
+	if command.RemoteHost != nil {
+		host.HostName = command.RemoteHost.HostName
+		host.User = command.RemoteHost.User
+		host.Port = command.RemoteHost.Port
+	}
+
+	return &cmdTemplate{
+		data: templateData{Name: command.Name, Vars: opts.Vars},
+		funcs: template.FuncMap{
+			"now": func(layout string) string {
+				return start.Format(layout)
+			},
+			"host": func() templateHost {
+				return host
+			},
+			"env": os.Getenv,
+			"vault": func(name string) (string, error) {
+				value, err := opts.vaultKeyValue(name, command.leases)
+				if err == nil {
+					opts.addSecret(value)
+				}
+				return value, err
+			},
+			"default": func(def, value string) string {
+				if value == "" {
+					return def
+				}
+				return value
+			},
+			"quote": func(s string) string {
+				return fmt.Sprintf("%q", s)
+			},
+			"shellQuote": usermanagercommon.ShellQuote,
+		},
+	}
+}
+
+// render executes text as a template. Text without actions is returned as is.
+func (t *cmdTemplate) render(field, text string) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New(field).Option("missingkey=error").Funcs(t.funcs).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("error parsing template of %s: %w", field, err)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, t.data); err != nil {
+		return "", fmt.Errorf("error rendering template of %s: %w", field, err)
+	}
+	return out.String(), nil
+}
+
+// validateTemplates parses the templates of command, so errors are found when the config file is loaded
+func validateTemplates(command *Command, opts *ConfigOpts) error {
+	funcs := opts.newCmdTemplate(command).funcs
+	fields := map[string]string{"cmd": command.Cmd}
+	for i, arg := range command.Args {
+		fields[fmt.Sprintf("args[%d]", i)] = arg
+	}
+	if command.Dir != nil {
+		fields["dir"] = *command.Dir
+	}
+	for i, env := range command.Environment {
+		fields[fmt.Sprintf("environment[%d]", i)] = env
+	}
+
+	for field, text := range fields {
+		if _, err := template.New(field).Funcs(funcs).Parse(text); err != nil {
+			return fmt.Errorf("command %s: error parsing template of %s: %w", command.Name, field, err)
+		}
+	}
+	return nil
+}
+
+// renderTemplates returns a copy of command with its cmd, args, dir and environment rendered, if it has template set.
+// Commands with hosts are rendered for each host when they run on it.
+func (command *Command) renderTemplates(opts *ConfigOpts) (*Command, error) {
+	if !command.Template || (command.Host == "" && command.Hosts != nil) {
+		return command, nil
+	}
+
+	rendered := *command
+	rendered.tmpl = opts.newCmdTemplate(command)
+
+	var err error
+	if rendered.Cmd, err = rendered.tmpl.render("cmd", command.Cmd); err != nil {
+		return nil, fmt.Errorf("command %s: %w", command.Name, err)
+	}
+
+	// nil and empty slices are kept as they are, as they choose how the command is run
+	rendered.Args = slices.Clone(command.Args)
+	for i, arg := range command.Args {
+		if rendered.Args[i], err = rendered.tmpl.render(fmt.Sprintf("args[%d]", i), arg); err != nil {
+			return nil, fmt.Errorf("command %s: %w", command.Name, err)
+		}
+	}
+
+	if command.Dir != nil {
+		dir, err := rendered.tmpl.render("dir", *command.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("command %s: %w", command.Name, err)
+		}
+		rendered.Dir = &dir
+	}
+
+	rendered.Environment = slices.Clone(command.Environment)
+	for i, env := range command.Environment {
+		if rendered.Environment[i], err = rendered.tmpl.render(fmt.Sprintf("environment[%d]", i), env); err != nil {
+			return nil, fmt.Errorf("command %s: %w", command.Name, err)
+		}
+	}
+
+	return &rendered, nil
+}
+
+// renderScript renders the script of a scriptFile or remoteScript command, if the command has template set
+func (command *Command) renderScript(script []byte) ([]byte, error) {
+	if command.tmpl == nil {
+		return script, nil
+	}
+	rendered, err := command.tmpl.render("script", string(script))
+	if err != nil {
+		return nil, fmt.Errorf("command %s: %w", command.Name, err)
+	}
+	return []byte(rendered), nil
+}
@@ -0,0 +1,182 @@
+package backy
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestCmdTemplateRender(t *testing.T) {
+	t.Setenv("BACKY_TEST_BUCKET", "backups")
+
+	opts := &ConfigOpts{Vars: map[string]string{"app": "shop"}, Logger: zerolog.Nop()}
+	command := &Command{
+		Name:       "dump",
+		Host:       "db-1",
+		RemoteHost: &Host{Host: "db-1", HostName: "10.0.0.5", User: "postgres", Port: 2222},
+	}
+	tmpl := opts.newCmdTemplate(command)
+
+	tests := []struct {
+		text    string
+		want    string
+		wantErr string
+	}{
+		{text: "no actions {", want: "no actions {"},
+		{text: `{{ now "2006" }}`, want: time.Now().Format("2006")},
+		{text: "{{ host.Name }} {{ host.HostName }} {{ host.User }} {{ host.Port }}", want: "db-1 10.0.0.5 postgres 2222"},
+		{text: "{{ .Name }}-{{ .Vars.app }}", want: "dump-shop"},
+		{text: `{{ env "BACKY_TEST_BUCKET" }}`, want: "backups"},
+		{text: `{{ env "BACKY_TEST_UNSET" | default "local" }}`, want: "local"},
+		{text: `{{ env "BACKY_TEST_BUCKET" | default "local" }}`, want: "backups"},
+		{text: `{{ quote "a b" }}`, want: `"a b"`},
+		{text: `{{ shellQuote "it's; rm -rf /" }}`, want: `'it'\''s; rm -rf /'`},
+		{text: "{{ .Vars.missing }}", wantErr: "missing"},
+		{text: `{{ vault "db-password" }}`, wantErr: "not found in vault keys"},
+		{text: "{{ now", wantErr: "error parsing template"},
+	}
+
+	for _, tt := range tests {
+		got, err := tmpl.render("cmd", tt.text)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("render(%q) error = %v, want %q", tt.text, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("render(%q): %v", tt.text, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("render(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+	opts := &ConfigOpts{Logger: zerolog.Nop()}
+	dir := "/backups/{{ host.Name }}"
+
+	command := &Command{
+		Name:        "archive",
+		Cmd:         "tar",
+		Args:        []string{"-czf", `{{ host.Name }}-{{ now "2006" }}.tar.gz`, "/srv"},
+		Dir:         &dir,
+		Environment: []string{"TARGET={{ .Name }}"},
+		Template:    true,
+	}
+
+	rendered, err := command.renderTemplates(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantArgs := []string{"-czf", "local-" + time.Now().Format("2006") + ".tar.gz", "/srv"}
+	if !slices.Equal(rendered.Args, wantArgs) {
+		t.Errorf("args = %q, want %q", rendered.Args, wantArgs)
+	}
+	if *rendered.Dir != "/backups/local" {
+		t.Errorf("dir = %q", *rendered.Dir)
+	}
+	if !slices.Equal(rendered.Environment, []string{"TARGET=archive"}) {
+		t.Errorf("environment = %q", rendered.Environment)
+	}
+	if command.Args[1] != `{{ host.Name }}-{{ now "2006" }}.tar.gz` || *command.Dir != dir {
+		t.Errorf("the command itself was rendered: %+v", command)
+	}
+
+	command.Template = false
+	if rendered, _ := command.renderTemplates(opts); rendered != command {
+		t.Error("command without template set was copied")
+	}
+
+	fanOut := &Command{Cmd: "echo", Args: []string{"{{ host.Name }}"}, Hosts: []string{"web-1", "web-2"}, Template: true}
+	if rendered, _ := fanOut.renderTemplates(opts); rendered != fanOut {
+		t.Error("command with hosts was rendered before running on each host")
+	}
+
+	noArgs := &Command{Cmd: "{{ .Name }}", Name: "uptime", Template: true}
+	if rendered, _ := noArgs.renderTemplates(opts); rendered.Cmd != "uptime" || rendered.Args != nil || rendered.Environment != nil {
+		t.Errorf("rendered = %+v, want cmd uptime without args or environment", rendered)
+	}
+}
+
+func TestValidateTemplates(t *testing.T) {
+	opts := &ConfigOpts{Logger: zerolog.Nop()}
+
+	valid := &Command{Name: "ok", Cmd: "echo", Args: []string{`{{ now "2006-01-02" | shellQuote }}`}, Template: true}
+	if err := validateTemplates(valid, opts); err != nil {
+		t.Errorf("validateTemplates: %v", err)
+	}
+
+	invalid := &Command{Name: "bad", Cmd: "echo", Environment: []string{"DAY={{ now "}, Template: true}
+	if err := validateTemplates(invalid, opts); err == nil || !strings.Contains(err.Error(), "environment[0]") {
+		t.Errorf("validateTemplates error = %v, want an error for environment[0]", err)
+	}
+
+	unknown := &Command{Name: "bad", Cmd: "{{ hostname }}", Template: true}
+	if err := validateTemplates(unknown, opts); err == nil {
+		t.Error("unknown function did not fail")
+	}
+}
+
+func TestRunCmdTemplate(t *testing.T) {
+	opts := newTestOpts(t)
+	host, _ := newTestHost(t, opts, "web-1")
+
+	script := filepath.Join(t.TempDir(), "backup.sh")
+	if err := os.WriteFile(script, []byte("echo \"{{ host.User }} on {{ host.Name }}\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("local", func(t *testing.T) {
+		command := &Command{Name: "local", Cmd: "echo", Args: []string{"{{ host.Name }}", "{{ shellQuote .Name }}"}, Template: true}
+		got, err := command.RunCmd(zerolog.Nop(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, []string{"local 'local'"}) {
+			t.Errorf("output = %q", got)
+		}
+		if command.Args[0] != "{{ host.Name }}" {
+			t.Errorf("args of the command were changed to %q", command.Args)
+		}
+	})
+
+	t.Run("remote", func(t *testing.T) {
+		command := &Command{Name: "remote", Cmd: "echo", Args: []string{"{{ host.Name }}"}, Host: host.Host, RemoteHost: host, Template: true}
+		got, err := command.RunCmdOnHost(zerolog.Nop(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, []string{"web-1"}) {
+			t.Errorf("output = %q", got)
+		}
+	})
+
+	t.Run("script file", func(t *testing.T) {
+		command := &Command{Name: "script", Type: ScriptFileCommandType, Cmd: script, Host: host.Host, RemoteHost: host, Template: true}
+		got, err := command.RunCmdOnHost(zerolog.Nop(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, []string{"web-1-user on web-1"}) {
+			t.Errorf("output = %q", got)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		command := &Command{Name: "error", Cmd: "echo", Args: []string{"{{ .Vars.missing }}"}, Template: true}
+		if _, err := command.RunCmd(zerolog.Nop(), opts); err == nil {
+			t.Fatal("missing variable did not fail")
+		}
+		if command.exitCode != -1 {
+			t.Errorf("exit code = %d, want -1", command.exitCode)
+		}
+	})
+}
@@ -2,10 +2,14 @@ package backy
 
 import (
 	"bytes"
+	"io"
+	"sync"
 	"text/template"
+	"time"
 
 	"strings"
 
+	"git.andrewnw.xyz/CyberShell/backy/pkg/inventory"
 	"git.andrewnw.xyz/CyberShell/backy/pkg/pkgman"
 	packagemanagercommon "git.andrewnw.xyz/CyberShell/backy/pkg/pkgman/common"
 	"git.andrewnw.xyz/CyberShell/backy/pkg/remotefetcher"
@@ -16,6 +20,7 @@ import (
 	"github.com/nikoksr/notify"
 	"github.com/rs/zerolog"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 type (
@@ -41,7 +46,38 @@ type (
 		isProxyHost        bool
 		// ProxyHost holds the configuration for a ProxyJump host
 		ProxyHost []*Host
-		// CertPath           string `yaml:"cert_path,omitempty"`
+		// Tags and Groups are used to select hosts with tag:name and group:name
+		Tags   []string `yaml:"tags,omitempty"`
+		Groups []string `yaml:"groups,omitempty"`
+		// CertPath is the OpenSSH certificate for the private key.
+		// If not set, IdentityFile-cert.pub is used if it exists.
+		CertPath string `yaml:"certificateFile,omitempty"`
+		// IdentityAgent is the ssh-agent socket, SSH_AUTH_SOCK if not set. "none" disables the agent.
+		IdentityAgent string `yaml:"identityAgent,omitempty"`
+		// HostKeyPolicy is strict (default) or tofu, which trusts and saves the key of new hosts.
+		// It takes precedence over StrictHostKeyChecking from the ssh config file.
+		HostKeyPolicy string `yaml:"hostKeyPolicy,omitempty"`
+		// ForwardAgent forwards the ssh-agent to commands run on the host
+		ForwardAgent bool `yaml:"forwardAgent,omitempty"`
+		agentClient  agent.ExtendedAgent
+
+		// LocalForwards and RemoteForwards are opened over the host's connection for the duration of a run.
+		// The format is that of ssh -L and -R: [bind_address:]port:host:hostport
+		LocalForwards  []string `yaml:"localForwards,omitempty"`
+		RemoteForwards []string `yaml:"remoteForwards,omitempty"`
+		forwards       []io.Closer
+		forwardsClient *ssh.Client
+
+		// connectMu serializes connecting to the host, as lists running at the same time share it
+		connectMu sync.Mutex
+
+		// settings read from the ssh config file
+		knownHostsFiles       []string
+		strictHostKeyChecking string
+		serverAliveInterval   time.Duration
+		serverAliveCountMax   int
+		proxyCommand          string
+		identitiesOnly        bool
 	}
 
 	sshConfigFile struct {
@@ -85,6 +121,34 @@ type (
 			InList bool   `yaml:"inList,omitempty"`
 		} `yaml:"output"`
 
+		// Pipeline holds the names of the commands of a pipeline command.
+		// The stdout of each command is the stdin of the next.
+		Pipeline []string `yaml:"pipeline,omitempty"`
+
+		// Template renders cmd, args, dir, environment and script files with text/template when the command runs
+		Template bool `yaml:"template,omitempty"`
+
+		// tmpl renders the script file of a command with Template set
+		tmpl *cmdTemplate
+
+		// Stdin is the input of the command
+		Stdin *CmdStdin `yaml:"stdin,omitempty"`
+
+		// SuccessExitCodes are exit codes besides 0 that count as success, such as 24 for rsync's vanished files
+		SuccessExitCodes []int `yaml:"successExitCodes,omitempty"`
+
+		// stderr and exitCode hold the result of the run of the command.
+		// The commands of opts.Cmds are shared, so each run uses its own copy of the command.
+		stderr   []string
+		exitCode int
+
+		// hookEnv holds the variables a hook is run with
+		hookEnv []string
+
+		// leases holds the dynamic Vault secrets read for a run of the command.
+		// It is only set on the copy of the command made for the run.
+		leases *vaultLeases
+
 		// BEGIN PACKAGE COMMAND FIELDS
 
 		PackageManager string `yaml:"packageManager,omitempty"`
@@ -100,6 +164,15 @@ type (
 		packageCmdSet bool
 		// END PACKAGE COMMAND FIELDS
 
+		// LocalForwards and RemoteForwards are opened for the duration of the command,
+		// over the connection to ForwardHost, or Host if ForwardHost is not set
+		LocalForwards  []string `yaml:"localForwards,omitempty"`
+		RemoteForwards []string `yaml:"remoteForwards,omitempty"`
+
+		// ForwardHost is the host that forwards go through.
+		// The host's own forwards are opened as well.
+		ForwardHost string `yaml:"forwardHost,omitempty"`
+
 		RemoteSource string `yaml:"remoteSource,omitempty"`
 
 		FetchBeforeExecution bool `yaml:"fetchBeforeExecution,omitempty"`
@@ -126,6 +199,14 @@ type (
 
 		UserSshPubKeys []string `yaml:"userSshPubKeys,omitempty"`
 
+		// remove keys not in UserSshPubKeys from authorized_keys
+		UserSshPubKeysExclusive bool `yaml:"userSshPubKeysExclusive,omitempty"`
+
+		// rules written to the user's sudoers.d file, without the username
+		UserSudoRules []string `yaml:"userSudoRules,omitempty"`
+
+		UserExpireDate string `yaml:"userExpireDate,omitempty"`
+
 		userMan usermanager.UserManager
 
 		// OS for the command, only used when type is user
@@ -168,6 +249,23 @@ type (
 		NotifyConfig *notify.Notify
 		Source       string `yaml:"source"` // URL to fetch remote commands
 		Type         string `yaml:"type"`
+
+		// Hosts holds the host selectors for the list when run on hosts.
+		// The selectors are resolved to host names when the config is loaded.
+		Hosts []string `yaml:"hosts,omitempty"`
+
+		// Strategy is how the list runs on hosts: serial, parallel, or rolling.
+		// If not set, the --parallel flag chooses between serial and parallel.
+		Strategy ListStrategy `yaml:"strategy,omitempty"`
+		// BatchSize is the number of hosts, or percentage of hosts such as 25%, a rolling list runs on at once.
+		// The default is one host.
+		BatchSize string `yaml:"batchSize,omitempty"`
+		// PauseBetweenBatches is how long a rolling list waits after a batch before starting the next one
+		PauseBetweenBatches time.Duration `yaml:"pauseBetweenBatches,omitempty"`
+		// MaxFailures and MaxFailPercentage halt a rolling list once more hosts have failed.
+		// If neither is set, the first failure halts the list.
+		MaxFailures       int     `yaml:"maxFailures,omitempty"`
+		MaxFailPercentage float64 `yaml:"maxFailPercentage,omitempty"`
 	}
 
 	GoCronOpts struct {
@@ -189,8 +287,23 @@ type (
 		// key is the host.
 		Hosts map[string]*Host `yaml:"hosts"`
 
+		// Inventory holds the sources from which more hosts are loaded
+		Inventory []inventory.Config `yaml:"inventory"`
+
 		GoCron GoCronOpts `yaml:"goCron:"`
 
+		// SSHPool configures the reuse of SSH connections
+		SSHPool SSHPoolOpts `yaml:"sshPool"`
+
+		// MaxParallel is the number of hosts commands are run on at once. Defaults to 10.
+		MaxParallel int `yaml:"maxParallel"`
+
+		connPool     *sshPool
+		connPoolOnce sync.Once
+
+		// hostsMu guards adding hosts to Hosts while hosts are connected to concurrently
+		hostsMu sync.Mutex
+
 		Logger zerolog.Logger
 
 		// Global log level
@@ -198,6 +311,15 @@ type (
 
 		CmdStdOut bool
 
+		// CmdStdOutMode is how command output is printed to stdout: prefixed, grouped or raw
+		CmdStdOutMode CmdStdOutMode
+
+		// CmdStdOutColor colors the prefix of each host's output
+		CmdStdOutColor bool
+
+		stdOut     *outputMux
+		stdOutOnce sync.Once
+
 		ConfigFilePath string
 
 		HostsFilePath string
@@ -219,6 +341,16 @@ type (
 		backyEnv map[string]string
 
 		vaultClient *vaultapi.Client
+		vaultAuth   *VaultAuth
+		// vaultToken is the secret of the login with vaultAuth, if one was used
+		vaultToken *vaultapi.Secret
+
+		// vaultLeases holds the dynamic secrets read outside of commands, such as for variables
+		vaultLeases *vaultLeases
+
+		// kvVersions holds the KV version of each Vault mount
+		kvVersions   map[string]string
+		kvVersionsMu sync.Mutex
 
 		List ListConfig
 
@@ -232,12 +364,31 @@ type (
 
 		Cache      *remotefetcher.Cache
 		CachedData []*remotefetcher.CacheData
+
+		// packageReports holds the latest listUpgrades and securityUpgrade results.
+		// Key is the host and command name.
+		packageReports   map[string]*PackageReport
+		packageReportsMu sync.Mutex
+
+		// cmdResults holds the result of each command run, in the order they finished
+		cmdResults   []CmdResult
+		cmdResultsMu sync.Mutex
+
+		// sopsFiles holds the data of decrypted sops files, by path
+		sopsFiles   map[string]any
+		sopsFilesMu sync.Mutex
+
+		// secrets holds the values resolved from directives and passwords,
+		// which are masked in logs, notifications and output
+		secrets secretRedactor
 	}
 
 	outStruct struct {
 		CmdName     string
 		CmdExecuted string
 		Output      []string
+		Stderr      []string
+		ExitCode    int
 	}
 
 	VaultKey struct {
@@ -252,9 +403,26 @@ type (
 		Token   string      `yaml:"token"`
 		Address string      `yaml:"address"`
 		Enabled string      `yaml:"enabled"`
+		Auth    *VaultAuth  `yaml:"auth"`
 		Keys    []*VaultKey `yaml:"keys"`
 	}
 
+	// VaultAuth is the auth method used to log in to Vault
+	VaultAuth struct {
+		Method VaultAuthMethod `yaml:"method"`
+		// Mount is the path the auth method is mounted at. Default is the name of the method.
+		Mount string `yaml:"mount"`
+
+		RoleID   string `yaml:"roleId"`   // approle
+		SecretID string `yaml:"secretId"` // approle
+
+		Role string `yaml:"role"` // kubernetes and jwt
+		JWT  string `yaml:"jwt"`  // jwt
+
+		// TokenFile is the service account token for kubernetes, or the JWT for jwt
+		TokenFile string `yaml:"tokenFile"`
+	}
+
 	Notifications struct {
 		MailConfig   map[string]MailConfig   `yaml:"mail,omitempty"`
 		MatrixConfig map[string]MatrixStruct `yaml:"matrix,omitempty"`
@@ -267,13 +435,17 @@ type (
 	}
 
 	environmentVars struct {
-		file string
-		env  []string
+		file   string
+		env    []string
+		vars   []string     // set as they are, without resolving directives
+		leases *vaultLeases // dynamic secrets of the command
 	}
 
 	msgTemplates struct {
 		success *template.Template
 		err     *template.Template
+		// redact masks secrets in messages
+		redact func(string) string
 	}
 
 	ListConfig struct {
@@ -282,6 +454,13 @@ type (
 		Hosts    []string
 	}
 
+	// CmdStdin is where the input of a command comes from. Only one field can be set.
+	CmdStdin struct {
+		File        string `yaml:"file,omitempty"`        // Path of a file
+		Content     string `yaml:"content,omitempty"`     // Literal input
+		FromCommand string `yaml:"fromCommand,omitempty"` // Name of a command whose output lines are the input; use a pipeline for binary data
+	}
+
 	Hooks struct {
 		Error   []string `yaml:"error,omitempty"`
 		Success []string `yaml:"success,omitempty"`
@@ -289,9 +468,35 @@ type (
 	}
 
 	CmdResult struct {
-		CmdName  string // Name of the command executed
-		ListName string // Name of the command list
-		Error    error  // Error encountered, if any
+		CmdName  string           // Name of the command executed
+		ListName string           // Name of the command list
+		Host     string           // Host the command ran on
+		Status   HostResultStatus // Whether the command succeeded
+		Duration time.Duration    // How long the command ran
+		ExitCode int              // Exit code of the command, or -1 if it did not exit
+		Output   []string         // Output of the command
+		Stderr   []string         // Stderr of the command
+		Error    error            // Error encountered, if any
+	}
+
+	// HostResult is the result of running a list on a host
+	HostResult struct {
+		Host   string           `json:"host"`
+		List   string           `json:"list"`
+		Status HostResultStatus `json:"status"`
+		// FailedCmd is the command that failed, if any
+		FailedCmd string        `json:"failedCmd,omitempty"`
+		Error     error         `json:"-"`
+		Duration  time.Duration `json:"duration"`
+	}
+
+	// PackageReport holds the packages found by a listUpgrades or securityUpgrade command on a host.
+	PackageReport struct {
+		Host             string                         `json:"host"`
+		CmdName          string                         `json:"command"`
+		Upgrades         int                            `json:"upgrades"`
+		SecurityUpgrades int                            `json:"securityUpgrades"`
+		Packages         []packagemanagercommon.Package `json:"packages"`
 	}
 
 	ListMetrics struct {
@@ -312,6 +517,10 @@ type (
 	CommandType               int
 	PackageOperation          int
 	AllowedExternalDirectives int
+	ListStrategy              int
+	HostResultStatus          int
+	CmdStdOutMode             int
+	VaultAuthMethod           int
 )
 
 //go:generate go run github.com/dmarkham/enumer -linecomment -yaml -text -json -type=CommandType
@@ -322,17 +531,20 @@ const (
 	RemoteScriptCommandType                    // remoteScript
 	PackageCommandType                         // package
 	UserCommandType                            // user
+	PipelineCommandType                        // pipeline
 )
 
 //go:generate go run github.com/dmarkham/enumer -linecomment -yaml -text -json -type=PackageOperation
 const (
-	DefaultPO                    PackageOperation = iota //
-	PackageOperationInstall                              // install
-	PackageOperationUpgrade                              // upgrade
-	PackageOperationPurge                                // purge
-	PackageOperationRemove                               // remove
-	PackageOperationCheckVersion                         // checkVersion
-	PackageOperationIsInstalled                          // isInstalled
+	DefaultPO                       PackageOperation = iota //
+	PackageOperationInstall                                 // install
+	PackageOperationUpgrade                                 // upgrade
+	PackageOperationPurge                                   // purge
+	PackageOperationRemove                                  // remove
+	PackageOperationCheckVersion                            // checkVersion
+	PackageOperationIsInstalled                             // isInstalled
+	PackageOperationListUpgrades                            // listUpgrades
+	PackageOperationSecurityUpgrade                         // securityUpgrade
 )
 
 //go:generate go run github.com/dmarkham/enumer -linecomment -yaml -text -json -type=AllowedExternalDirectives
@@ -346,3 +558,35 @@ const (
 	AllowedExternalDirectiveFile                                // file
 	AllowedExternalDirectiveEnv                                 // env
 )
+
+//go:generate go run github.com/dmarkham/enumer -linecomment -yaml -text -json -type=ListStrategy
+const (
+	DefaultListStrategy  ListStrategy = iota //
+	SerialListStrategy                       // serial
+	ParallelListStrategy                     // parallel
+	RollingListStrategy                      // rolling
+)
+
+//go:generate go run github.com/dmarkham/enumer -linecomment -yaml -text -json -type=HostResultStatus
+const (
+	HostResultSucceeded HostResultStatus = iota // succeeded
+	HostResultFailed                            // failed
+	HostResultSkipped                           // skipped
+)
+
+//go:generate go run github.com/dmarkham/enumer -linecomment -yaml -text -json -type=CmdStdOutMode
+const (
+	DefaultCmdStdOutMode  CmdStdOutMode = iota //
+	PrefixedCmdStdOutMode                      // prefixed
+	GroupedCmdStdOutMode                       // grouped
+	RawCmdStdOutMode                           // raw
+)
+
+//go:generate go run github.com/dmarkham/enumer -linecomment -yaml -text -json -type=VaultAuthMethod
+const (
+	DefaultVaultAuthMethod    VaultAuthMethod = iota //
+	TokenVaultAuthMethod                             // token
+	AppRoleVaultAuthMethod                           // approle
+	KubernetesVaultAuthMethod                        // kubernetes
+	JWTVaultAuthMethod                               // jwt
+)
@@ -0,0 +1,168 @@
+// userensure.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/ssh"
+)
+
+// ensureUser creates the user if it does not exist.
+// Otherwise, it compares the user's shell, home, groups, and keys with the command
+// and only changes the ones that differ.
+func (command *Command) ensureUser(cmdCtxLogger zerolog.Logger, opts *ConfigOpts) ([]string, error) {
+	var (
+		changes []string
+		cmd     string
+		args    []string
+	)
+
+	existsCmd, existsArgs := command.userMan.UserExists(command.Username)
+	_, err := command.runUserCmd(existsCmd, existsArgs, opts)
+	if err != nil && !isExitError(err) {
+		return nil, fmt.Errorf("error checking if user %s exists: %w", command.Username, err)
+	}
+
+	if err != nil {
+		cmd, args = command.userMan.AddUser(
+			command.Username,
+			command.UserHome,
+			command.UserShell,
+			command.UserIsSystem,
+			command.UserCreateHome,
+			command.UserGroups,
+			command.Args)
+		changes = append(changes, "created")
+		if command.UserSshPubKeys != nil {
+			keysCmd, keysArgs := command.userMan.SetAuthorizedKeys(command.Username, command.UserSshPubKeys, command.UserSshPubKeysExclusive)
+			args = chainCommandArgs(args, keysCmd, keysArgs)
+		}
+	} else {
+		getCmd, getArgs := command.userMan.GetUser(command.Username)
+		output, err := command.runUserCmd(getCmd, getArgs, opts)
+		if err != nil {
+			return nil, fmt.Errorf("error getting user %s: %w: %s", command.Username, err, output)
+		}
+		info, err := command.userMan.ParseUser(output)
+		if err != nil {
+			return nil, err
+		}
+
+		var home, shell string
+		var groups []string
+
+		if command.UserHome != "" && command.UserHome != info.Home {
+			home = command.UserHome
+			changes = append(changes, "home")
+		}
+		if command.UserShell != "" && command.UserShell != info.Shell {
+			shell = command.UserShell
+			changes = append(changes, "shell")
+		}
+		// groups are only added so groups not managed by backy are kept
+		missingGroups := missingItems(command.UserGroups, info.Groups)
+		if len(missingGroups) > 0 {
+			for _, g := range info.Groups {
+				if g != info.PrimaryGroup {
+					groups = append(groups, g)
+				}
+			}
+			groups = append(groups, missingGroups...)
+			changes = append(changes, "groups")
+		}
+		if home != "" || shell != "" || groups != nil {
+			cmd, args = command.userMan.ModifyUser(command.Username, home, shell, groups)
+		}
+
+		if command.UserSshPubKeys != nil && !authorizedKeysInSync(command.UserSshPubKeys, info.SshPubKeys, command.UserSshPubKeysExclusive) {
+			keysCmd, keysArgs := command.userMan.SetAuthorizedKeys(command.Username, command.UserSshPubKeys, command.UserSshPubKeysExclusive)
+			if cmd == "" {
+				cmd, args = keysCmd, keysArgs
+			} else {
+				args = chainCommandArgs(args, keysCmd, keysArgs)
+			}
+			changes = append(changes, "sshPubKeys")
+		}
+	}
+
+	if len(changes) == 0 {
+		cmdCtxLogger.Info().Bool("changed", false).Str("user", command.Username).Msg("user unchanged")
+		return []string{fmt.Sprintf("user %s unchanged", command.Username)}, nil
+	}
+
+	output, err := command.runUserCmd(cmd, args, opts)
+	outputArr := strings.Split(strings.TrimSpace(output), "\n")
+	if command.Output.ToLog {
+		for _, o := range outputArr {
+			cmdCtxLogger.Info().Str("cmd", command.Name).Str("output", o).Send()
+		}
+	}
+	if err != nil {
+		return outputArr, fmt.Errorf("error ensuring user %s: %w", command.Username, err)
+	}
+
+	cmdCtxLogger.Info().Bool("changed", true).Str("user", command.Username).Strs("changes", changes).Msg("user changed")
+	return append(outputArr, fmt.Sprintf("user %s changed: %s", command.Username, strings.Join(changes, ", "))), nil
+}
+
+// runUserCmd runs cmd and args in a shell on the command's host and returns the combined output
+func (command *Command) runUserCmd(cmd string, args []string, opts *ConfigOpts) (string, error) {
+	cmdStr := strings.Join(append([]string{cmd}, args...), " ")
+
+	if IsHostLocal(command.Host) {
+		out, err := exec.Command("/bin/sh", "-c", cmdStr).CombinedOutput()
+		return string(out), err
+	}
+
+	session, releaseSession, err := command.RemoteHost.createSSHSession(opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to create SSH session: %w", err)
+	}
+	defer releaseSession()
+	defer session.Close()
+
+	out, err := session.CombinedOutput(cmdStr)
+	return string(out), err
+}
+
+// isExitError returns true if the command ran and exited with a non-zero status
+func isExitError(err error) bool {
+	var localErr *exec.ExitError
+	var remoteErr *ssh.ExitError
+	return errors.As(err, &localErr) || errors.As(err, &remoteErr)
+}
+
+// missingItems returns the items in want that are not in have
+func missingItems(want, have []string) []string {
+	var missing []string
+	for _, w := range want {
+		if !slices.Contains(have, w) && !slices.Contains(missing, w) {
+			missing = append(missing, w)
+		}
+	}
+	return missing
+}
+
+// authorizedKeysInSync returns true if the authorized keys do not need to be changed
+func authorizedKeysInSync(want, have []string, exclusive bool) bool {
+	trimmed := make([]string, 0, len(want))
+	for _, k := range want {
+		trimmed = append(trimmed, strings.TrimSpace(k))
+	}
+
+	if len(missingItems(trimmed, have)) > 0 {
+		return false
+	}
+	if exclusive {
+		return len(missingItems(have, trimmed)) == 0 && len(have) == len(trimmed)
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package backy
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMissingItems(t *testing.T) {
+	tests := []struct {
+		want []string
+		have []string
+		exp  []string
+	}{
+		{want: []string{"wheel", "docker"}, have: []string{"alice", "wheel"}, exp: []string{"docker"}},
+		{want: []string{"wheel"}, have: []string{"wheel", "docker"}},
+		{want: []string{"docker", "docker", "adm"}, have: nil, exp: []string{"docker", "adm"}},
+		{want: nil, have: []string{"wheel"}},
+	}
+	for _, tt := range tests {
+		if got := missingItems(tt.want, tt.have); !slices.Equal(got, tt.exp) {
+			t.Errorf("missingItems(%q, %q) = %q, want %q", tt.want, tt.have, got, tt.exp)
+		}
+	}
+}
+
+func TestAuthorizedKeysInSync(t *testing.T) {
+	const (
+		laptop  = "ssh-ed25519 AAAAC3Nza alice@laptop"
+		desktop = "ssh-rsa AAAAB3Nza alice@desktop"
+		old     = "ssh-ed25519 AAAAC3Nzb alice@old"
+	)
+
+	tests := []struct {
+		name      string
+		want      []string
+		have      []string
+		exclusive bool
+		inSync    bool
+	}{
+		{name: "same keys", want: []string{laptop, desktop}, have: []string{desktop, laptop}, inSync: true},
+		{name: "same keys exclusive", want: []string{laptop, desktop}, have: []string{desktop, laptop}, exclusive: true, inSync: true},
+		{name: "whitespace around wanted keys", want: []string{"  " + laptop + "\n"}, have: []string{laptop}, exclusive: true, inSync: true},
+		{name: "missing key", want: []string{laptop, desktop}, have: []string{laptop}},
+		{name: "missing key exclusive", want: []string{laptop, desktop}, have: []string{laptop}, exclusive: true},
+		{name: "extra key", want: []string{laptop}, have: []string{laptop, old}, inSync: true},
+		{name: "extra key exclusive", want: []string{laptop}, have: []string{laptop, old}, exclusive: true},
+		{name: "duplicate key exclusive", want: []string{laptop}, have: []string{laptop, laptop}, exclusive: true},
+		{name: "no keys", want: []string{}, have: []string{old}, inSync: true},
+		{name: "no keys exclusive", want: []string{}, have: []string{old}, exclusive: true},
+		{name: "no keys exclusive and none set", want: []string{}, have: nil, exclusive: true, inSync: true},
+	}
+
+	for _, tt := range tests {
+		if got := authorizedKeysInSync(tt.want, tt.have, tt.exclusive); got != tt.inSync {
+			t.Errorf("%s: authorizedKeysInSync = %v, want %v", tt.name, got, tt.inSync)
+		}
+	}
+}
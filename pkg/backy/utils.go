@@ -18,6 +18,7 @@ import (
 
 	"git.andrewnw.xyz/CyberShell/backy/pkg/logging"
 	"git.andrewnw.xyz/CyberShell/backy/pkg/remotefetcher"
+	usermanagercommon "git.andrewnw.xyz/CyberShell/backy/pkg/usermanager/common"
 	vault "github.com/hashicorp/vault/api"
 	"github.com/joho/godotenv"
 	"github.com/knadh/koanf/v2"
@@ -62,6 +63,13 @@ func SetCmdsToSearch(cmds []string) BackyOptionFunc {
 	}
 }
 
+// SetHostsToSearch sets the host selectors used to choose the hosts to run on
+func SetHostsToSearch(hosts []string) BackyOptionFunc {
+	return func(bco *ConfigOpts) {
+		bco.List.Hosts = append(bco.List.Hosts, hosts...)
+	}
+}
+
 // SetLogFile sets the path to the log file
 func SetLogFile(logFile string) BackyOptionFunc {
 	return func(bco *ConfigOpts) {
@@ -82,6 +90,27 @@ func EnableCommandStdOut(setStdOut bool) BackyOptionFunc {
 	}
 }
 
+// SetMaxParallel sets the number of hosts commands are run on at once
+func SetMaxParallel(maxParallel int) BackyOptionFunc {
+	return func(bco *ConfigOpts) {
+		bco.MaxParallel = maxParallel
+	}
+}
+
+// SetCmdStdOutMode sets how command output is printed to stdout
+func SetCmdStdOutMode(mode CmdStdOutMode) BackyOptionFunc {
+	return func(bco *ConfigOpts) {
+		bco.CmdStdOutMode = mode
+	}
+}
+
+// EnableCmdStdOutColor colors the prefix of each host's output on stdout
+func EnableCmdStdOutColor(color bool) BackyOptionFunc {
+	return func(bco *ConfigOpts) {
+		bco.CmdStdOutColor = color
+	}
+}
+
 // EnableCron enables the execution of command lists at specified times
 func EnableCron() BackyOptionFunc {
 	return func(bco *ConfigOpts) {
@@ -117,7 +146,7 @@ func injectEnvIntoSSH(envVarsToInject environmentVars, session *ssh.Session, opt
 			log.Fatal().Str("envFile", envPath).Err(err).Send()
 		}
 		for key, val := range envMap {
-			err = session.Setenv(key, getExternalConfigDirectiveValue(val, opts, AllowedExternalDirectiveVault))
+			err = session.Setenv(key, envVarsToInject.directiveValue(val, opts, AllowedExternalDirectiveVault))
 			if err != nil {
 				log.Info().Err(err).Send()
 				return fmt.Errorf("failed to set environment variable %s: %w", val, err)
@@ -131,13 +160,19 @@ func injectEnvIntoSSH(envVarsToInject environmentVars, session *ssh.Session, opt
 		if strings.Contains(envVal, "=") {
 			envVarArr := strings.Split(envVal, "=")
 
-			err := session.Setenv(envVarArr[0], getExternalConfigDirectiveValue(envVarArr[1], opts, AllowedExternalDirectiveVaultFile))
+			err := session.Setenv(envVarArr[0], envVarsToInject.directiveValue(envVarArr[1], opts, AllowedExternalDirectiveVaultFile))
 			if err != nil {
 				log.Info().Err(err).Send()
 				return fmt.Errorf("failed to set environment variable %s: %w", envVarArr[1], err)
 			}
 		}
 	}
+	for _, envVal := range envVarsToInject.vars {
+		key, val, _ := strings.Cut(envVal, "=")
+		if err := session.Setenv(key, val); err != nil {
+			return fmt.Errorf("failed to set environment variable %s: %w", key, err)
+		}
+	}
 	return nil
 }
 
@@ -166,9 +201,10 @@ errEnvFile:
 	for _, envVal := range envVarsToInject.env {
 		if strings.Contains(envVal, "=") {
 			envVarArr := strings.Split(envVal, "=")
-			process.Env = append(process.Env, fmt.Sprintf("%s=%s", envVarArr[0], getExternalConfigDirectiveValue(envVarArr[1], opts, AllowedExternalDirectiveVault)))
+			process.Env = append(process.Env, fmt.Sprintf("%s=%s", envVarArr[0], envVarsToInject.directiveValue(envVarArr[1], opts, AllowedExternalDirectiveVault)))
 		}
 	}
+	process.Env = append(process.Env, envVarsToInject.vars...)
 	process.Env = append(process.Env, os.Environ()...)
 }
 
@@ -190,17 +226,39 @@ func prependEnvVarsToCommand(envVars environmentVars, opts *ConfigOpts, command
 			log.Fatal().Str("envFile", envPath).Err(err).Send()
 		}
 		for key, val := range envMap {
-			envPrefix += fmt.Sprintf("%s=%s ", key, getExternalConfigDirectiveValue(val, opts, AllowedExternalDirectiveVaultEnv))
+			envPrefix += fmt.Sprintf("%s=%s ", key, envVars.directiveValue(val, opts, AllowedExternalDirectiveVaultEnv))
 		}
 	}
 	for _, value := range envVars.env {
 		envVarArr := strings.Split(value, "=")
-		envPrefix += fmt.Sprintf("%s=%s ", envVarArr[0], getExternalConfigDirectiveValue(envVarArr[1], opts, AllowedExternalDirectiveVault))
+		envPrefix += fmt.Sprintf("%s=%s ", envVarArr[0], envVars.directiveValue(envVarArr[1], opts, AllowedExternalDirectiveVault))
 		envPrefix += "\n"
 	}
+	for _, value := range envVars.vars {
+		key, val, _ := strings.Cut(value, "=")
+		envPrefix += fmt.Sprintf("%s=%s\n", key, usermanagercommon.ShellQuote(val))
+	}
 	return envPrefix + command + " " + strings.Join(args, " ")
 }
 
+// directiveValue returns the value of the directive val.
+// Dynamic Vault secrets are read with the leases of the command, so they are revoked after it runs.
+func (envVars environmentVars) directiveValue(val string, opts *ConfigOpts, allowedDirectives AllowedExternalDirectives) string {
+	ref, found := strings.CutPrefix(val, vaultExternDirectiveStart)
+	if !found || !strings.HasSuffix(ref, externDirectiveEnd) || envVars.leases == nil || !allowedDirectives.allows("vault") {
+		return getExternalConfigDirectiveValue(val, opts, allowedDirectives)
+	}
+
+	ref = replaceVarInString(opts.Vars, strings.TrimSuffix(ref, externDirectiveEnd), opts.Logger)
+	value, err := opts.vaultKeyValue(ref, envVars.leases)
+	if err != nil {
+		opts.Logger.Err(err).Str("directive", "vault").Send()
+		return ""
+	}
+	opts.addSecret(value)
+	return value
+}
+
 func contains(s []string, e string) bool {
 	for _, a := range s {
 		if a == e {
@@ -328,6 +386,10 @@ func getCommandTypeAndSetCommandInfo(command *Command) *Command {
 			command.Cmd, command.Args = command.pkgMan.Upgrade(command.Packages)
 		case PackageOperationCheckVersion:
 			command.Cmd, command.Args = command.pkgMan.CheckVersion(command.Packages)
+		case PackageOperationListUpgrades:
+			command.Cmd, command.Args = command.pkgMan.ListUpgrades(command.Packages)
+		case PackageOperationSecurityUpgrade:
+			command.Cmd, command.Args = command.pkgMan.SecurityUpgrade(command.Packages)
 		}
 	}
 
@@ -343,24 +405,71 @@ func getCommandTypeAndSetCommandInfo(command *Command) *Command {
 				command.UserCreateHome,
 				command.UserGroups,
 				command.Args)
+			command.chainAuthorizedKeys()
 		case "modify":
 			command.Cmd, command.Args = command.userMan.ModifyUser(
 				command.Username,
 				command.UserHome,
 				command.UserShell,
 				command.UserGroups)
+			command.chainAuthorizedKeys()
 		case "checkIfExists":
 			command.Cmd, command.Args = command.userMan.UserExists(command.Username)
-		case "delete":
+		case "delete", "remove":
 			command.Cmd, command.Args = command.userMan.RemoveUser(command.Username)
 		case "password":
 			command.Cmd, command.stdin, command.UserPassword = command.userMan.ModifyPassword(command.Username, command.UserPassword)
+		case "addGroup":
+			for i, g := range command.UserGroups {
+				groupCmd, groupArgs := command.userMan.AddGroup(g, command.UserIsSystem)
+				if i == 0 {
+					command.Cmd, command.Args = groupCmd, groupArgs
+					continue
+				}
+				command.Args = chainCommandArgs(command.Args, groupCmd, groupArgs)
+			}
+		case "removeGroup":
+			for i, g := range command.UserGroups {
+				groupCmd, groupArgs := command.userMan.RemoveGroup(g)
+				if i == 0 {
+					command.Cmd, command.Args = groupCmd, groupArgs
+					continue
+				}
+				command.Args = chainCommandArgs(command.Args, groupCmd, groupArgs)
+			}
+		case "authorizedKeys":
+			command.Cmd, command.Args = command.userMan.SetAuthorizedKeys(command.Username, command.UserSshPubKeys, command.UserSshPubKeysExclusive)
+		case "lock":
+			command.Cmd, command.Args = command.userMan.LockUser(command.Username)
+		case "unlock":
+			command.Cmd, command.Args = command.userMan.UnlockUser(command.Username)
+		case "expire":
+			command.Cmd, command.Args = command.userMan.ExpireUser(command.Username, command.UserExpireDate)
+		case "sudoers":
+			command.Cmd, command.Args = command.userMan.SetSudoers(command.Username, command.UserSudoRules)
+		case "removeSudoers":
+			command.Cmd, command.Args = command.userMan.RemoveSudoers(command.Username)
 		}
 	}
 
 	return command
 }
 
+// chainAuthorizedKeys runs the authorized_keys command after the user command if keys are set
+func (command *Command) chainAuthorizedKeys() {
+	if command.UserSshPubKeys == nil {
+		return
+	}
+	keysCmd, keysArgs := command.userMan.SetAuthorizedKeys(command.Username, command.UserSshPubKeys, command.UserSshPubKeysExclusive)
+	command.Args = chainCommandArgs(command.Args, keysCmd, keysArgs)
+}
+
+// chainCommandArgs appends cmd and its args to args so they are run by the shell if the previous command succeeds
+func chainCommandArgs(args []string, cmd string, cmdArgs []string) []string {
+	args = append(args, "&&", cmd)
+	return append(args, cmdArgs...)
+}
+
 func parsePackageVersion(output string, cmdCtxLogger zerolog.Logger, command *Command, cmdOutBuf bytes.Buffer) ([]string, error) {
 
 	var err error
@@ -426,6 +535,8 @@ func getPackageIndexFromCommand(command *Command, name string) int {
 	return -1
 }
 
+// getExternalConfigDirectiveValue returns the value of the directive key with the resolver of the directive.
+// Keys that are not directives are returned as they are.
 func getExternalConfigDirectiveValue(key string, opts *ConfigOpts, allowedDirectives AllowedExternalDirectives) string {
 	if !(strings.HasPrefix(key, externDirectiveStart) && strings.HasSuffix(key, externDirectiveEnd)) {
 		return key
@@ -433,68 +544,49 @@ func getExternalConfigDirectiveValue(key string, opts *ConfigOpts, allowedDirect
 	key = replaceVarInString(opts.Vars, key, opts.Logger)
 	opts.Logger.Debug().Str("expanding external key", key).Send()
 
-	if newKeyStr, directiveFound := strings.CutPrefix(key, envExternDirectiveStart); directiveFound {
-		if IsExternalDirectiveEnv(allowedDirectives) {
-
-			key = strings.TrimSuffix(newKeyStr, externDirectiveEnd)
-			key = os.Getenv(key)
-		} else {
-			opts.Logger.Error().Msgf("Config key with value %s does not support env directive", key)
-		}
+	name, ref, found := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(key, externDirectiveStart), externDirectiveEnd), ":")
+	if !found {
+		return key
 	}
-
-	if newKeyStr, directiveFound := strings.CutPrefix(key, externFileDirectiveStart); directiveFound {
-		if IsExternalDirectiveFile(allowedDirectives) {
-
-			var err error
-			var keyValue []byte
-			key = strings.TrimSuffix(newKeyStr, externDirectiveEnd)
-			key, err = getFullPathWithHomeDir(key)
-			if err != nil {
-				opts.Logger.Err(err).Send()
-				return ""
-			}
-			if !path.IsAbs(key) {
-				key = path.Join(opts.ConfigDir, key)
-			}
-			keyValue, err = os.ReadFile(key)
-			if err != nil {
-				opts.Logger.Err(err).Send()
-				return ""
-			}
-			key = string(keyValue)
-		} else {
-			opts.Logger.Error().Msgf("Config key with value %s does not support file directive", key)
-		}
+	resolver, found := getDirectiveResolver(name)
+	if !found {
+		opts.Logger.Warn().Msgf("Config key with value %s has unknown directive %s", key, name)
+		return key
 	}
-
-	if newKeyStr, directiveFound := strings.CutPrefix(key, vaultExternDirectiveStart); directiveFound {
-		if IsExternalDirectiveVault(allowedDirectives) {
-
-			key = strings.TrimSuffix(newKeyStr, externDirectiveEnd)
-			key = GetVaultKey(key, opts, opts.Logger)
-		} else {
-			opts.Logger.Error().Msgf("Config key with value %s does not support vault directive", key)
-		}
+	if !allowedDirectives.allows(name) {
+		opts.Logger.Error().Msgf("Config key with value %s does not support %s directive", key, name)
+		return key
 	}
 
-	return key
+	value, err := resolver.Resolve(ref, opts)
+	if err != nil {
+		opts.Logger.Err(err).Str("directive", name).Send()
+		return ""
+	}
+	opts.addSecret(value)
+	return value
 }
 
-func getVaultSecret(vaultClient *vault.Client, key *VaultKey) (string, error) {
+// getVaultSecret reads key from the KV secrets engine. Without a type, the KV version of the mount is found from Vault.
+func (opts *ConfigOpts) getVaultSecret(key *VaultKey) (string, error) {
 	var (
 		secret *vault.KVSecret
 		err    error
 	)
 
-	if key.ValueType == "KVv2" {
-		secret, err = vaultClient.KVv2(key.MountPath).Get(context.Background(), key.Path)
-	} else if key.ValueType == "KVv1" {
-		secret, err = vaultClient.KVv1(key.MountPath).Get(context.Background(), key.Path)
-	} else if key.ValueType != "" {
-		return "", fmt.Errorf("type %s for key %s not known. Valid types are KVv1 or KVv2", key.ValueType, key.Name)
+	valueType := key.ValueType
+	if valueType == "" {
+		if valueType, err = opts.kvVersion(key.MountPath); err != nil {
+			return "", err
+		}
+	}
+
+	if valueType == "KVv2" {
+		secret, err = opts.vaultClient.KVv2(key.MountPath).Get(context.Background(), key.Path)
+	} else if valueType == "KVv1" {
+		secret, err = opts.vaultClient.KVv1(key.MountPath).Get(context.Background(), key.Path)
 	} else {
-		return "", fmt.Errorf("type for key %s must be specified. Valid types are KVv1 or KVv2", key.Name)
+		return "", fmt.Errorf("type %s for key %s not known. Valid types are KVv1, KVv2 or dynamic", key.ValueType, key.Name)
 	}
 	if err != nil {
 		return "", fmt.Errorf("unable to read secret: %v", err)
@@ -502,7 +594,7 @@ func getVaultSecret(vaultClient *vault.Client, key *VaultKey) (string, error) {
 
 	value, ok := secret.Data[key.Key].(string)
 	if !ok {
-		return "", fmt.Errorf("value type assertion failed for vault key %s: %T %#v", key.Name, secret.Data[key.Name], secret.Data[key.Name])
+		return "", fmt.Errorf("value type assertion failed for vault key %s: %T %#v", key.Name, secret.Data[key.Key], secret.Data[key.Key])
 	}
 
 	return value, nil
@@ -518,20 +610,12 @@ func getVaultKeyData(keyName string, keys []*VaultKey) (*VaultKey, error) {
 }
 
 func GetVaultKey(str string, opts *ConfigOpts, log zerolog.Logger) string {
-	key, err := getVaultKeyData(str, opts.VaultKeys)
-	if key == nil && err == nil {
-		return str
-	}
-	if err != nil && key == nil {
+	value, err := opts.vaultKeyValue(str, nil)
+	if err != nil {
 		log.Err(err).Send()
 		return ""
 	}
-
-	value, secretErr := getVaultSecret(opts.vaultClient, key)
-	if secretErr != nil {
-		log.Err(secretErr).Send()
-		return value
-	}
+	opts.addSecret(value)
 	return value
 }
 
@@ -0,0 +1,335 @@
+// vault.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog"
+)
+
+const (
+	vaultExternDirectiveStart string = "%{vault:"
+
+	// dynamicVaultKeyType is the type of keys with dynamic secrets, such as database credentials
+	dynamicVaultKeyType = "dynamic"
+
+	defaultKubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// vaultLoginRetryInterval is how long to wait before logging in to Vault again after a failed login
+	vaultLoginRetryInterval = 30 * time.Second
+)
+
+// vaultLogin logs client in with the auth method of the config file, and sets the token of client.
+// Returns the login secret, or nil for static tokens.
+func (opts *ConfigOpts) vaultLogin(client *vaultapi.Client) (*vaultapi.Secret, error) {
+	auth := opts.vaultAuth
+	if auth == nil {
+		auth = &VaultAuth{}
+	}
+
+	resolve := func(value string) string {
+		return strings.TrimSpace(getExternalConfigDirectiveValue(value, opts, AllowedExternalDirectiveFileEnv))
+	}
+	readTokenFile := func(file string) (string, error) {
+		token, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("error reading token file: %w", err)
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+
+	var data map[string]any
+	switch auth.Method {
+	case DefaultVaultAuthMethod, TokenVaultAuthMethod:
+		token := opts.koanf.String("vault.token")
+		if strings.TrimSpace(token) == "" {
+			token = os.Getenv("VAULT_TOKEN")
+		}
+		token = resolve(token)
+		if token == "" {
+			return nil, fmt.Errorf("no token found. One is required. \n\nSet the config key vault.token or the environment variable VAULT_TOKEN, or set vault.auth")
+		}
+		opts.addSecret(token)
+		client.SetToken(token)
+		return nil, nil
+
+	case AppRoleVaultAuthMethod:
+		data = map[string]any{"role_id": resolve(auth.RoleID), "secret_id": resolve(auth.SecretID)}
+
+	case KubernetesVaultAuthMethod:
+		tokenFile := auth.TokenFile
+		if tokenFile == "" {
+			tokenFile = defaultKubernetesTokenFile
+		}
+		jwt, err := readTokenFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		data = map[string]any{"role": auth.Role, "jwt": jwt}
+
+	case JWTVaultAuthMethod:
+		jwt := resolve(auth.JWT)
+		if jwt == "" && auth.TokenFile != "" {
+			var err error
+			if jwt, err = readTokenFile(auth.TokenFile); err != nil {
+				return nil, err
+			}
+		}
+		if jwt == "" {
+			return nil, fmt.Errorf("jwt auth requires vault.auth.jwt or vault.auth.tokenFile")
+		}
+		data = map[string]any{"role": auth.Role, "jwt": jwt}
+
+	default:
+		return nil, fmt.Errorf("unknown vault auth method %s", auth.Method)
+	}
+
+	mount := auth.Mount
+	if mount == "" {
+		mount = auth.Method.String()
+	}
+	secret, err := client.Logical().Write(fmt.Sprintf("auth/%s/login", strings.Trim(mount, "/")), data)
+	if err != nil {
+		return nil, fmt.Errorf("error logging in to vault with %s: %w", auth.Method, err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("error logging in to vault with %s: no token returned", auth.Method)
+	}
+	opts.addSecret(secret.Auth.ClientToken)
+	client.SetToken(secret.Auth.ClientToken)
+	opts.Logger.Info().Str("method", auth.Method.String()).Msg("logged in to vault")
+	return secret, nil
+}
+
+// renewVaultToken keeps the Vault token renewed in the background until stop is closed.
+// Tokens from auth methods are replaced by logging in again once they can't be renewed any more.
+func (opts *ConfigOpts) renewVaultToken(login *vaultapi.Secret, stop <-chan struct{}) {
+	client := opts.vaultClient
+	if client == nil {
+		return
+	}
+
+	go func() {
+		for {
+			secret := login
+			if secret == nil {
+				var err error
+				if secret, err = client.Auth().Token().RenewSelf(0); err != nil {
+					opts.Logger.Debug().Err(err).Msg("vault token is not renewable")
+					return
+				}
+			}
+			switch {
+			case secret.Auth != nil && secret.Auth.Renewable:
+				if !opts.watchVaultLease(secret, stop) {
+					return
+				}
+			case login == nil || secret.Auth == nil || secret.Auth.LeaseDuration == 0:
+				opts.Logger.Debug().Msg("vault token is not renewable")
+				return
+			default:
+				// log in again before the token expires
+				select {
+				case <-stop:
+					return
+				case <-time.After(time.Duration(secret.Auth.LeaseDuration) * time.Second * 2 / 3):
+				}
+			}
+
+			if login == nil {
+				opts.Logger.Warn().Msg("vault token can't be renewed any more; set vault.auth to log in again")
+				return
+			}
+			for {
+				var err error
+				if login, err = opts.vaultLogin(client); err == nil {
+					break
+				}
+				opts.Logger.Err(err).Send()
+				select {
+				case <-stop:
+					return
+				case <-time.After(vaultLoginRetryInterval):
+				}
+			}
+		}
+	}()
+}
+
+// watchVaultLease renews secret until it can't be renewed any more, and returns true,
+// or until stop is closed or the lease can't be watched, and returns false
+func (opts *ConfigOpts) watchVaultLease(secret *vaultapi.Secret, stop <-chan struct{}) bool {
+	watcher, err := opts.vaultClient.NewLifetimeWatcher(&vaultapi.LifetimeWatcherInput{Secret: secret})
+	if err != nil {
+		opts.Logger.Err(err).Send()
+		return false
+	}
+	go watcher.Start()
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return false
+		case err := <-watcher.DoneCh():
+			if err != nil {
+				opts.Logger.Warn().Err(err).Msg("error renewing vault lease")
+			}
+			return true
+		case renewal := <-watcher.RenewCh():
+			opts.Logger.Debug().Time("renewed at", renewal.RenewedAt).Msg("renewed vault lease")
+		}
+	}
+}
+
+// kvVersion returns KVv1 or KVv2 for the KV secrets engine mounted at mount
+func (opts *ConfigOpts) kvVersion(mount string) (string, error) {
+	mount = strings.Trim(mount, "/")
+
+	opts.kvVersionsMu.Lock()
+	defer opts.kvVersionsMu.Unlock()
+	if version, found := opts.kvVersions[mount]; found {
+		return version, nil
+	}
+
+	secret, err := opts.vaultClient.Logical().Read("sys/internal/ui/mounts/" + mount)
+	if err != nil {
+		return "", fmt.Errorf("error finding the KV version of mount %s; set the type of the key to KVv1 or KVv2: %w", mount, err)
+	}
+	version := "KVv1"
+	if secret != nil {
+		if options, ok := secret.Data["options"].(map[string]any); ok && options["version"] == "2" {
+			version = "KVv2"
+		}
+	}
+
+	if opts.kvVersions == nil {
+		opts.kvVersions = make(map[string]string)
+	}
+	opts.kvVersions[mount] = version
+	return version, nil
+}
+
+// vaultKeyValue returns the value of the Vault key name.
+// Dynamic secrets are read once for each path in leases.
+func (opts *ConfigOpts) vaultKeyValue(name string, leases *vaultLeases) (string, error) {
+	key, err := getVaultKeyData(name, opts.VaultKeys)
+	if err != nil {
+		return "", err
+	}
+	if opts.vaultClient == nil {
+		return "", fmt.Errorf("vault key %s: vault is not enabled", name)
+	}
+
+	if key.ValueType != dynamicVaultKeyType {
+		return opts.getVaultSecret(key)
+	}
+	if leases == nil {
+		leases = opts.vaultLeases
+	}
+	if leases == nil {
+		return "", fmt.Errorf("vault key %s: dynamic secrets can't be read here", name)
+	}
+	return leases.value(opts, key)
+}
+
+// vaultLeases holds the dynamic secrets read for a command or a run.
+// The leases are renewed until they are revoked.
+type vaultLeases struct {
+	mu      sync.Mutex
+	secrets map[string]*vaultapi.Secret
+	stop    chan struct{}
+}
+
+// value returns the value of key, reading its path if it has not been read.
+// All keys with the same path have values from one secret, such as the username and password of database credentials.
+func (l *vaultLeases) value(opts *ConfigOpts, key *VaultKey) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	secret, found := l.secrets[key.Path]
+	if !found {
+		var err error
+		secret, err = opts.vaultClient.Logical().Read(key.Path)
+		if err != nil {
+			return "", fmt.Errorf("unable to read secret: %v", err)
+		}
+		if secret == nil {
+			return "", fmt.Errorf("no secret found at path %s for vault key %s", key.Path, key.Name)
+		}
+
+		if l.secrets == nil {
+			l.secrets = make(map[string]*vaultapi.Secret)
+			l.stop = make(chan struct{})
+		}
+		l.secrets[key.Path] = secret
+		if secret.Renewable || secret.LeaseDuration > 0 {
+			go l.watch(opts, key.Path, secret, l.stop)
+		}
+		opts.Logger.Debug().Str("lease", secret.LeaseID).Str("key", key.Name).Msg("read dynamic vault secret")
+	}
+
+	value, ok := secret.Data[key.Key].(string)
+	if !ok {
+		return "", fmt.Errorf("value type assertion failed for vault key %s: %T %#v", key.Name, secret.Data[key.Key], secret.Data[key.Key])
+	}
+	opts.addSecret(value)
+	return value, nil
+}
+
+// watch renews the lease of secret until it can't be renewed any more, or waits for it to expire if it is not renewable.
+// The secret is then dropped, so that the next read of path gets new credentials.
+// This matters in cron mode, where the secrets of variables are kept between runs.
+func (l *vaultLeases) watch(opts *ConfigOpts, path string, secret *vaultapi.Secret, stop <-chan struct{}) {
+	if secret.Renewable {
+		if !opts.watchVaultLease(secret, stop) {
+			return
+		}
+	} else {
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Duration(secret.LeaseDuration) * time.Second):
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.secrets[path] == secret {
+		delete(l.secrets, path)
+		opts.Logger.Info().Str("lease", secret.LeaseID).Str("path", path).Msg("vault lease expired, new credentials will be read when they are used")
+	}
+}
+
+// revoke revokes the leases of the secrets that have been read
+func (l *vaultLeases) revoke(opts *ConfigOpts, logger zerolog.Logger) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.secrets == nil {
+		return
+	}
+	close(l.stop)
+	for path, secret := range l.secrets {
+		if secret.LeaseID == "" {
+			continue
+		}
+		if err := opts.vaultClient.Sys().Revoke(secret.LeaseID); err != nil {
+			logger.Err(err).Str("path", path).Msg("error revoking vault lease")
+			continue
+		}
+		logger.Debug().Str("lease", secret.LeaseID).Msg("revoked vault lease")
+	}
+	l.secrets = nil
+}
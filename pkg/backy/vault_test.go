@@ -0,0 +1,335 @@
+package backy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/knadh/koanf/v2"
+	"github.com/rs/zerolog"
+)
+
+// fakeVault is a Vault server with KV mounts, database credentials and auth methods
+type fakeVault struct {
+	mu      sync.Mutex
+	leases  int
+	revoked []string
+	renews  int
+}
+
+func (f *fakeVault) handler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		var body map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		reply := func(v any) {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(v)
+		}
+		login := func(token string) {
+			reply(map[string]any{"auth": map[string]any{"client_token": token, "renewable": true, "lease_duration": 3600}})
+		}
+
+		switch path := strings.TrimPrefix(r.URL.Path, "/v1/"); path {
+		case "auth/approle/login":
+			if body["role_id"] != "backy-role" || body["secret_id"] != "backy-secret" {
+				http.Error(w, `{"errors":["invalid role or secret ID"]}`, http.StatusBadRequest)
+				return
+			}
+			login("s.approle")
+		case "auth/kubernetes/login":
+			if body["role"] != "backy" || body["jwt"] != "k8s-jwt" {
+				http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+				return
+			}
+			login("s.kubernetes")
+		case "auth/gitlab/login":
+			if body["role"] != "ci" || body["jwt"] != "ci-jwt" {
+				http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+				return
+			}
+			login("s.jwt")
+		case "auth/token/renew-self":
+			f.renews++
+			reply(map[string]any{"auth": map[string]any{"client_token": r.Header.Get("X-Vault-Token"), "renewable": true, "lease_duration": 1}})
+		case "sys/internal/ui/mounts/secret":
+			reply(map[string]any{"data": map[string]any{"type": "kv", "options": map[string]any{"version": "2"}}})
+		case "sys/internal/ui/mounts/kv":
+			reply(map[string]any{"data": map[string]any{"type": "kv", "options": nil}})
+		case "secret/data/app":
+			reply(map[string]any{"data": map[string]any{"data": map[string]any{"password": "kv2-password"}}})
+		case "kv/app":
+			reply(map[string]any{"data": map[string]any{"password": "kv1-password"}})
+		case "database/creds/readonly":
+			f.leases++
+			reply(map[string]any{
+				"lease_id":       fmt.Sprintf("database/creds/readonly/%d", f.leases),
+				"lease_duration": 3600,
+				"data":           map[string]any{"username": fmt.Sprintf("v-backy-%d", f.leases), "password": fmt.Sprintf("db-password-%d", f.leases)},
+			})
+		case "database/creds/short":
+			f.leases++
+			reply(map[string]any{
+				"lease_id":       fmt.Sprintf("database/creds/short/%d", f.leases),
+				"lease_duration": 1,
+				"data":           map[string]any{"username": fmt.Sprintf("v-short-%d", f.leases)},
+			})
+		case "sys/leases/revoke":
+			f.revoked = append(f.revoked, body["lease_id"].(string))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected vault request %s %s", r.Method, path)
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// newTestVault starts a fake Vault server and sets up opts to use it
+func newTestVault(t *testing.T, opts *ConfigOpts) *fakeVault {
+	t.Helper()
+	fake := &fakeVault{}
+	server := httptest.NewServer(fake.handler(t))
+	t.Cleanup(server.Close)
+
+	config := vaultapi.DefaultConfig()
+	config.Address = server.URL
+	config.MaxRetries = 0
+	client, err := vaultapi.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetToken("s.static")
+
+	opts.vaultClient = client
+	opts.vaultLeases = &vaultLeases{}
+	opts.VaultKeys = []*VaultKey{
+		{Name: "appPassword", MountPath: "secret", Path: "app", Key: "password"},
+		{Name: "legacyPassword", MountPath: "kv", Path: "app", Key: "password"},
+		{Name: "typedPassword", MountPath: "kv", Path: "app", Key: "password", ValueType: "KVv1"},
+		{Name: "dbUser", Path: "database/creds/readonly", Key: "username", ValueType: "dynamic"},
+		{Name: "dbPassword", Path: "database/creds/readonly", Key: "password", ValueType: "dynamic"},
+		{Name: "shortUser", Path: "database/creds/short", Key: "username", ValueType: "dynamic"},
+	}
+	return fake
+}
+
+func TestVaultLogin(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("k8s-jwt\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BACKY_TEST_SECRET_ID", "backy-secret")
+	t.Setenv("VAULT_TOKEN", "s.from-env")
+
+	tests := []struct {
+		name      string
+		auth      *VaultAuth
+		wantToken string
+		wantErr   string
+	}{
+		{name: "token", wantToken: "s.from-env"},
+		{name: "approle", auth: &VaultAuth{Method: AppRoleVaultAuthMethod, RoleID: "backy-role", SecretID: "%{env:BACKY_TEST_SECRET_ID}%"}, wantToken: "s.approle"},
+		{name: "approle with wrong secret", auth: &VaultAuth{Method: AppRoleVaultAuthMethod, RoleID: "backy-role", SecretID: "wrong"}, wantErr: "invalid role or secret ID"},
+		{name: "kubernetes", auth: &VaultAuth{Method: KubernetesVaultAuthMethod, Role: "backy", TokenFile: tokenFile}, wantToken: "s.kubernetes"},
+		{name: "kubernetes without token file", auth: &VaultAuth{Method: KubernetesVaultAuthMethod, Role: "backy", TokenFile: tokenFile + ".missing"}, wantErr: "error reading token file"},
+		{name: "jwt", auth: &VaultAuth{Method: JWTVaultAuthMethod, Mount: "gitlab", Role: "ci", JWT: "ci-jwt"}, wantToken: "s.jwt"},
+		{name: "jwt without jwt", auth: &VaultAuth{Method: JWTVaultAuthMethod, Role: "ci"}, wantErr: "requires vault.auth.jwt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &ConfigOpts{Logger: zerolog.Nop(), koanf: koanf.New("."), vaultAuth: tt.auth}
+			newTestVault(t, opts)
+
+			login, err := opts.vaultLogin(opts.vaultClient)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := opts.vaultClient.Token(); got != tt.wantToken {
+				t.Errorf("token = %q, want %q", got, tt.wantToken)
+			}
+			if (login != nil) != (tt.auth != nil) {
+				t.Errorf("login = %v, want a login secret only for auth methods", login)
+			}
+			if got := opts.Redact(tt.wantToken); got != redactedSecret {
+				t.Errorf("token was not added as a secret: %q", got)
+			}
+		})
+	}
+}
+
+func TestVaultKeyValue(t *testing.T) {
+	opts := &ConfigOpts{Logger: zerolog.Nop()}
+	fake := newTestVault(t, opts)
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "appPassword", want: "kv2-password"},
+		{key: "legacyPassword", want: "kv1-password"},
+		{key: "typedPassword", want: "kv1-password"},
+	}
+	for _, tt := range tests {
+		got, err := opts.vaultKeyValue(tt.key, nil)
+		if err != nil {
+			t.Errorf("vaultKeyValue(%s): %v", tt.key, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("vaultKeyValue(%s) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+
+	leases := &vaultLeases{}
+	user, err := opts.vaultKeyValue("dbUser", leases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, err := opts.vaultKeyValue("dbPassword", leases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "v-backy-1" || password != "db-password-1" {
+		t.Errorf("credentials = %s/%s, want both from the first lease", user, password)
+	}
+
+	leases.revoke(opts, zerolog.Nop())
+	if !slices.Equal(fake.revoked, []string{"database/creds/readonly/1"}) {
+		t.Errorf("revoked = %q", fake.revoked)
+	}
+	if user, _ := opts.vaultKeyValue("dbUser", leases); user != "v-backy-2" {
+		t.Errorf("user after revoke = %q, want credentials from a new lease", user)
+	}
+	leases.revoke(opts, zerolog.Nop())
+
+	if _, err := opts.vaultKeyValue("missing", nil); err == nil {
+		t.Error("missing key did not fail")
+	}
+}
+
+func TestExpiredVaultLease(t *testing.T) {
+	opts := &ConfigOpts{Logger: zerolog.Nop()}
+	fake := newTestVault(t, opts)
+	defer opts.vaultLeases.revoke(opts, zerolog.Nop())
+
+	user, err := opts.vaultKeyValue("shortUser", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := opts.vaultKeyValue("shortUser", nil); again != user {
+		t.Errorf("user = %q, want %q from the lease that has not expired", again, user)
+	}
+
+	// in cron mode the secrets of variables are kept between runs, until their lease expires
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if got, err := opts.vaultKeyValue("shortUser", nil); err == nil && got != user {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	t.Errorf("read %d leases, want new credentials after the lease of %s expired", fake.leases, user)
+}
+
+func TestRunCmdRevokesVaultLeases(t *testing.T) {
+	opts := newTestOpts(t)
+	fake := newTestVault(t, opts)
+
+	command := &Command{
+		Name:        "dump",
+		Shell:       "sh",
+		Cmd:         "echo",
+		Args:        []string{"$DB_USER"},
+		Environment: []string{"DB_USER=%{vault:dbUser}%"},
+	}
+	got, err := command.RunCmd(zerolog.Nop(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []string{"v-backy-1"}) {
+		t.Errorf("output = %q", got)
+	}
+	if !slices.Equal(fake.revoked, []string{"database/creds/readonly/1"}) {
+		t.Errorf("revoked = %q, want the lease of the command revoked after it ran", fake.revoked)
+	}
+	if command.leases != nil {
+		t.Error("leases of the run were stored on the command")
+	}
+}
+
+func TestRenewVaultToken(t *testing.T) {
+	opts := &ConfigOpts{Logger: zerolog.Nop(), koanf: koanf.New(".")}
+	fake := newTestVault(t, opts)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	opts.renewVaultToken(nil, stop)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		fake.mu.Lock()
+		renews := fake.renews
+		fake.mu.Unlock()
+		if renews >= 2 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Errorf("token was renewed %d times, want it renewed before it expires", fake.renews)
+}
+
+func TestConcurrentRunsRevokeVaultLeases(t *testing.T) {
+	opts := newTestOpts(t)
+	fake := newTestVault(t, opts)
+
+	opts.Cmds = map[string]*Command{
+		"dump": {
+			Name:        "dump",
+			Shell:       "sh",
+			Cmd:         "echo",
+			Args:        []string{"$DB_USER"},
+			Environment: []string{"DB_USER=%{vault:dbUser}%"},
+		},
+	}
+	opts.CmdConfigLists = make(map[string]*CmdList)
+	for i := range 6 {
+		name := fmt.Sprintf("list%d", i)
+		opts.CmdConfigLists[name] = &CmdList{Name: name, Order: []string{"dump"}}
+	}
+
+	opts.RunListConfig("")
+
+	for _, r := range opts.CmdResults() {
+		// the credentials are secrets, so the output is redacted
+		if r.Error != nil || !slices.Equal(r.Output, []string{redactedSecret}) {
+			t.Errorf("list %s: output = %q, error = %v", r.ListName, r.Output, r.Error)
+		}
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	slices.Sort(fake.revoked)
+	if fake.leases != 6 || len(slices.Compact(fake.revoked)) != fake.leases {
+		t.Errorf("revoked %q of %d leases, want every lease revoked", fake.revoked, fake.leases)
+	}
+}
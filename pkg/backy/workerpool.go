@@ -0,0 +1,45 @@
+// workerpool.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package backy
+
+import "sync"
+
+// defaultMaxParallel is the number of hosts commands run on at once when maxParallel is not set
+const defaultMaxParallel = 10
+
+// maxParallel returns the number of hosts commands are run on at once
+func (opts *ConfigOpts) maxParallel() int {
+	if opts.MaxParallel > 0 {
+		return opts.MaxParallel
+	}
+	return defaultMaxParallel
+}
+
+// runParallel calls fn for each index from 0 to n-1, on at most limit goroutines at a time,
+// and returns once all calls have finished.
+// Results should be stored by index, so no locking is needed to collect them.
+func runParallel(n, limit int, fn func(i int)) {
+	if limit <= 0 || limit > n {
+		limit = n
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < limit; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
@@ -0,0 +1,157 @@
+package backy
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.andrewnw.xyz/CyberShell/backy/pkg/sshtest"
+)
+
+// concurrencyCounter records the most calls that were running at the same time
+type concurrencyCounter struct {
+	running atomic.Int32
+	max     atomic.Int32
+}
+
+func (c *concurrencyCounter) enter() {
+	n := c.running.Add(1)
+	for {
+		m := c.max.Load()
+		if n <= m || c.max.CompareAndSwap(m, n) {
+			return
+		}
+	}
+}
+
+func (c *concurrencyCounter) leave() {
+	c.running.Add(-1)
+}
+
+// handler returns an sshtest handler that prints the user it runs as, and counts how many commands run at once
+func (c *concurrencyCounter) handler() sshtest.Handler {
+	return func(e *sshtest.Exec) int {
+		c.enter()
+		defer c.leave()
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprintln(e.Stdout, e.User)
+		return 0
+	}
+}
+
+func TestRunParallel(t *testing.T) {
+	tests := []struct {
+		n, limit int
+		wantMax  int32
+	}{
+		{n: 0, limit: 3},
+		{n: 10, limit: 3, wantMax: 3},
+		{n: 2, limit: 5, wantMax: 2},
+		{n: 4, limit: 0, wantMax: 4},
+		{n: 5, limit: 1, wantMax: 1},
+	}
+
+	for _, tt := range tests {
+		var counter concurrencyCounter
+		// wait for enough calls to start, so the limit is reached
+		var started sync.WaitGroup
+		started.Add(min(tt.n, int(tt.wantMax)))
+
+		calls := make([]int, tt.n)
+		runParallel(tt.n, tt.limit, func(i int) {
+			counter.enter()
+			defer counter.leave()
+			if i < int(tt.wantMax) {
+				started.Done()
+				started.Wait()
+			}
+			calls[i]++
+		})
+
+		for i, c := range calls {
+			if c != 1 {
+				t.Errorf("runParallel(%d, %d) called index %d %d times", tt.n, tt.limit, i, c)
+			}
+		}
+		if got := counter.max.Load(); got != tt.wantMax {
+			t.Errorf("runParallel(%d, %d) ran %d calls at once, want %d", tt.n, tt.limit, got, tt.wantMax)
+		}
+	}
+}
+
+// Run with -race to check that the output of each host is collected without data races
+func TestExecCommandOnHostsParallel(t *testing.T) {
+	const hostCount, limit = 12, 3
+
+	var counter concurrencyCounter
+	opts := newTestOpts(t)
+	opts.MaxParallel = limit
+
+	var hostNames []string
+	for i := range hostCount {
+		host, _ := newTestHost(t, opts, fmt.Sprintf("web-%d", i), sshtest.WithHandler(counter.handler()))
+		hostNames = append(hostNames, host.Host)
+	}
+	opts.Cmds = map[string]*Command{
+		"whoami": {Name: "whoami", Cmd: "whoami", Hosts: hostNames},
+	}
+
+	results, err := opts.ExecCommandOnHostsParallel("whoami")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != hostCount {
+		t.Fatalf("got %d results, want %d", len(results), hostCount)
+	}
+	for i, r := range results {
+		if r.Error != nil {
+			t.Errorf("host %s: %v", r.Host, r.Error)
+		}
+		if r.Host != hostNames[i] {
+			t.Errorf("result %d is for host %s, want %s", i, r.Host, hostNames[i])
+		}
+		if want := []string{hostNames[i] + "-user"}; !slices.Equal(r.Output, want) {
+			t.Errorf("host %s output = %q, want %q", r.Host, r.Output, want)
+		}
+	}
+	if got := counter.max.Load(); got > limit {
+		t.Errorf("ran on %d hosts at once, want at most %d", got, limit)
+	}
+}
+
+// Run with -race to check that hosts do not share the command or its logger fields
+func TestCmdListWorkerExecuteCommandsInParallel(t *testing.T) {
+	const hostCount, limit = 8, 2
+
+	var counter concurrencyCounter
+	opts := newTestOpts(t)
+	opts.MaxParallel = limit
+	opts.Cmds = map[string]*Command{
+		"first":  {Name: "first", Cmd: "first"},
+		"second": {Name: "second", Cmd: "second"},
+	}
+
+	var hosts []*Host
+	for i := range hostCount {
+		host, _ := newTestHost(t, opts, fmt.Sprintf("web-%d", i), sshtest.WithHandler(counter.handler()))
+		hosts = append(hosts, host)
+	}
+
+	jobs := make(chan *CmdList, 1)
+	results := make(chan string, 1)
+	jobs <- &CmdList{Name: "deploy", Order: []string{"first", "second"}, GetCommandOutputInNotificationsOnSuccess: true}
+	close(jobs)
+
+	cmdListWorkerExecuteCommandsInParallel(nil, jobs, hosts, results, opts)
+
+	if got := <-results; got != "done" {
+		t.Errorf("result = %q, want done", got)
+	}
+	if got := counter.max.Load(); got > limit {
+		t.Errorf("ran on %d hosts at once, want at most %d", got, limit)
+	}
+}
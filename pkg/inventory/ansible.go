@@ -0,0 +1,530 @@
+package inventory
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"git.andrewnw.xyz/CyberShell/backy/pkg/remotefetcher"
+	"gopkg.in/yaml.v3"
+)
+
+// AnsibleFileSource loads hosts from an Ansible INI or YAML inventory file.
+// The file can be local or a remote resource.
+type AnsibleFileSource struct {
+	config Config
+	cache  *remotefetcher.Cache
+}
+
+// Load reads and parses the inventory file
+func (a *AnsibleFileSource) Load() ([]Host, error) {
+	format := a.config.Format
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(a.config.Path)) {
+		case ".yml", ".yaml":
+			format = "yaml"
+		case ".json":
+			format = "json"
+		default:
+			format = "ini"
+		}
+	}
+
+	data, err := loadWithCache(a.cache, a.config.Path, format, a.config.CacheTTL, func() ([]byte, error) {
+		fetcher, err := remotefetcher.NewRemoteFetcher(a.config.Path, a.cache)
+		if err != nil {
+			return nil, err
+		}
+		return fetcher.Fetch(a.config.Path)
+	})
+	if err != nil && !isStale(err) {
+		return nil, fmt.Errorf("error loading ansible inventory %s: %w", a.config.Path, err)
+	}
+
+	return parseLoaded(data, format, err)
+}
+
+// ParseAnsibleInventory parses an Ansible inventory in json (dynamic inventory), ini, or yaml format
+func ParseAnsibleInventory(data []byte, format string) ([]Host, error) {
+	inv := newAnsibleInventory()
+
+	var err error
+	switch format {
+	case "json":
+		err = inv.parseJSON(data)
+	case "ini":
+		err = inv.parseINI(data)
+	case "yaml", "yml":
+		err = inv.parseYAML(data)
+	default:
+		return nil, fmt.Errorf("unsupported ansible inventory format: %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return inv.hosts(), nil
+}
+
+// ansibleInventory holds the groups and variables of an Ansible inventory
+type ansibleInventory struct {
+	hostOrder  []string
+	hostVars   map[string]map[string]string
+	groupHosts map[string][]string
+	groupVars  map[string]map[string]string
+	children   map[string][]string
+}
+
+func newAnsibleInventory() *ansibleInventory {
+	return &ansibleInventory{
+		hostVars:   map[string]map[string]string{},
+		groupHosts: map[string][]string{},
+		groupVars:  map[string]map[string]string{},
+		children:   map[string][]string{},
+	}
+}
+
+func (inv *ansibleInventory) addHost(group, host string, vars map[string]string) {
+	if _, exists := inv.hostVars[host]; !exists {
+		inv.hostVars[host] = map[string]string{}
+		inv.hostOrder = append(inv.hostOrder, host)
+	}
+	for k, v := range vars {
+		inv.hostVars[host][k] = v
+	}
+	if group != "" && !slices.Contains(inv.groupHosts[group], host) {
+		inv.groupHosts[group] = append(inv.groupHosts[group], host)
+	}
+}
+
+func (inv *ansibleInventory) addGroupVars(group string, vars map[string]string) {
+	if inv.groupVars[group] == nil {
+		inv.groupVars[group] = map[string]string{}
+	}
+	for k, v := range vars {
+		inv.groupVars[group][k] = v
+	}
+}
+
+func (inv *ansibleInventory) addChild(group, child string) {
+	if !slices.Contains(inv.children[group], child) {
+		inv.children[group] = append(inv.children[group], child)
+	}
+}
+
+// groupsOf returns the groups of host, including the parents of its groups
+func (inv *ansibleInventory) groupsOf(host string) []string {
+	var groups []string
+	var addGroup func(g string)
+	addGroup = func(g string) {
+		if slices.Contains(groups, g) {
+			return
+		}
+		groups = append(groups, g)
+		for parent, children := range inv.children {
+			if slices.Contains(children, g) {
+				addGroup(parent)
+			}
+		}
+	}
+
+	for group, hosts := range inv.groupHosts {
+		if slices.Contains(hosts, host) {
+			addGroup(group)
+		}
+	}
+
+	groups = slices.DeleteFunc(groups, func(g string) bool {
+		return g == "all" || g == "ungrouped"
+	})
+	slices.Sort(groups)
+	return groups
+}
+
+func (inv *ansibleInventory) hosts() []Host {
+	hosts := make([]Host, 0, len(inv.hostOrder))
+
+	for _, name := range inv.hostOrder {
+		groups := inv.groupsOf(name)
+
+		// group vars apply first, so host vars take precedence
+		vars := map[string]string{}
+		for k, v := range inv.groupVars["all"] {
+			vars[k] = v
+		}
+		for _, g := range groups {
+			for k, v := range inv.groupVars[g] {
+				vars[k] = v
+			}
+		}
+		for k, v := range inv.hostVars[name] {
+			vars[k] = v
+		}
+
+		host := Host{
+			Name:           name,
+			HostName:       vars["ansible_host"],
+			User:           vars["ansible_user"],
+			PrivateKeyPath: vars["ansible_ssh_private_key_file"],
+			Groups:         groups,
+		}
+		if port, err := strconv.ParseUint(vars["ansible_port"], 10, 16); err == nil {
+			host.Port = uint16(port)
+		}
+		for _, t := range strings.Split(vars["backy_tags"], ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				host.Tags = append(host.Tags, t)
+			}
+		}
+
+		hosts = append(hosts, host)
+	}
+
+	return hosts
+}
+
+// parseJSON parses the output of an Ansible dynamic inventory script
+func (inv *ansibleInventory) parseJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("error parsing inventory json: %w", err)
+	}
+
+	var groupNames []string
+	for name := range raw {
+		if name != "_meta" {
+			groupNames = append(groupNames, name)
+		}
+	}
+	slices.Sort(groupNames)
+
+	for _, name := range groupNames {
+		// a group can be a list of hosts
+		var hostList []string
+		if err := json.Unmarshal(raw[name], &hostList); err == nil {
+			for _, h := range hostList {
+				inv.addHost(name, h, nil)
+			}
+			continue
+		}
+
+		var group struct {
+			Hosts    []string       `json:"hosts"`
+			Vars     map[string]any `json:"vars"`
+			Children []string       `json:"children"`
+		}
+		if err := json.Unmarshal(raw[name], &group); err != nil {
+			return fmt.Errorf("error parsing inventory group %s: %w", name, err)
+		}
+		for _, h := range group.Hosts {
+			inv.addHost(name, h, nil)
+		}
+		inv.addGroupVars(name, stringifyVars(group.Vars))
+		for _, c := range group.Children {
+			inv.addChild(name, c)
+		}
+	}
+
+	if meta, ok := raw["_meta"]; ok {
+		var m struct {
+			HostVars map[string]map[string]any `json:"hostvars"`
+		}
+		if err := json.Unmarshal(meta, &m); err != nil {
+			return fmt.Errorf("error parsing inventory _meta: %w", err)
+		}
+		hostNames := make([]string, 0, len(m.HostVars))
+		for h := range m.HostVars {
+			hostNames = append(hostNames, h)
+		}
+		slices.Sort(hostNames)
+		for _, h := range hostNames {
+			inv.addHost("", h, stringifyVars(m.HostVars[h]))
+		}
+	}
+
+	return nil
+}
+
+// parseINI parses an Ansible INI inventory
+func (inv *ansibleInventory) parseINI(data []byte) error {
+	group := "ungrouped"
+	section := "hosts"
+
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			group = strings.TrimSuffix(strings.TrimPrefix(line, "["), "]")
+			section = "hosts"
+			if name, kind, found := strings.Cut(group, ":"); found {
+				group, section = name, kind
+			}
+			if section != "hosts" && section != "vars" && section != "children" {
+				return fmt.Errorf("line %d: unknown section type %s", lineNum, section)
+			}
+			continue
+		}
+
+		switch section {
+		case "vars":
+			k, v, found := strings.Cut(line, "=")
+			if !found {
+				return fmt.Errorf("line %d: expected key=value in [%s:vars]", lineNum, group)
+			}
+			inv.addGroupVars(group, map[string]string{strings.TrimSpace(k): unquote(strings.TrimSpace(v))})
+		case "children":
+			inv.addChild(group, line)
+		default:
+			fields, err := splitINIFields(line)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			vars := map[string]string{}
+			for _, f := range fields[1:] {
+				k, v, found := strings.Cut(f, "=")
+				if !found {
+					return fmt.Errorf("line %d: expected key=value after host %s", lineNum, fields[0])
+				}
+				vars[k] = unquote(v)
+			}
+			if err := inv.addHostPattern(group, fields[0], vars); err != nil {
+				return fmt.Errorf("line %d: %w", lineNum, err)
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+type ansibleYAMLGroup struct {
+	Hosts    map[string]map[string]any    `yaml:"hosts"`
+	Vars     map[string]any               `yaml:"vars"`
+	Children map[string]*ansibleYAMLGroup `yaml:"children"`
+}
+
+// parseYAML parses an Ansible YAML inventory
+func (inv *ansibleInventory) parseYAML(data []byte) error {
+	var groups map[string]*ansibleYAMLGroup
+	if err := yaml.Unmarshal(data, &groups); err != nil {
+		return fmt.Errorf("error parsing inventory yaml: %w", err)
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if err := inv.addYAMLGroup(name, groups[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (inv *ansibleInventory) addYAMLGroup(name string, group *ansibleYAMLGroup) error {
+	if group == nil {
+		return nil
+	}
+
+	hostNames := make([]string, 0, len(group.Hosts))
+	for h := range group.Hosts {
+		hostNames = append(hostNames, h)
+	}
+	slices.Sort(hostNames)
+
+	for _, h := range hostNames {
+		if err := inv.addHostPattern(name, h, stringifyVars(group.Hosts[h])); err != nil {
+			return err
+		}
+	}
+	inv.addGroupVars(name, stringifyVars(group.Vars))
+
+	for _, childName := range slices.Sorted(maps.Keys(group.Children)) {
+		inv.addChild(name, childName)
+		if err := inv.addYAMLGroup(childName, group.Children[childName]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addHostPattern adds the hosts of pattern to group.
+// The pattern can have ranges and a port, such as web[01:03].example.com:2222.
+// The port is used unless vars has ansible_port.
+func (inv *ansibleInventory) addHostPattern(group, pattern string, vars map[string]string) error {
+	pattern, port, err := splitHostPort(pattern)
+	if err != nil {
+		return err
+	}
+	if port != "" && vars["ansible_port"] == "" {
+		vars = maps.Clone(vars)
+		if vars == nil {
+			vars = map[string]string{}
+		}
+		vars["ansible_port"] = port
+	}
+
+	hosts, err := expandHostPattern(pattern)
+	if err != nil {
+		return err
+	}
+	for _, h := range hosts {
+		inv.addHost(group, h, vars)
+	}
+	return nil
+}
+
+// splitHostPort splits the port from a host pattern such as db.example.com:2222.
+// Colons in ranges are not port separators, and patterns with more colons are IPv6 addresses without a port.
+func splitHostPort(pattern string) (string, string, error) {
+	i := -1
+	inRange := false
+	for j, r := range pattern {
+		switch {
+		case r == '[':
+			inRange = true
+		case r == ']':
+			inRange = false
+		case r == ':' && !inRange:
+			if i != -1 {
+				return pattern, "", nil
+			}
+			i = j
+		}
+	}
+	if i == -1 {
+		return pattern, "", nil
+	}
+	port := pattern[i+1:]
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", "", fmt.Errorf("invalid port in host %s", pattern)
+	}
+	return pattern[:i], port, nil
+}
+
+// expandHostPattern expands a host range such as web[01:03].example.com, web[01:09:2] or db-[a:c]
+func expandHostPattern(pattern string) ([]string, error) {
+	start := strings.Index(pattern, "[")
+	end := strings.Index(pattern, "]")
+	if start == -1 || end < start {
+		return []string{pattern}, nil
+	}
+
+	prefix, suffix := pattern[:start], pattern[end+1:]
+	bounds := strings.Split(pattern[start+1:end], ":")
+	if len(bounds) != 2 && len(bounds) != 3 {
+		return nil, fmt.Errorf("invalid host range %s", pattern)
+	}
+	from, to := bounds[0], bounds[1]
+	step := 1
+	if len(bounds) == 3 {
+		var err error
+		if step, err = strconv.Atoi(bounds[2]); err != nil || step < 1 {
+			return nil, fmt.Errorf("invalid step in host range %s", pattern)
+		}
+	}
+
+	var names []string
+	if fromNum, err := strconv.Atoi(from); err == nil {
+		toNum, err := strconv.Atoi(to)
+		if err != nil || toNum < fromNum {
+			return nil, fmt.Errorf("invalid host range %s", pattern)
+		}
+		for i := fromNum; i <= toNum; i += step {
+			names = append(names, fmt.Sprintf("%s%0*d", prefix, len(from), i))
+		}
+	} else if len(from) == 1 && len(to) == 1 && from <= to {
+		for c := int(from[0]); c <= int(to[0]); c += step {
+			names = append(names, prefix+string(rune(c)))
+		}
+	} else {
+		return nil, fmt.Errorf("invalid host range %s", pattern)
+	}
+
+	// expand any further ranges in the suffix
+	var expanded []string
+	for _, n := range names {
+		rest, err := expandHostPattern(suffix)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rest {
+			expanded = append(expanded, n+r)
+		}
+	}
+	return expanded, nil
+}
+
+// stringifyVars converts variable values to strings. Lists are joined with commas.
+func stringifyVars(vars map[string]any) map[string]string {
+	out := make(map[string]string, len(vars))
+	for k, v := range vars {
+		switch val := v.(type) {
+		case nil:
+			out[k] = ""
+		case []any:
+			items := make([]string, 0, len(val))
+			for _, item := range val {
+				items = append(items, fmt.Sprint(item))
+			}
+			out[k] = strings.Join(items, ",")
+		case float64:
+			out[k] = strconv.FormatFloat(val, 'f', -1, 64)
+		default:
+			out[k] = fmt.Sprint(val)
+		}
+	}
+	return out
+}
+
+// splitINIFields splits a host line on whitespace. Quoted values can contain whitespace, such as key="a b".
+func splitINIFields(line string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	var quote rune
+	inField := false
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ' ' || r == '\t':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+			continue
+		}
+		field.WriteRune(r)
+		inField = true
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %s", line)
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
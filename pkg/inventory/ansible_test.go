@@ -0,0 +1,186 @@
+package inventory
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestParseAnsibleInventory(t *testing.T) {
+	web := func(name, user string) Host {
+		return Host{Name: name, User: user, PrivateKeyPath: "~/.ssh/web", Groups: []string{"prod", "web"}}
+	}
+	bastion := Host{Name: "bastion.example.com", User: "root", Port: 2222, PrivateKeyPath: "~/.ssh/web", Groups: []string{"prod", "web"}, Tags: []string{"edge", "public"}}
+	stepped := func(name string, groups ...string) Host {
+		return Host{Name: name, HostName: "10.0.0.1", User: "root", Port: 2200, Groups: groups}
+	}
+
+	tests := []struct {
+		file   string
+		format string
+		want   []Host
+	}{
+		{
+			file:   "hosts.ini",
+			format: "ini",
+			want: []Host{
+				web("web01.example.com", "deploy"),
+				web("web02.example.com", "deploy"),
+				web("web03.example.com", "deploy"),
+				bastion,
+				{Name: "dba.example.com", User: "root", Port: 5022, Groups: []string{"db", "prod"}},
+				{Name: "dbb.example.com", User: "root", Port: 5022, Groups: []string{"db", "prod"}},
+				{Name: "dbc.example.com", User: "root", Port: 5022, Groups: []string{"db", "prod"}},
+				stepped("db-01", "db", "prod"),
+				stepped("db-03", "db", "prod"),
+				stepped("db-05", "db", "prod"),
+			},
+		},
+		{
+			file:   "hosts.yml",
+			format: "yaml",
+			want: []Host{
+				stepped("db-01", "db"),
+				stepped("db-03", "db"),
+				stepped("db-05", "db"),
+				{Name: "bastion.example.com", User: "root", Port: 2222, PrivateKeyPath: "~/.ssh/web", Groups: []string{"web"}, Tags: []string{"edge", "public"}},
+				{Name: "web01.example.com", User: "deploy", PrivateKeyPath: "~/.ssh/web", Groups: []string{"web"}},
+				{Name: "web02.example.com", User: "deploy", PrivateKeyPath: "~/.ssh/web", Groups: []string{"web"}},
+			},
+		},
+		{
+			file:   "inventory.json",
+			format: "json",
+			want: []Host{
+				{Name: "db01.example.com", HostName: "10.0.0.1", Port: 2200, Groups: []string{"db", "prod"}, Tags: []string{"backup", "postgres"}},
+				{Name: "web01.example.com", User: "deploy", Groups: []string{"prod", "web"}},
+				{Name: "web02.example.com", User: "deploy", Groups: []string{"prod", "web"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ParseAnsibleInventory(data, tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hosts =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAnsibleInventoryErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		format string
+	}{
+		{name: "unknown format", data: "web", format: "toml"},
+		{name: "unknown section", data: "[web:meta]\n", format: "ini"},
+		{name: "vars without value", data: "[web:vars]\nansible_user\n", format: "ini"},
+		{name: "host var without value", data: "web01 ansible_user\n", format: "ini"},
+		{name: "unterminated quote", data: `web01 ansible_ssh_common_args="-o Foo=bar` + "\n", format: "ini"},
+		{name: "invalid port", data: "web01:ssh\n", format: "ini"},
+		{name: "invalid range", data: "web[03:01]\n", format: "ini"},
+		{name: "invalid json", data: "{", format: "json"},
+		{name: "invalid yaml", data: "all: [", format: "yaml"},
+	}
+
+	for _, tt := range tests {
+		if _, err := ParseAnsibleInventory([]byte(tt.data), tt.format); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestExpandHostPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []string
+		wantErr bool
+	}{
+		{pattern: "web.example.com", want: []string{"web.example.com"}},
+		{pattern: "web[1:3]", want: []string{"web1", "web2", "web3"}},
+		{pattern: "web[01:03].example.com", want: []string{"web01.example.com", "web02.example.com", "web03.example.com"}},
+		{pattern: "web[01:10:3]", want: []string{"web01", "web04", "web07", "web10"}},
+		{pattern: "db-[a:c]", want: []string{"db-a", "db-b", "db-c"}},
+		{pattern: "db-[a:e:2]", want: []string{"db-a", "db-c", "db-e"}},
+		{pattern: "rack[1:2]-node[a:b]", want: []string{"rack1-nodea", "rack1-nodeb", "rack2-nodea", "rack2-nodeb"}},
+		{pattern: "web[1]", wantErr: true},
+		{pattern: "web[3:1]", wantErr: true},
+		{pattern: "web[1:3:0]", wantErr: true},
+		{pattern: "web[1:a]", wantErr: true},
+		{pattern: "web[aa:bb]", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := expandHostPattern(tt.pattern)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("expandHostPattern(%s) error = %v, want error %t", tt.pattern, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("expandHostPattern(%s) = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestSplitHostPort(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		wantHost string
+		wantPort string
+		wantErr  bool
+	}{
+		{pattern: "db.example.com", wantHost: "db.example.com"},
+		{pattern: "db.example.com:2222", wantHost: "db.example.com", wantPort: "2222"},
+		{pattern: "web[01:03]", wantHost: "web[01:03]"},
+		{pattern: "web[01:03]:2222", wantHost: "web[01:03]", wantPort: "2222"},
+		{pattern: "fe80::1", wantHost: "fe80::1"},
+		{pattern: "db:ssh", wantErr: true},
+		{pattern: "db:70000", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		host, port, err := splitHostPort(tt.pattern)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("splitHostPort(%s) error = %v, want error %t", tt.pattern, err, tt.wantErr)
+			continue
+		}
+		if host != tt.wantHost || port != tt.wantPort {
+			t.Errorf("splitHostPort(%s) = %q, %q, want %q, %q", tt.pattern, host, port, tt.wantHost, tt.wantPort)
+		}
+	}
+}
+
+func TestSplitINIFields(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{line: "web01", want: []string{"web01"}},
+		{line: "web01  ansible_user=deploy\tansible_port=22", want: []string{"web01", "ansible_user=deploy", "ansible_port=22"}},
+		{line: `web01 ansible_ssh_common_args="-o Foo=bar" x=1`, want: []string{"web01", `ansible_ssh_common_args="-o Foo=bar"`, "x=1"}},
+		{line: `web01 motd='it is "fine"'`, want: []string{"web01", `motd='it is "fine"'`}},
+	}
+
+	for _, tt := range tests {
+		got, err := splitINIFields(tt.line)
+		if err != nil {
+			t.Errorf("splitINIFields(%s): %v", tt.line, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("splitINIFields(%s) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
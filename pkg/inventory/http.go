@@ -0,0 +1,31 @@
+package inventory
+
+import (
+	"fmt"
+
+	"git.andrewnw.xyz/CyberShell/backy/pkg/remotefetcher"
+)
+
+// HTTPSource loads hosts from an HTTP endpoint.
+// The response is an Ansible inventory in the config's format, json by default.
+type HTTPSource struct {
+	config Config
+	cache  *remotefetcher.Cache
+}
+
+// Load fetches the endpoint and parses the response
+func (h *HTTPSource) Load() ([]Host, error) {
+	format := h.config.Format
+	if format == "" {
+		format = "json"
+	}
+
+	data, err := loadWithCache(h.cache, h.config.URL, format, h.config.CacheTTL, func() ([]byte, error) {
+		return remotefetcher.NewHTTPFetcher().Fetch(h.config.URL)
+	})
+	if err != nil && !isStale(err) {
+		return nil, fmt.Errorf("error fetching inventory %s: %w", h.config.URL, err)
+	}
+
+	return parseLoaded(data, format, err)
+}
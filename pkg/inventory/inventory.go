@@ -0,0 +1,150 @@
+package inventory
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.andrewnw.xyz/CyberShell/backy/pkg/remotefetcher"
+)
+
+// Source is an interface used to load hosts from outside the backy config. This shall be implemented by every source.
+type Source interface {
+	// Load returns the hosts from the source.
+	// If the source fails to load and the cached hosts are returned instead, the error is a *StaleError.
+	Load() ([]Host, error)
+}
+
+// StaleError is returned with the cached hosts when a source fails to load
+type StaleError struct {
+	// Source is the path or URL of the source
+	Source string
+	// CachedAt is when the cached hosts were loaded
+	CachedAt time.Time
+	Err      error
+}
+
+func (e *StaleError) Error() string {
+	return fmt.Sprintf("inventory %s failed to load, using the cached result from %s: %v", e.Source, e.CachedAt.Format(time.RFC3339), e.Err)
+}
+
+func (e *StaleError) Unwrap() error { return e.Err }
+
+// Host is a host loaded from an inventory source
+type Host struct {
+	Name           string
+	HostName       string
+	User           string
+	Port           uint16
+	PrivateKeyPath string
+	Groups         []string
+	Tags           []string
+}
+
+// Config holds the configuration of an inventory source
+type Config struct {
+	// Type is one of script, ansible, or http
+	Type string `yaml:"type"`
+
+	// Path is the path to the script or Ansible inventory file
+	Path string `yaml:"path,omitempty"`
+
+	// Args are passed to the script. Defaults to --list
+	Args []string `yaml:"args,omitempty"`
+
+	// URL of the http source
+	URL string `yaml:"url,omitempty"`
+
+	// Format of the http source or Ansible file: json, ini, or yaml.
+	// The http source defaults to json. The Ansible file format is detected from the extension.
+	Format string `yaml:"format,omitempty"`
+
+	// CacheTTL is how long the cached result is used before the source is loaded again.
+	// If the source fails to load, the cached result is used regardless of its age.
+	CacheTTL time.Duration `yaml:"cacheTTL,omitempty"`
+}
+
+// NewSource returns the Source for the config's type.
+// dir is used to resolve relative paths.
+func NewSource(config Config, cache *remotefetcher.Cache, dir string) (Source, error) {
+	var source Source
+
+	if config.Path != "" && !filepath.IsAbs(config.Path) && !strings.Contains(config.Path, "://") {
+		config.Path = filepath.Join(dir, config.Path)
+	}
+
+	switch config.Type {
+	case "script":
+		if config.Path == "" {
+			return nil, fmt.Errorf("inventory source script requires a path")
+		}
+		source = &ScriptSource{config: config, cache: cache}
+	case "ansible":
+		if config.Path == "" {
+			return nil, fmt.Errorf("inventory source ansible requires a path")
+		}
+		source = &AnsibleFileSource{config: config, cache: cache}
+	case "http":
+		if config.URL == "" {
+			return nil, fmt.Errorf("inventory source http requires a url")
+		}
+		source = &HTTPSource{config: config, cache: cache}
+	default:
+		return nil, fmt.Errorf("unsupported inventory source type: %s", config.Type)
+	}
+
+	return source, nil
+}
+
+// loadWithCache returns the cached data for key if it is newer than ttl.
+// Otherwise, it calls load and caches the result.
+// If load fails, the cached data is returned with a *StaleError.
+func loadWithCache(cache *remotefetcher.Cache, key, dataType string, ttl time.Duration, load func() ([]byte, error)) ([]byte, error) {
+	if cache == nil {
+		return load()
+	}
+
+	var cachedAt time.Time
+	cached, cacheData, cacheExists := cache.Get(remotefetcher.HashURL(key))
+	if cacheExists {
+		if info, err := os.Stat(cacheData.Path); err == nil {
+			cachedAt = info.ModTime()
+		}
+		if ttl > 0 && !cachedAt.IsZero() && time.Since(cachedAt) < ttl {
+			return cached, nil
+		}
+	}
+
+	data, err := load()
+	if err != nil {
+		if cacheExists {
+			return cached, &StaleError{Source: key, CachedAt: cachedAt, Err: err}
+		}
+		return nil, err
+	}
+
+	if _, err := cache.Set(key, remotefetcher.HashURL(string(data)), data, dataType); err != nil {
+		return nil, fmt.Errorf("error caching inventory %s: %w", key, err)
+	}
+
+	return data, nil
+}
+
+// parseLoaded parses data returned by loadWithCache.
+// A *StaleError from loadWithCache is returned with the hosts parsed from the cached data.
+func parseLoaded(data []byte, format string, loadErr error) ([]Host, error) {
+	hosts, err := ParseAnsibleInventory(data, format)
+	if err != nil {
+		return nil, err
+	}
+	return hosts, loadErr
+}
+
+// isStale reports whether err is a *StaleError
+func isStale(err error) bool {
+	var stale *StaleError
+	return errors.As(err, &stale)
+}
@@ -0,0 +1,176 @@
+package inventory
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.andrewnw.xyz/CyberShell/backy/pkg/remotefetcher"
+)
+
+func TestNewSource(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		wantPath string
+		wantErr  string
+	}{
+		{name: "relative path", config: Config{Type: "ansible", Path: "hosts.ini"}, wantPath: "/etc/backy/hosts.ini"},
+		{name: "absolute path", config: Config{Type: "script", Path: "/opt/inventory.sh"}, wantPath: "/opt/inventory.sh"},
+		{name: "remote path", config: Config{Type: "ansible", Path: "https://example.com/hosts.ini"}, wantPath: "https://example.com/hosts.ini"},
+		{name: "script without path", config: Config{Type: "script"}, wantErr: "requires a path"},
+		{name: "ansible without path", config: Config{Type: "ansible"}, wantErr: "requires a path"},
+		{name: "http without url", config: Config{Type: "http"}, wantErr: "requires a url"},
+		{name: "unknown type", config: Config{Type: "consul"}, wantErr: "unsupported inventory source type"},
+	}
+
+	for _, tt := range tests {
+		source, err := NewSource(tt.config, nil, "/etc/backy")
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		var path string
+		switch s := source.(type) {
+		case *AnsibleFileSource:
+			path = s.config.Path
+		case *ScriptSource:
+			path = s.config.Path
+		}
+		if path != tt.wantPath {
+			t.Errorf("%s: path = %s, want %s", tt.name, path, tt.wantPath)
+		}
+	}
+}
+
+func TestAnsibleFileSource(t *testing.T) {
+	for _, file := range []string{"hosts.ini", "hosts.yml", "inventory.json"} {
+		source, err := NewSource(Config{Type: "ansible", Path: file}, nil, "testdata")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts, err := source.Load()
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		if len(hosts) == 0 {
+			t.Errorf("%s: no hosts loaded", file)
+		}
+	}
+
+	source, _ := NewSource(Config{Type: "ansible", Path: "missing.ini"}, nil, "testdata")
+	if _, err := source.Load(); err == nil {
+		t.Error("missing inventory file did not fail")
+	}
+}
+
+func TestScriptSource(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "inventory.sh")
+	inventory, err := filepath.Abs(filepath.Join("testdata", "inventory.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(script, []byte(`#!/bin/sh
+case "$1" in
+--list) cat `+inventory+` ;;
+*) echo "unknown argument $1" >&2; exit 1 ;;
+esac
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := NewSource(Config{Type: "script", Path: "inventory.sh"}, nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := source.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 3 || hosts[0].Name != "db01.example.com" {
+		t.Errorf("hosts = %+v, want the hosts of the script's inventory", hosts)
+	}
+
+	source, _ = NewSource(Config{Type: "script", Path: "inventory.sh", Args: []string{"--host"}}, nil, dir)
+	if _, err := source.Load(); err == nil || !strings.Contains(err.Error(), "unknown argument --host") {
+		t.Errorf("error = %v, want the stderr of the script", err)
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+	var requests atomic.Int32
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("[web]\nweb01.example.com:2222 ansible_user=deploy\n"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	cache, err := remotefetcher.NewCache(filepath.Join(dir, "cache.yml"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	load := func(ttl time.Duration) ([]Host, error) {
+		source, err := NewSource(Config{Type: "http", URL: server.URL + "/inventory", Format: "ini", CacheTTL: ttl}, cache, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return source.Load()
+	}
+	check := func(hosts []Host, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hosts) != 1 || hosts[0].Name != "web01.example.com" || hosts[0].Port != 2222 || hosts[0].User != "deploy" {
+			t.Errorf("hosts = %+v, want web01.example.com", hosts)
+		}
+	}
+
+	check(load(0))
+	check(load(time.Hour))
+	if got := requests.Load(); got != 1 {
+		t.Errorf("requests = %d, want the cached inventory used within its TTL", got)
+	}
+
+	failing.Store(true)
+	hosts, err := load(0)
+	var stale *StaleError
+	if !errors.As(err, &stale) {
+		t.Fatalf("failing endpoint with a cached inventory returned %v, want a StaleError", err)
+	}
+	if stale.Source != server.URL+"/inventory" || stale.CachedAt.IsZero() {
+		t.Errorf("stale error = %+v, want the source and the time it was cached", stale)
+	}
+	check(hosts, nil)
+	if got := requests.Load(); got != 2 {
+		t.Errorf("requests = %d, want the endpoint requested once the TTL is 0", got)
+	}
+
+	source, _ := NewSource(Config{Type: "http", URL: server.URL + "/other"}, nil, dir)
+	if _, err := source.Load(); err == nil {
+		t.Error("failing endpoint without a cached inventory did not fail")
+	}
+}
@@ -0,0 +1,43 @@
+package inventory
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"git.andrewnw.xyz/CyberShell/backy/pkg/remotefetcher"
+)
+
+// ScriptSource loads hosts from an executable that prints an Ansible dynamic inventory in JSON
+type ScriptSource struct {
+	config Config
+	cache  *remotefetcher.Cache
+}
+
+// Load runs the script and parses its output
+func (s *ScriptSource) Load() ([]Host, error) {
+	args := s.config.Args
+	if args == nil {
+		args = []string{"--list"}
+	}
+
+	key := strings.Join(append([]string{s.config.Path}, args...), " ")
+	data, err := loadWithCache(s.cache, key, "json", s.config.CacheTTL, func() ([]byte, error) {
+		var stderr bytes.Buffer
+		cmd := exec.Command(s.config.Path, args...)
+		cmd.Dir = filepath.Dir(s.config.Path)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return out, nil
+	})
+	if err != nil && !isStale(err) {
+		return nil, fmt.Errorf("error running inventory script %s: %w", s.config.Path, err)
+	}
+
+	return parseLoaded(data, "json", err)
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"regexp"
 	"strings"
 
 	packagemanagercommon "git.andrewnw.xyz/CyberShell/backy/pkg/pkgman/common"
@@ -76,6 +77,38 @@ func (a *AptManager) CheckVersion(pkgs []packagemanagercommon.Package) (string,
 	return baseCmd, baseArgs
 }
 
+// ListUpgrades returns the command and arguments for listing upgradable packages.
+func (a *AptManager) ListUpgrades(pkgs []packagemanagercommon.Package) (string, []string) {
+	baseCmd := a.prependAuthCommand(DefaultPackageCommand)
+	baseArgs := []string{"update", "-qq", "&&"}
+	baseArgs = append(baseArgs, aptListUpgradableArgs(pkgs)...)
+
+	return baseCmd, baseArgs
+}
+
+// SecurityUpgrade returns the command and arguments for listing the upgradable packages
+// and then upgrading the packages that come from a security suite.
+func (a *AptManager) SecurityUpgrade(pkgs []packagemanagercommon.Package) (string, []string) {
+	baseCmd := a.prependAuthCommand(DefaultPackageCommand)
+	baseArgs := []string{"update", "-qq", "&&"}
+	baseArgs = append(baseArgs, aptListUpgradableArgs(pkgs)...)
+	baseArgs = append(baseArgs, "&&", "echo", packagemanagercommon.UpgradeSectionMarker, "&&")
+	baseArgs = append(baseArgs, aptListUpgradableArgs(pkgs)...)
+	baseArgs = append(baseArgs, "|", "grep", "-e", "-security", "|", "cut", "-d/", "-f1", "|",
+		"xargs", "-r", baseCmd, "install", "--only-upgrade", "-y")
+
+	return baseCmd, baseArgs
+}
+
+func aptListUpgradableArgs(pkgs []packagemanagercommon.Package) []string {
+	args := []string{"apt", "list", "--upgradable"}
+	for _, p := range pkgs {
+		args = append(args, p.Name)
+	}
+	// apt warns that its CLI is not stable on stderr
+	return append(args, "2>/dev/null")
+}
+
 // UpgradeAll returns the command and arguments for upgrading all packages.
 func (a *AptManager) UpgradeAll() (string, []string) {
 	baseCmd := a.prependAuthCommand(DefaultPackageCommand)
@@ -163,6 +196,49 @@ func (a *AptManager) ParseRemotePackageManagerVersionOutput(output string) ([]pa
 	return packages, nil
 }
 
+// aptUpgradableRegex matches lines such as
+// openssl/jammy-updates,jammy-security 3.0.2-0ubuntu1.12 amd64 [upgradable from: 3.0.2-0ubuntu1.10]
+var aptUpgradableRegex = regexp.MustCompile(`^([^/\s]+)/(\S+)\s+(\S+)\s+\S+\s+\[upgradable from:\s*([^\]]+)\]`)
+
+// ParseUpgradesOutput parses the apt list --upgradable output.
+// A package is flagged as a security upgrade if any of its suites ends in -security.
+func (a *AptManager) ParseUpgradesOutput(output string) ([]packagemanagercommon.Package, error) {
+	packages := []packagemanagercommon.Package{}
+	outputScan := bufio.NewScanner(strings.NewReader(output))
+	for outputScan.Scan() {
+		line := strings.TrimSpace(outputScan.Text())
+		if line == packagemanagercommon.UpgradeSectionMarker {
+			break
+		}
+		if strings.HasPrefix(line, "E: ") {
+			return nil, fmt.Errorf("error: %s", line)
+		}
+
+		match := aptUpgradableRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		security := false
+		for _, suite := range strings.Split(match[2], ",") {
+			if strings.HasSuffix(suite, "-security") {
+				security = true
+			}
+		}
+
+		packages = append(packages, packagemanagercommon.Package{
+			Name: match[1],
+			VersionCheck: packagemanagercommon.PackageVersion{
+				Installed: strings.TrimSpace(match[4]),
+				Candidate: match[3],
+				Security:  security,
+			},
+		})
+	}
+
+	return packages, nil
+}
+
 func SearchPackages(pkgs []string, version string) (string, []string) {
 	baseCommand := "dpkg-query"
 	baseArgs := []string{"-W", "-f='${Package}\t${Architecture}\t${db:Status-Status}\t${Version}\t${Installed-Size}\t${Binary:summary}\n'"}
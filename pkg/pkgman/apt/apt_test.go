@@ -0,0 +1,104 @@
+package apt
+
+import (
+	"slices"
+	"testing"
+
+	packagemanagercommon "git.andrewnw.xyz/CyberShell/backy/pkg/pkgman/common"
+)
+
+// aptListUpgradable is the output of the securityUpgrade command on Ubuntu 22.04
+const aptListUpgradable = `Listing... Done
+bind9-libs/jammy-updates,jammy-security 1:9.18.28-0ubuntu0.22.04.1 amd64 [upgradable from: 1:9.18.18-0ubuntu0.22.04.2]
+curl/jammy-updates,jammy-security 7.81.0-1ubuntu1.16 amd64 [upgradable from: 7.81.0-1ubuntu1.15]
+tzdata/jammy-updates 2024a-0ubuntu0.22.04 all [upgradable from: 2023c-0ubuntu0.22.04.2]
+backy:upgrade
+Reading package lists...
+curl/jammy-updates,jammy-security 7.81.0-1ubuntu1.16 amd64 [upgradable from: 7.81.0-1ubuntu1.15]
+`
+
+func TestParseUpgradesOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    []packagemanagercommon.Package
+		wantErr bool
+	}{
+		{
+			name:   "ubuntu",
+			output: aptListUpgradable,
+			want: []packagemanagercommon.Package{
+				{Name: "bind9-libs", VersionCheck: packagemanagercommon.PackageVersion{Installed: "1:9.18.18-0ubuntu0.22.04.2", Candidate: "1:9.18.28-0ubuntu0.22.04.1", Security: true}},
+				{Name: "curl", VersionCheck: packagemanagercommon.PackageVersion{Installed: "7.81.0-1ubuntu1.15", Candidate: "7.81.0-1ubuntu1.16", Security: true}},
+				{Name: "tzdata", VersionCheck: packagemanagercommon.PackageVersion{Installed: "2023c-0ubuntu0.22.04.2", Candidate: "2024a-0ubuntu0.22.04"}},
+			},
+		},
+		{
+			name: "debian",
+			output: `Listing...
+openssl/stable-security 3.0.15-1~deb12u1 amd64 [upgradable from: 3.0.14-1~deb12u2]
+libc6/stable 2.36-9+deb12u9 amd64 [upgradable from: 2.36-9+deb12u8]
+`,
+			want: []packagemanagercommon.Package{
+				{Name: "openssl", VersionCheck: packagemanagercommon.PackageVersion{Installed: "3.0.14-1~deb12u2", Candidate: "3.0.15-1~deb12u1", Security: true}},
+				{Name: "libc6", VersionCheck: packagemanagercommon.PackageVersion{Installed: "2.36-9+deb12u8", Candidate: "2.36-9+deb12u9"}},
+			},
+		},
+		{
+			name:   "no upgrades",
+			output: "Listing... Done\n",
+			want:   []packagemanagercommon.Package{},
+		},
+		{
+			name:   "empty",
+			output: "",
+			want:   []packagemanagercommon.Package{},
+		},
+		{
+			name:    "error",
+			output:  "E: Could not open lock file /var/lib/apt/lists/lock - open (13: Permission denied)\n",
+			wantErr: true,
+		},
+	}
+
+	a := NewAptManager()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.ParseUpgradesOutput(tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("packages = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAptUpgradableRegex(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{
+			line: "openssl/jammy-updates,jammy-security 3.0.2-0ubuntu1.12 amd64 [upgradable from: 3.0.2-0ubuntu1.10]",
+			want: []string{"openssl", "jammy-updates,jammy-security", "3.0.2-0ubuntu1.12", "3.0.2-0ubuntu1.10"},
+		},
+		{
+			line: "python3.10/jammy-updates 3.10.12-1~22.04.6 amd64 [upgradable from: 3.10.12-1~22.04.5]",
+			want: []string{"python3.10", "jammy-updates", "3.10.12-1~22.04.6", "3.10.12-1~22.04.5"},
+		},
+		{line: "Listing... Done"},
+		{line: "curl/jammy-updates,now 7.81.0-1ubuntu1.16 amd64 [installed]"},
+	}
+	for _, tt := range tests {
+		match := aptUpgradableRegex.FindStringSubmatch(tt.line)
+		var got []string
+		if match != nil {
+			got = match[1:]
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("match of %q = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
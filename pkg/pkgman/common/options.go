@@ -10,14 +10,24 @@ type PackageParser interface {
 
 // PackageVersion represents the installed and candidate versions of a package.
 type PackageVersion struct {
-	Installed string
-	Candidate string
-	Match     bool
-	Message   string
+	Installed string `json:"installed"`
+	Candidate string `json:"candidate"`
+	Match     bool   `json:"match,omitempty"`
+	Message   string `json:"message,omitempty"`
+	// Security is true when the candidate version fixes a security issue.
+	Security bool `json:"security"`
 }
 
 type Package struct {
-	Name         string `yaml:"name"`
-	Version      string `yaml:"version,omitempty"`
-	VersionCheck PackageVersion
+	Name         string         `yaml:"name" json:"name"`
+	Version      string         `yaml:"version,omitempty" json:"version,omitempty"`
+	VersionCheck PackageVersion `json:"versionCheck"`
 }
+
+// Section markers echoed between the parts of a listUpgrades or securityUpgrade command.
+// The output parsers use them to tell the parts apart.
+const (
+	SecuritySectionMarker  = "backy:security"
+	InstalledSectionMarker = "backy:installed"
+	UpgradeSectionMarker   = "backy:upgrade"
+)
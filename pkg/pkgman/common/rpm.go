@@ -0,0 +1,101 @@
+package packagemanagercommon
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RPMInstalledQueryFormat is passed to rpm --queryformat so the installed versions
+// are printed in the same form as the yum and dnf listings.
+const RPMInstalledQueryFormat = `'%{NAME}.%{ARCH} %|EPOCH?{%{EPOCH}:}|%{VERSION}-%{RELEASE}\n'`
+
+var rpmEpochRegex = regexp.MustCompile(`(^|-)\d+:`)
+
+// rpmObsoletingSection is printed by yum and dnf before the packages that replace installed packages.
+// Each replacing package is followed by an indented line with the package it obsoletes.
+const rpmObsoletingSection = "Obsoleting Packages"
+
+// ParseRPMUpgradesOutput parses the output of the listUpgrades and securityUpgrade commands
+// built by the yum and dnf package managers.
+//
+// The output has up to four sections:
+//  1. the list of available upgrades (name.arch version repo), which can end with the
+//     obsoleting packages; these are ignored, as they are not upgrades of installed packages
+//  2. after SecuritySectionMarker, the security advisories (id severity nevra)
+//  3. after InstalledSectionMarker, the installed packages (name.arch version)
+//  4. after UpgradeSectionMarker, the upgrade output, which is ignored
+func ParseRPMUpgradesOutput(output string) ([]Package, error) {
+	var (
+		section   string
+		packages  []Package
+		security  = map[string]bool{}
+		installed = map[string]string{}
+	)
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == UpgradeSectionMarker {
+			break
+		}
+		if line == SecuritySectionMarker || line == InstalledSectionMarker || line == rpmObsoletingSection {
+			section = line
+			continue
+		}
+
+		if strings.HasPrefix(line, "Error:") {
+			if strings.Contains(line, "No matching Packages") {
+				continue
+			}
+			return nil, fmt.Errorf("error: %s", line)
+		}
+
+		fields := strings.Fields(line)
+
+		switch section {
+		case rpmObsoletingSection:
+			continue
+		case SecuritySectionMarker:
+			if len(fields) == 3 {
+				security[stripRPMEpoch(fields[2])] = true
+			}
+		case InstalledSectionMarker:
+			if len(fields) == 2 {
+				installed[fields[0]] = fields[1]
+			}
+		default:
+			if len(fields) != 3 || !strings.Contains(fields[0], ".") {
+				continue
+			}
+			packages = append(packages, Package{
+				Name: fields[0],
+				VersionCheck: PackageVersion{
+					Candidate: fields[1],
+				},
+			})
+		}
+	}
+
+	for i, p := range packages {
+		packages[i].VersionCheck.Installed = installed[p.Name]
+		packages[i].VersionCheck.Security = security[rpmNEVRA(p.Name, p.VersionCheck.Candidate)]
+	}
+
+	return packages, nil
+}
+
+// rpmNEVRA builds name-version-release.arch without the epoch from a name.arch and a version
+func rpmNEVRA(nameArch, version string) string {
+	dot := strings.LastIndex(nameArch, ".")
+	if dot == -1 {
+		return stripRPMEpoch(nameArch + "-" + version)
+	}
+	return stripRPMEpoch(fmt.Sprintf("%s-%s%s", nameArch[:dot], version, nameArch[dot:]))
+}
+
+func stripRPMEpoch(s string) string {
+	return rpmEpochRegex.ReplaceAllString(s, "$1")
+}
@@ -0,0 +1,134 @@
+package packagemanagercommon
+
+import (
+	"slices"
+	"testing"
+)
+
+// dnfListUpgrades is the output of the dnf listUpgrades command on Rocky Linux 9
+const dnfListUpgrades = `Available Upgrades
+curl.x86_64                          7.76.1-26.el9_3.3              baseos
+openssl.x86_64                       1:3.0.7-25.el9_3               baseos
+openssl-libs.x86_64                  1:3.0.7-25.el9_3               baseos
+tzdata.noarch                        2024a-1.el9                    baseos
+backy:security
+RHSA-2024:0310 Moderate/Sec.  openssl-1:3.0.7-25.el9_3.x86_64
+RHSA-2024:0310 Moderate/Sec.  openssl-libs-1:3.0.7-25.el9_3.x86_64
+RHSA-2024:1234 Important/Sec. curl-7.76.1-26.el9_3.3.x86_64
+backy:installed
+bash.x86_64 5.1.8-6.el9_1
+curl.x86_64 7.76.1-26.el9_3.2
+openssl.x86_64 1:3.0.7-24.el9
+openssl-libs.x86_64 1:3.0.7-24.el9
+tzdata.noarch 2023c-1.el9
+`
+
+// yumListUpgrades is the output of the yum listUpgrades and securityUpgrade commands on CentOS 7
+const yumListUpgrades = `Updated Packages
+bind-export-libs.x86_64             32:9.11.4-26.P2.el7_9.16             updates
+openssl.x86_64                      1:1.0.2k-26.el7_9                    updates
+systemd.x86_64                      219-78.el7_9.9                       updates
+backy:security
+RHSA-2023:1335 Important/Sec. openssl-1:1.0.2k-26.el7_9.x86_64
+RHSA-2024:0627 Important/Sec. bind-export-libs-32:9.11.4-26.P2.el7_9.16.x86_64
+backy:installed
+bind-export-libs.x86_64 32:9.11.4-26.P2.el7_9.15
+openssl.x86_64 1:1.0.2k-25.el7_9
+systemd.x86_64 219-78.el7_9.7
+backy:upgrade
+Resolving Dependencies
+--> Running transaction check
+---> Package openssl.x86_64 1:1.0.2k-25.el7_9 will be updated
+`
+
+// dnfCheckUpdate is the output of dnf check-update, with packages that obsolete installed packages
+const dnfCheckUpdate = `
+Last metadata expiration check: 0:12:31 ago on Mon 14 Oct 2024 09:12:01 AM UTC.
+
+kernel.x86_64                     5.14.0-427.40.1.el9_4            baseos
+NetworkManager.x86_64             1:1.46.0-19.el9_4                baseos
+Obsoleting Packages
+grub2-tools.x86_64                1:2.06-82.el9_4                  baseos
+    grub2-tools.x86_64            1:2.06-77.el9                    @anaconda
+grub2-tools-efi.x86_64            1:2.06-82.el9_4                  baseos
+    grub2-tools.x86_64            1:2.06-77.el9                    @anaconda
+`
+
+func TestParseRPMUpgradesOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    []Package
+		wantErr bool
+	}{
+		{
+			name:   "dnf",
+			output: dnfListUpgrades,
+			want: []Package{
+				{Name: "curl.x86_64", VersionCheck: PackageVersion{Installed: "7.76.1-26.el9_3.2", Candidate: "7.76.1-26.el9_3.3", Security: true}},
+				{Name: "openssl.x86_64", VersionCheck: PackageVersion{Installed: "1:3.0.7-24.el9", Candidate: "1:3.0.7-25.el9_3", Security: true}},
+				{Name: "openssl-libs.x86_64", VersionCheck: PackageVersion{Installed: "1:3.0.7-24.el9", Candidate: "1:3.0.7-25.el9_3", Security: true}},
+				{Name: "tzdata.noarch", VersionCheck: PackageVersion{Installed: "2023c-1.el9", Candidate: "2024a-1.el9"}},
+			},
+		},
+		{
+			name:   "yum with upgrade output",
+			output: yumListUpgrades,
+			want: []Package{
+				{Name: "bind-export-libs.x86_64", VersionCheck: PackageVersion{Installed: "32:9.11.4-26.P2.el7_9.15", Candidate: "32:9.11.4-26.P2.el7_9.16", Security: true}},
+				{Name: "openssl.x86_64", VersionCheck: PackageVersion{Installed: "1:1.0.2k-25.el7_9", Candidate: "1:1.0.2k-26.el7_9", Security: true}},
+				{Name: "systemd.x86_64", VersionCheck: PackageVersion{Installed: "219-78.el7_9.7", Candidate: "219-78.el7_9.9"}},
+			},
+		},
+		{
+			name:   "obsoleting packages",
+			output: dnfCheckUpdate,
+			want: []Package{
+				{Name: "kernel.x86_64", VersionCheck: PackageVersion{Candidate: "5.14.0-427.40.1.el9_4"}},
+				{Name: "NetworkManager.x86_64", VersionCheck: PackageVersion{Candidate: "1:1.46.0-19.el9_4"}},
+			},
+		},
+		{
+			name:   "no matching packages",
+			output: "Error: No matching Packages to list\nbacky:security\nbacky:installed\nbash.x86_64 5.1.8-6.el9_1\n",
+		},
+		{
+			name:   "empty",
+			output: "",
+		},
+		{
+			name:    "error",
+			output:  "Error: Failed to download metadata for repo 'appstream': Cannot download repomd.xml\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRPMUpgradesOutput(tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("packages = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripRPMEpoch(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "1:3.0.7-25.el9_3", want: "3.0.7-25.el9_3"},
+		{in: "openssl-1:3.0.7-25.el9_3.x86_64", want: "openssl-3.0.7-25.el9_3.x86_64"},
+		{in: "bind-export-libs-32:9.11.4-26.P2.el7_9.16.x86_64", want: "bind-export-libs-9.11.4-26.P2.el7_9.16.x86_64"},
+		{in: "curl-7.76.1-26.el9_3.3.x86_64", want: "curl-7.76.1-26.el9_3.3.x86_64"},
+	}
+	for _, tt := range tests {
+		if got := stripRPMEpoch(tt.in); got != tt.want {
+			t.Errorf("stripRPMEpoch(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
@@ -80,6 +80,43 @@ func (y *DnfManager) UpgradeAll() (string, []string) {
 	return baseCmd, baseArgs
 }
 
+// ListUpgrades returns the command and arguments for listing upgradable packages,
+// the security advisories that apply to them and the installed versions.
+func (d *DnfManager) ListUpgrades(pkgs []packagemanagercommon.Package) (string, []string) {
+	baseCmd := d.prependAuthCommand("dnf")
+	baseArgs := []string{"-q", "list", "--upgrades"}
+	for _, p := range pkgs {
+		baseArgs = append(baseArgs, p.Name)
+	}
+
+	// list exits non-zero when nothing matches, so the sections are separated by ;
+	baseArgs = append(baseArgs, ";", "echo", packagemanagercommon.SecuritySectionMarker, ";", baseCmd, "-q", "updateinfo", "list", "--security")
+	for _, p := range pkgs {
+		baseArgs = append(baseArgs, p.Name)
+	}
+	baseArgs = append(baseArgs, ";", "echo", packagemanagercommon.InstalledSectionMarker, ";",
+		"rpm", "-qa", "--queryformat", packagemanagercommon.RPMInstalledQueryFormat)
+
+	return baseCmd, baseArgs
+}
+
+// SecurityUpgrade returns the command and arguments for listing the upgradable packages
+// and then applying the security upgrades.
+func (d *DnfManager) SecurityUpgrade(pkgs []packagemanagercommon.Package) (string, []string) {
+	baseCmd, baseArgs := d.ListUpgrades(pkgs)
+	baseArgs = append(baseArgs, ";", "echo", packagemanagercommon.UpgradeSectionMarker, ";", baseCmd, "upgrade", "--security", "-y")
+	for _, p := range pkgs {
+		baseArgs = append(baseArgs, p.Name)
+	}
+
+	return baseCmd, baseArgs
+}
+
+// ParseUpgradesOutput parses the output of ListUpgrades and SecurityUpgrade.
+func (d *DnfManager) ParseUpgradesOutput(output string) ([]packagemanagercommon.Package, error) {
+	return packagemanagercommon.ParseRPMUpgradesOutput(output)
+}
+
 // CheckVersion returns the command and arguments for checking the info of a specific package.
 func (d *DnfManager) CheckVersion(pkgs []packagemanagercommon.Package) (string, []string) {
 	baseCmd := d.prependAuthCommand("dnf")
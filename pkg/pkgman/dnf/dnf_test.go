@@ -0,0 +1,56 @@
+package dnf
+
+import (
+	"slices"
+	"testing"
+
+	packagemanagercommon "git.andrewnw.xyz/CyberShell/backy/pkg/pkgman/common"
+)
+
+func TestParseUpgradesOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    []packagemanagercommon.Package
+		wantErr bool
+	}{
+		{
+			name: "fedora",
+			output: `Available Upgrades
+glibc.x86_64                         2.39-22.fc40                   updates
+vim-minimal.x86_64                   2:9.1.719-1.fc40               updates
+backy:security
+FEDORA-2024-8f5d5d2a83 Moderate/Sec.  vim-minimal-2:9.1.719-1.fc40.x86_64
+backy:installed
+glibc.x86_64 2.39-17.fc40
+vim-minimal.x86_64 2:9.1.393-1.fc40
+`,
+			want: []packagemanagercommon.Package{
+				{Name: "glibc.x86_64", VersionCheck: packagemanagercommon.PackageVersion{Installed: "2.39-17.fc40", Candidate: "2.39-22.fc40"}},
+				{Name: "vim-minimal.x86_64", VersionCheck: packagemanagercommon.PackageVersion{Installed: "2:9.1.393-1.fc40", Candidate: "2:9.1.719-1.fc40", Security: true}},
+			},
+		},
+		{
+			name:   "no upgrades",
+			output: "backy:security\nbacky:installed\nglibc.x86_64 2.39-22.fc40\n",
+		},
+		{
+			name:    "error",
+			output:  "Error: Failed to download metadata for repo 'updates': Cannot download repomd.xml\n",
+			wantErr: true,
+		},
+	}
+
+	d := NewDnfManager()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := d.ParseUpgradesOutput(tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("packages = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -17,6 +17,12 @@ type PackageManager interface {
 	UpgradeAll() (string, []string)
 	CheckVersion(pkgs []packagemanagercommon.Package) (string, []string)
 	ParseRemotePackageManagerVersionOutput(output string) ([]packagemanagercommon.Package, error)
+	// ListUpgrades lists available upgrades. If pkgs is empty, all upgradable packages are listed.
+	ListUpgrades(pkgs []packagemanagercommon.Package) (string, []string)
+	// SecurityUpgrade lists the available security upgrades and then installs them.
+	SecurityUpgrade(pkgs []packagemanagercommon.Package) (string, []string)
+	// ParseUpgradesOutput parses the output of ListUpgrades or SecurityUpgrade.
+	ParseUpgradesOutput(output string) ([]packagemanagercommon.Package, error)
 	// Configure applies functional options to customize the package manager.
 	Configure(options ...packagemanagercommon.PackageManagerOption)
 }
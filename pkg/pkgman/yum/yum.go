@@ -78,6 +78,43 @@ func (y *YumManager) UpgradeAll() (string, []string) {
 	return baseCmd, baseArgs
 }
 
+// ListUpgrades returns the command and arguments for listing upgradable packages,
+// the security advisories that apply to them and the installed versions.
+func (y *YumManager) ListUpgrades(pkgs []packagemanagercommon.Package) (string, []string) {
+	baseCmd := y.prependAuthCommand("yum")
+	baseArgs := []string{"-q", "list", "updates"}
+	for _, p := range pkgs {
+		baseArgs = append(baseArgs, p.Name)
+	}
+
+	// list exits non-zero when nothing matches, so the sections are separated by ;
+	baseArgs = append(baseArgs, ";", "echo", packagemanagercommon.SecuritySectionMarker, ";", baseCmd, "-q", "updateinfo", "list", "security")
+	for _, p := range pkgs {
+		baseArgs = append(baseArgs, p.Name)
+	}
+	baseArgs = append(baseArgs, ";", "echo", packagemanagercommon.InstalledSectionMarker, ";",
+		"rpm", "-qa", "--queryformat", packagemanagercommon.RPMInstalledQueryFormat)
+
+	return baseCmd, baseArgs
+}
+
+// SecurityUpgrade returns the command and arguments for listing the upgradable packages
+// and then applying the security upgrades.
+func (y *YumManager) SecurityUpgrade(pkgs []packagemanagercommon.Package) (string, []string) {
+	baseCmd, baseArgs := y.ListUpgrades(pkgs)
+	baseArgs = append(baseArgs, ";", "echo", packagemanagercommon.UpgradeSectionMarker, ";", baseCmd, "update", "--security", "-y")
+	for _, p := range pkgs {
+		baseArgs = append(baseArgs, p.Name)
+	}
+
+	return baseCmd, baseArgs
+}
+
+// ParseUpgradesOutput parses the output of ListUpgrades and SecurityUpgrade.
+func (y *YumManager) ParseUpgradesOutput(output string) ([]packagemanagercommon.Package, error) {
+	return packagemanagercommon.ParseRPMUpgradesOutput(output)
+}
+
 // CheckVersion returns the command and arguments for checking the info of a specific package.
 func (y *YumManager) CheckVersion(pkgs []packagemanagercommon.Package) (string, []string) {
 	baseCmd := y.prependAuthCommand("yum")
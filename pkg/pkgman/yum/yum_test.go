@@ -0,0 +1,56 @@
+package yum
+
+import (
+	"slices"
+	"testing"
+
+	packagemanagercommon "git.andrewnw.xyz/CyberShell/backy/pkg/pkgman/common"
+)
+
+func TestParseUpgradesOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    []packagemanagercommon.Package
+		wantErr bool
+	}{
+		{
+			name: "centos",
+			output: `Updated Packages
+kernel.x86_64                       3.10.0-1160.119.1.el7                updates
+sudo.x86_64                         1.8.23-10.el7_9.3                    updates
+backy:security
+RHSA-2023:6577 Important/Sec. sudo-1.8.23-10.el7_9.3.x86_64
+backy:installed
+kernel.x86_64 3.10.0-1160.118.1.el7
+sudo.x86_64 1.8.23-10.el7_9.2
+`,
+			want: []packagemanagercommon.Package{
+				{Name: "kernel.x86_64", VersionCheck: packagemanagercommon.PackageVersion{Installed: "3.10.0-1160.118.1.el7", Candidate: "3.10.0-1160.119.1.el7"}},
+				{Name: "sudo.x86_64", VersionCheck: packagemanagercommon.PackageVersion{Installed: "1.8.23-10.el7_9.2", Candidate: "1.8.23-10.el7_9.3", Security: true}},
+			},
+		},
+		{
+			name:   "no matching packages",
+			output: "Error: No matching Packages to list\nbacky:security\nbacky:installed\n",
+		},
+		{
+			name:    "error",
+			output:  "Error: Cannot retrieve repository metadata (repomd.xml) for repository: base\n",
+			wantErr: true,
+		},
+	}
+
+	y := NewYumManager()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := y.ParseUpgradesOutput(tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("packages = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -86,8 +86,6 @@ func (s *S3Fetcher) Fetch(source string) ([]byte, error) {
 
 	fileObject, err := s.S3Client.GetObject(context.TODO(), bucket, object, minio.GetObjectOptions{})
 	if err != nil {
-		println(err.Error())
-
 		return nil, err
 	}
 	defer fileObject.Close()
@@ -0,0 +1,368 @@
+// server.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+// Package sshtest runs in-process SSH servers for tests.
+// Commands run with sh in a sandbox directory, and direct-tcpip channels for ProxyJump and local forwards
+// and agent forwarding are supported, so remote execution can be tested without docker or network access.
+package sshtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Server is an SSH server listening on a random port of 127.0.0.1.
+// It is closed when the test ends.
+type Server struct {
+	// Addr is the host:port the server listens on
+	Addr string
+	// HostKey is the server's host key
+	HostKey ssh.Signer
+	// Dir is the sandbox directory commands run in
+	Dir string
+
+	authorizedKeys map[string][]ssh.PublicKey
+	passwords      map[string]string
+	authorities    []ssh.PublicKey
+	handler        Handler
+	rejectEnv      bool
+	stallRequests  bool
+	maxSessions    int
+
+	config   *ssh.ServerConfig
+	listener net.Listener
+
+	mu          sync.Mutex
+	conns       map[*ssh.ServerConn]struct{}
+	connections int
+	users       []string
+	execs       []Exec
+	closed      bool
+	wg          sync.WaitGroup
+}
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithHostKey sets the host key of the server. A new ed25519 key is generated by default.
+func WithHostKey(signer ssh.Signer) Option {
+	return func(s *Server) {
+		s.HostKey = signer
+	}
+}
+
+// WithAuthorizedKey allows user to log in with key
+func WithAuthorizedKey(user string, key ssh.PublicKey) Option {
+	return func(s *Server) {
+		s.authorizedKeys[user] = append(s.authorizedKeys[user], key)
+	}
+}
+
+// WithPassword allows user to log in with password
+func WithPassword(user, password string) Option {
+	return func(s *Server) {
+		s.passwords[user] = password
+	}
+}
+
+// WithCertAuthority allows users to log in with certificates signed by ca, if the user is a principal of the certificate
+func WithCertAuthority(ca ssh.PublicKey) Option {
+	return func(s *Server) {
+		s.authorities = append(s.authorities, ca)
+	}
+}
+
+// WithStalledRequests makes the server never answer global requests such as keepalives, as a half-open connection does
+func WithStalledRequests() Option {
+	return func(s *Server) {
+		s.stallRequests = true
+	}
+}
+
+// WithMaxSessions makes the server refuse more than n open sessions per connection, as sshd's MaxSessions does
+func WithMaxSessions(n int) Option {
+	return func(s *Server) {
+		s.maxSessions = n
+	}
+}
+
+// NewServer starts a server. Without WithAuthorizedKey, WithPassword or WithCertAuthority, clients are not authenticated.
+func NewServer(t testing.TB, opts ...Option) *Server {
+	t.Helper()
+
+	s := &Server{
+		authorizedKeys: make(map[string][]ssh.PublicKey),
+		passwords:      make(map[string]string),
+		conns:          make(map[*ssh.ServerConn]struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.HostKey == nil {
+		_, s.HostKey = NewKey(t)
+	}
+	if s.Dir == "" {
+		s.Dir = t.TempDir()
+	}
+	if s.handler == nil {
+		s.handler = RunShell
+	}
+
+	s.config = &ssh.ServerConfig{
+		NoClientAuth: len(s.authorizedKeys) == 0 && len(s.passwords) == 0 && len(s.authorities) == 0,
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if _, ok := key.(*ssh.Certificate); ok {
+				checker := &ssh.CertChecker{
+					IsUserAuthority: func(auth ssh.PublicKey) bool {
+						for _, ca := range s.authorities {
+							if string(ca.Marshal()) == string(auth.Marshal()) {
+								return true
+							}
+						}
+						return false
+					},
+				}
+				return checker.Authenticate(conn, key)
+			}
+			for _, authorized := range s.authorizedKeys[conn.User()] {
+				if string(authorized.Marshal()) == string(key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("key %s is not authorized for user %s", ssh.FingerprintSHA256(key), conn.User())
+		},
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if want, ok := s.passwords[conn.User()]; ok && want == string(password) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("wrong password for user %s", conn.User())
+		},
+	}
+	s.config.AddHostKey(s.HostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("sshtest: could not listen: %v", err)
+	}
+	s.listener = listener
+	s.Addr = listener.Addr().String()
+
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Host returns the address the server listens on, without the port
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr)
+	return host
+}
+
+// Port returns the port the server listens on
+func (s *Server) Port() uint16 {
+	_, port, _ := net.SplitHostPort(s.Addr)
+	p, _ := strconv.ParseUint(port, 10, 16)
+	return uint16(p)
+}
+
+// Connections returns the number of authenticated connections the server has accepted
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections
+}
+
+// Users returns the users of the authenticated connections, in order
+func (s *Server) Users() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.users...)
+}
+
+// KnownHostsLine returns the known_hosts line of the server's host key
+func (s *Server) KnownHostsLine() string {
+	return knownhosts.Line([]string{knownhosts.Normalize(s.Addr)}, s.HostKey.PublicKey())
+}
+
+// Close stops the server and closes its connections
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) handleConn(netConn net.Conn) {
+	defer s.wg.Done()
+
+	conn, chans, reqs, err := ssh.NewServerConn(netConn, s.config)
+	if err != nil {
+		netConn.Close()
+		return
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.connections++
+	s.users = append(s.users, conn.User())
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	if s.stallRequests {
+		go func() {
+			for range reqs {
+			}
+		}()
+	} else {
+		go ssh.DiscardRequests(reqs)
+	}
+
+	var sessions atomic.Int32
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "session":
+			if s.maxSessions > 0 && int(sessions.Load()) >= s.maxSessions {
+				_ = newChannel.Reject(ssh.ResourceShortage, "too many sessions")
+				continue
+			}
+			sessions.Add(1)
+			go func() {
+				defer sessions.Add(-1)
+				s.handleSession(conn, newChannel)
+			}()
+		case "direct-tcpip":
+			go handleDirectTCPIP(newChannel)
+		default:
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// handleDirectTCPIP connects a direct-tcpip channel, used by ProxyJump and local forwards, to its target
+func handleDirectTCPIP(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, "invalid direct-tcpip payload")
+		return
+	}
+
+	target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		target.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(channel, target)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(target, channel)
+		done <- struct{}{}
+	}()
+	<-done
+	channel.Close()
+	target.Close()
+}
+
+// NewKey generates an ed25519 key
+func NewKey(t testing.TB) (ed25519.PrivateKey, ssh.Signer) {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("sshtest: could not generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("sshtest: could not create signer: %v", err)
+	}
+	return key, signer
+}
+
+// WriteKey generates an ed25519 key, writes it to path in OpenSSH format and returns its signer
+func WriteKey(t testing.TB, path string) ssh.Signer {
+	t.Helper()
+
+	key, signer := NewKey(t)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatalf("sshtest: could not marshal key: %v", err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("sshtest: could not write key: %v", err)
+	}
+	return signer
+}
+
+// WriteKnownHosts writes the known_hosts lines of servers to path
+func WriteKnownHosts(t testing.TB, path string, servers ...*Server) {
+	t.Helper()
+
+	var lines []byte
+	for _, s := range servers {
+		lines = append(lines, s.KnownHostsLine()+"\n"...)
+	}
+	if err := os.WriteFile(path, lines, 0600); err != nil {
+		t.Fatalf("sshtest: could not write known_hosts: %v", err)
+	}
+}
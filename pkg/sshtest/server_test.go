@@ -0,0 +1,98 @@
+package sshtest
+
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestServerAuth(t *testing.T) {
+	_, userKey := NewKey(t)
+	_, otherKey := NewKey(t)
+	_, caKey := NewKey(t)
+
+	cert := &ssh.Certificate{
+		Key:             userKey.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"deploy"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, caKey); err != nil {
+		t.Fatal(err)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		user    string
+		auth    ssh.AuthMethod
+		wantErr bool
+	}{
+		{name: "key", opts: []Option{WithAuthorizedKey("deploy", userKey.PublicKey())}, user: "deploy", auth: ssh.PublicKeys(userKey)},
+		{name: "wrong key", opts: []Option{WithAuthorizedKey("deploy", userKey.PublicKey())}, user: "deploy", auth: ssh.PublicKeys(otherKey), wantErr: true},
+		{name: "key of other user", opts: []Option{WithAuthorizedKey("deploy", userKey.PublicKey())}, user: "root", auth: ssh.PublicKeys(userKey), wantErr: true},
+		{name: "password", opts: []Option{WithPassword("deploy", "secret")}, user: "deploy", auth: ssh.Password("secret")},
+		{name: "wrong password", opts: []Option{WithPassword("deploy", "secret")}, user: "deploy", auth: ssh.Password("guess"), wantErr: true},
+		{name: "certificate", opts: []Option{WithCertAuthority(caKey.PublicKey())}, user: "deploy", auth: ssh.PublicKeys(certSigner)},
+		{name: "certificate of other principal", opts: []Option{WithCertAuthority(caKey.PublicKey())}, user: "root", auth: ssh.PublicKeys(certSigner), wantErr: true},
+		{name: "no auth", user: "anyone", auth: ssh.Password("")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(t, tt.opts...)
+			config := &ssh.ClientConfig{
+				User:            tt.user,
+				Auth:            []ssh.AuthMethod{tt.auth},
+				HostKeyCallback: ssh.FixedHostKey(s.HostKey.PublicKey()),
+			}
+			client, err := ssh.Dial("tcp", s.Addr, config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Dial error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				client.Close()
+			}
+		})
+	}
+}
+
+func TestServerExec(t *testing.T) {
+	s := NewServer(t)
+	client, err := ssh.Dial("tcp", s.Addr, &ssh.ClientConfig{User: "test", HostKeyCallback: ssh.FixedHostKey(s.HostKey.PublicKey())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Setenv("NAME", "world"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := session.CombinedOutput(`echo "hello $NAME" > greeting && cat greeting && exit 4`)
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 4 {
+		t.Fatalf("exit error = %v, want status 4", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "hello world" {
+		t.Errorf("output = %q, want %q", got, "hello world")
+	}
+	if _, err := os.Stat(filepath.Join(s.Dir, "greeting")); err != nil {
+		t.Errorf("command did not run in the sandbox: %v", err)
+	}
+	if execs := s.Execs(); len(execs) != 1 || execs[0].Env["NAME"] != "world" || execs[0].User != "test" {
+		t.Errorf("execs = %+v", execs)
+	}
+}
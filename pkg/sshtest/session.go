@@ -0,0 +1,241 @@
+// session.go
+// Copyright (C) Andrew Woodlee 2023
+// License: Apache-2.0
+
+package sshtest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Exec is a command run on the server with an exec or shell request
+type Exec struct {
+	// User is the user the session was opened as
+	User string
+	// Command is the command of an exec request. It is empty for shells, which read commands from Stdin.
+	Command string
+	// Env holds the variables set with env requests
+	Env map[string]string
+	// Dir is the sandbox directory of the server
+	Dir string
+	// ForwardAgent is true if the client requested agent forwarding before the command
+	ForwardAgent bool
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// stdin holds what the command read from Stdin
+	stdin *syncBuffer
+	conn  *ssh.ServerConn
+}
+
+// Agent connects to the agent the client forwarded, as sshd does for SSH_AUTH_SOCK
+func (e *Exec) Agent() (agent.ExtendedAgent, error) {
+	if !e.ForwardAgent || e.conn == nil {
+		return nil, errors.New("agent forwarding was not requested")
+	}
+	channel, reqs, err := e.conn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return agent.NewClient(channel), nil
+}
+
+// Input returns what the command read from stdin. For shells, this is the script.
+func (e Exec) Input() string {
+	if e.stdin == nil {
+		return ""
+	}
+	return e.stdin.String()
+}
+
+// Handler runs e and returns its exit status
+type Handler func(e *Exec) int
+
+// WithHandler sets the handler of exec and shell requests. RunShell is used by default.
+func WithHandler(h Handler) Option {
+	return func(s *Server) {
+		s.handler = h
+	}
+}
+
+// WithDir sets the sandbox directory commands run in. A temporary directory is used by default.
+func WithDir(dir string) Option {
+	return func(s *Server) {
+		s.Dir = dir
+	}
+}
+
+// WithEnvRejected makes the server reject env requests, as sshd does for variables not in AcceptEnv
+func WithEnvRejected() Option {
+	return func(s *Server) {
+		s.rejectEnv = true
+	}
+}
+
+// RunShell runs e with sh in e.Dir. HOME is set to e.Dir and PATH is inherited from the test.
+// Exec requests run sh -c Command, shells run sh with the script on stdin.
+func RunShell(e *Exec) int {
+	args := []string{}
+	if e.Command != "" {
+		args = append(args, "-c", e.Command)
+	}
+	cmd := exec.Command("sh", args...)
+	cmd.Dir = e.Dir
+	cmd.Env = []string{"HOME=" + e.Dir, "PATH=" + os.Getenv("PATH")}
+	for k, v := range e.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stdout = e.Stdout
+	cmd.Stderr = e.Stderr
+
+	// stdin is copied without waiting for the client to close it, so commands that do not read it can exit
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return 255
+	}
+	if err := cmd.Start(); err != nil {
+		io.WriteString(e.Stderr, err.Error()+"\n")
+		return 127
+	}
+	go func() {
+		_, _ = io.Copy(stdin, e.Stdin)
+		stdin.Close()
+	}()
+
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		return 255
+	}
+	return 0
+}
+
+// Execs returns the commands run on the server, in order
+func (s *Server) Execs() []Exec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Exec(nil), s.execs...)
+}
+
+// Commands returns the commands of the exec requests run on the server, in order
+func (s *Server) Commands() []string {
+	var commands []string
+	for _, e := range s.Execs() {
+		if e.Command != "" {
+			commands = append(commands, e.Command)
+		}
+	}
+	return commands
+}
+
+// handleSession serves the requests of a session channel
+func (s *Server) handleSession(conn *ssh.ServerConn, newChannel ssh.NewChannel) {
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+
+	user := conn.User()
+	env := make(map[string]string)
+	forwardAgent := false
+	for req := range reqs {
+		switch req.Type {
+		case "auth-agent-req@openssh.com":
+			forwardAgent = true
+			_ = req.Reply(true, nil)
+		case "env":
+			var payload struct{ Name, Value string }
+			if s.rejectEnv || ssh.Unmarshal(req.Payload, &payload) != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			env[payload.Name] = payload.Value
+			_ = req.Reply(true, nil)
+		case "pty-req":
+			_ = req.Reply(true, nil)
+		case "exec", "shell":
+			var payload struct{ Command string }
+			if req.Type == "exec" && ssh.Unmarshal(req.Payload, &payload) != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+
+			stdin := &syncBuffer{}
+			e := &Exec{
+				User:         user,
+				Command:      payload.Command,
+				Env:          env,
+				Dir:          s.Dir,
+				ForwardAgent: forwardAgent,
+				Stdin:        io.TeeReader(channel, stdin),
+				Stdout:       channel,
+				Stderr:       channel.Stderr(),
+				stdin:        stdin,
+				conn:         conn,
+			}
+			status := s.handler(e)
+
+			s.mu.Lock()
+			s.execs = append(s.execs, Exec{User: e.User, Command: e.Command, Env: e.Env, Dir: e.Dir, ForwardAgent: forwardAgent, stdin: stdin})
+			s.mu.Unlock()
+
+			_ = channel.CloseWrite()
+			_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+			return
+		case "subsystem":
+			var payload struct{ Name string }
+			if ssh.Unmarshal(req.Payload, &payload) != nil || payload.Name != "sftp" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+
+			server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(s.Dir))
+			if err != nil {
+				return
+			}
+			_ = server.Serve()
+			return
+		default:
+			// signals and window changes are not supported
+			_ = req.Reply(false, nil)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer that can be written and read from different goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -5,3 +5,15 @@ type ConfigurableUserManager interface {
 	SetUseAuth(useAuth bool)
 	SetAuthCommand(authCommand string)
 }
+
+// UserInfo holds the current state of a user on a system
+type UserInfo struct {
+	Username     string
+	UID          string
+	Home         string
+	Shell        string
+	PrimaryGroup string
+	// Groups holds all groups of the user, including the primary group
+	Groups     []string
+	SshPubKeys []string
+}
@@ -0,0 +1,68 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ShellQuote quotes s so it is passed to a POSIX shell as a single word
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// ShellCommand returns the command and args that run script using sh
+func ShellCommand(script string) (string, []string) {
+	return "sh", []string{"-c", ShellQuote(script)}
+}
+
+// AuthorizedKeysScript builds a shell script that writes keys to the authorized_keys file in the user's home directory.
+// homeCmd is a command that prints the home directory of username.
+// If exclusive is true, keys not in keys are removed from the file, so an empty keys empties the file.
+// Otherwise, only keys that are not already in the file are appended.
+// Blank keys are skipped.
+func AuthorizedKeysScript(username, homeCmd string, keys []string, exclusive bool) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "home=$(%s) && [ -n \"$home\" ] && ", homeCmd)
+	b.WriteString(`mkdir -p "$home/.ssh" && chmod 700 "$home/.ssh" && touch "$home/.ssh/authorized_keys"`)
+
+	quotedKeys := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if k = strings.TrimSpace(k); k != "" {
+			quotedKeys = append(quotedKeys, ShellQuote(k))
+		}
+	}
+
+	switch {
+	case exclusive && len(quotedKeys) == 0:
+		b.WriteString(` && : > "$home/.ssh/authorized_keys"`)
+	case exclusive:
+		fmt.Fprintf(&b, ` && printf '%%s\n' %s > "$home/.ssh/authorized_keys"`, strings.Join(quotedKeys, " "))
+	default:
+		for _, k := range quotedKeys {
+			fmt.Fprintf(&b, ` && { grep -qxF %s "$home/.ssh/authorized_keys" || printf '%%s\n' %s >> "$home/.ssh/authorized_keys"; }`, k, k)
+		}
+	}
+
+	fmt.Fprintf(&b, ` && chmod 600 "$home/.ssh/authorized_keys" && chown -R %s "$home/.ssh"`, ShellQuote(username))
+
+	return b.String()
+}
+
+// SudoersScript builds a shell script that writes rules for username to path.
+// The file is validated with visudo -c before it is installed.
+func SudoersScript(username, path string, rules []string, rootGroup string) string {
+	lines := make([]string, 0, len(rules))
+	for _, r := range rules {
+		lines = append(lines, ShellQuote(fmt.Sprintf("%s %s", username, strings.TrimSpace(r))))
+	}
+
+	return fmt.Sprintf(`tmp=$(mktemp) && printf '%%s\n' %s > "$tmp" && visudo -c -f "$tmp" && install -m 0440 -o root -g %s "$tmp" %s; rc=$?; rm -f "$tmp"; exit $rc`,
+		strings.Join(lines, " "), rootGroup, ShellQuote(path))
+}
+
+// SudoersFileName returns the name of the sudoers.d file for username.
+// sudo skips files in sudoers.d that contain a '.' or end with '~'.
+func SudoersFileName(username string) string {
+	return strings.NewReplacer(".", "_", "~", "_", "/", "_").Replace(username)
+}
@@ -0,0 +1,113 @@
+package common
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	for _, s := range []string{
+		"alice",
+		"",
+		"two words",
+		"it's",
+		`$HOME "quoted" \back\slash`,
+		"ssh-ed25519 AAAAC3Nza alice@laptop; rm -rf /",
+		"line\nbreak",
+	} {
+		out, err := exec.Command("sh", "-c", "printf '%s' "+ShellQuote(s)).Output()
+		if err != nil {
+			t.Fatalf("%q: %v", s, err)
+		}
+		if string(out) != s {
+			t.Errorf("ShellQuote(%q) was passed to the shell as %q", s, out)
+		}
+	}
+}
+
+func TestAuthorizedKeysScript(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	const (
+		laptop  = "ssh-ed25519 AAAAC3Nza alice@laptop"
+		desktop = "ssh-rsa AAAAB3Nza alice@desktop"
+		old     = "ssh-ed25519 AAAAC3Nzb alice@old"
+	)
+
+	tests := []struct {
+		name      string
+		existing  string
+		keys      []string
+		exclusive bool
+		want      string
+	}{
+		{name: "new file", keys: []string{laptop, " " + desktop + "\n"}, want: laptop + "\n" + desktop + "\n"},
+		{name: "append missing keys", existing: old + "\n" + laptop + "\n", keys: []string{laptop, desktop}, want: old + "\n" + laptop + "\n" + desktop + "\n"},
+		{name: "exclusive", existing: old + "\n" + laptop + "\n", keys: []string{laptop, desktop}, exclusive: true, want: laptop + "\n" + desktop + "\n"},
+		{name: "exclusive without keys", existing: old + "\n", keys: nil, exclusive: true, want: ""},
+		{name: "blank keys", existing: old + "\n", keys: []string{"", "  "}, exclusive: true, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			file := filepath.Join(home, ".ssh", "authorized_keys")
+			if tt.existing != "" {
+				if err := os.Mkdir(filepath.Join(home, ".ssh"), 0700); err != nil {
+					t.Fatal(err)
+				}
+				writeFile(t, file, tt.existing)
+			}
+
+			script := AuthorizedKeysScript(current.Username, "echo "+ShellQuote(home), tt.keys, tt.exclusive)
+			if out, err := exec.Command("sh", "-c", script).CombinedOutput(); err != nil {
+				t.Fatalf("%v: %s", err, out)
+			}
+
+			got, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("authorized_keys = %q, want %q", got, tt.want)
+			}
+			if fi, err := os.Stat(file); err != nil || fi.Mode().Perm() != 0600 {
+				t.Errorf("authorized_keys mode = %v, %v, want 0600", fi.Mode().Perm(), err)
+			}
+		})
+	}
+}
+
+func TestSudoersScript(t *testing.T) {
+	script := SudoersScript("alice", "/etc/sudoers.d/alice", []string{" ALL=(ALL) NOPASSWD: /usr/bin/systemctl restart nginx", "ALL=(root) /usr/bin/journalctl"}, "root")
+
+	for _, want := range []string{
+		`'alice ALL=(ALL) NOPASSWD: /usr/bin/systemctl restart nginx' 'alice ALL=(root) /usr/bin/journalctl' > "$tmp"`,
+		`visudo -c -f "$tmp" && install -m 0440 -o root -g root "$tmp" '/etc/sudoers.d/alice'`,
+		`rm -f "$tmp"; exit $rc`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("expected script to contain %q, got %s", want, script)
+		}
+	}
+}
+
+func TestSudoersFileName(t *testing.T) {
+	for name, want := range map[string]string{
+		"alice":       "alice",
+		"alice.smith": "alice_smith",
+		"backup~":     "backup_",
+		"../etc":      "___etc",
+	} {
+		if got := SudoersFileName(name); got != want {
+			t.Errorf("SudoersFileName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
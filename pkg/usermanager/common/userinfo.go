@@ -0,0 +1,77 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+const (
+	// GroupsSectionMarker is printed before the user's groups
+	GroupsSectionMarker = "backy:groups"
+	// KeysSectionMarker is printed before the user's authorized keys
+	KeysSectionMarker = "backy:keys"
+)
+
+// UserInfoScript builds a shell script that prints the user's passwd entry, groups, and authorized keys.
+// passwdCmd must print the user's entry in passwd(5) format.
+// A missing authorized_keys file means the user has no keys, but the script fails if the file can't be read,
+// so the keys are not replaced as if there were none.
+// The output is parsed by ParseUserInfo.
+func UserInfoScript(username, passwdCmd string) string {
+	u := ShellQuote(username)
+	return fmt.Sprintf(`entry=$(%s) && echo "$entry" && echo %s && id -gn %s && id -Gn %s && echo %s && home=$(echo "$entry" | cut -d: -f6) && keys="$home/.ssh/authorized_keys" && { [ ! -e "$keys" ] || cat "$keys"; }`,
+		passwdCmd, GroupsSectionMarker, u, u, KeysSectionMarker)
+}
+
+// ParseUserInfo parses the output of UserInfoScript
+func ParseUserInfo(output string) (UserInfo, error) {
+	var (
+		info        UserInfo
+		section     string
+		groupsLines int
+	)
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == GroupsSectionMarker || line == KeysSectionMarker {
+			section = line
+			continue
+		}
+
+		switch section {
+		case GroupsSectionMarker:
+			if groupsLines == 0 {
+				info.PrimaryGroup = line
+			} else {
+				info.Groups = append(info.Groups, strings.Fields(line)...)
+			}
+			groupsLines++
+		case KeysSectionMarker:
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			info.SshPubKeys = append(info.SshPubKeys, line)
+		default:
+			if info.Username != "" || line == "" {
+				continue
+			}
+			fields := strings.Split(line, ":")
+			if len(fields) != 7 {
+				return info, fmt.Errorf("error parsing passwd entry %q", line)
+			}
+			info.Username = fields[0]
+			info.UID = fields[2]
+			info.Home = fields[5]
+			info.Shell = fields[6]
+		}
+	}
+
+	if info.Username == "" {
+		return info, fmt.Errorf("passwd entry not found in output")
+	}
+
+	return info, nil
+}
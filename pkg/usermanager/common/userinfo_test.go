@@ -0,0 +1,159 @@
+package common
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestUserInfoScript(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tests := []struct {
+		name     string
+		keys     func(t *testing.T, sshDir string)
+		wantKeys []string
+		wantErr  bool
+	}{
+		{
+			name: "no authorized_keys",
+		},
+		{
+			name: "authorized_keys",
+			keys: func(t *testing.T, sshDir string) {
+				writeFile(t, filepath.Join(sshDir, "authorized_keys"), "# backup keys\nssh-ed25519 AAAAC3Nza alice@laptop\n\nssh-rsa AAAAB3Nza alice@desktop\n")
+			},
+			wantKeys: []string{"ssh-ed25519 AAAAC3Nza alice@laptop", "ssh-rsa AAAAB3Nza alice@desktop"},
+		},
+		{
+			name: "unreadable authorized_keys",
+			keys: func(t *testing.T, sshDir string) {
+				// a directory can't be read even as root
+				if err := os.MkdirAll(filepath.Join(sshDir, "authorized_keys"), 0700); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			if tt.keys != nil {
+				sshDir := filepath.Join(home, ".ssh")
+				if err := os.Mkdir(sshDir, 0700); err != nil {
+					t.Fatal(err)
+				}
+				tt.keys(t, sshDir)
+			}
+
+			passwdCmd := "echo " + ShellQuote(current.Username+":x:"+current.Uid+":"+current.Gid+"::"+home+":/bin/sh")
+			out, err := exec.Command("sh", "-c", UserInfoScript(current.Username, passwdCmd)).CombinedOutput()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("script did not fail: %s", out)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%v: %s", err, out)
+			}
+
+			info, err := ParseUserInfo(string(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Username != current.Username || info.Home != home || info.PrimaryGroup == "" {
+				t.Errorf("info = %+v", info)
+			}
+			if !slices.Equal(info.SshPubKeys, tt.wantKeys) {
+				t.Errorf("keys = %q, want %q", info.SshPubKeys, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestParseUserInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    UserInfo
+		wantErr bool
+	}{
+		{
+			name: "user with keys",
+			output: `alice:x:1001:1001:Alice:/home/alice:/bin/bash
+backy:groups
+alice
+alice wheel docker
+backy:keys
+# laptop
+ssh-ed25519 AAAAC3Nza alice@laptop
+
+ssh-rsa AAAAB3Nza alice@desktop
+`,
+			want: UserInfo{
+				Username:     "alice",
+				UID:          "1001",
+				Home:         "/home/alice",
+				Shell:        "/bin/bash",
+				PrimaryGroup: "alice",
+				Groups:       []string{"alice", "wheel", "docker"},
+				SshPubKeys:   []string{"ssh-ed25519 AAAAC3Nza alice@laptop", "ssh-rsa AAAAB3Nza alice@desktop"},
+			},
+		},
+		{
+			name:   "user without keys",
+			output: "svc:*:250:250:Service:/var/empty:/usr/sbin/nologin\nbacky:groups\nsvc\nsvc\nbacky:keys\n",
+			want: UserInfo{
+				Username:     "svc",
+				UID:          "250",
+				Home:         "/var/empty",
+				Shell:        "/usr/sbin/nologin",
+				PrimaryGroup: "svc",
+				Groups:       []string{"svc"},
+			},
+		},
+		{
+			name:    "invalid passwd entry",
+			output:  "alice:x:1001\nbacky:groups\nalice\n",
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			output:  "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseUserInfo(tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Username != tt.want.Username || got.UID != tt.want.UID || got.Home != tt.want.Home ||
+				got.Shell != tt.want.Shell || got.PrimaryGroup != tt.want.PrimaryGroup ||
+				!slices.Equal(got.Groups, tt.want.Groups) || !slices.Equal(got.SshPubKeys, tt.want.SshPubKeys) {
+				t.Errorf("info = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,174 @@
+package freebsd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"git.andrewnw.xyz/CyberShell/backy/pkg/usermanager/common"
+	passGen "github.com/sethvargo/go-password/password"
+)
+
+// FreeBSDUserManager implements UserManager for FreeBSD systems using pw(8).
+type FreeBSDUserManager struct{}
+
+func (f FreeBSDUserManager) NewFreeBSDManager() *FreeBSDUserManager {
+	return &FreeBSDUserManager{}
+}
+
+// AddUser adds a new user to the system.
+// pw has no option for system users, so isSystem only sets the shell to nologin if shell is empty.
+func (f FreeBSDUserManager) AddUser(username, homeDir, shell string, isSystem, createHome bool, groups, args []string) (string, []string) {
+	baseArgs := []string{"useradd", "-n", username}
+
+	if isSystem && shell == "" {
+		shell = "/usr/sbin/nologin"
+	}
+
+	if homeDir != "" {
+		baseArgs = append(baseArgs, "-d", homeDir)
+	}
+
+	if shell != "" {
+		baseArgs = append(baseArgs, "-s", shell)
+	}
+
+	if len(groups) > 0 {
+		baseArgs = append(baseArgs, "-G", strings.Join(groups, ","))
+	}
+
+	if createHome {
+		baseArgs = append(baseArgs, "-m")
+	}
+
+	if len(args) > 0 {
+		baseArgs = append(baseArgs, args...)
+	}
+
+	cmd := "pw"
+	return cmd, baseArgs
+}
+
+// ModifyPassword sets the password using pw usermod -h 0, which reads the password from stdin.
+func (f FreeBSDUserManager) ModifyPassword(username, password string) (string, *strings.Reader, string) {
+	cmd := "pw"
+	if password == "" {
+		password = passGen.MustGenerate(20, 5, 5, false, false)
+	}
+	stdin := strings.NewReader(password)
+	return cmd + " usermod -n " + username + " -h 0", stdin, password
+}
+
+// RemoveUser removes an existing user from the system.
+func (f FreeBSDUserManager) RemoveUser(username string) (string, []string) {
+	cmd := "pw"
+
+	return cmd, []string{"userdel", "-n", username}
+}
+
+// ModifyUser modifies an existing user's details.
+func (f FreeBSDUserManager) ModifyUser(username, homeDir, shell string, groups []string) (string, []string) {
+	args := []string{"usermod", "-n", username}
+
+	if homeDir != "" {
+		args = append(args, "-d", homeDir)
+	}
+
+	if shell != "" {
+		args = append(args, "-s", shell)
+	}
+
+	if len(groups) > 0 {
+		args = append(args, "-G", strings.Join(groups, ","))
+	}
+
+	cmd := "pw"
+
+	return cmd, args
+}
+
+// UserExists checks if a user exists on the system.
+func (f FreeBSDUserManager) UserExists(username string) (string, []string) {
+	cmd := "id"
+	return cmd, []string{username}
+}
+
+// GetUser prints the user's passwd entry, groups, and authorized keys.
+func (f FreeBSDUserManager) GetUser(username string) (string, []string) {
+	passwdCmd := fmt.Sprintf("getent passwd %s", common.ShellQuote(username))
+
+	return common.ShellCommand(common.UserInfoScript(username, passwdCmd))
+}
+
+// ParseUser parses the output of the command returned by GetUser.
+func (f FreeBSDUserManager) ParseUser(output string) (common.UserInfo, error) {
+	return common.ParseUserInfo(output)
+}
+
+// AddGroup adds a new group to the system.
+// The command succeeds if the group already exists.
+// pw has no option for system groups, so isSystem is ignored.
+func (f FreeBSDUserManager) AddGroup(group string, isSystem bool) (string, []string) {
+	cmd := "pw"
+
+	return cmd, []string{"groupshow", group, ">/dev/null", "2>&1", "||", "pw", "groupadd", "-n", group}
+}
+
+// RemoveGroup removes an existing group from the system.
+func (f FreeBSDUserManager) RemoveGroup(group string) (string, []string) {
+	cmd := "pw"
+
+	return cmd, []string{"groupdel", "-n", group}
+}
+
+// SetAuthorizedKeys writes keys to the user's authorized_keys file.
+// If exclusive is true, all other keys are removed.
+func (f FreeBSDUserManager) SetAuthorizedKeys(username string, keys []string, exclusive bool) (string, []string) {
+	homeCmd := fmt.Sprintf("getent passwd %s | cut -d: -f6", common.ShellQuote(username))
+
+	return common.ShellCommand(common.AuthorizedKeysScript(username, homeCmd, keys, exclusive))
+}
+
+// LockUser locks the user's account.
+func (f FreeBSDUserManager) LockUser(username string) (string, []string) {
+	cmd := "pw"
+
+	return cmd, []string{"lock", username}
+}
+
+// UnlockUser unlocks the user's account.
+func (f FreeBSDUserManager) UnlockUser(username string) (string, []string) {
+	cmd := "pw"
+
+	return cmd, []string{"unlock", username}
+}
+
+// ExpireUser sets the date on which the account is disabled.
+// date is converted from YYYY-MM-DD to the dd-mm-yyyy format used by pw.
+// If date is empty, the account is expired immediately.
+func (f FreeBSDUserManager) ExpireUser(username, date string) (string, []string) {
+	if date == "" {
+		date = "1"
+	} else if t, err := time.Parse(time.DateOnly, date); err == nil {
+		date = t.Format("02-01-2006")
+	}
+
+	cmd := "pw"
+
+	return cmd, []string{"usermod", "-n", username, "-e", date}
+}
+
+// SetSudoers writes rules for the user to /usr/local/etc/sudoers.d.
+// The file is validated with visudo before it is installed.
+func (f FreeBSDUserManager) SetSudoers(username string, rules []string) (string, []string) {
+	path := "/usr/local/etc/sudoers.d/" + common.SudoersFileName(username)
+
+	return common.ShellCommand(common.SudoersScript(username, path, rules, "wheel"))
+}
+
+// RemoveSudoers removes the user's file from /usr/local/etc/sudoers.d.
+func (f FreeBSDUserManager) RemoveSudoers(username string) (string, []string) {
+	cmd := "rm"
+
+	return cmd, []string{"-f", "/usr/local/etc/sudoers.d/" + common.SudoersFileName(username)}
+}
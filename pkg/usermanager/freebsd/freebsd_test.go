@@ -0,0 +1,146 @@
+package freebsd
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFreeBSDUserManagerCommands(t *testing.T) {
+	f := FreeBSDUserManager{}
+
+	tests := []struct {
+		name     string
+		cmdFunc  func() (string, []string)
+		wantCmd  string
+		wantArgs []string
+	}{
+		{
+			name: "AddUser",
+			cmdFunc: func() (string, []string) {
+				return f.AddUser("alice", "/home/alice", "/bin/sh", false, true, []string{"wheel", "staff"}, nil)
+			},
+			wantCmd:  "pw",
+			wantArgs: []string{"useradd", "-n", "alice", "-d", "/home/alice", "-s", "/bin/sh", "-G", "wheel,staff", "-m"},
+		},
+		{
+			name: "AddSystemUser",
+			cmdFunc: func() (string, []string) {
+				return f.AddUser("svc", "", "", true, false, nil, nil)
+			},
+			wantCmd:  "pw",
+			wantArgs: []string{"useradd", "-n", "svc", "-s", "/usr/sbin/nologin"},
+		},
+		{
+			name:     "RemoveUser",
+			cmdFunc:  func() (string, []string) { return f.RemoveUser("alice") },
+			wantCmd:  "pw",
+			wantArgs: []string{"userdel", "-n", "alice"},
+		},
+		{
+			name: "ModifyUser",
+			cmdFunc: func() (string, []string) {
+				return f.ModifyUser("alice", "", "/usr/local/bin/bash", []string{"wheel"})
+			},
+			wantCmd:  "pw",
+			wantArgs: []string{"usermod", "-n", "alice", "-s", "/usr/local/bin/bash", "-G", "wheel"},
+		},
+		{
+			name:     "UserExists",
+			cmdFunc:  func() (string, []string) { return f.UserExists("alice") },
+			wantCmd:  "id",
+			wantArgs: []string{"alice"},
+		},
+		{
+			name:     "AddGroup",
+			cmdFunc:  func() (string, []string) { return f.AddGroup("ops", false) },
+			wantCmd:  "pw",
+			wantArgs: []string{"groupshow", "ops", ">/dev/null", "2>&1", "||", "pw", "groupadd", "-n", "ops"},
+		},
+		{
+			name:     "RemoveGroup",
+			cmdFunc:  func() (string, []string) { return f.RemoveGroup("ops") },
+			wantCmd:  "pw",
+			wantArgs: []string{"groupdel", "-n", "ops"},
+		},
+		{
+			name:     "LockUser",
+			cmdFunc:  func() (string, []string) { return f.LockUser("alice") },
+			wantCmd:  "pw",
+			wantArgs: []string{"lock", "alice"},
+		},
+		{
+			name:     "UnlockUser",
+			cmdFunc:  func() (string, []string) { return f.UnlockUser("alice") },
+			wantCmd:  "pw",
+			wantArgs: []string{"unlock", "alice"},
+		},
+		{
+			name:     "ExpireUserNow",
+			cmdFunc:  func() (string, []string) { return f.ExpireUser("alice", "") },
+			wantCmd:  "pw",
+			wantArgs: []string{"usermod", "-n", "alice", "-e", "1"},
+		},
+		{
+			name:     "ExpireUserOnDate",
+			cmdFunc:  func() (string, []string) { return f.ExpireUser("alice", "2026-12-31") },
+			wantCmd:  "pw",
+			wantArgs: []string{"usermod", "-n", "alice", "-e", "31-12-2026"},
+		},
+		{
+			name:     "RemoveSudoers",
+			cmdFunc:  func() (string, []string) { return f.RemoveSudoers("alice.smith") },
+			wantCmd:  "rm",
+			wantArgs: []string{"-f", "/usr/local/etc/sudoers.d/alice_smith"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, args := tt.cmdFunc()
+			if cmd != tt.wantCmd {
+				t.Errorf("expected command %q, got %q", tt.wantCmd, cmd)
+			}
+			if !slices.Equal(args, tt.wantArgs) {
+				t.Errorf("expected args %q, got %q", tt.wantArgs, args)
+			}
+		})
+	}
+}
+
+func TestFreeBSDModifyPassword(t *testing.T) {
+	f := FreeBSDUserManager{}
+
+	cmd, stdin, password := f.ModifyPassword("alice", "secret")
+	if cmd != "pw usermod -n alice -h 0" {
+		t.Errorf("unexpected command %q", cmd)
+	}
+	if password != "secret" {
+		t.Errorf("expected password secret, got %q", password)
+	}
+	input, _ := io.ReadAll(stdin)
+	if string(input) != "secret" {
+		t.Errorf("expected stdin to be the password, got %q", input)
+	}
+
+	_, _, password = f.ModifyPassword("alice", "")
+	if password == "" {
+		t.Error("expected a generated password")
+	}
+}
+
+func TestFreeBSDSudoers(t *testing.T) {
+	f := FreeBSDUserManager{}
+
+	cmd, args := f.SetSudoers("alice", []string{"ALL=(ALL) ALL"})
+	script := strings.Join(args, " ")
+	if cmd != "sh" {
+		t.Errorf("expected command sh, got %q", cmd)
+	}
+	for _, want := range []string{"alice ALL=(ALL) ALL", "visudo -c -f", "-g wheel", "/usr/local/etc/sudoers.d/alice"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("expected script to contain %q, got %s", want, script)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strings"
 
+	"git.andrewnw.xyz/CyberShell/backy/pkg/usermanager/common"
 	passGen "github.com/sethvargo/go-password/password"
 )
 
@@ -92,3 +93,86 @@ func (l LinuxUserManager) UserExists(username string) (string, []string) {
 	cmd := "id"
 	return cmd, []string{username}
 }
+
+// GetUser prints the user's passwd entry, groups, and authorized keys.
+func (l LinuxUserManager) GetUser(username string) (string, []string) {
+	passwdCmd := fmt.Sprintf("getent passwd %s", common.ShellQuote(username))
+
+	return common.ShellCommand(common.UserInfoScript(username, passwdCmd))
+}
+
+// ParseUser parses the output of the command returned by GetUser.
+func (l LinuxUserManager) ParseUser(output string) (common.UserInfo, error) {
+	return common.ParseUserInfo(output)
+}
+
+// AddGroup adds a new group to the system.
+// The command succeeds if the group already exists.
+func (l LinuxUserManager) AddGroup(group string, isSystem bool) (string, []string) {
+	args := []string{"-f"}
+
+	if isSystem {
+		args = append(args, "--system")
+	}
+
+	args = append(args, group)
+
+	cmd := "groupadd"
+	return cmd, args
+}
+
+// RemoveGroup removes an existing group from the system.
+func (l LinuxUserManager) RemoveGroup(group string) (string, []string) {
+	cmd := "groupdel"
+
+	return cmd, []string{group}
+}
+
+// SetAuthorizedKeys writes keys to the user's authorized_keys file.
+// If exclusive is true, all other keys are removed.
+func (l LinuxUserManager) SetAuthorizedKeys(username string, keys []string, exclusive bool) (string, []string) {
+	homeCmd := fmt.Sprintf("getent passwd %s | cut -d: -f6", common.ShellQuote(username))
+
+	return common.ShellCommand(common.AuthorizedKeysScript(username, homeCmd, keys, exclusive))
+}
+
+// LockUser locks the user's password.
+func (l LinuxUserManager) LockUser(username string) (string, []string) {
+	cmd := "usermod"
+
+	return cmd, []string{"--lock", username}
+}
+
+// UnlockUser unlocks the user's password.
+func (l LinuxUserManager) UnlockUser(username string) (string, []string) {
+	cmd := "usermod"
+
+	return cmd, []string{"--unlock", username}
+}
+
+// ExpireUser sets the date on which the account is disabled.
+// If date is empty, the account is expired immediately.
+func (l LinuxUserManager) ExpireUser(username, date string) (string, []string) {
+	if date == "" {
+		date = "1"
+	}
+
+	cmd := "usermod"
+
+	return cmd, []string{"--expiredate", date, username}
+}
+
+// SetSudoers writes rules for the user to /etc/sudoers.d.
+// The file is validated with visudo before it is installed.
+func (l LinuxUserManager) SetSudoers(username string, rules []string) (string, []string) {
+	path := "/etc/sudoers.d/" + common.SudoersFileName(username)
+
+	return common.ShellCommand(common.SudoersScript(username, path, rules, "root"))
+}
+
+// RemoveSudoers removes the user's file from /etc/sudoers.d.
+func (l LinuxUserManager) RemoveSudoers(username string) (string, []string) {
+	cmd := "rm"
+
+	return cmd, []string{"-f", "/etc/sudoers.d/" + common.SudoersFileName(username)}
+}
@@ -0,0 +1,145 @@
+package linux
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLinuxUserManagerCommands(t *testing.T) {
+	l := LinuxUserManager{}
+
+	tests := []struct {
+		name     string
+		cmdFunc  func() (string, []string)
+		wantCmd  string
+		wantArgs []string
+	}{
+		{
+			name: "AddUser",
+			cmdFunc: func() (string, []string) {
+				return l.AddUser("alice", "/home/alice", "/bin/bash", false, true, []string{"wheel", "docker"}, nil)
+			},
+			wantCmd:  "useradd",
+			wantArgs: []string{"--home", "/home/alice", "--shell", "/bin/bash", "--groups", "wheel,docker", "-m", "alice"},
+		},
+		{
+			name: "AddSystemUser",
+			cmdFunc: func() (string, []string) {
+				return l.AddUser("svc", "", "/usr/sbin/nologin", true, false, nil, []string{"--no-user-group"})
+			},
+			wantCmd:  "useradd",
+			wantArgs: []string{"--system", "--shell", "/usr/sbin/nologin", "--no-user-group", "svc"},
+		},
+		{
+			name:     "RemoveUser",
+			cmdFunc:  func() (string, []string) { return l.RemoveUser("alice") },
+			wantCmd:  "userdel",
+			wantArgs: []string{"alice"},
+		},
+		{
+			name: "ModifyUser",
+			cmdFunc: func() (string, []string) {
+				return l.ModifyUser("alice", "", "/bin/zsh", []string{"wheel"})
+			},
+			wantCmd:  "usermod",
+			wantArgs: []string{"--shell", "/bin/zsh", "--groups", "wheel", "alice"},
+		},
+		{
+			name:     "UserExists",
+			cmdFunc:  func() (string, []string) { return l.UserExists("alice") },
+			wantCmd:  "id",
+			wantArgs: []string{"alice"},
+		},
+		{
+			name:     "AddGroup",
+			cmdFunc:  func() (string, []string) { return l.AddGroup("ops", false) },
+			wantCmd:  "groupadd",
+			wantArgs: []string{"-f", "ops"},
+		},
+		{
+			name:     "AddSystemGroup",
+			cmdFunc:  func() (string, []string) { return l.AddGroup("backup", true) },
+			wantCmd:  "groupadd",
+			wantArgs: []string{"-f", "--system", "backup"},
+		},
+		{
+			name:     "RemoveGroup",
+			cmdFunc:  func() (string, []string) { return l.RemoveGroup("ops") },
+			wantCmd:  "groupdel",
+			wantArgs: []string{"ops"},
+		},
+		{
+			name:     "LockUser",
+			cmdFunc:  func() (string, []string) { return l.LockUser("alice") },
+			wantCmd:  "usermod",
+			wantArgs: []string{"--lock", "alice"},
+		},
+		{
+			name:     "UnlockUser",
+			cmdFunc:  func() (string, []string) { return l.UnlockUser("alice") },
+			wantCmd:  "usermod",
+			wantArgs: []string{"--unlock", "alice"},
+		},
+		{
+			name:     "ExpireUserNow",
+			cmdFunc:  func() (string, []string) { return l.ExpireUser("alice", "") },
+			wantCmd:  "usermod",
+			wantArgs: []string{"--expiredate", "1", "alice"},
+		},
+		{
+			name:     "ExpireUserOnDate",
+			cmdFunc:  func() (string, []string) { return l.ExpireUser("alice", "2026-12-31") },
+			wantCmd:  "usermod",
+			wantArgs: []string{"--expiredate", "2026-12-31", "alice"},
+		},
+		{
+			name:     "RemoveSudoers",
+			cmdFunc:  func() (string, []string) { return l.RemoveSudoers("alice.smith") },
+			wantCmd:  "rm",
+			wantArgs: []string{"-f", "/etc/sudoers.d/alice_smith"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, args := tt.cmdFunc()
+			if cmd != tt.wantCmd {
+				t.Errorf("expected command %q, got %q", tt.wantCmd, cmd)
+			}
+			if !slices.Equal(args, tt.wantArgs) {
+				t.Errorf("expected args %q, got %q", tt.wantArgs, args)
+			}
+		})
+	}
+}
+
+func TestLinuxSudoers(t *testing.T) {
+	l := LinuxUserManager{}
+
+	cmd, args := l.SetSudoers("alice", []string{"ALL=(ALL) NOPASSWD: /usr/bin/systemctl"})
+	script := strings.Join(args, " ")
+	if cmd != "sh" {
+		t.Errorf("expected command sh, got %q", cmd)
+	}
+	for _, want := range []string{"alice ALL=(ALL) NOPASSWD: /usr/bin/systemctl", "visudo -c -f", "-g root", "/etc/sudoers.d/alice"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("expected script to contain %q, got %s", want, script)
+		}
+	}
+}
+
+func TestLinuxSetAuthorizedKeys(t *testing.T) {
+	l := LinuxUserManager{}
+
+	cmd, args := l.SetAuthorizedKeys("alice", []string{"ssh-ed25519 AAAAC3Nza alice@laptop"}, false)
+	script := strings.Join(args, " ")
+	if cmd != "sh" {
+		t.Errorf("expected command sh, got %q", cmd)
+	}
+	for _, want := range []string{"getent passwd", "alice@laptop", "authorized_keys"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("expected script to contain %q, got %s", want, script)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package macos
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"git.andrewnw.xyz/CyberShell/backy/pkg/usermanager/common"
+	passGen "github.com/sethvargo/go-password/password"
+)
+
+// MacOSUserManager implements UserManager for macOS systems using dscl, dseditgroup, sysadminctl, and pwpolicy.
+type MacOSUserManager struct{}
+
+func (m MacOSUserManager) NewMacOSManager() *MacOSUserManager {
+	return &MacOSUserManager{}
+}
+
+// AddUser adds a new user to the system with sysadminctl.
+// sysadminctl always creates the home directory and has no option for system users,
+// so createHome and isSystem are ignored.
+func (m MacOSUserManager) AddUser(username, homeDir, shell string, isSystem, createHome bool, groups, args []string) (string, []string) {
+	baseArgs := []string{"-addUser", username}
+
+	if homeDir != "" {
+		baseArgs = append(baseArgs, "-home", homeDir)
+	}
+
+	if shell != "" {
+		baseArgs = append(baseArgs, "-shell", shell)
+	}
+
+	if len(args) > 0 {
+		baseArgs = append(baseArgs, args...)
+	}
+
+	for _, g := range groups {
+		baseArgs = append(baseArgs, "&&", "dseditgroup", "-o", "edit", "-a", username, "-t", "user", g)
+	}
+
+	cmd := "sysadminctl"
+	return cmd, baseArgs
+}
+
+// ModifyPassword sets the password with dscl, which reads the password from stdin.
+func (m MacOSUserManager) ModifyPassword(username, password string) (string, *strings.Reader, string) {
+	if password == "" {
+		password = passGen.MustGenerate(20, 5, 5, false, false)
+	}
+	stdin := strings.NewReader(password)
+	cmd := fmt.Sprintf(`dscl . -passwd %s "$(cat)"`, userPath(username))
+	return cmd, stdin, password
+}
+
+// RemoveUser removes an existing user from the system.
+func (m MacOSUserManager) RemoveUser(username string) (string, []string) {
+	cmd := "sysadminctl"
+
+	return cmd, []string{"-deleteUser", username}
+}
+
+// ModifyUser modifies an existing user's details.
+// Groups are added to the user's groups; the user is not removed from other groups.
+func (m MacOSUserManager) ModifyUser(username, homeDir, shell string, groups []string) (string, []string) {
+	var cmds [][]string
+
+	if homeDir != "" {
+		cmds = append(cmds, []string{"dscl", ".", "-create", userPath(username), "NFSHomeDirectory", homeDir})
+	}
+
+	if shell != "" {
+		cmds = append(cmds, []string{"dscl", ".", "-create", userPath(username), "UserShell", shell})
+	}
+
+	for _, g := range groups {
+		cmds = append(cmds, []string{"dseditgroup", "-o", "edit", "-a", username, "-t", "user", g})
+	}
+
+	if len(cmds) == 0 {
+		return "true", nil
+	}
+
+	args := cmds[0][1:]
+	for _, c := range cmds[1:] {
+		args = append(args, "&&")
+		args = append(args, c...)
+	}
+
+	return cmds[0][0], args
+}
+
+// UserExists checks if a user exists on the system.
+func (m MacOSUserManager) UserExists(username string) (string, []string) {
+	cmd := "id"
+	return cmd, []string{username}
+}
+
+// GetUser prints the user's passwd entry, groups, and authorized keys.
+// macOS does not have getent, so the passwd entry is built from dscl.
+func (m MacOSUserManager) GetUser(username string) (string, []string) {
+	u := common.ShellQuote(username)
+	passwdCmd := fmt.Sprintf(`printf '%%s:*:%%s:%%s::%%s:%%s\n' %s "$(id -u %s)" "$(id -g %s)" "$(%s)" "$(%s)"`,
+		u, u, u, dsclReadCmd(username, "NFSHomeDirectory"), dsclReadCmd(username, "UserShell"))
+
+	return common.ShellCommand(common.UserInfoScript(username, passwdCmd))
+}
+
+// ParseUser parses the output of the command returned by GetUser.
+func (m MacOSUserManager) ParseUser(output string) (common.UserInfo, error) {
+	return common.ParseUserInfo(output)
+}
+
+// AddGroup adds a new group to the system.
+// The command succeeds if the group already exists.
+// dseditgroup has no option for system groups, so isSystem is ignored.
+func (m MacOSUserManager) AddGroup(group string, isSystem bool) (string, []string) {
+	cmd := "dscl"
+
+	return cmd, []string{".", "-read", "/Groups/" + group, ">/dev/null", "2>&1", "||", "dseditgroup", "-o", "create", group}
+}
+
+// RemoveGroup removes an existing group from the system.
+func (m MacOSUserManager) RemoveGroup(group string) (string, []string) {
+	cmd := "dseditgroup"
+
+	return cmd, []string{"-o", "delete", group}
+}
+
+// SetAuthorizedKeys writes keys to the user's authorized_keys file.
+// If exclusive is true, all other keys are removed.
+func (m MacOSUserManager) SetAuthorizedKeys(username string, keys []string, exclusive bool) (string, []string) {
+	return common.ShellCommand(common.AuthorizedKeysScript(username, dsclReadCmd(username, "NFSHomeDirectory"), keys, exclusive))
+}
+
+// LockUser disables the user's account.
+func (m MacOSUserManager) LockUser(username string) (string, []string) {
+	cmd := "pwpolicy"
+
+	return cmd, []string{"-u", username, "disableuser"}
+}
+
+// UnlockUser enables the user's account.
+func (m MacOSUserManager) UnlockUser(username string) (string, []string) {
+	cmd := "pwpolicy"
+
+	return cmd, []string{"-u", username, "enableuser"}
+}
+
+// ExpireUser sets the date on which the account is disabled.
+// date is converted from YYYY-MM-DD to the mm/dd/yy format used by pwpolicy.
+// If date is empty, the account is disabled immediately.
+func (m MacOSUserManager) ExpireUser(username, date string) (string, []string) {
+	if date == "" {
+		return m.LockUser(username)
+	}
+
+	if t, err := time.Parse(time.DateOnly, date); err == nil {
+		date = t.Format("01/02/06")
+	}
+
+	cmd := "pwpolicy"
+
+	return cmd, []string{"-u", username, "-setpolicy", common.ShellQuote("usingHardExpirationDate=1 hardExpireDateGMT=" + date)}
+}
+
+// SetSudoers writes rules for the user to /etc/sudoers.d.
+// The file is validated with visudo before it is installed.
+func (m MacOSUserManager) SetSudoers(username string, rules []string) (string, []string) {
+	path := "/etc/sudoers.d/" + common.SudoersFileName(username)
+
+	return common.ShellCommand(common.SudoersScript(username, path, rules, "wheel"))
+}
+
+// RemoveSudoers removes the user's file from /etc/sudoers.d.
+func (m MacOSUserManager) RemoveSudoers(username string) (string, []string) {
+	cmd := "rm"
+
+	return cmd, []string{"-f", "/etc/sudoers.d/" + common.SudoersFileName(username)}
+}
+
+func userPath(username string) string {
+	return common.ShellQuote("/Users/" + username)
+}
+
+// dsclReadCmd returns a command that prints the value of key for the user
+func dsclReadCmd(username, key string) string {
+	return fmt.Sprintf("dscl . -read %s %s | sed 's/^%s: //'", userPath(username), key, key)
+}
@@ -0,0 +1,142 @@
+package macos
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMacOSUserManagerCommands(t *testing.T) {
+	m := MacOSUserManager{}
+
+	tests := []struct {
+		name     string
+		cmdFunc  func() (string, []string)
+		wantCmd  string
+		wantArgs []string
+	}{
+		{
+			name: "AddUser",
+			cmdFunc: func() (string, []string) {
+				return m.AddUser("alice", "/Users/alice", "/bin/zsh", false, true, []string{"admin"}, nil)
+			},
+			wantCmd:  "sysadminctl",
+			wantArgs: []string{"-addUser", "alice", "-home", "/Users/alice", "-shell", "/bin/zsh", "&&", "dseditgroup", "-o", "edit", "-a", "alice", "-t", "user", "admin"},
+		},
+		{
+			name:     "RemoveUser",
+			cmdFunc:  func() (string, []string) { return m.RemoveUser("alice") },
+			wantCmd:  "sysadminctl",
+			wantArgs: []string{"-deleteUser", "alice"},
+		},
+		{
+			name: "ModifyUser",
+			cmdFunc: func() (string, []string) {
+				return m.ModifyUser("alice", "", "/bin/bash", []string{"staff"})
+			},
+			wantCmd:  "dscl",
+			wantArgs: []string{".", "-create", "'/Users/alice'", "UserShell", "/bin/bash", "&&", "dseditgroup", "-o", "edit", "-a", "alice", "-t", "user", "staff"},
+		},
+		{
+			name:     "ModifyUserNoChanges",
+			cmdFunc:  func() (string, []string) { return m.ModifyUser("alice", "", "", nil) },
+			wantCmd:  "true",
+			wantArgs: nil,
+		},
+		{
+			name:     "UserExists",
+			cmdFunc:  func() (string, []string) { return m.UserExists("alice") },
+			wantCmd:  "id",
+			wantArgs: []string{"alice"},
+		},
+		{
+			name:     "AddGroup",
+			cmdFunc:  func() (string, []string) { return m.AddGroup("ops", false) },
+			wantCmd:  "dscl",
+			wantArgs: []string{".", "-read", "/Groups/ops", ">/dev/null", "2>&1", "||", "dseditgroup", "-o", "create", "ops"},
+		},
+		{
+			name:     "RemoveGroup",
+			cmdFunc:  func() (string, []string) { return m.RemoveGroup("ops") },
+			wantCmd:  "dseditgroup",
+			wantArgs: []string{"-o", "delete", "ops"},
+		},
+		{
+			name:     "LockUser",
+			cmdFunc:  func() (string, []string) { return m.LockUser("alice") },
+			wantCmd:  "pwpolicy",
+			wantArgs: []string{"-u", "alice", "disableuser"},
+		},
+		{
+			name:     "UnlockUser",
+			cmdFunc:  func() (string, []string) { return m.UnlockUser("alice") },
+			wantCmd:  "pwpolicy",
+			wantArgs: []string{"-u", "alice", "enableuser"},
+		},
+		{
+			name:     "ExpireUserNow",
+			cmdFunc:  func() (string, []string) { return m.ExpireUser("alice", "") },
+			wantCmd:  "pwpolicy",
+			wantArgs: []string{"-u", "alice", "disableuser"},
+		},
+		{
+			name:     "ExpireUserOnDate",
+			cmdFunc:  func() (string, []string) { return m.ExpireUser("alice", "2026-12-31") },
+			wantCmd:  "pwpolicy",
+			wantArgs: []string{"-u", "alice", "-setpolicy", "'usingHardExpirationDate=1 hardExpireDateGMT=12/31/26'"},
+		},
+		{
+			name:     "RemoveSudoers",
+			cmdFunc:  func() (string, []string) { return m.RemoveSudoers("alice") },
+			wantCmd:  "rm",
+			wantArgs: []string{"-f", "/etc/sudoers.d/alice"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, args := tt.cmdFunc()
+			if cmd != tt.wantCmd {
+				t.Errorf("expected command %q, got %q", tt.wantCmd, cmd)
+			}
+			if !slices.Equal(args, tt.wantArgs) {
+				t.Errorf("expected args %q, got %q", tt.wantArgs, args)
+			}
+		})
+	}
+}
+
+func TestMacOSModifyPassword(t *testing.T) {
+	m := MacOSUserManager{}
+
+	cmd, stdin, password := m.ModifyPassword("alice", "secret")
+	if cmd != `dscl . -passwd '/Users/alice' "$(cat)"` {
+		t.Errorf("unexpected command %q", cmd)
+	}
+	if strings.Contains(cmd, "chpasswd") || strings.Contains(cmd, "secret") {
+		t.Errorf("command must not use chpasswd or contain the password: %q", cmd)
+	}
+	if password != "secret" {
+		t.Errorf("expected password secret, got %q", password)
+	}
+	input, _ := io.ReadAll(stdin)
+	if string(input) != "secret" {
+		t.Errorf("expected stdin to be the password, got %q", input)
+	}
+}
+
+func TestMacOSGetUser(t *testing.T) {
+	m := MacOSUserManager{}
+
+	cmd, args := m.GetUser("alice")
+	script := strings.Join(args, " ")
+	if cmd != "sh" {
+		t.Errorf("expected command sh, got %q", cmd)
+	}
+	for _, want := range []string{"NFSHomeDirectory", "UserShell", "id -u", "backy:groups", "backy:keys"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("expected script to contain %q, got %s", want, script)
+		}
+	}
+}
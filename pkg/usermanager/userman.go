@@ -4,20 +4,38 @@ import (
 	"fmt"
 	"strings"
 
+	"git.andrewnw.xyz/CyberShell/backy/pkg/usermanager/common"
+	"git.andrewnw.xyz/CyberShell/backy/pkg/usermanager/freebsd"
 	"git.andrewnw.xyz/CyberShell/backy/pkg/usermanager/linux"
+	"git.andrewnw.xyz/CyberShell/backy/pkg/usermanager/macos"
 )
 
 // UserManager defines the interface for user management operations.
 // All functions but one return a string for the command and any args.
 type UserManager interface {
-	AddUser(username, homeDir, shell string, createHome, isSystem bool, groups, args []string) (string, []string)
+	AddUser(username, homeDir, shell string, isSystem, createHome bool, groups, args []string) (string, []string)
 	RemoveUser(username string) (string, []string)
 	ModifyUser(username, homeDir, shell string, groups []string) (string, []string)
-	// Modify password uses chpasswd for Linux systems to build the command to change the password
+	// ModifyPassword returns the command to change the password and the input to pass to it on stdin.
 	// Should return a password as the last argument
-	// TODO: refactor when adding more systems instead of Linux
 	ModifyPassword(username, password string) (string, *strings.Reader, string)
 	UserExists(username string) (string, []string)
+	// GetUser returns a command that prints the current state of the user
+	GetUser(username string) (string, []string)
+	// ParseUser parses the output of the command returned by GetUser
+	ParseUser(output string) (common.UserInfo, error)
+	AddGroup(group string, isSystem bool) (string, []string)
+	RemoveGroup(group string) (string, []string)
+	// SetAuthorizedKeys adds keys to the user's authorized_keys file if they are not present.
+	// If exclusive is true, all other keys are removed.
+	SetAuthorizedKeys(username string, keys []string, exclusive bool) (string, []string)
+	LockUser(username string) (string, []string)
+	UnlockUser(username string) (string, []string)
+	// ExpireUser expires the account on date (YYYY-MM-DD), or immediately if date is empty
+	ExpireUser(username, date string) (string, []string)
+	// SetSudoers writes rules for the user to a sudoers.d file validated with visudo -c
+	SetSudoers(username string, rules []string) (string, []string)
+	RemoveSudoers(username string) (string, []string)
 }
 
 // NewUserManager returns a UserManager-compatible struct
@@ -27,6 +45,10 @@ func NewUserManager(system string) (UserManager, error) {
 	switch system {
 	case "linux", "Linux":
 		manager = linux.LinuxUserManager{}
+	case "freebsd", "FreeBSD":
+		manager = freebsd.FreeBSDUserManager{}
+	case "darwin", "Darwin", "macos", "macOS":
+		manager = macos.MacOSUserManager{}
 	default:
 		return nil, fmt.Errorf("usermanger system %s is not recognized", system)
 	}